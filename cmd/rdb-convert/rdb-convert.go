@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	internal "myredis/internal"
+)
+
+// record is one line of the JSON export. TTL is the time to live in
+// milliseconds, or -1 for keys that do not expire.
+type record struct {
+	DB    int             `json:"db"`
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	TTL   int64           `json:"ttl"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonExporter writes each key of an rdb file as a line of JSON as soon as
+// it is parsed, so dumps never have to fit in memory.
+type jsonExporter struct {
+	encoder *json.Encoder
+	now     int64
+	keys    int
+}
+
+func (e *jsonExporter) Header(version int) error                   { return nil }
+func (e *jsonExporter) Aux(key string, value string) error         { return nil }
+func (e *jsonExporter) ModuleAux(value internal.ModuleValue) error { return nil }
+func (e *jsonExporter) Function(code string) error                 { return nil }
+func (e *jsonExporter) SelectDB(db int) error                      { return nil }
+func (e *jsonExporter) ResizeDB(dbSize int, expiresSize int) error { return nil }
+func (e *jsonExporter) SlotInfo(slot, size, expiresSize int) error { return nil }
+func (e *jsonExporter) End(checksum uint64) error                  { return nil }
+
+func (e *jsonExporter) Entry(entry internal.RdbEntry) error {
+	ttl := int64(-1)
+	if entry.ExpiryTime != 0 {
+		expiry := entry.ExpiryTime
+		if !entry.TimeInMilliseconds {
+			expiry *= 1000
+		}
+		ttl = max(expiry-e.now, 0)
+	}
+
+	value, err := json.Marshal(jsonValue(entry.Value))
+	if err != nil {
+		return fmt.Errorf("failed to encode value of key %s: %v", entry.Key, err)
+	}
+	e.keys++
+	return e.encoder.Encode(record{
+		DB:    entry.DB,
+		Key:   entry.Key,
+		Type:  internal.RdbTypeName(entry.Type),
+		TTL:   ttl,
+		Value: value,
+	})
+}
+
+// jsonScore is a sorted set member with its score formatted as a string,
+// since JSON numbers cannot hold infinite scores.
+type jsonScore struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+// jsonValue converts integer encoded strings back to strings, and sorted
+// set scores to strings.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return strconv.Itoa(v)
+	case internal.SortedSetValue:
+		members := make([]jsonScore, 0, len(v))
+		for _, member := range v {
+			members = append(members, jsonScore{Member: member.Member, Score: strconv.FormatFloat(member.Score, 'g', -1, 64)})
+		}
+		return members
+	}
+	return value
+}
+
+// rdbValue converts the JSON value of a record to what the rdb writer
+// expects for its type.
+func rdbValue(rec record) (interface{}, error) {
+	var value interface{}
+	var err error
+	switch rec.Type {
+	case "string":
+		var s string
+		err = json.Unmarshal(rec.Value, &s)
+		value = s
+	case "list":
+		var list internal.ListValue
+		err = json.Unmarshal(rec.Value, &list)
+		value = list
+	case "set":
+		var set internal.SetValue
+		err = json.Unmarshal(rec.Value, &set)
+		value = set
+	case "zset":
+		value, err = sortedSetValue(rec.Value)
+	case "hash":
+		// Hashes with field expiries are objects holding the fields and
+		// their expiries rather than the fields themselves.
+		var hash internal.HashValue
+		if json.Unmarshal(rec.Value, &hash) == nil {
+			value = hash
+		} else {
+			var hashWithExpiries internal.HashFieldExpiryValue
+			err = json.Unmarshal(rec.Value, &hashWithExpiries)
+			value = hashWithExpiries
+		}
+	case "stream":
+		var stream internal.StreamValue
+		err = json.Unmarshal(rec.Value, &stream)
+		value = stream
+	case "module":
+		value, err = moduleValue(rec.Value)
+	default:
+		return nil, fmt.Errorf("unsupported type %s for key %s", rec.Type, rec.Key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s value of key %s: %v", rec.Type, rec.Key, err)
+	}
+	return value, nil
+}
+
+func sortedSetValue(raw json.RawMessage) (internal.SortedSetValue, error) {
+	var members []jsonScore
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return nil, err
+	}
+	zset := make(internal.SortedSetValue, 0, len(members))
+	for _, member := range members {
+		score, err := strconv.ParseFloat(member.Score, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score %s of member %s", member.Score, member.Member)
+		}
+		zset = append(zset, internal.SortedSetMember{Member: member.Member, Score: score})
+	}
+	return zset, nil
+}
+
+// moduleValue decodes module data, where JSON cannot tell the integer and
+// floating point types apart: integers are read back as uint64, or int64
+// when negative, and other numbers as float64.
+func moduleValue(raw json.RawMessage) (internal.ModuleValue, error) {
+	var value internal.ModuleValue
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return value, err
+	}
+	for i, field := range value.Data {
+		number, ok := field.(json.Number)
+		if !ok {
+			continue
+		}
+		if unsigned, err := strconv.ParseUint(number.String(), 10, 64); err == nil {
+			value.Data[i] = unsigned
+		} else if signed, err := strconv.ParseInt(number.String(), 10, 64); err == nil {
+			value.Data[i] = signed
+		} else if float, err := number.Float64(); err == nil {
+			value.Data[i] = float
+		} else {
+			return value, err
+		}
+	}
+	return value, nil
+}
+
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+func rdbToJSON(inputPath string, outputPath string) error {
+	input, err := openInput(inputPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	output := os.Stdout
+	if outputPath != "-" {
+		output, err = os.Create(outputPath)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+	}
+
+	writer := bufio.NewWriter(output)
+	exporter := &jsonExporter{encoder: json.NewEncoder(writer), now: time.Now().UnixMilli()}
+	if err := internal.ParseRdb(input, exporter, true); err != nil {
+		writer.Flush()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Converted %d keys\n", exporter.keys)
+	return nil
+}
+
+func jsonToRdb(inputPath string, outputPath string) error {
+	input, err := openInput(inputPath)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	writer, err := internal.NewRdbWriter(outputPath)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(input))
+	now := time.Now().UnixMilli()
+	keys := 0
+	for decoder.More() {
+		var rec record
+		if err := decoder.Decode(&rec); err != nil {
+			writer.Abort()
+			return fmt.Errorf("invalid record %d: %v", keys+1, err)
+		}
+		value, err := rdbValue(rec)
+		if err != nil {
+			writer.Abort()
+			return fmt.Errorf("invalid record %d: %v", keys+1, err)
+		}
+
+		entry := internal.RdbEntry{DB: rec.DB, Key: rec.Key, Value: value}
+		if rec.TTL >= 0 {
+			entry.ExpiryTime = now + rec.TTL
+			entry.TimeInMilliseconds = true
+		}
+		if err := writer.WriteEntry(entry); err != nil {
+			writer.Abort()
+			return err
+		}
+		keys++
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Converted %d keys\n", keys)
+	return nil
+}
+
+func usage() {
+	fmt.Println("Usage: rdb-convert to-json <dump.rdb|-> [<output.jsonl>]")
+	fmt.Println("       rdb-convert to-rdb <input.jsonl|-> <output.rdb>")
+}
+
+func main() {
+	if len(os.Args) < 3 {
+		usage()
+		os.Exit(1)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "to-json":
+		outputPath := "-"
+		if len(os.Args) > 3 {
+			outputPath = os.Args[3]
+		}
+		err = rdbToJSON(os.Args[2], outputPath)
+	case "to-rdb":
+		if len(os.Args) != 4 {
+			usage()
+			os.Exit(1)
+		}
+		err = jsonToRdb(os.Args[2], os.Args[3])
+	default:
+		usage()
+		os.Exit(1)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Conversion failed: ", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRecords = `{"db":0,"key":"string","type":"string","ttl":-1,"value":"value"}
+{"db":0,"key":"number","type":"string","ttl":-1,"value":"12345"}
+{"db":0,"key":"expiring","type":"string","ttl":60000,"value":"soon"}
+{"db":0,"key":"list","type":"list","ttl":-1,"value":["a","b","a"]}
+{"db":0,"key":"set","type":"set","ttl":-1,"value":["x","y"]}
+{"db":0,"key":"zset","type":"zset","ttl":-1,"value":[{"member":"low","score":"-Inf"},{"member":"mid","score":"1.5"},{"member":"high","score":"+Inf"}]}
+{"db":0,"key":"hash","type":"hash","ttl":-1,"value":{"a":"1","b":"2"}}
+{"db":0,"key":"hash-expiries","type":"hash","ttl":-1,"value":{"fields":{"a":"1","b":"2"},"expiries":{"a":4102444800000}}}
+{"db":1,"key":"other-db","type":"string","ttl":-1,"value":"1"}
+`
+
+func readRecords(t *testing.T, path string) []record {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []record
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for decoder.More() {
+		var rec record
+		if err := decoder.Decode(&rec); err != nil {
+			t.Fatalf("Failed to decode %s: %v", path, err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.jsonl")
+	rdbPath := filepath.Join(dir, "dump.rdb")
+	outputPath := filepath.Join(dir, "output.jsonl")
+	if err := os.WriteFile(inputPath, []byte(testRecords), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := jsonToRdb(inputPath, rdbPath); err != nil {
+		t.Fatalf("Failed to convert to rdb: %v", err)
+	}
+	if err := rdbToJSON(rdbPath, outputPath); err != nil {
+		t.Fatalf("Failed to convert back to JSON: %v", err)
+	}
+
+	expected, converted := readRecords(t, inputPath), readRecords(t, outputPath)
+	if len(converted) != len(expected) {
+		t.Fatalf("Expected %d records, Got %d", len(expected), len(converted))
+	}
+	for i, rec := range converted {
+		want := expected[i]
+		// The TTL counts down while the test runs.
+		if want.TTL > 0 && rec.TTL <= want.TTL && rec.TTL > want.TTL-10000 {
+			rec.TTL = want.TTL
+		}
+		var wantValue, gotValue interface{}
+		json.Unmarshal(want.Value, &wantValue)
+		json.Unmarshal(rec.Value, &gotValue)
+		if rec.DB != want.DB || rec.Key != want.Key || rec.Type != want.Type || rec.TTL != want.TTL || !jsonEqual(wantValue, gotValue) {
+			t.Errorf("Expected record %+v, Got %+v", want, rec)
+		}
+	}
+}
+
+func jsonEqual(a, b interface{}) bool {
+	encodedA, _ := json.Marshal(a)
+	encodedB, _ := json.Marshal(b)
+	return bytes.Equal(encodedA, encodedB)
+}
+
+func TestFailedConversionKeepsOutput(t *testing.T) {
+	dir := t.TempDir()
+	inputPath := filepath.Join(dir, "input.jsonl")
+	rdbPath := filepath.Join(dir, "dump.rdb")
+	invalid := testRecords + `{"db":0,"key":"bad","type":"zset","ttl":-1,"value":[{"member":"m","score":"x"}]}` + "\n"
+	if err := os.WriteFile(inputPath, []byte(invalid), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rdbPath, []byte("previous"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err := jsonToRdb(inputPath, rdbPath)
+	if err == nil || !strings.Contains(err.Error(), "invalid record 10") {
+		t.Fatalf("Expected the invalid record to fail the conversion, Got %v", err)
+	}
+	if contents, _ := os.ReadFile(rdbPath); string(contents) != "previous" {
+		t.Errorf("Expected the output to be left alone, Got %q", contents)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Expected the partial rdb file to be removed, Got %v", entries)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	internal "myredis/internal"
+)
+
+// aofCheck is the result of checking one file of an AOF.
+type aofCheck struct {
+	path     string
+	size     int64
+	validEnd int64
+	commands int
+	isRdb    bool
+	err      error
+}
+
+// nopRdbVisitor lets ParseRdb validate an rdb preamble without keeping any
+// of its contents.
+type nopRdbVisitor struct{}
+
+func (nopRdbVisitor) Header(version int) error                   { return nil }
+func (nopRdbVisitor) Aux(key string, value string) error         { return nil }
+func (nopRdbVisitor) ModuleAux(value internal.ModuleValue) error { return nil }
+func (nopRdbVisitor) Function(code string) error                 { return nil }
+func (nopRdbVisitor) SelectDB(db int) error                      { return nil }
+func (nopRdbVisitor) ResizeDB(dbSize int, expiresSize int) error { return nil }
+func (nopRdbVisitor) SlotInfo(slot, size, expiresSize int) error { return nil }
+func (nopRdbVisitor) Entry(entry internal.RdbEntry) error        { return nil }
+func (nopRdbVisitor) End(checksum uint64) error                  { return nil }
+
+// checkFile validates one file, which is either an rdb preamble or a list
+// of commands. The error is only set when the file cannot be read at all.
+func checkFile(path string) (aofCheck, error) {
+	check := aofCheck{path: path}
+	file, err := os.Open(path)
+	if err != nil {
+		return check, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return check, err
+	}
+	check.size = info.Size()
+
+	header := make([]byte, 5)
+	n, _ := io.ReadFull(file, header)
+	check.isRdb = string(header[:n]) == "REDIS"
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return check, err
+	}
+
+	if check.isRdb {
+		check.err = internal.ParseRdb(file, nopRdbVisitor{}, true)
+		if check.err == nil {
+			check.validEnd = check.size
+		}
+		return check, nil
+	}
+	check.validEnd, check.err = internal.ScanAof(file, func(command []interface{}) error {
+		check.commands++
+		return nil
+	})
+	return check, nil
+}
+
+func confirm(question string) bool {
+	fmt.Print(question + " [y/N]: ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func main() {
+	fix := pflag.Bool("fix", false, "--fix to truncate the AOF to the last valid command")
+	pflag.Usage = func() {
+		fmt.Println("Usage: redis-check-aof [--fix] <file.manifest|file.aof>")
+	}
+	pflag.Parse()
+	if pflag.NArg() != 1 {
+		pflag.Usage()
+		os.Exit(1)
+	}
+	path := pflag.Arg(0)
+
+	files := []string{path}
+	if strings.HasSuffix(path, ".manifest") {
+		var err error
+		files, err = internal.AofManifestFiles(path)
+		if err != nil {
+			fmt.Println("Invalid AOF manifest: ", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Start checking Multi Part AOF %s with %d files\n", filepath.Base(path), len(files))
+	}
+
+	for i, filePath := range files {
+		check, err := checkFile(filePath)
+		if err != nil {
+			fmt.Printf("Failed to check %s: %v\n", filePath, err)
+			os.Exit(1)
+		}
+		if check.err == nil {
+			if check.isRdb {
+				fmt.Printf("RDB preamble of %s is valid\n", check.path)
+			} else {
+				fmt.Printf("AOF %s is valid, %d commands\n", check.path, check.commands)
+			}
+			continue
+		}
+
+		var rdbErr *internal.RdbError
+		if errors.As(check.err, &rdbErr) {
+			fmt.Printf("RDB preamble of %s is not valid at offset %d: %v\n", check.path, rdbErr.Offset, rdbErr.Err)
+			os.Exit(1)
+		}
+		fmt.Printf("AOF %s is not valid: %v\n", check.path, check.err)
+		fmt.Printf("AOF analyzed: size=%d, ok_up_to=%d, diff=%d\n", check.size, check.validEnd, check.size-check.validEnd)
+		if i != len(files)-1 {
+			fmt.Println("Only the last file of a multi part AOF can be fixed, please check the other files manually")
+			os.Exit(1)
+		}
+		if !*fix {
+			fmt.Println("AOF is not valid. Use the --fix option to try fixing it.")
+			os.Exit(1)
+		}
+
+		fmt.Printf("This will shrink the AOF %s from %d bytes, with %d bytes, to %d bytes\n", check.path, check.size, check.size-check.validEnd, check.validEnd)
+		if !confirm("Continue?") {
+			fmt.Println("Aborting...")
+			os.Exit(1)
+		}
+		if err := os.Truncate(check.path, check.validEnd); err != nil {
+			fmt.Println("Failed to truncate AOF: ", err)
+			os.Exit(1)
+		}
+		fmt.Println("Successfully truncated AOF ", check.path)
+		return
+	}
+	fmt.Println("All AOF files are valid")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	internal "myredis/internal"
+)
+
+func TestCheckFile(t *testing.T) {
+	valid := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+	tests := []struct {
+		name      string
+		contents  string
+		commands  int
+		validEnd  int64
+		truncated bool
+		format    bool
+	}{
+		{name: "valid", contents: valid + "#TS:1700000000\r\n" + valid, commands: 2, validEnd: int64(2*len(valid) + 16)},
+		{name: "truncated", contents: valid + "*3\r\n$3\r\nSET\r\n$3\r\nfo", commands: 1, validEnd: int64(len(valid)), truncated: true},
+		{name: "negative bulk length", contents: valid + "*2\r\n$3\r\nSET\r\n$-5\r\n", commands: 1, validEnd: int64(len(valid)), format: true},
+		{name: "huge bulk length", contents: "*2\r\n$3\r\nGET\r\n$99999999999\r\n", validEnd: 0, format: true},
+		{name: "garbage array header", contents: valid + "*x\r\n" + valid, commands: 1, validEnd: int64(len(valid)), format: true},
+		{name: "negative array length", contents: "*-7\r\n" + valid, validEnd: 0, format: true},
+		{name: "empty command", contents: valid + "*0\r\n", commands: 1, validEnd: int64(len(valid)), format: true},
+		{name: "missing CRLF", contents: "*1\r\n$4\r\nPINGxx" + valid, validEnd: 0, format: true},
+		{name: "garbage", contents: valid + "hello", commands: 1, validEnd: int64(len(valid)), format: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof")
+			if err := os.WriteFile(path, []byte(test.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+			check, err := checkFile(path)
+			if err != nil {
+				t.Fatalf("Failed to check %s: %v", path, err)
+			}
+			if check.commands != test.commands || check.validEnd != test.validEnd {
+				t.Errorf("Expected %d commands valid up to %d, Got %d commands valid up to %d", test.commands, test.validEnd, check.commands, check.validEnd)
+			}
+			if truncated := errors.Is(check.err, io.ErrUnexpectedEOF); truncated != test.truncated {
+				t.Errorf("Expected truncated %v, Got error %v", test.truncated, check.err)
+			}
+			if format := errors.Is(check.err, internal.ErrAofFormat); format != test.format {
+				t.Errorf("Expected bad format %v, Got error %v", test.format, check.err)
+			}
+		})
+	}
+}
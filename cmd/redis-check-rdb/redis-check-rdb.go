@@ -0,0 +1,219 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	internal "myredis/internal"
+)
+
+type dbStats struct {
+	keys           int
+	types          map[string]int
+	expires        int
+	alreadyExpired int
+	firstExpiry    int64
+	lastExpiry     int64
+	resizeKeys     int
+	resizeExpires  int
+}
+
+// rdbChecker collects statistics about an rdb file while it is parsed.
+type rdbChecker struct {
+	version  int
+	aux      [][2]string
+	modules  map[string]int
+	libs     int
+	slots    int
+	dbs      map[int]*dbStats
+	db       int
+	checksum uint64
+	now      int64
+	// err is why the file is not valid, nil when it is.
+	err error
+}
+
+func (c *rdbChecker) Header(version int) error {
+	c.version = version
+	return nil
+}
+
+func (c *rdbChecker) Aux(key string, value string) error {
+	c.aux = append(c.aux, [2]string{key, value})
+	return nil
+}
+
+func (c *rdbChecker) ModuleAux(value internal.ModuleValue) error {
+	c.modules[value.Module]++
+	return nil
+}
+
+func (c *rdbChecker) Function(code string) error {
+	c.libs++
+	return nil
+}
+
+func (c *rdbChecker) SlotInfo(slot int, size int, expiresSize int) error {
+	c.slots++
+	return nil
+}
+
+func (c *rdbChecker) SelectDB(db int) error {
+	c.db = db
+	c.stats(db)
+	return nil
+}
+
+func (c *rdbChecker) ResizeDB(dbSize int, expiresSize int) error {
+	stats := c.stats(c.db)
+	stats.resizeKeys = dbSize
+	stats.resizeExpires = expiresSize
+	return nil
+}
+
+func (c *rdbChecker) Entry(entry internal.RdbEntry) error {
+	stats := c.stats(entry.DB)
+	stats.keys++
+	stats.types[internal.RdbTypeName(entry.Type)]++
+	if entry.ExpiryTime == 0 {
+		return nil
+	}
+
+	expiry := entry.ExpiryTime
+	if !entry.TimeInMilliseconds {
+		expiry *= 1000
+	}
+	stats.expires++
+	if expiry < c.now {
+		stats.alreadyExpired++
+	}
+	if stats.firstExpiry == 0 || expiry < stats.firstExpiry {
+		stats.firstExpiry = expiry
+	}
+	if expiry > stats.lastExpiry {
+		stats.lastExpiry = expiry
+	}
+	return nil
+}
+
+func (c *rdbChecker) End(checksum uint64) error {
+	c.checksum = checksum
+	return nil
+}
+
+func (c *rdbChecker) stats(db int) *dbStats {
+	if _, exists := c.dbs[db]; !exists {
+		c.dbs[db] = &dbStats{types: make(map[string]int), resizeKeys: -1, resizeExpires: -1}
+	}
+	return c.dbs[db]
+}
+
+func (c *rdbChecker) printStats() {
+	total := 0
+	var dbs []int
+	for db, stats := range c.dbs {
+		dbs = append(dbs, db)
+		total += stats.keys
+	}
+	sort.Ints(dbs)
+
+	for _, db := range dbs {
+		stats := c.dbs[db]
+		fmt.Printf("[db %d] %d keys, %d with an expiry, %d already expired\n", db, stats.keys, stats.expires, stats.alreadyExpired)
+		if stats.resizeKeys >= 0 {
+			fmt.Printf("[db %d] resize hint: %d keys, %d expires\n", db, stats.resizeKeys, stats.resizeExpires)
+		}
+
+		var types []string
+		for name, count := range stats.types {
+			types = append(types, fmt.Sprintf("%s=%d", name, count))
+		}
+		sort.Strings(types)
+		if len(types) > 0 {
+			fmt.Printf("[db %d] types: %s\n", db, strings.Join(types, " "))
+		}
+		if stats.expires > 0 {
+			fmt.Printf("[db %d] expiry range: %s to %s\n", db, formatExpiry(stats.firstExpiry), formatExpiry(stats.lastExpiry))
+		}
+	}
+	fmt.Printf("[info] %d keys read\n", total)
+}
+
+func formatExpiry(ms int64) string {
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano)
+}
+
+// checkFile parses the rdb file at path, collecting its statistics. It only
+// returns an error when the file cannot be read at all.
+func checkFile(path string) (*rdbChecker, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	checker := &rdbChecker{dbs: make(map[int]*dbStats), modules: make(map[string]int), now: time.Now().UnixMilli()}
+	checker.err = internal.ParseRdb(file, checker, true)
+	return checker, nil
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Println("Usage: redis-check-rdb <rdb-file-name>")
+		os.Exit(1)
+	}
+	rdbFilePath := os.Args[1]
+
+	fmt.Printf("[offset 0] Checking RDB file %s\n", rdbFilePath)
+	checker, err := checkFile(rdbFilePath)
+	if err != nil {
+		fmt.Println("Cannot open RDB file: ", err)
+		os.Exit(1)
+	}
+
+	if checker.version > 0 {
+		fmt.Printf("[info] RDB version %d\n", checker.version)
+	}
+	for _, field := range checker.aux {
+		fmt.Printf("[info] AUX FIELD %s = '%s'\n", field[0], field[1])
+	}
+	for module, count := range checker.modules {
+		fmt.Printf("[info] MODULE AUX for: %s (%d)\n", module, count)
+	}
+	if checker.libs > 0 {
+		fmt.Printf("[info] %d function libraries\n", checker.libs)
+	}
+	if checker.slots > 0 {
+		fmt.Printf("[info] slot info for %d slots\n", checker.slots)
+	}
+
+	if err := checker.err; err != nil {
+		fmt.Println("--- RDB ERROR DETECTED ---")
+		var rdbErr *internal.RdbError
+		if errors.As(err, &rdbErr) {
+			if rdbErr.Opcode >= 0 {
+				fmt.Printf("[offset %d] opcode 0x%02X (%s): %v\n", rdbErr.Offset, rdbErr.Opcode, internal.RdbOpcodeName(rdbErr.Opcode), rdbErr.Err)
+			} else {
+				fmt.Printf("[offset %d] %v\n", rdbErr.Offset, rdbErr.Err)
+			}
+		} else {
+			fmt.Println(err)
+		}
+		checker.printStats()
+		os.Exit(1)
+	}
+
+	if checker.version < 5 {
+		fmt.Println("[info] RDB version has no checksum: no check performed")
+	} else if checker.checksum == 0 {
+		fmt.Println("[info] RDB file was saved with checksum disabled: no check performed")
+	} else {
+		fmt.Printf("[info] Checksum OK (%x)\n", checker.checksum)
+	}
+	checker.printStats()
+	fmt.Println("\\o/ RDB looks OK! \\o/")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	internal "myredis/internal"
+)
+
+// writeFixture writes an rdb file with keys in two dbs, one of them with an
+// expiry, and returns its path and contents.
+func writeFixture(t *testing.T) (string, []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	writer, err := internal.NewRdbWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	for _, entry := range []internal.RdbEntry{
+		{DB: 0, Key: "string", Value: "value"},
+		{DB: 0, Key: "list", Value: internal.ListValue{"a", "b"}, ExpiryTime: expiry, TimeInMilliseconds: true},
+		{DB: 2, Key: "hash", Value: internal.HashValue{"field": "value"}},
+	} {
+		if err := writer.WriteEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, contents
+}
+
+func TestCheckValidFile(t *testing.T) {
+	path, _ := writeFixture(t)
+	checker, err := checkFile(path)
+	if err != nil {
+		t.Fatalf("Failed to check %s: %v", path, err)
+	}
+	if checker.err != nil {
+		t.Fatalf("Expected the file to be valid, Got %v", checker.err)
+	}
+	if checker.version == 0 || checker.checksum == 0 {
+		t.Errorf("Expected a checksummed rdb file, Got version %d checksum %x", checker.version, checker.checksum)
+	}
+	db0, db2 := checker.dbs[0], checker.dbs[2]
+	if len(checker.dbs) != 2 || db0 == nil || db2 == nil {
+		t.Fatalf("Expected stats for dbs 0 and 2, Got %v", checker.dbs)
+	}
+	if db0.keys != 2 || db0.expires != 1 || db0.alreadyExpired != 0 || db0.types["string"] != 1 || db0.types["list"] != 1 {
+		t.Errorf("Expected a string and an expiring list in db 0, Got %+v", db0)
+	}
+	if db2.keys != 1 || db2.types["hash"] != 1 {
+		t.Errorf("Expected a hash in db 2, Got %+v", db2)
+	}
+}
+
+func TestCheckBadChecksum(t *testing.T) {
+	path, contents := writeFixture(t)
+	index := bytes.LastIndex(contents, []byte("value"))
+	contents[index] = 'V'
+	os.WriteFile(path, contents, 0644)
+
+	checker, err := checkFile(path)
+	if err != nil {
+		t.Fatalf("Failed to check %s: %v", path, err)
+	}
+	var rdbErr *internal.RdbError
+	if !errors.As(checker.err, &rdbErr) || internal.RdbOpcodeName(rdbErr.Opcode) != "EOF" || !strings.Contains(checker.err.Error(), "wrong RDB checksum") {
+		t.Fatalf("Expected a checksum error, Got %v", checker.err)
+	}
+	// The keys are all read before the checksum is.
+	if checker.dbs[0].keys+checker.dbs[2].keys != 3 {
+		t.Errorf("Expected all 3 keys to be read, Got %v", checker.dbs)
+	}
+}
+
+func TestCheckTruncatedFile(t *testing.T) {
+	path, contents := writeFixture(t)
+	index := bytes.Index(contents, []byte("list"))
+	os.WriteFile(path, contents[:index+2], 0644)
+
+	checker, err := checkFile(path)
+	if err != nil {
+		t.Fatalf("Failed to check %s: %v", path, err)
+	}
+	var rdbErr *internal.RdbError
+	if !errors.Is(checker.err, io.ErrUnexpectedEOF) || !errors.As(checker.err, &rdbErr) || rdbErr.Offset > int64(index) {
+		t.Fatalf("Expected the file to end in the middle of a key, Got %v", checker.err)
+	}
+	if checker.dbs[0].keys != 1 {
+		t.Errorf("Expected the key before the truncation to be read, Got %+v", checker.dbs[0])
+	}
+}
+
+func TestCheckMissingFile(t *testing.T) {
+	if _, err := checkFile(filepath.Join(t.TempDir(), "missing.rdb")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected a missing file error, Got %v", err)
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/spf13/pflag"
 
@@ -20,65 +24,228 @@ func main() {
 
 	config.InstReplicationInfo.MasterReplId = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
 	config.InstReplicationInfo.MasterReplOffset = 0
+	config.InstReplicationInfo.MasterReplId2 = "0000000000000000000000000000000000000000"
+	config.InstReplicationInfo.SecondReplOffset = -1
 
 	port := pflag.String("port", "6377", "--port to set the port number")
 	replicaOf := pflag.String("replicaof", "", "--replicaof '<Master_Host> <Master_Port>' ")
+	configFlags := make(map[string]*string)
+	for key, value := range internal.Config {
+		configFlags[key] = pflag.String(key, value, fmt.Sprintf("--%s to set the %s config", key, key))
+	}
 	pflag.Parse()
 
+	for key, value := range configFlags {
+		internal.Config[key] = *value
+	}
+
 	config.InstReplicationInfo.Role = "master"
 	config.InstanceConfig.Port = *port
 
+	var masterHost, masterPort string
 	if *replicaOf != "" {
-		masterDetails := strings.Split(*replicaOf, "")
-		config.InstReplicationInfo.MasterHost = masterDetails[0]
-		config.InstReplicationInfo.MasterPort = masterDetails[1]
-		config.InstReplicationInfo.Role = "slave"
-		internal.HandshakeWithMaster()
+		masterDetails := strings.Fields(*replicaOf)
+		if len(masterDetails) != 2 {
+			fmt.Println("Invalid --replicaof, expected '<Master_Host> <Master_Port>': ", *replicaOf)
+			os.Exit(1)
+		}
+		masterHost, masterPort = masterDetails[0], masterDetails[1]
 	}
 
-	tasksChannel := make(chan func())
-	internal.SpawnWorkers(10, tasksChannel)
+	if err := internal.LoadAcl(); err != nil {
+		fmt.Println("Failed to load ACL: ", err)
+		os.Exit(1)
+	}
 
-	if config.InstReplicationInfo.Role == "master" {
-		loadRdbFile()
+	// A replica gets its dataset from the master instead.
+	if masterHost == "" {
+		loadDataFromDisk()
+	}
+	if err := internal.OpenAppendOnlyFile(); err != nil {
+		fmt.Println("Failed to open append only file: ", err)
+		os.Exit(1)
+	}
+	internal.StartServerCron()
+	if masterHost != "" {
+		internal.StartReplication(masterHost, masterPort)
 	}
 
-	url := fmt.Sprintf("0.0.0.0:%s", *port)
-	listener, err := net.Listen("tcp", url)
+	bindAddresses := strings.Fields(internal.Config["bind"])
+	if len(bindAddresses) > 0 {
+		config.InstanceConfig.IpAddress = strings.TrimPrefix(bindAddresses[0], "-")
+	}
 
-	if err != nil {
-		fmt.Errorf("Failed to bind to port: %v", err)
+	var listeners []net.Listener
+	if *port != "0" {
+		tcpListeners, err := listenTCP(bindAddresses, *port, nil)
+		if err != nil {
+			fmt.Println("Failed to bind to port: ", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, tcpListeners...)
+	}
+
+	if tlsPort := internal.Config["tls-port"]; tlsPort != "0" {
+		tlsConfig, err := internal.ServerTLSConfig()
+		if err != nil {
+			fmt.Println("Failed to configure TLS: ", err)
+			os.Exit(1)
+		}
+		tlsListeners, err := listenTCP(bindAddresses, tlsPort, tlsConfig)
+		if err != nil {
+			fmt.Println("Failed to bind to TLS port: ", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, tlsListeners...)
+	}
+
+	if socketPath := internal.Config["unixsocket"]; socketPath != "" {
+		listener, err := listenUnixSocket(socketPath, internal.Config["unixsocketperm"])
+		if err != nil {
+			fmt.Println("Failed to open unix socket: ", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	if len(listeners) == 0 {
+		fmt.Println("Configured to not listen anywhere, exiting.")
 		os.Exit(1)
 	}
-	defer listener.Close()
+
+	go shutdownOnSignal()
+
 	fmt.Println("Accepting connections")
+	acceptErrors := make(chan error)
+	for _, listener := range listeners {
+		go func() {
+			acceptErrors <- acceptConnections(listener)
+		}()
+	}
+	err := <-acceptErrors
+	fmt.Println("Error accepting connection: ", err.Error())
+	// os.Exit skips deferred calls, so the listeners are closed here, which
+	// also removes the unix socket file.
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	os.Exit(1)
+}
+
+// listenTCP binds port on every bind address. "*" and "::*" stand for all
+// IPv4 and IPv6 interfaces, and addresses prefixed with "-" are skipped when
+// they cannot be bound instead of failing startup.
+func listenTCP(bindAddresses []string, port string, tlsConfig *tls.Config) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, address := range bindAddresses {
+		optional := strings.HasPrefix(address, "-")
+		address = strings.TrimPrefix(address, "-")
+
+		network := "tcp4"
+		switch {
+		case address == "*":
+			address = "0.0.0.0"
+		case address == "::*":
+			address = "::"
+			network = "tcp6"
+		case strings.Contains(address, ":"):
+			network = "tcp6"
+		}
+
+		var listener net.Listener
+		var err error
+		if tlsConfig != nil {
+			listener, err = tls.Listen(network, net.JoinHostPort(address, port), tlsConfig)
+		} else {
+			listener, err = net.Listen(network, net.JoinHostPort(address, port))
+		}
+		if err != nil {
+			if optional {
+				fmt.Printf("Skipping optional bind address %s: %v\n", address, err)
+				continue
+			}
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func listenUnixSocket(socketPath string, permStr string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(permStr, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unixsocketperm %s: %v", permStr, err)
+	}
+
+	// A socket file left behind by a previous run would make the bind fail.
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if perm != 0 {
+		if err := os.Chmod(socketPath, os.FileMode(perm)); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("failed to set permissions of %s: %v", socketPath, err)
+		}
+	}
+	return listener, nil
+}
+
+// shutdownOnSignal removes the unix socket file on SIGINT or SIGTERM and then
+// exits.
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Received shutdown signal, exiting")
+	if socketPath := internal.Config["unixsocket"]; socketPath != "" {
+		os.Remove(socketPath)
+	}
+	os.Exit(0)
+}
+
+// acceptConnections serves every connection on a goroutine of its own, as a
+// client may block for a long time, e.g. on CLIENT PAUSE or WAIT.
+func acceptConnections(listener net.Listener) error {
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
-			os.Exit(1)
-		}
-		tasksChannel <- func() {
-			handleConn(conn)
+			return err
 		}
+		go handleConn(conn)
 	}
 }
 
 func handleConn(conn net.Conn) {
-	defer conn.Close()
+	if internal.DeniedByProtectedMode(conn) {
+		conn.Write([]byte(internal.ProtectedModeError))
+		conn.Close()
+		return
+	}
+
+	client := internal.RegisterClient(conn)
+	defer internal.UnregisterClient(client)
 
-	reader := bufio.NewReader(conn)
+	reader := client.Reader()
 	for {
 		parsedArr, err := internal.ParseArray(reader)
 		resp := ""
 
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF || client.Closed() {
 				break
 			}
 			conn.Write([]byte(fmt.Sprintf("failed to parse command: %v", err)))
 			continue
 		}
+		if len(parsedArr) == 0 {
+			continue
+		}
 		command, ok := parsedArr[0].(string)
 		if !ok {
 			conn.Write([]byte(fmt.Sprintf("command has to be string: %v", parsedArr[0])))
@@ -90,16 +257,39 @@ func handleConn(conn net.Conn) {
 			args = parsedArr[1:]
 		}
 
-		resp, err = internal.Handle(command, args)
+		resp, err = internal.Handle(client, command, args)
 		if err != nil {
 			conn.Write([]byte(fmt.Sprintf("invalid command: %v", err)))
 			continue
 		}
-		conn.Write([]byte(resp))
+		client.WriteReply(resp)
+		if client.Closed() {
+			break
+		}
 	}
 }
 
+// loadDataFromDisk restores the keyspace from the AOF when appendonly is
+// enabled and the file exists, and from the rdb file otherwise.
+func loadDataFromDisk() {
+	if internal.Config["appendonly"] == "yes" {
+		err := internal.LoadAppendOnlyFile()
+		if err == nil {
+			return
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("Failed to load append only file: ", err)
+			os.Exit(1)
+		}
+	}
+	loadRdbFile()
+}
+
 func loadRdbFile() {
 	rdbFilePath := filepath.Join(internal.Config["dir"], internal.Config["dbfilename"])
-	internal.ParseRdbFile(rdbFilePath)
+	err := internal.ParseRdbFile(rdbFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		fmt.Println("Failed to load rdb file: ", err)
+		os.Exit(1)
+	}
 }
@@ -2,11 +2,25 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"myredis/internal"
 	"net"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,10 +28,18 @@ import (
 var conn net.Conn
 
 func TestMain(t *testing.T) {
-	copyRdbDumpToSourceDir()
+	if err := copyRdbDumpToSourceDir(); err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := generateTestCertificate(t, t.TempDir())
+	internal.Config["tls-port"] = "6378"
+	internal.Config["tls-cert-file"] = certFile
+	internal.Config["tls-key-file"] = keyFile
+	internal.Config["tls-ca-cert-file"] = certFile
+	internal.Config["tls-auth-clients"] = "no"
 
 	go main()
-	conn, _ = net.Dial("tcp", "localhost:6377")
+	conn = dialServer(t, "localhost:6377")
 	t.Run("Test RDB File Load", testRDBLoad)
 	t.Run("Echo Command Test", testEchoCommand)
 	t.Run("SET Command Test", testSetCommand)
@@ -25,9 +47,37 @@ func TestMain(t *testing.T) {
 	t.Run("GET Non Existent Value", testGetValueDoesNotExist)
 	t.Run("SET and GET value with expiry", testSetAndGetValueWithExpiry)
 	t.Run("Save RDB File", testSaveCommand)
+	t.Run("Save RDB File in background", testBgsaveCommand)
 	t.Run("Test CONFIG Get Command", testConfigGet)
 	t.Run("Test KEYS Command", testKeysCommand)
 	t.Run("Test INFO command", testInfoCommand)
+	t.Run("Test CLIENT command", testClientCommand)
+	t.Run("Test CLIENT PAUSE ALL", testClientPauseAll)
+	t.Run("Test TLS connection", testTLSConnection)
+	t.Run("Test TLS client authentication and replication", testTLSAuthAndReplication)
+	t.Run("Test replication stream", testReplicationStream)
+	t.Run("Test partial resynchronization", testPartialResync)
+	t.Run("Test WAIT command", testWaitCommand)
+	t.Run("Test REPLICAOF and FAILOVER commands", testReplicaOfCommand)
+	t.Run("Test read only replica", testReadOnlyReplica)
+	t.Run("Test PSYNC on a replica", testPsyncOnReplica)
+	t.Run("Test diskless sync", testDisklessSync)
+	t.Run("Test FAILOVER", testFailover)
+	t.Run("Test chained replication", testReplicaChain)
+	t.Run("Test unix socket", testUnixSocket)
+	t.Run("Test protected mode", testProtectedMode)
+}
+
+// TestReplicaProcess runs another server, with the arguments in
+// REDIS_TEST_SERVER_ARGS, for the replication tests to sync with the one
+// TestMain runs.
+func TestReplicaProcess(t *testing.T) {
+	args := os.Getenv("REDIS_TEST_SERVER_ARGS")
+	if args == "" {
+		t.Skip("Only runs as a server started by the replication tests")
+	}
+	os.Args = append([]string{"redis-server"}, strings.Split(args, "\n")...)
+	main()
 }
 
 func testEchoCommand(t *testing.T) {
@@ -49,8 +99,7 @@ func testGetValueDoesNotExist(t *testing.T) {
 func testSetAndGetValueWithExpiry(t *testing.T) {
 	runCommandTest(t, "*5\r\n$3\r\nSET\r\n$3\r\ncow\r\n$3\r\nsay\r\n$2\r\nPX\r\n$4\r\n2000\r\n", "+OK\r\n", 5, conn)
 	runCommandTest(t, "*2\r\n$3\r\nGET\r\n$3\r\ncow\r\n", "$3\r\nsay\r\n", 9, conn)
-	time.Sleep(2 * time.Second)
-	runCommandTest(t, "*2\r\n$3\r\nGET\r\n$3\r\ncow\r\n", "$-1\r\n", 5, conn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$3\r\ncow\r\n", "$-1\r\n", conn)
 }
 
 func testSaveCommand(t *testing.T) {
@@ -58,6 +107,19 @@ func testSaveCommand(t *testing.T) {
 	runCommandTest(t, "*1\r\n$4\r\nSAVE\r\n", "+OK\r\n", 5, conn)
 }
 
+func testBgsaveCommand(t *testing.T) {
+	runCommandTest(t, "*1\r\n$6\r\nBGSAVE\r\n", "+Background saving started\r\n", 28, conn)
+	waitForInfoField(t, "persistence", "rdb_bgsave_in_progress:0", conn)
+	info := infoSection(t, "persistence", conn)
+	if !strings.Contains(info, "rdb_last_bgsave_status:ok") || !strings.Contains(info, "rdb_changes_since_last_save:0") {
+		t.Errorf("Error: Expected the background save to succeed, Got %q", info)
+	}
+	resp := sendCommand(t, "*1\r\n$8\r\nLASTSAVE\r\n", 13, conn)
+	if !strings.HasPrefix(resp, ":") {
+		t.Errorf("expected an integer reply to LASTSAVE, got %q", resp)
+	}
+}
+
 func testRDBLoad(t *testing.T) {
 	runCommandTest(t, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", "$3\r\nbar\r\n", 9, conn)
 	runCommandTest(t, "*2\r\n$3\r\nGET\r\n$3\r\ncow\r\n", "$-1\r\n", 5, conn)
@@ -65,27 +127,640 @@ func testRDBLoad(t *testing.T) {
 }
 
 func testConfigGet(t *testing.T) {
-	tempDir := internal.Config["dir"]
-	tempDbFileName := internal.Config["dbfilename"]
-	internal.Config["dir"] = "/tmp/dir"
-	internal.Config["dbfilename"] = "dump.rdb"
-
+	// The config can't change while the server runs, so these are the
+	// values TestMain started it with.
 	runCommandTest(t, "*4\r\n$6\r\nCONFIG\r\n$3\r\nGET\r\n$3\r\ndir\r\n$10\r\ndbfilename\r\n",
-		"*4\r\n$3\r\ndir\r\n$8\r\n/tmp/dir\r\n$10\r\ndbfilename\r\n$8\r\ndump.rdb\r\n", 58, conn)
-
-	internal.Config["dir"] = tempDir
-	internal.Config["dbfilename"] = tempDbFileName
+		"*4\r\n$3\r\ndir\r\n$7\r\n../dump\r\n$10\r\ndbfilename\r\n$8\r\ndump.rdb\r\n", 57, conn)
 }
 
 func testKeysCommand(t *testing.T) {
-	runCommandTest(t, "*2\r\n$4\r\nKEYS\r\n$1\r\n*\r\n", "*2\r\n$3\r\nfoo\r\n$3\r\ncow\r\n", 22, conn)
+	// KEYS makes no promise about the order of the keys it returns.
+	resp := sendCommand(t, "*2\r\n$4\r\nKEYS\r\n$1\r\n*\r\n", 22, conn)
+	if resp != "*2\r\n$3\r\nfoo\r\n$3\r\ncow\r\n" && resp != "*2\r\n$3\r\ncow\r\n$3\r\nfoo\r\n" {
+		t.Errorf("Error: Expected keys foo and cow, Got %s", resp)
+	}
 }
 
 func testInfoCommand(t *testing.T) {
-	runCommandTest(t, "*2\r\n$4\r\nINFO\r\n$10\r\nreplication\r\n", "$87\r\nrole:master\nmaster_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\nmaster_repl_offset:0\r\n", 94, conn)
+	runCommandTest(t, "*2\r\n$4\r\nINFO\r\n$11\r\nreplication\r\n", "$322\r\nrole:master\nconnected_slaves:0\nmaster_failover_state:no-failover\nmaster_replid:8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\nmaster_replid2:0000000000000000000000000000000000000000\nmaster_repl_offset:0\nsecond_repl_offset:-1\nrepl_backlog_active:0\nrepl_backlog_size:1048576\nrepl_backlog_first_byte_offset:0\nrepl_backlog_histlen:0\r\n", 330, conn)
+}
+
+func testClientCommand(t *testing.T) {
+	runCommandTest(t, "*2\r\n$6\r\nCLIENT\r\n$7\r\nGETNAME\r\n", "$-1\r\n", 5, conn)
+	runCommandTest(t, "*3\r\n$6\r\nCLIENT\r\n$7\r\nSETNAME\r\n$4\r\ntest\r\n", "+OK\r\n", 5, conn)
+	runCommandTest(t, "*2\r\n$6\r\nCLIENT\r\n$7\r\nGETNAME\r\n", "$4\r\ntest\r\n", 10, conn)
+}
+
+func testClientPauseAll(t *testing.T) {
+	runCommandTest(t, "*4\r\n$6\r\nCLIENT\r\n$5\r\nPAUSE\r\n$5\r\n60000\r\n$3\r\nALL\r\n", "+OK\r\n", 5, conn)
+
+	// More paused clients than there used to be connection workers.
+	var paused []net.Conn
+	for i := 0; i < 12; i++ {
+		pausedConn := dialServer(t, "localhost:6377")
+		defer pausedConn.Close()
+		pausedConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		pausedConn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+		paused = append(paused, pausedConn)
+	}
+
+	// CLIENT commands are not paused, so the pause can be lifted early.
+	runCommandTest(t, "*2\r\n$6\r\nCLIENT\r\n$7\r\nUNPAUSE\r\n", "+OK\r\n", 5, conn)
+	for _, pausedConn := range paused {
+		runCommandTest(t, "", "+PONG\r\n", 7, pausedConn)
+	}
+}
+
+func testTLSConnection(t *testing.T) {
+	caCert, err := os.ReadFile(internal.Config["tls-ca-cert-file"])
+	if err != nil {
+		t.Fatalf("Failed to read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+
+	tlsConn, err := tls.Dial("tcp", "localhost:6378", &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err != nil {
+		t.Fatalf("Failed to connect over TLS: %v", err)
+	}
+	defer tlsConn.Close()
+	runCommandTest(t, "*1\r\n$4\r\nPING\r\n", "+PONG\r\n", 7, tlsConn)
+}
+
+func testTLSAuthAndReplication(t *testing.T) {
+	dir := t.TempDir()
+	caFile, caKeyFile := generateTestCertificate(t, dir)
+	clientCertFile, clientKeyFile := generateClientCertificate(t, dir, caFile, caKeyFile)
+	untrustedCertFile, untrustedKeyFile := generateTestCertificate(t, t.TempDir())
+	tlsArgs := []string{"--tls-cert-file", caFile, "--tls-key-file", caKeyFile, "--tls-ca-cert-file", caFile}
+
+	masterConn, _ := startServerProcess(t, append([]string{"--port", "6402", "--tls-port", "6401", "--dir", t.TempDir(),
+		"--tls-auth-clients", "yes"}, tlsArgs...)...)
+	defer masterConn.Close()
+
+	caCert, err := os.ReadFile(caFile)
+	if err != nil {
+		t.Fatalf("Failed to read CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caCert)
+	for _, test := range []struct {
+		name     string
+		certFile string
+		keyFile  string
+		accepted bool
+	}{
+		{"without a certificate", "", "", false},
+		{"with a certificate of another CA", untrustedCertFile, untrustedKeyFile, false},
+		{"with a certificate of the CA", clientCertFile, clientKeyFile, true},
+	} {
+		tlsConfig := &tls.Config{RootCAs: pool, ServerName: "localhost"}
+		if test.certFile != "" {
+			certificate, err := tls.LoadX509KeyPair(test.certFile, test.keyFile)
+			if err != nil {
+				t.Fatalf("Failed to load client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		// With TLS 1.3 the server checks the client certificate after the
+		// client finished its handshake, so a rejection shows on the first
+		// read.
+		reply := ""
+		if tlsConn, err := tls.Dial("tcp", "localhost:6401", tlsConfig); err == nil {
+			tlsConn.SetDeadline(time.Now().Add(5 * time.Second))
+			tlsConn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
+			reply, _ = bufio.NewReader(tlsConn).ReadString('\n')
+			tlsConn.Close()
+		}
+		if accepted := reply == "+PONG\r\n"; accepted != test.accepted {
+			t.Errorf("Error: Expected a client %s to be accepted %v, Got %q", test.name, test.accepted, reply)
+		}
+	}
+
+	// The replica connects to the TLS port of its master, authenticating
+	// with its own certificate.
+	replicaConn, _ := startServerProcess(t, append([]string{"--port", "6403", "--tls-port", "6404", "--dir", t.TempDir(),
+		"--tls-replication", "yes", "--replicaof", "127.0.0.1 6401"}, tlsArgs...)...)
+	defer replicaConn.Close()
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$3\r\ntls\r\n$10\r\nreplicated\r\n", "+OK\r\n", 5, masterConn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$3\r\ntls\r\n", "$10\r\nreplicated\r\n", replicaConn)
+	waitForInfoField(t, "replication", "master_link_status:up", replicaConn)
+	if info := infoSection(t, "replication", masterConn); !strings.Contains(info, "slave0:ip=127.0.0.1,port=6404,state=online,") {
+		t.Errorf("Error: Expected the master to list the replica by its TLS port, Got %q", info)
+	}
+}
+
+func testReplicationStream(t *testing.T) {
+	replicaConn := dialServer(t, "localhost:6377")
+	defer replicaConn.Close()
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(replicaConn)
+
+	replicaConn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$4\r\n7000\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "+OK\r\n" {
+		t.Fatalf("Error: Expected +OK to REPLCONF, Got %q", line)
+	}
+	replicaConn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "+FULLRESYNC 8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb 0\r\n" {
+		t.Fatalf("Error: Expected FULLRESYNC, Got %q", line)
+	}
+	line, _ := reader.ReadString('\n')
+	var rdbLength int
+	if _, err := fmt.Sscanf(line, "$%d\r\n", &rdbLength); err != nil {
+		t.Fatalf("Error: Expected the rdb file length, Got %q", line)
+	}
+	rdb := make([]byte, rdbLength)
+	if _, err := io.ReadFull(reader, rdb); err != nil || !strings.HasPrefix(string(rdb), "REDIS") {
+		t.Fatalf("Error: Expected the rdb file, Got %q: %v", rdb, err)
+	}
+
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$4\r\nrepl\r\n$3\r\nval\r\n", "+OK\r\n", 5, conn)
+	expected := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$4\r\nrepl\r\n$3\r\nval\r\n"
+	stream := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, stream); err != nil || string(stream) != expected {
+		t.Errorf("Error: Expected %q, Got %q: %v", expected, stream, err)
+	}
+}
+
+func testPartialResync(t *testing.T) {
+	replicaConn := dialServer(t, "localhost:6377")
+	defer replicaConn.Close()
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(replicaConn)
+
+	// Asking for the stream from its first byte replays the whole backlog.
+	replicaConn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$40\r\n8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\r\n$1\r\n1\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "+CONTINUE\r\n" {
+		t.Fatalf("Error: Expected CONTINUE, Got %q", line)
+	}
+	expected := "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*3\r\n$3\r\nSET\r\n$4\r\nrepl\r\n$3\r\nval\r\n"
+	stream := make([]byte, len(expected))
+	if _, err := io.ReadFull(reader, stream); err != nil || string(stream) != expected {
+		t.Errorf("Error: Expected %q, Got %q: %v", expected, stream, err)
+	}
+}
+
+func testWaitCommand(t *testing.T) {
+	replicaConn := dialServer(t, "localhost:6377")
+	defer replicaConn.Close()
+	replicaConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(replicaConn)
+
+	replicaConn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$40\r\n8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\r\n$2\r\n56\r\n"))
+	if line, _ := reader.ReadString('\n'); line != "+CONTINUE\r\n" {
+		t.Fatalf("Error: Expected CONTINUE, Got %q", line)
+	}
+
+	// Without an acknowledgement WAIT times out, after asking for one.
+	runCommandTest(t, "*3\r\n$4\r\nWAIT\r\n$1\r\n1\r\n$3\r\n100\r\n", ":0\r\n", 4, conn)
+
+	// Acknowledge the offset after every GETACK, and after the PINGs the
+	// master may send in between, like a replica would.
+	go func() {
+		var stream []byte
+		for {
+			b, err := reader.ReadByte()
+			if err != nil {
+				return
+			}
+			stream = append(stream, b)
+			if strings.HasSuffix(string(stream), "$6\r\nGETACK\r\n$1\r\n*\r\n") || strings.HasSuffix(string(stream), "$4\r\nPING\r\n") {
+				offset := fmt.Sprint(55 + len(stream))
+				replicaConn.Write([]byte(fmt.Sprintf("*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$%d\r\n%s\r\n", len(offset), offset)))
+			}
+		}
+	}()
+	runCommandTest(t, "*3\r\n$4\r\nWAIT\r\n$1\r\n1\r\n$4\r\n1000\r\n", ":1\r\n", 4, conn)
+
+	// A second replica that never acknowledges makes WAIT 2 time out with
+	// the one acknowledgement there is.
+	laggingConn := dialServer(t, "localhost:6377")
+	defer laggingConn.Close()
+	laggingConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	laggingReader := bufio.NewReader(laggingConn)
+	laggingConn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$4\r\n7002\r\n"))
+	if line, _ := laggingReader.ReadString('\n'); line != "+OK\r\n" {
+		t.Fatalf("Error: Expected +OK to REPLCONF, Got %q", line)
+	}
+	offset := fmt.Sprint(infoOffset(t, "master_repl_offset", infoSection(t, "replication", conn)) + 1)
+	laggingConn.Write([]byte(fmt.Sprintf("*3\r\n$5\r\nPSYNC\r\n$40\r\n8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb\r\n$%d\r\n%s\r\n", len(offset), offset)))
+	if line, _ := laggingReader.ReadString('\n'); line != "+CONTINUE\r\n" {
+		t.Fatalf("Error: Expected CONTINUE, Got %q", line)
+	}
+	start := time.Now()
+	runCommandTest(t, "*3\r\n$4\r\nWAIT\r\n$1\r\n2\r\n$3\r\n200\r\n", ":1\r\n", 4, conn)
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Error: Expected WAIT to block until its timeout, returned after %v", elapsed)
+	}
+
+	// INFO reports the offset each replica acknowledged: all of the stream
+	// for the first one, which answered the GETACK, none for the other.
+	info := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		info = infoSection(t, "replication", conn)
+		acked := fmt.Sprintf(",state=online,offset=%d,lag=0\n", infoOffset(t, "master_repl_offset", info))
+		if strings.Contains(info, acked) && strings.Contains(info, "port=7002,state=online,offset=0,lag=0\n") {
+			return
+		}
+	}
+	t.Errorf("Error: Expected the replicas to show their acknowledged offsets, Got %q", info)
+}
+
+// infoOffset returns the integer value of field in the text of an INFO
+// section.
+func infoOffset(t *testing.T, field string, info string) int {
+	t.Helper()
+	for _, line := range strings.Split(info, "\n") {
+		if value, found := strings.CutPrefix(line, field+":"); found {
+			offset, err := strconv.Atoi(value)
+			if err != nil {
+				t.Fatalf("Error: Expected an integer %s, Got %q", field, value)
+			}
+			return offset
+		}
+	}
+	t.Fatalf("Error: Expected INFO to hold %s, Got %q", field, info)
+	return 0
+}
+
+func testReplicaOfCommand(t *testing.T) {
+	runCommandTest(t, "*3\r\n$9\r\nREPLICAOF\r\n$2\r\nNO\r\n$3\r\nONE\r\n", "+OK\r\n", 5, conn)
+	runCommandTest(t, "*3\r\n$7\r\nSLAVEOF\r\n$9\r\nlocalhost\r\n$3\r\nabc\r\n", "-ERR Invalid master port\r\n", 26, conn)
+	runCommandTest(t, "*2\r\n$8\r\nFAILOVER\r\n$5\r\nABORT\r\n", "-ERR No failover in progress.\r\n", 31, conn)
+	runCommandTest(t, "*3\r\n$8\r\nFAILOVER\r\n$7\r\nTIMEOUT\r\n$1\r\n0\r\n", "-ERR FAILOVER timeout must be greater than 0\r\n", 46, conn)
+}
+
+func testReadOnlyReplica(t *testing.T) {
+	runCommandTest(t, "*3\r\n$9\r\nREPLICAOF\r\n$9\r\n127.0.0.1\r\n$1\r\n1\r\n", "+OK\r\n", 5, conn)
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n", "-READONLY You can't write against a read only replica.\r\n", 56, conn)
+	runCommandTest(t, "*2\r\n$3\r\nGET\r\n$3\r\nfoo\r\n", "$3\r\nbar\r\n", 9, conn)
+	runCommandTest(t, "*3\r\n$9\r\nREPLICAOF\r\n$2\r\nNO\r\n$3\r\nONE\r\n", "+OK\r\n", 5, conn)
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n", "+OK\r\n", 5, conn)
+}
+
+func testPsyncOnReplica(t *testing.T) {
+	runCommandTest(t, "*3\r\n$9\r\nREPLICAOF\r\n$9\r\n127.0.0.1\r\n$1\r\n1\r\n", "+OK\r\n", 5, conn)
+	runCommandTest(t, "*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n", "-NOMASTERLINK Can't SYNC while not connected with my master\r\n", 61, conn)
+	runCommandTest(t, "*3\r\n$9\r\nREPLICAOF\r\n$2\r\nNO\r\n$3\r\nONE\r\n", "+OK\r\n", 5, conn)
+}
+
+func testDisklessSync(t *testing.T) {
+	// The master runs in a process of its own, as the config of this one
+	// can't change while it serves clients.
+	masterConn, _ := startServerProcess(t, "--port", "6394", "--dir", t.TempDir(),
+		"--repl-diskless-sync", "yes", "--repl-diskless-sync-delay", "0")
+	defer masterConn.Close()
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$8\r\ndiskless\r\n$5\r\nfirst\r\n", "+OK\r\n", 5, masterConn)
+
+	for i, test := range []struct {
+		load    string
+		logLine string
+		rdbFile bool
+	}{
+		{"disabled", "MASTER <-> REPLICA sync: receiving streamed RDB from master", true},
+		{"on-empty-db", "MASTER <-> REPLICA sync: Finished loading the RDB from the socket", false},
+	} {
+		dir := t.TempDir()
+		port := fmt.Sprint(6390 + i)
+		replicaConn, output := startServerProcess(t, "--port", port, "--dir", dir,
+			"--replicaof", "127.0.0.1 6394", "--repl-diskless-load", test.load)
+		defer replicaConn.Close()
+
+		waitForReply(t, "*2\r\n$3\r\nGET\r\n$8\r\ndiskless\r\n", "$5\r\nfirst\r\n", replicaConn)
+		if !strings.Contains(output.String(), test.logLine) {
+			t.Errorf("Error: Expected the replica with repl-diskless-load %s to log %q, Got %q", test.load, test.logLine, output.String())
+		}
+		if _, err := os.Stat(filepath.Join(dir, "dump.rdb")); (err == nil) != test.rdbFile {
+			t.Errorf("Error: Expected the replica with repl-diskless-load %s to store the rdb file %v, Got %v", test.load, test.rdbFile, err)
+		}
+
+		// The stream of writes follows the transfer.
+		value := fmt.Sprintf("after-%d", i)
+		runCommandTest(t, fmt.Sprintf("*3\r\n$3\r\nSET\r\n$8\r\ndiskless\r\n$%d\r\n%s\r\n", len(value), value), "+OK\r\n", 5, masterConn)
+		waitForReply(t, "*2\r\n$3\r\nGET\r\n$8\r\ndiskless\r\n", fmt.Sprintf("$%d\r\n%s\r\n", len(value), value), replicaConn)
+		runCommandTest(t, "*3\r\n$3\r\nSET\r\n$8\r\ndiskless\r\n$5\r\nfirst\r\n", "+OK\r\n", 5, masterConn)
+	}
+}
+
+func testFailover(t *testing.T) {
+	masterConn, masterOutput := startServerProcess(t, "--port", "6395", "--dir", t.TempDir())
+	defer masterConn.Close()
+	replicaConn, replicaOutput := startServerProcess(t, "--port", "6396", "--dir", t.TempDir(),
+		"--replicaof", "127.0.0.1 6395")
+	defer replicaConn.Close()
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$8\r\nfailover\r\n$6\r\nbefore\r\n", "+OK\r\n", 5, masterConn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$8\r\nfailover\r\n", "$6\r\nbefore\r\n", replicaConn)
+
+	// A replica that never acknowledges anything can't catch up, so a
+	// failover to it rolls back. It claims a port nothing listens on.
+	laggingConn := dialServer(t, "127.0.0.1:6395")
+	defer laggingConn.Close()
+	go io.Copy(io.Discard, laggingConn)
+	laggingConn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$4\r\n6397\r\n"))
+	laggingConn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"))
+	waitForInfoField(t, "replication", "slave1:ip=127.0.0.1,port=6397,state=online,offset=0,lag=0", masterConn)
+
+	// Writes are paused while the target catches up, until the timeout.
+	writerConn := dialServer(t, "localhost:6395")
+	defer writerConn.Close()
+	runCommandTest(t, "*6\r\n$8\r\nFAILOVER\r\n$2\r\nTO\r\n$9\r\n127.0.0.1\r\n$4\r\n6397\r\n$7\r\nTIMEOUT\r\n$3\r\n500\r\n", "+OK\r\n", 5, masterConn)
+	waitForInfoField(t, "replication", "master_failover_state:waiting-for-sync", masterConn)
+	writerConn.Write([]byte("*3\r\n$3\r\nSET\r\n$8\r\nfailover\r\n$6\r\npaused\r\n"))
+	writerReader := bufio.NewReader(writerConn)
+	writerConn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if line, err := writerReader.ReadString('\n'); err == nil {
+		t.Errorf("Error: Expected SET to wait during the failover, Got %q", line)
+	}
+	writerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, _ := writerReader.ReadString('\n'); line != "+OK\r\n" {
+		t.Errorf("Error: Expected SET to run once the failover timed out, Got %q", line)
+	}
+	writerConn.SetReadDeadline(time.Time{})
+	waitForInfoField(t, "replication", "master_failover_state:no-failover", masterConn)
+	if !strings.Contains(masterOutput.String(), "FAILOVER aborted: Replica never caught up before timeout") {
+		t.Errorf("Error: Expected the failover to time out, Got %q", masterOutput.String())
+	}
+
+	runCommandTest(t, "*4\r\n$8\r\nFAILOVER\r\n$2\r\nTO\r\n$9\r\n127.0.0.1\r\n$4\r\n6397\r\n", "+OK\r\n", 5, masterConn)
+	runCommandTest(t, "*2\r\n$8\r\nFAILOVER\r\n$5\r\nABORT\r\n", "+OK\r\n", 5, masterConn)
+	waitForInfoField(t, "replication", "master_failover_state:no-failover", masterConn)
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$8\r\nfailover\r\n$7\r\naborted\r\n", "+OK\r\n", 5, masterConn)
+
+	// FORCE hands over once the timeout expires, and rolls back when the
+	// target does not take over.
+	runCommandTest(t, "*7\r\n$8\r\nFAILOVER\r\n$2\r\nTO\r\n$9\r\n127.0.0.1\r\n$4\r\n6397\r\n$5\r\nFORCE\r\n$7\r\nTIMEOUT\r\n$3\r\n200\r\n", "+OK\r\n", 5, masterConn)
+	waitForReply(t, "*3\r\n$3\r\nSET\r\n$8\r\nfailover\r\n$6\r\nforced\r\n", "+OK\r\n", masterConn)
+	waitForInfoField(t, "replication", "master_failover_state:no-failover", masterConn)
+	waitForInfoField(t, "replication", "role:master", masterConn)
+	for _, line := range []string{"Failover target 127.0.0.1:6397 never caught up, forcing failover.", "FAILOVER aborted: Failover target rejected the PSYNC request"} {
+		if !strings.Contains(masterOutput.String(), line) {
+			t.Errorf("Error: Expected the master to log %q, Got %q", line, masterOutput.String())
+		}
+	}
+
+	// Once the replica caught up it takes over, and the old master follows
+	// it.
+	waitForInfoField(t, "replication", "master_link_status:up", replicaConn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$8\r\nfailover\r\n", "$6\r\nforced\r\n", replicaConn)
+	runCommandTest(t, "*4\r\n$8\r\nFAILOVER\r\n$2\r\nTO\r\n$9\r\n127.0.0.1\r\n$4\r\n6396\r\n", "+OK\r\n", 5, masterConn)
+	waitForInfoField(t, "replication", "role:master", replicaConn)
+	waitForInfoField(t, "replication", "master_port:6396", masterConn)
+	waitForInfoField(t, "replication", "master_failover_state:no-failover", masterConn)
+	if !strings.Contains(replicaOutput.String(), "Failover request received for replica") {
+		t.Errorf("Error: Expected the target to get PSYNC FAILOVER, Got %q", replicaOutput.String())
+	}
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$8\r\nfailover\r\n$5\r\nafter\r\n", "+OK\r\n", 5, replicaConn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$8\r\nfailover\r\n", "$5\r\nafter\r\n", masterConn)
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$8\r\nfailover\r\n$5\r\nafter\r\n", "-READONLY You can't write against a read only replica.\r\n", 56, masterConn)
+}
+
+func testReplicaChain(t *testing.T) {
+	masterConn, _ := startServerProcess(t, "--port", "6398", "--dir", t.TempDir())
+	defer masterConn.Close()
+	replicaConn, replicaOutput := startServerProcess(t, "--port", "6399", "--dir", t.TempDir(),
+		"--replicaof", "127.0.0.1 6398")
+	defer replicaConn.Close()
+	subReplicaConn, subReplicaOutput := startServerProcess(t, "--port", "6400", "--dir", t.TempDir(),
+		"--replicaof", "127.0.0.1 6399")
+	defer subReplicaConn.Close()
+
+	// Writes to the master flow through the replica to the sub-replica.
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$5\r\nchain\r\n$5\r\nfirst\r\n", "+OK\r\n", 5, masterConn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$5\r\nchain\r\n", "$5\r\nfirst\r\n", subReplicaConn)
+	waitForInfoField(t, "replication", "master_link_status:up", subReplicaConn)
+
+	// Once the replica drops it, the sub-replica continues from its offset
+	// with what the replica kept of the stream of the master.
+	runCommandTest(t, "*4\r\n$6\r\nCLIENT\r\n$4\r\nKILL\r\n$4\r\nTYPE\r\n$7\r\nreplica\r\n", ":1\r\n", 4, replicaConn)
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$5\r\nchain\r\n$6\r\nsecond\r\n", "+OK\r\n", 5, masterConn)
+	waitForReply(t, "*2\r\n$3\r\nGET\r\n$5\r\nchain\r\n", "$6\r\nsecond\r\n", subReplicaConn)
+	if !strings.Contains(subReplicaOutput.String(), "MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization") {
+		t.Errorf("Error: Expected the sub-replica to resync partially, Got %q", subReplicaOutput.String())
+	}
+	if !strings.Contains(replicaOutput.String(), "Partial resynchronization request from 127.0.0.1:6400 accepted") {
+		t.Errorf("Error: Expected the replica to serve the partial resync, Got %q", replicaOutput.String())
+	}
+	masterOffset := infoOffset(t, "master_repl_offset", infoSection(t, "replication", masterConn))
+	waitForInfoField(t, "replication", fmt.Sprintf("master_repl_offset:%d", masterOffset), subReplicaConn)
+}
+
+func testUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "redis.sock")
+	// A socket file left behind by a previous run is replaced.
+	if err := os.WriteFile(socketPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tcpConn, _ := startServerProcess(t, "--port", "6392", "--unixsocket", socketPath, "--unixsocketperm", "700")
+	defer tcpConn.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil || info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0700 {
+		t.Fatalf("Error: Expected a socket file with permissions 0700, Got %v %v", info, err)
+	}
+	unixConn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to %s: %v", socketPath, err)
+	}
+	defer unixConn.Close()
+	runCommandTest(t, "*3\r\n$3\r\nSET\r\n$4\r\nunix\r\n$6\r\nsocket\r\n", "+OK\r\n", 5, unixConn)
+	runCommandTest(t, "*2\r\n$3\r\nGET\r\n$4\r\nunix\r\n", "$6\r\nsocket\r\n", 12, tcpConn)
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "redis.sock")
+	if _, err := listenUnixSocket(socketPath, "9"); err == nil {
+		t.Errorf("Error: Expected unixsocketperm 9 to be rejected")
+	}
+	listener, err := listenUnixSocket(socketPath, "600")
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", socketPath, err)
+	}
+	if info, err := os.Stat(socketPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Error: Expected permissions 0600, Got %v %v", info, err)
+	}
+	// Closing the listener is all it takes to clean up when exiting.
+	listener.Close()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("Error: Expected the socket file to be removed, Got %v", err)
+	}
+}
+
+func testProtectedMode(t *testing.T) {
+	// A client on another host, as seen through a pipe.
+	server, client := net.Pipe()
+	go handleConn(&remoteConn{Conn: server, remote: &net.TCPAddr{IP: net.ParseIP("192.0.2.10"), Port: 50000}})
+	resp, err := io.ReadAll(client)
+	if err != nil || string(resp) != internal.ProtectedModeError {
+		t.Errorf("Error: Expected a non loopback connection to be denied, Got %q %v", resp, err)
+	}
+
+	// The server binds every interface, so an address of this host that is
+	// not on the loopback interface reaches it from outside.
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || ipNet.IP.To4() == nil {
+			continue
+		}
+		externalConn, err := net.Dial("tcp", net.JoinHostPort(ipNet.IP.String(), "6377"))
+		if err != nil {
+			t.Fatalf("Failed to connect to %s: %v", ipNet.IP, err)
+		}
+		defer externalConn.Close()
+		externalConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if resp, _ := io.ReadAll(externalConn); !strings.HasPrefix(string(resp), "-DENIED") {
+			t.Errorf("Error: Expected a connection to %s to be denied, Got %q", ipNet.IP, resp)
+		}
+		return
+	}
+	t.Log("No non loopback IPv4 address to connect from")
+}
+
+// remoteConn is a connection from remote.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestListenTCP(t *testing.T) {
+	// The default bind: every IPv4 interface, and every IPv6 interface when
+	// the host has IPv6.
+	listeners, err := listenTCP(strings.Fields("* -::*"), "6393", nil)
+	if err != nil {
+		t.Fatalf("Failed to bind: %v", err)
+	}
+	var addresses []string
+	for _, listener := range listeners {
+		addresses = append(addresses, listener.Addr().String())
+		listener.Close()
+	}
+	if len(addresses) < 1 || len(addresses) > 2 || addresses[0] != "0.0.0.0:6393" || len(addresses) == 2 && addresses[1] != "[::]:6393" {
+		t.Errorf("Error: Expected to listen on 0.0.0.0:6393 and optionally [::]:6393, Got %v", addresses)
+	}
+
+	// An address that cannot be bound fails startup unless it is optional,
+	// and the addresses bound before it are released.
+	listeners, err = listenTCP([]string{"127.0.0.1", "-192.0.2.10"}, "6393", nil)
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("Error: Expected the optional address to be skipped, Got %v %v", listeners, err)
+	}
+	listeners[0].Close()
+	if _, err := listenTCP([]string{"127.0.0.1", "192.0.2.10"}, "6393", nil); err == nil {
+		t.Fatalf("Error: Expected binding 192.0.2.10 to fail")
+	}
+	listener, err := net.Listen("tcp4", "127.0.0.1:6393")
+	if err != nil {
+		t.Fatalf("Error: Expected 127.0.0.1:6393 to be released, Got %v", err)
+	}
+	listener.Close()
+}
+
+// startServerProcess runs a server with args in a process of its own, killed
+// when the test ends, and connects to it. The returned buffer collects its
+// output.
+func startServerProcess(t *testing.T, args ...string) (net.Conn, *syncBuffer) {
+	command := exec.Command(os.Args[0], "-test.run=^TestReplicaProcess$")
+	command.Env = append(os.Environ(), "REDIS_TEST_SERVER_ARGS="+strings.Join(args, "\n"))
+	output := &syncBuffer{}
+	command.Stdout = output
+	command.Stderr = output
+	if err := command.Start(); err != nil {
+		t.Fatalf("Failed to start server process: %v", err)
+	}
+	t.Cleanup(func() {
+		command.Process.Kill()
+		command.Wait()
+	})
+
+	port := ""
+	for i, arg := range args {
+		if arg == "--port" {
+			port = args[i+1]
+		}
+	}
+	return dialServer(t, "localhost:"+port), output
+}
+
+// syncBuffer is a bytes.Buffer safe to write from a process while the test
+// reads it.
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.String()
+}
+
+// waitForReply sends command until it replies with expectedResp, for up to
+// 5 seconds.
+func waitForReply(t *testing.T, command string, expectedResp string, conn net.Conn) {
+	t.Helper()
+	resp := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp = strings.TrimRight(sendCommand(t, command, len(expectedResp), conn), "\x00"); resp == expectedResp {
+			return
+		}
+	}
+	t.Fatalf("Error: Expected %q, Got %q", expectedResp, resp)
+}
+
+// infoSection returns the text of an INFO section.
+func infoSection(t *testing.T, section string, conn net.Conn) string {
+	t.Helper()
+	if _, err := fmt.Fprintf(conn, "*2\r\n$4\r\nINFO\r\n$%d\r\n%s\r\n", len(section), section); err != nil {
+		t.Fatalf("Failed to send command: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	header, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	var length int
+	if _, err := fmt.Sscanf(header, "$%d\r\n", &length); err != nil {
+		t.Fatalf("Error: Expected a bulk string reply to INFO, Got %q", header)
+	}
+	body := make([]byte, length+2)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		t.Fatalf("Failed to read response: %v", err)
+	}
+	return string(body[:length])
+}
+
+// waitForInfoField polls an INFO section until it holds field, for up to 5
+// seconds.
+func waitForInfoField(t *testing.T, section string, field string, conn net.Conn) {
+	t.Helper()
+	info := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if info = infoSection(t, section, conn); strings.Contains(info, field+"\n") || strings.HasSuffix(info, field) {
+			return
+		}
+	}
+	t.Fatalf("Error: Expected INFO %s to hold %s, Got %q", section, field, info)
 }
 
 func runCommandTest(t *testing.T, command string, expectedResp string, respByteCount int, conn net.Conn) {
+	resp := sendCommand(t, command, respByteCount, conn)
+	if resp != expectedResp {
+		t.Errorf("Error: Expected %s, Got %s", expectedResp, resp)
+	}
+
+}
+
+func sendCommand(t *testing.T, command string, respByteCount int, conn net.Conn) string {
 	_, err := conn.Write([]byte(command))
 	if err != nil {
 		t.Fatalf("Failed to send command: %v", err)
@@ -97,35 +772,116 @@ func runCommandTest(t *testing.T, command string, expectedResp string, respByteC
 	if err != nil {
 		t.Fatalf("Failed to read response: %v", err)
 	}
-	if string(resp) != expectedResp {
-		t.Errorf("Error: Expected %s, Got %s", expectedResp, resp)
-	}
-
+	return string(resp)
 }
 
-func copyRdbDumpToSourceDir() {
+func copyRdbDumpToSourceDir() error {
 	internal.Config["dir"] = "../dump"
 	internal.Config["dbfilename"] = "dump.rdb"
 	err := os.MkdirAll("../dump", 0755)
 	if err != nil {
-		fmt.Errorf("failed to create directory")
+		return fmt.Errorf("failed to create directory: %v", err)
 	}
 
 	src, err := os.Open("../test/dump.rdb")
 	if err != nil {
-		fmt.Errorf("failed to open directory")
+		return fmt.Errorf("failed to open directory: %v", err)
 	}
 	defer src.Close()
 
 	dest, err := os.Create("../dump/dump.rdb")
 	if err != nil {
-		fmt.Errorf("failed to create directory in destination")
+		return fmt.Errorf("failed to create directory in destination: %v", err)
 	}
 	defer dest.Close()
 
 	_, err = io.Copy(dest, src)
 	if err != nil {
-		fmt.Errorf("failed to copy file")
+		return fmt.Errorf("failed to copy file: %v", err)
+	}
+	return nil
+}
+
+func dialServer(t *testing.T, address string) net.Conn {
+	for i := 0; i < 50; i++ {
+		serverConn, err := net.Dial("tcp", address)
+		if err == nil {
+			return serverConn
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("Failed to connect to server at %s", address)
+	return nil
+}
+
+func generateTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certFile := filepath.Join(dir, "redis.crt")
+	keyFile := filepath.Join(dir, "redis.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// generateClientCertificate writes a client certificate signed by the CA in
+// caFile and caKeyFile to dir.
+func generateClientCertificate(t *testing.T, dir string, caFile string, caKeyFile string) (string, string) {
+	ca, err := tls.LoadX509KeyPair(caFile, caKeyFile)
+	if err != nil {
+		t.Fatalf("Failed to load CA: %v", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	certDer, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
 	}
 
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
 }
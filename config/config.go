@@ -13,6 +13,8 @@ type ReplicationInfo struct {
 	MasterPort       string
 	MasterReplId     string
 	MasterReplOffset int
+	MasterReplId2    string
+	SecondReplOffset int
 	MasterConn       net.Conn
 }
 
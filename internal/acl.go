@@ -0,0 +1,836 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type keyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+type aclUser struct {
+	name    string
+	enabled bool
+	noPass  bool
+	// passwords holds the hex encoded SHA-256 of every accepted password.
+	passwords       []string
+	commands        map[string]bool
+	subcommands     map[string]bool
+	commandRules    []string
+	keyPatterns     []keyPattern
+	channelPatterns []string
+}
+
+type aclLogEntry struct {
+	id          int
+	count       int
+	reason      string
+	context     string
+	object      string
+	username    string
+	clientInfo  string
+	createdAt   time.Time
+	lastUpdated time.Time
+}
+
+type aclState struct {
+	mu        sync.Mutex
+	users     map[string]*aclUser
+	log       []*aclLogEntry
+	nextLogId int
+}
+
+var acl = aclState{
+	users: map[string]*aclUser{
+		"default": newDefaultAclUser(),
+	},
+}
+
+const aclLogMaxLen = 128
+
+func newAclUser(name string) *aclUser {
+	return &aclUser{
+		name:         name,
+		commands:     make(map[string]bool),
+		subcommands:  make(map[string]bool),
+		commandRules: []string{"-@all"},
+	}
+}
+
+func newDefaultAclUser() *aclUser {
+	user := newAclUser("default")
+	user.applyRules([]string{"on", "nopass", "~*", "&*", "+@all"})
+	return user
+}
+
+// LoadAcl applies requirepass to the default user and loads the users
+// defined in aclfile, if one is configured. Like Redis it refuses both, as
+// the aclfile replaces the default user and would drop the password.
+func LoadAcl() error {
+	if Config["requirepass"] != "" && Config["aclfile"] != "" {
+		return fmt.Errorf("requirepass can't be used together with aclfile, set the password of the default user in the aclfile instead")
+	}
+	if password := Config["requirepass"]; password != "" {
+		acl.mu.Lock()
+		err := acl.users["default"].applyRules([]string{"resetpass", ">" + password})
+		acl.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if Config["aclfile"] == "" {
+		return nil
+	}
+	return loadAclFile(Config["aclfile"])
+}
+
+func (u *aclUser) clone() *aclUser {
+	copied := *u
+	copied.passwords = append([]string{}, u.passwords...)
+	copied.commandRules = append([]string{}, u.commandRules...)
+	copied.keyPatterns = append([]keyPattern{}, u.keyPatterns...)
+	copied.channelPatterns = append([]string{}, u.channelPatterns...)
+	copied.commands = make(map[string]bool)
+	for command, allowed := range u.commands {
+		copied.commands[command] = allowed
+	}
+	copied.subcommands = make(map[string]bool)
+	for subcommand, allowed := range u.subcommands {
+		copied.subcommands[subcommand] = allowed
+	}
+	return &copied
+}
+
+func (u *aclUser) applyRules(rules []string) error {
+	for _, rule := range rules {
+		if err := u.applyRule(rule); err != nil {
+			return fmt.Errorf("Error in ACL SETUSER modifier '%s': %v", rule, err)
+		}
+	}
+	return nil
+}
+
+func (u *aclUser) applyRule(rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.noPass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.noPass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.keyPatterns = []keyPattern{{pattern: "*", read: true, write: true}}
+		return nil
+	case "resetkeys":
+		u.keyPatterns = nil
+		return nil
+	case "allchannels":
+		u.channelPatterns = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channelPatterns = nil
+		return nil
+	case "allcommands":
+		return u.applyRule("+@all")
+	case "nocommands":
+		return u.applyRule("-@all")
+	case "reset":
+		return u.applyRules([]string{"resetpass", "resetkeys", "resetchannels", "off", "-@all"})
+	}
+
+	if len(rule) < 2 {
+		return fmt.Errorf("Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.addPassword(hashPassword(rule[1:]))
+	case '#':
+		hash := strings.ToLower(rule[1:])
+		if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+			return fmt.Errorf("The password hash must be exactly 64 characters and contain only lowercase hexadecimal characters")
+		}
+		u.addPassword(hash)
+	case '<':
+		return u.removePassword(hashPassword(rule[1:]))
+	case '!':
+		return u.removePassword(strings.ToLower(rule[1:]))
+	case '~':
+		u.addKeyPattern(keyPattern{pattern: rule[1:], read: true, write: true})
+	case '%':
+		separator := strings.Index(rule, "~")
+		if separator < 2 {
+			return fmt.Errorf("Syntax error")
+		}
+		pattern := keyPattern{pattern: rule[separator+1:]}
+		for _, permission := range strings.ToUpper(rule[1:separator]) {
+			switch permission {
+			case 'R':
+				pattern.read = true
+			case 'W':
+				pattern.write = true
+			default:
+				return fmt.Errorf("Syntax error")
+			}
+		}
+		u.addKeyPattern(pattern)
+	case '&':
+		u.channelPatterns = append(u.channelPatterns, rule[1:])
+	case '+', '-':
+		return u.applyCommandRule(rule[0] == '+', strings.ToLower(rule[1:]))
+	default:
+		return fmt.Errorf("Syntax error")
+	}
+	return nil
+}
+
+func hashPassword(password string) string {
+	hash := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(hash[:])
+}
+
+func (u *aclUser) addPassword(hash string) {
+	u.noPass = false
+	for _, existing := range u.passwords {
+		if existing == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) error {
+	for i, existing := range u.passwords {
+		if existing == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no such password")
+}
+
+func (u *aclUser) addKeyPattern(pattern keyPattern) {
+	for i, existing := range u.keyPatterns {
+		if existing.pattern == pattern.pattern {
+			u.keyPatterns[i].read = existing.read || pattern.read
+			u.keyPatterns[i].write = existing.write || pattern.write
+			return
+		}
+	}
+	u.keyPatterns = append(u.keyPatterns, pattern)
+}
+
+func (u *aclUser) applyCommandRule(allow bool, name string) error {
+	sign := "-"
+	if allow {
+		sign = "+"
+	}
+
+	if strings.HasPrefix(name, "@") {
+		category := name[1:]
+		if !isCommandCategory(category) {
+			return fmt.Errorf("Unknown command or category name in ACL")
+		}
+		if category == "all" {
+			u.commands = make(map[string]bool)
+			u.subcommands = make(map[string]bool)
+			u.commandRules = nil
+		}
+		for _, command := range commandsInCategory(category) {
+			u.setCommand(command, allow)
+		}
+		u.commandRules = append(u.commandRules, sign+name)
+		return nil
+	}
+
+	command, subcommand, hasSubcommand := strings.Cut(strings.ToUpper(name), "|")
+	if _, exists := commandTable[command]; !exists {
+		return fmt.Errorf("Unknown command or category name in ACL")
+	}
+	if hasSubcommand {
+		if subcommand == "" {
+			return fmt.Errorf("Syntax error")
+		}
+		u.subcommands[command+"|"+subcommand] = allow
+	} else {
+		u.setCommand(command, allow)
+	}
+	u.commandRules = append(u.commandRules, sign+name)
+	return nil
+}
+
+func (u *aclUser) setCommand(command string, allow bool) {
+	u.commands[command] = allow
+	for subcommand := range u.subcommands {
+		if strings.HasPrefix(subcommand, command+"|") {
+			delete(u.subcommands, subcommand)
+		}
+	}
+}
+
+func (u *aclUser) checkPassword(password string) bool {
+	if u.noPass {
+		return true
+	}
+	hash := hashPassword(password)
+	for _, existing := range u.passwords {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(existing)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) allowsCommand(command string, args []interface{}) bool {
+	if len(args) > 0 {
+		subcommand, _ := args[0].(string)
+		if allowed, exists := u.subcommands[command+"|"+strings.ToUpper(subcommand)]; exists {
+			return allowed
+		}
+	}
+	return u.commands[command]
+}
+
+func (u *aclUser) allowsChannel(channel string) bool {
+	for _, pattern := range u.channelPatterns {
+		if stringMatch(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) allowsKey(key string, write bool) bool {
+	for _, pattern := range u.keyPatterns {
+		if (write && !pattern.write) || (!write && !pattern.read) {
+			continue
+		}
+		if stringMatch(pattern.pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *aclUser) flags() []interface{} {
+	flags := []interface{}{"off"}
+	if u.enabled {
+		flags[0] = "on"
+	}
+	if u.noPass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) describeKeys() string {
+	var keys []string
+	for _, pattern := range u.keyPatterns {
+		switch {
+		case pattern.read && pattern.write:
+			keys = append(keys, "~"+pattern.pattern)
+		case pattern.read:
+			keys = append(keys, "%R~"+pattern.pattern)
+		case pattern.write:
+			keys = append(keys, "%W~"+pattern.pattern)
+		}
+	}
+	return strings.Join(keys, " ")
+}
+
+func (u *aclUser) describeChannels() string {
+	var channels []string
+	for _, pattern := range u.channelPatterns {
+		channels = append(channels, "&"+pattern)
+	}
+	return strings.Join(channels, " ")
+}
+
+// describe renders the user as the rules ACL LIST prints and ACL SAVE writes.
+func (u *aclUser) describe() string {
+	rules := []string{"user", u.name}
+	for _, flag := range u.flags() {
+		rules = append(rules, flag.(string))
+	}
+	for _, hash := range u.passwords {
+		rules = append(rules, "#"+hash)
+	}
+	if keys := u.describeKeys(); keys != "" {
+		rules = append(rules, keys)
+	}
+	if channels := u.describeChannels(); channels != "" {
+		rules = append(rules, channels)
+	} else {
+		rules = append(rules, "resetchannels")
+	}
+	rules = append(rules, u.commandRules...)
+	return strings.Join(rules, " ")
+}
+
+func authenticate(client *Client, username string, password string) bool {
+	acl.mu.Lock()
+	user, exists := acl.users[username]
+	ok := exists && user.enabled && user.checkPassword(password)
+	acl.mu.Unlock()
+
+	if !ok {
+		addAclLogEntry(client, "auth", "AUTH", username)
+		return false
+	}
+
+	clients.mu.Lock()
+	client.authenticated = true
+	client.user = username
+	clients.mu.Unlock()
+	return true
+}
+
+// defaultUserNoPass reports whether new connections are authenticated as
+// the default user without having to call AUTH.
+func defaultUserNoPass() bool {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	user := acl.users["default"]
+	return user.enabled && user.noPass
+}
+
+// aclCheckCommand returns the NOPERM error to reply with when the client's
+// user may not run the command, or an empty string when it may.
+func aclCheckCommand(client *Client, command string, args []interface{}) string {
+	clients.mu.Lock()
+	username := client.user
+	clients.mu.Unlock()
+
+	reason, object := aclDenyReason(username, command, args)
+	switch reason {
+	case "":
+		return ""
+	case "key":
+		addAclLogEntry(client, reason, object, username)
+		return "NOPERM No permissions to access a key"
+	case "channel":
+		addAclLogEntry(client, reason, object, username)
+		return "NOPERM No permissions to access a channel"
+	default:
+		addAclLogEntry(client, reason, object, username)
+		return fmt.Sprintf("NOPERM User %s has no permissions to run the '%s' command", username, strings.ToLower(command))
+	}
+}
+
+func aclDenyReason(username string, command string, args []interface{}) (string, string) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	user, exists := acl.users[username]
+	if !exists || !user.allowsCommand(command, args) {
+		return "command", strings.ToLower(command)
+	}
+	for _, key := range commandKeys(command, args) {
+		if !user.allowsKey(key, isWriteCommand(command)) {
+			return "key", key
+		}
+	}
+	for _, channel := range commandChannels(command, args) {
+		if !user.allowsChannel(channel) {
+			return "channel", channel
+		}
+	}
+	return "", ""
+}
+
+func addAclLogEntry(client *Client, reason string, object string, username string) {
+	clientInfo := ""
+	if client != nil {
+		clients.mu.Lock()
+		clientInfo = client.info()
+		clients.mu.Unlock()
+	}
+
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	now := time.Now()
+	for _, entry := range acl.log {
+		if entry.reason == reason && entry.object == object && entry.username == username &&
+			now.Sub(entry.lastUpdated) < time.Minute {
+			entry.count++
+			entry.lastUpdated = now
+			entry.clientInfo = clientInfo
+			return
+		}
+	}
+
+	entry := &aclLogEntry{
+		id:          acl.nextLogId,
+		count:       1,
+		reason:      reason,
+		context:     "toplevel",
+		object:      object,
+		username:    username,
+		clientInfo:  clientInfo,
+		createdAt:   now,
+		lastUpdated: now,
+	}
+	acl.nextLogId++
+	acl.log = append([]*aclLogEntry{entry}, acl.log...)
+	if len(acl.log) > aclLogMaxLen {
+		acl.log = acl.log[:aclLogMaxLen]
+	}
+}
+
+func handleAcl(client *Client, args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("failed to execute ACL command, it requires a subcommand")
+	}
+	subcommand, _ := args[0].(string)
+	args = args[1:]
+
+	switch strings.ToUpper(subcommand) {
+	case "SETUSER":
+		return handleAclSetUser(args)
+	case "GETUSER":
+		return handleAclGetUser(client, args)
+	case "DELUSER":
+		return handleAclDelUser(client, args)
+	case "LIST":
+		return handleAclList()
+	case "USERS":
+		return handleAclUsers()
+	case "WHOAMI":
+		clients.mu.Lock()
+		username := client.user
+		clients.mu.Unlock()
+		return encodeBulkString(&username), nil
+	case "CAT":
+		return handleAclCat(args)
+	case "LOG":
+		return handleAclLog(args)
+	case "DRYRUN":
+		return handleAclDryRun(args)
+	case "LOAD":
+		if Config["aclfile"] == "" {
+			return encodeSimpleError("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."), nil
+		}
+		if err := loadAclFile(Config["aclfile"]); err != nil {
+			return encodeSimpleError("ERR " + err.Error()), nil
+		}
+		return encodeSimpleString("OK"), nil
+	case "SAVE":
+		if Config["aclfile"] == "" {
+			return encodeSimpleError("ERR This Redis instance is not configured to use an ACL file. You may want to specify users via the ACL SETUSER command and then issue a CONFIG REWRITE (assuming you have a Redis configuration file set) in order to store users in the Redis configuration."), nil
+		}
+		if err := saveAclFile(Config["aclfile"]); err != nil {
+			return encodeSimpleError("ERR There was an error trying to save the ACLs. Please check the server logs for more information"), nil
+		}
+		return encodeSimpleString("OK"), nil
+	default:
+		return "", fmt.Errorf("ACL subcommand %s is unsupported", subcommand)
+	}
+}
+
+func handleAclSetUser(args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("failed to execute ACL SETUSER command, it requires a username")
+	}
+	username, _ := args[0].(string)
+	var rules []string
+	for _, arg := range args[1:] {
+		rule, _ := arg.(string)
+		rules = append(rules, rule)
+	}
+
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+
+	user, exists := acl.users[username]
+	if exists {
+		user = user.clone()
+	} else {
+		user = newAclUser(username)
+	}
+	if err := user.applyRules(rules); err != nil {
+		return encodeSimpleError("ERR " + err.Error()), nil
+	}
+	acl.users[username] = user
+	return encodeSimpleString("OK"), nil
+}
+
+func handleAclGetUser(client *Client, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("failed to execute ACL GETUSER command, it requires a username")
+	}
+	username, _ := args[0].(string)
+
+	acl.mu.Lock()
+	user, exists := acl.users[username]
+	if !exists {
+		acl.mu.Unlock()
+		return encodeBulkString(nil), nil
+	}
+	var passwords []interface{}
+	for _, hash := range user.passwords {
+		passwords = append(passwords, hash)
+	}
+	info := []interface{}{
+		"flags", user.flags(),
+		"passwords", passwords,
+		"commands", strings.Join(user.commandRules, " "),
+		"keys", user.describeKeys(),
+		"channels", user.describeChannels(),
+		"selectors", []interface{}{},
+	}
+	acl.mu.Unlock()
+
+	if client.protocol == 3 {
+		return encodeMap(info)
+	}
+	return encodeArray(info)
+}
+
+func handleAclDelUser(client *Client, args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("failed to execute ACL DELUSER command, it requires at least one username")
+	}
+
+	var deleted []string
+	acl.mu.Lock()
+	for _, arg := range args {
+		username, _ := arg.(string)
+		if username == "default" {
+			acl.mu.Unlock()
+			return encodeSimpleError("ERR The 'default' user cannot be removed"), nil
+		}
+	}
+	for _, arg := range args {
+		username, _ := arg.(string)
+		if _, exists := acl.users[username]; exists {
+			delete(acl.users, username)
+			deleted = append(deleted, username)
+		}
+	}
+	acl.mu.Unlock()
+
+	for _, username := range deleted {
+		killClients(client, clientKillFilter{user: username})
+	}
+	return encodeInteger(len(deleted)), nil
+}
+
+func sortedAclUsers() []*aclUser {
+	var users []*aclUser
+	for _, user := range acl.users {
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].name < users[j].name })
+	return users
+}
+
+func handleAclList() (string, error) {
+	acl.mu.Lock()
+	var rules []interface{}
+	for _, user := range sortedAclUsers() {
+		rules = append(rules, user.describe())
+	}
+	acl.mu.Unlock()
+	return encodeArray(rules)
+}
+
+func handleAclUsers() (string, error) {
+	acl.mu.Lock()
+	var names []interface{}
+	for _, user := range sortedAclUsers() {
+		names = append(names, user.name)
+	}
+	acl.mu.Unlock()
+	return encodeArray(names)
+}
+
+func handleAclCat(args []interface{}) (string, error) {
+	var list []interface{}
+	if len(args) == 0 {
+		for _, category := range commandCategories {
+			list = append(list, category)
+		}
+		return encodeArray(list)
+	}
+
+	category, _ := args[0].(string)
+	category = strings.ToLower(category)
+	if !isCommandCategory(category) {
+		return encodeSimpleError(fmt.Sprintf("ERR Unknown category '%s'", category)), nil
+	}
+	for _, command := range commandsInCategory(category) {
+		list = append(list, strings.ToLower(command))
+	}
+	return encodeArray(list)
+}
+
+func handleAclLog(args []interface{}) (string, error) {
+	count := aclLogMaxLen
+	if len(args) > 0 {
+		option, _ := args[0].(string)
+		if strings.ToUpper(option) == "RESET" {
+			acl.mu.Lock()
+			acl.log = nil
+			acl.mu.Unlock()
+			return encodeSimpleString("OK"), nil
+		}
+		parsed, err := strconv.Atoi(option)
+		if err != nil || parsed < 0 {
+			return encodeSimpleError("ERR value is out of range, must be positive"), nil
+		}
+		count = parsed
+	}
+
+	acl.mu.Lock()
+	var entries []interface{}
+	now := time.Now()
+	for i, entry := range acl.log {
+		if i >= count {
+			break
+		}
+		fields := []interface{}{
+			"count", entry.count,
+			"reason", entry.reason,
+			"context", entry.context,
+			"object", entry.object,
+			"username", entry.username,
+			"age-seconds", fmt.Sprintf("%.3f", now.Sub(entry.createdAt).Seconds()),
+			"client-info", entry.clientInfo,
+			"entry-id", entry.id,
+			"timestamp-created", int(entry.createdAt.UnixMilli()),
+			"timestamp-last-updated", int(entry.lastUpdated.UnixMilli()),
+		}
+		entries = append(entries, fields)
+	}
+	acl.mu.Unlock()
+	return encodeArray(entries)
+}
+
+func handleAclDryRun(args []interface{}) (string, error) {
+	if len(args) < 2 {
+		return "", fmt.Errorf("failed to execute ACL DRYRUN command, it requires a username and a command")
+	}
+	username, _ := args[0].(string)
+	command, _ := args[1].(string)
+	command = strings.ToUpper(command)
+	commandArgs := args[2:]
+
+	acl.mu.Lock()
+	_, exists := acl.users[username]
+	acl.mu.Unlock()
+	if !exists {
+		return encodeSimpleError(fmt.Sprintf("ERR User '%s' not found", username)), nil
+	}
+	if _, exists := commandTable[command]; !exists {
+		return encodeSimpleError(fmt.Sprintf("ERR Command '%s' not found", strings.ToLower(command))), nil
+	}
+
+	reason, object := aclDenyReason(username, command, commandArgs)
+	var message string
+	switch reason {
+	case "":
+		return encodeSimpleString("OK"), nil
+	case "key":
+		message = fmt.Sprintf("User %s has no permissions to access the '%s' key", username, object)
+	case "channel":
+		message = fmt.Sprintf("User %s has no permissions to access the '%s' channel", username, object)
+	default:
+		message = fmt.Sprintf("User %s has no permissions to run the '%s' command", username, strings.ToLower(command))
+	}
+	return encodeBulkString(&message), nil
+}
+
+func loadAclFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open ACL file %s: %v", path, err)
+	}
+	defer file.Close()
+
+	users := make(map[string]*aclUser)
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if fields[0] != "user" || len(fields) < 2 {
+			return fmt.Errorf("%s:%d: line should start with user keyword", path, lineNumber)
+		}
+		if _, exists := users[fields[1]]; exists {
+			return fmt.Errorf("%s:%d: duplicate user '%s' found", path, lineNumber, fields[1])
+		}
+		user := newAclUser(fields[1])
+		if err := user.applyRules(fields[2:]); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNumber, err)
+		}
+		users[user.name] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ACL file %s: %v", path, err)
+	}
+	if _, exists := users["default"]; !exists {
+		users["default"] = newDefaultAclUser()
+	}
+
+	acl.mu.Lock()
+	acl.users = users
+	acl.mu.Unlock()
+
+	// Connections authenticated as users that no longer exist are dropped.
+	clients.mu.Lock()
+	var orphaned []string
+	for _, client := range clients.clients {
+		if _, exists := users[client.user]; !exists {
+			orphaned = append(orphaned, client.user)
+		}
+	}
+	clients.mu.Unlock()
+	for _, username := range orphaned {
+		killClients(nil, clientKillFilter{user: username})
+	}
+	return nil
+}
+
+func saveAclFile(path string) error {
+	acl.mu.Lock()
+	content := ""
+	for _, user := range sortedAclUsers() {
+		content += user.describe() + "\n"
+	}
+	acl.mu.Unlock()
+
+	tempPath := filepath.Join(filepath.Dir(path), fmt.Sprintf("temp-acl-%d.acl", os.Getpid()))
+	if err := os.WriteFile(tempPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write ACL file %s: %v", tempPath, err)
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename ACL file %s to %s: %v", tempPath, path, err)
+	}
+	return nil
+}
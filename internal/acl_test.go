@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAclSetUserRules(t *testing.T) {
+	useTestAcl(t)
+	admin, _ := newTestClient(t)
+
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "alice", "on", ">secret", ">other", "<other", "~cached:*", "&news", "-@all", "+get", "+client|getname")
+	acl.mu.Lock()
+	alice := acl.users["alice"]
+	acl.mu.Unlock()
+	if !alice.enabled || alice.noPass || len(alice.passwords) != 1 || !alice.checkPassword("secret") || alice.checkPassword("other") {
+		t.Errorf("Expected alice to be enabled with only the password secret, Got %+v", alice)
+	}
+	expected := "user alice on #" + hashPassword("secret") + " ~cached:* &news -@all +get +client|getname"
+	if described := alice.describe(); described != expected {
+		t.Errorf("Expected %q, Got %q", expected, described)
+	}
+
+	for _, rules := range [][]interface{}{
+		{"+nosuchcommand"},
+		{"+@nosuchcategory"},
+		{"%X~key"},
+		{"#notahash"},
+		{"<notapassword"},
+		{"x"},
+	} {
+		resp := run(t, admin, "ACL", append([]interface{}{"SETUSER", "alice"}, rules...)...)
+		if !strings.HasPrefix(resp, "-ERR Error in ACL SETUSER modifier") {
+			t.Errorf("Expected rules %v to be rejected, Got %q", rules, resp)
+		}
+	}
+	// A rejected SETUSER leaves the user untouched.
+	acl.mu.Lock()
+	unchanged := acl.users["alice"].describe()
+	acl.mu.Unlock()
+	if unchanged != expected {
+		t.Errorf("Expected %q, Got %q", expected, unchanged)
+	}
+}
+
+func TestAclKeyPatterns(t *testing.T) {
+	useTestAcl(t)
+	admin, _ := newTestClient(t)
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "bob", "on", "nopass", "+@all", "%R~read:*", "%W~write:*", "~both:*")
+
+	for _, test := range []struct {
+		command string
+		key     string
+		allowed bool
+	}{
+		{"GET", "read:1", true},
+		{"SET", "read:1", false},
+		{"SET", "write:1", true},
+		{"GET", "write:1", false},
+		{"GET", "both:1", true},
+		{"SET", "both:1", true},
+		{"GET", "other", false},
+	} {
+		args := []interface{}{test.key}
+		if test.command == "SET" {
+			args = append(args, "value")
+		}
+		reason, _ := aclDenyReason("bob", test.command, args)
+		if allowed := reason == ""; allowed != test.allowed {
+			t.Errorf("Expected %s %s allowed %v, Got denied for %q", test.command, test.key, test.allowed, reason)
+		}
+	}
+}
+
+func TestAclCategories(t *testing.T) {
+	useTestAcl(t)
+	admin, _ := newTestClient(t)
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "carol", "on", "nopass", "allkeys", "+@all", "-@dangerous", "+info")
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "dave", "on", "nopass", "allkeys", "-@all", "+@read", "+client|getname")
+
+	for _, test := range []struct {
+		user    string
+		command string
+		args    []interface{}
+		allowed bool
+	}{
+		{"carol", "GET", []interface{}{"foo"}, true},
+		{"carol", "CONFIG", []interface{}{"GET", "dir"}, false},
+		{"carol", "INFO", nil, true},
+		{"dave", "GET", []interface{}{"foo"}, true},
+		{"dave", "SET", []interface{}{"foo", "bar"}, false},
+		{"dave", "CLIENT", []interface{}{"GETNAME"}, true},
+		{"dave", "CLIENT", []interface{}{"KILL", "ID", "1"}, false},
+	} {
+		reason, _ := aclDenyReason(test.user, test.command, test.args)
+		if allowed := reason == ""; allowed != test.allowed {
+			t.Errorf("Expected %s running %s %v allowed %v, Got denied for %q", test.user, test.command, test.args, test.allowed, reason)
+		}
+	}
+}
+
+func TestAclNoPerm(t *testing.T) {
+	useTestDir(t)
+	useTestAcl(t)
+	client, _ := newTestClient(t)
+	expectReply(t, client, "+OK\r\n", "ACL", "SETUSER", "erin", "on", ">pass", "~allowed:*", "+get", "+auth")
+	expectReply(t, client, "+OK\r\n", "AUTH", "erin", "pass")
+
+	expectReply(t, client, "-NOPERM User erin has no permissions to run the 'set' command\r\n", "SET", "allowed:1", "x")
+	expectReply(t, client, "-NOPERM No permissions to access a key\r\n", "GET", "secret")
+	expectReply(t, client, "$-1\r\n", "GET", "allowed:1")
+
+	acl.mu.Lock()
+	entries := len(acl.log)
+	acl.mu.Unlock()
+	if entries != 2 {
+		t.Errorf("Expected 2 ACL LOG entries, Got %d", entries)
+	}
+}
+
+func TestAclSaveAndLoad(t *testing.T) {
+	dir := useTestDir(t)
+	useTestAcl(t)
+	Config["aclfile"] = filepath.Join(dir, "users.acl")
+	admin, _ := newTestClient(t)
+
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "frank", "on", ">pass", "%R~read:*", "~all:*", "&chan", "+@read", "-keys", "+client|getname")
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "grace", "off", "nopass", "allkeys", "+@all")
+	saved := run(t, admin, "ACL", "LIST")
+	expectReply(t, admin, "+OK\r\n", "ACL", "SAVE")
+
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "frank", "reset")
+	expectReply(t, admin, ":1\r\n", "ACL", "DELUSER", "grace")
+	expectReply(t, admin, "+OK\r\n", "ACL", "LOAD")
+	if loaded := run(t, admin, "ACL", "LIST"); loaded != saved {
+		t.Errorf("Expected ACL LIST %q after loading the saved file, Got %q", saved, loaded)
+	}
+
+	os.WriteFile(Config["aclfile"], []byte("user frank on nopass +nosuchcommand\n"), 0644)
+	if resp := run(t, admin, "ACL", "LOAD"); !strings.Contains(resp, "users.acl:1") {
+		t.Errorf("Expected ACL LOAD to point at the invalid line, Got %q", resp)
+	}
+	if loaded := run(t, admin, "ACL", "LIST"); loaded != saved {
+		t.Errorf("Expected a failed ACL LOAD to keep the users, Got %q", loaded)
+	}
+}
+
+func TestLoadAclRefusesRequirepassWithAclfile(t *testing.T) {
+	dir := useTestDir(t)
+	useTestAcl(t)
+	Config["aclfile"] = filepath.Join(dir, "users.acl")
+	Config["requirepass"] = "secret"
+	os.WriteFile(Config["aclfile"], []byte("user alice on nopass +@all\n"), 0644)
+
+	if err := LoadAcl(); err == nil {
+		t.Fatalf("Expected LoadAcl to refuse requirepass together with aclfile")
+	}
+
+	Config["aclfile"] = ""
+	if err := LoadAcl(); err != nil {
+		t.Fatalf("Failed to load requirepass: %v", err)
+	}
+	if defaultUserNoPass() {
+		t.Errorf("Expected requirepass to protect the default user")
+	}
+}
@@ -0,0 +1,687 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errAofRewriteInProgress = errors.New("Background append only file rewriting already in progress")
+	errAofRewriteActive     = errors.New("Another child process is active (AOF?): can't BGSAVE right now. Use BGSAVE SCHEDULE in order to schedule a BGSAVE whenever possible")
+	// ErrAofFormat is wrapped by the errors ScanAof returns for input that is
+	// not a valid AOF.
+	ErrAofFormat = errors.New("bad file format")
+)
+
+type aofState struct {
+	mu       sync.Mutex
+	manifest *aofManifest
+	// file is the incremental file new commands are appended to.
+	file      *os.File
+	fileSize  int64
+	unsynced  bool
+	lastFsync time.Time
+
+	baseSize int64
+	incrSize int64
+	// rewriteBaseSize is the size of the AOF after the last rewrite, which
+	// automatic rewrites measure growth against.
+	rewriteBaseSize int64
+
+	lastWriteStatus string
+}
+
+var aof = aofState{
+	lastWriteStatus: "ok",
+}
+
+func aofEnabled() bool {
+	return Config["appendonly"] == "yes"
+}
+
+// LoadAppendOnlyFile loads the base file and replays the incremental files
+// listed in the manifest. An AOF written before the manifest existed is
+// moved into appenddirname and used as the base file. It returns an error
+// wrapping os.ErrNotExist when there is no AOF at all.
+func LoadAppendOnlyFile() error {
+	manifest, err := loadAofManifest()
+	if errors.Is(err, os.ErrNotExist) {
+		manifest, err = upgradeLegacyAof()
+	}
+	if err != nil {
+		return err
+	}
+	removeUnusedAofFiles(manifest)
+
+	files := manifest.files()
+	for i, entry := range files {
+		filePath := filepath.Join(aofDirPath(), entry.name)
+		isRdb, err := hasRdbPreamble(filePath)
+		if err != nil {
+			return fmt.Errorf("failed to open aof file %s: %v", filePath, err)
+		}
+		if isRdb {
+			err = ParseRdbFile(filePath)
+		} else {
+			err = loadAofCommands(filePath, i == len(files)-1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.manifest = manifest
+	return nil
+}
+
+// upgradeLegacyAof turns a single appendfilename in dir into the base file
+// of a new multi-part AOF.
+func upgradeLegacyAof() (*aofManifest, error) {
+	legacyPath := filepath.Join(Config["dir"], Config["appendfilename"])
+	if _, err := os.Stat(legacyPath); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create aof directory %s: %v", aofDirPath(), err)
+	}
+
+	manifest := &aofManifest{
+		base: &aofManifestEntry{name: Config["appendfilename"], seq: 1, fileType: aofBaseFile},
+	}
+	if err := os.Rename(legacyPath, filepath.Join(aofDirPath(), manifest.base.name)); err != nil {
+		return nil, fmt.Errorf("failed to move %s into %s: %v", legacyPath, aofDirPath(), err)
+	}
+	if err := persistAofManifest(manifest); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Upgraded %s to a multi part AOF in %s\n", legacyPath, aofDirPath())
+	return manifest, nil
+}
+
+func hasRdbPreamble(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	header := make([]byte, 5)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return string(header[:n]) == "REDIS", nil
+}
+
+// loadAofCommands replays the commands of one AOF file. A command cut short
+// at the end of the last file is dropped when aof-load-truncated is yes.
+func loadAofCommands(filePath string, isLast bool) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	loader := &Client{user: "default", authenticated: true}
+	commands := 0
+	offset, err := ScanAof(file, func(command []interface{}) error {
+		name, _ := command[0].(string)
+		resp, err := execute(loader, name, command[1:])
+		if err == nil && len(resp) > 0 && resp[0] == '-' {
+			err = errors.New(resp[1 : len(resp)-2])
+		}
+		if err != nil {
+			return fmt.Errorf("failed to replay %s: %v", name, err)
+		}
+		commands++
+		return nil
+	})
+	if errors.Is(err, io.ErrUnexpectedEOF) && isLast {
+		err = truncateAppendOnlyFile(filePath, offset)
+	} else if errors.Is(err, ErrAofFormat) {
+		err = fmt.Errorf("Bad file format reading the append only file %s at offset %d: %v", filePath, offset, err)
+	} else if err != nil {
+		err = fmt.Errorf("failed to load the append only file %s at offset %d: %v", filePath, offset, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Loaded %d commands from append only file %s\n", commands, filePath)
+	return nil
+}
+
+// ScanAof parses the commands of an AOF, calling visit with each of them.
+// It returns the offset where the last complete command ends or, on error,
+// where the command that failed starts. A command cut short by the end of
+// the input is reported with an error wrapping io.ErrUnexpectedEOF.
+func ScanAof(reader io.Reader, visit func(command []interface{}) error) (int64, error) {
+	counter := &countingReader{reader: reader}
+	bufferedReader := bufio.NewReader(counter)
+	for {
+		offset := counter.count - int64(bufferedReader.Buffered())
+		prefix, err := bufferedReader.Peek(1)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		switch prefix[0] {
+		case '#':
+			// Annotations such as timestamps take a line of their own.
+			if _, err := bufferedReader.ReadString('\n'); err != nil {
+				return offset, fmt.Errorf("unexpected end of file in annotation: %w", io.ErrUnexpectedEOF)
+			}
+			continue
+		case '*':
+		default:
+			return offset, fmt.Errorf("%w, expected '*' got %q", ErrAofFormat, prefix[0])
+		}
+
+		command, err := ParseArray(bufferedReader)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, fmt.Errorf("unexpected end of file: %w", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return offset, fmt.Errorf("%w: %v", ErrAofFormat, err)
+		}
+		if len(command) == 0 {
+			return offset, fmt.Errorf("%w, command without arguments", ErrAofFormat)
+		}
+		for _, arg := range command {
+			if _, ok := arg.(string); !ok {
+				return offset, fmt.Errorf("%w, command argument is not a bulk string", ErrAofFormat)
+			}
+		}
+		if err := visit(command); err != nil {
+			return offset, err
+		}
+	}
+}
+
+func truncateAppendOnlyFile(filePath string, offset int64) error {
+	if Config["aof-load-truncated"] != "yes" {
+		return fmt.Errorf("unexpected end of file reading the append only file %s at offset %d, set aof-load-truncated to yes or fix the file with redis-check-aof", filePath, offset)
+	}
+	fmt.Printf("!!! Warning: short read while loading the AOF file %s !!!\n", filePath)
+	if err := os.Truncate(filePath, offset); err != nil {
+		return fmt.Errorf("failed to truncate the append only file %s: %v", filePath, err)
+	}
+	fmt.Printf("AOF %s truncated to offset %d\n", filePath, offset)
+	return nil
+}
+
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// OpenAppendOnlyFile opens the last incremental file for appending when
+// appendonly is enabled. Without a manifest the current dataset, loaded from
+// the rdb file, is first written out as the base file.
+func OpenAppendOnlyFile() error {
+	if !aofEnabled() {
+		return nil
+	}
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create aof directory %s: %v", aofDirPath(), err)
+	}
+
+	aof.mu.Lock()
+	manifest := aof.manifest
+	aof.mu.Unlock()
+	if manifest == nil {
+		manifest = &aofManifest{}
+		base := manifest.nextBase()
+		tempPath := filepath.Join(aofDirPath(), fmt.Sprintf("temp-rewriteaof-%d.aof", os.Getpid()))
+		if err := writeAofBase(tempPath, kvStore.freeze()); err != nil {
+			kvStore.thaw()
+			return err
+		}
+		kvStore.thaw()
+		if err := os.Rename(tempPath, filepath.Join(aofDirPath(), base.name)); err != nil {
+			os.Remove(tempPath)
+			return fmt.Errorf("failed to rename aof base file %s: %v", tempPath, err)
+		}
+		manifest.base = &base
+	}
+
+	var incr aofManifestEntry
+	if len(manifest.incrs) > 0 {
+		incr = manifest.incrs[len(manifest.incrs)-1]
+	} else {
+		incr = manifest.nextIncr()
+		manifest.incrs = append(manifest.incrs, incr)
+	}
+	file, err := os.OpenFile(filepath.Join(aofDirPath(), incr.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the append only file %s: %v", incr.name, err)
+	}
+	if err := persistAofManifest(manifest); err != nil {
+		file.Close()
+		return err
+	}
+
+	baseSize, incrSize := aofFileSizes(manifest)
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat the append only file %s: %v", incr.name, err)
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	aof.manifest = manifest
+	aof.file = file
+	aof.fileSize = info.Size()
+	aof.lastFsync = time.Now()
+	aof.baseSize = baseSize
+	aof.incrSize = incrSize
+	aof.rewriteBaseSize = baseSize + incrSize
+	return nil
+}
+
+func aofFileSizes(manifest *aofManifest) (int64, int64) {
+	var baseSize, incrSize int64
+	for _, entry := range manifest.files() {
+		info, err := os.Stat(filepath.Join(aofDirPath(), entry.name))
+		if err != nil {
+			continue
+		}
+		if entry.fileType == aofBaseFile {
+			baseSize = info.Size()
+		} else {
+			incrSize += info.Size()
+		}
+	}
+	return baseSize, incrSize
+}
+
+// writeAofBase writes a snapshot to filePath, as an rdb file when
+// aof-use-rdb-preamble is yes and as SET commands otherwise.
+func writeAofBase(filePath string, snapshot keyspaceSnapshot) error {
+	var file *os.File
+	var err error
+	if Config["aof-use-rdb-preamble"] == "yes" {
+		file, err = createRdbFile(filePath)
+		if err == nil {
+			err = writeRdbSnapshot(file, snapshot)
+		}
+	} else {
+		file, err = os.Create(filePath)
+		if err == nil {
+			writer := bufio.NewWriter(file)
+			for _, item := range snapshot.Items() {
+				switch item.Value.(type) {
+				case string, int:
+					_, err = writer.WriteString(aofSetCommand(item))
+				default:
+					err = fmt.Errorf("key %s holds a %T, which can only be saved with aof-use-rdb-preamble", item.Key, item.Value)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = writer.Flush()
+			}
+		}
+	}
+	if file == nil {
+		return fmt.Errorf("failed to create aof base file %s: %v", filePath, err)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filePath)
+		return fmt.Errorf("failed to write aof base file %s: %v", filePath, err)
+	}
+	return nil
+}
+
+// aofSetCommand renders a key as the SET command that recreates it.
+func aofSetCommand(item KeyValueWithExpiry) string {
+	command := []interface{}{"SET", item.Key, fmt.Sprint(item.Value)}
+	if item.ExpiryTime != 0 {
+		expireAt := item.ExpiryTime
+		if !item.TimeInMilliseconds {
+			expireAt *= 1000
+		}
+		command = append(command, "PXAT", strconv.FormatInt(expireAt, 10))
+	}
+	encoded, _ := encodeArray(command)
+	return encoded
+}
+
+// rewriteAppendOnlyFileBackground starts a rewrite of the AOF. Commands are
+// switched to a new incremental file and a snapshot of the dataset at that
+// point is written in the background as the new base file. The manifest on
+// disk lists the old files plus the new incremental file until the base is
+// complete, so a crash at any point leaves a loadable AOF.
+func rewriteAppendOnlyFileBackground() error {
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+	if persistence.aofRewriteInProgress {
+		return errAofRewriteInProgress
+	}
+	if persistence.saveInProgress || persistence.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		return fmt.Errorf("failed to create aof directory %s: %v", aofDirPath(), err)
+	}
+
+	aof.mu.Lock()
+	manifest, err := aof.switchIncrFile()
+	aof.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	snapshot := kvStore.freeze()
+	persistence.aofRewriteInProgress = true
+	persistence.aofRewriteScheduled = false
+	persistence.aofRewriteStart = time.Now()
+	fmt.Println("Background append only file rewriting started")
+
+	go func() {
+		base := manifest.nextBase()
+		tempPath := filepath.Join(aofDirPath(), fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := writeAofBase(tempPath, snapshot)
+		kvStore.thaw()
+		if err == nil {
+			err = aof.installBase(tempPath, base, manifest)
+		}
+
+		persistence.mu.Lock()
+		defer persistence.mu.Unlock()
+		persistence.aofRewriteInProgress = false
+		persistence.lastAofRewriteDuration = time.Since(persistence.aofRewriteStart)
+		if err != nil {
+			persistence.lastAofRewriteStatus = "err"
+			fmt.Println("Background append only file rewriting failed: ", err)
+			return
+		}
+		persistence.lastAofRewriteStatus = "ok"
+		persistence.aofRewrites++
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+// switchIncrFile makes new commands go to a fresh incremental file and
+// returns the manifest the rewrite starts from. The caller must hold aof.mu.
+func (a *aofState) switchIncrFile() (*aofManifest, error) {
+	manifest := a.manifest
+	if manifest == nil {
+		loaded, err := loadAofManifest()
+		if errors.Is(err, os.ErrNotExist) {
+			loaded, err = &aofManifest{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		manifest = loaded
+	}
+	if a.file == nil {
+		return manifest, nil
+	}
+
+	incr := manifest.nextIncr()
+	file, err := os.OpenFile(filepath.Join(aofDirPath(), incr.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the append only file %s: %v", incr.name, err)
+	}
+	next := &aofManifest{base: manifest.base, incrs: append(append([]aofManifestEntry{}, manifest.incrs...), incr)}
+	if err := persistAofManifest(next); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	if err := a.file.Sync(); err != nil {
+		fmt.Println("Failed to fsync the AOF file: ", err)
+	}
+	a.file.Close()
+	a.manifest = next
+	a.file = file
+	a.fileSize = 0
+	a.unsynced = false
+	return next, nil
+}
+
+// installBase replaces the base file and the incremental files that were
+// written before the rewrite started with the newly written base.
+func (a *aofState) installBase(tempPath string, base aofManifestEntry, started *aofManifest) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := os.Rename(tempPath, filepath.Join(aofDirPath(), base.name)); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename aof base file %s: %v", tempPath, err)
+	}
+	next := &aofManifest{base: &base}
+	if a.file != nil {
+		next.incrs = started.incrs[len(started.incrs)-1:]
+	}
+	if err := persistAofManifest(next); err != nil {
+		return err
+	}
+	a.manifest = next
+	for _, entry := range started.files() {
+		if entry.name != base.name && (len(next.incrs) == 0 || entry.name != next.incrs[0].name) {
+			os.Remove(filepath.Join(aofDirPath(), entry.name))
+		}
+	}
+	removeUnusedAofFiles(next)
+
+	if a.file != nil {
+		a.baseSize, _ = aofFileSizes(&aofManifest{base: &base})
+		a.incrSize = a.fileSize
+		a.rewriteBaseSize = a.baseSize + a.incrSize
+	}
+	return nil
+}
+
+// feedAppendOnlyFile logs a write command that has just been applied. With
+// appendfsync always the command is on disk before the client is answered.
+func feedAppendOnlyFile(command string, args []interface{}) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.file == nil {
+		return
+	}
+
+	entry, err := encodeArray(append([]interface{}{command}, aofArgs(command, args)...))
+	if err != nil {
+		fmt.Println("Failed to encode command for the AOF: ", err)
+		return
+	}
+
+	n, err := aof.file.WriteString(entry)
+	if err != nil {
+		aof.lastWriteStatus = "err"
+		fmt.Println("Error writing to the AOF file: ", err)
+		// Drop the partial command so the file stays loadable.
+		if n > 0 && aof.file.Truncate(aof.fileSize) != nil {
+			aof.fileSize += int64(n)
+			aof.incrSize += int64(n)
+		}
+		if Config["appendfsync"] == "always" {
+			fmt.Println("Can't recover from AOF write error when the AOF fsync policy is 'always'. Exiting...")
+			os.Exit(1)
+		}
+		return
+	}
+	aof.fileSize += int64(n)
+	aof.incrSize += int64(n)
+	aof.lastWriteStatus = "ok"
+	aof.unsynced = true
+
+	if Config["appendfsync"] == "always" {
+		if err := aof.file.Sync(); err != nil {
+			fmt.Println("Can't persist AOF for fsync error when the AOF fsync policy is 'always': ", err, ". Exiting...")
+			os.Exit(1)
+		}
+		aof.unsynced = false
+		aof.lastFsync = time.Now()
+	}
+}
+
+// aofArgs turns relative expiry times into absolute ones, so replaying the
+// log later does not extend the TTL of a key.
+func aofArgs(command string, args []interface{}) []interface{} {
+	if command != "SET" {
+		return args
+	}
+	rewritten := make([]interface{}, len(args))
+	copy(rewritten, args)
+	for i := 2; i < len(rewritten)-1; i++ {
+		if option, _ := rewritten[i].(string); option == "PX" {
+			ms, _ := rewritten[i+1].(string)
+			px, _ := strconv.ParseFloat(ms, 64)
+			rewritten[i] = "PXAT"
+			rewritten[i+1] = strconv.FormatInt(time.Now().Add(time.Duration(px)*time.Millisecond).UnixMilli(), 10)
+			i++
+		}
+	}
+	return rewritten
+}
+
+// fsyncAppendOnlyFile flushes the AOF to disk once a second when appendfsync
+// is everysec.
+func fsyncAppendOnlyFile(now time.Time) {
+	if Config["appendfsync"] != "everysec" {
+		return
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+	if aof.file == nil || !aof.unsynced || now.Sub(aof.lastFsync) < time.Second {
+		return
+	}
+	aof.lastFsync = now
+	if err := aof.file.Sync(); err != nil {
+		fmt.Println("Failed to fsync the AOF file: ", err)
+		return
+	}
+	aof.unsynced = false
+}
+
+// checkAofRewrite starts a scheduled rewrite, or an automatic one once the
+// AOF has grown by auto-aof-rewrite-percentage since the last rewrite.
+func checkAofRewrite() {
+	persistence.mu.Lock()
+	busy := persistence.saveInProgress || persistence.bgsaveInProgress || persistence.aofRewriteInProgress
+	start := persistence.aofRewriteScheduled
+	persistence.mu.Unlock()
+	if busy {
+		return
+	}
+
+	if !start {
+		percentage, _ := strconv.Atoi(Config["auto-aof-rewrite-percentage"])
+		minSize, _ := parseMemory(Config["auto-aof-rewrite-min-size"])
+
+		aof.mu.Lock()
+		currentSize := aof.baseSize + aof.incrSize
+		baseSize := aof.rewriteBaseSize
+		enabled := aof.file != nil
+		aof.mu.Unlock()
+
+		if baseSize == 0 {
+			baseSize = 1
+		}
+		growth := (currentSize*100)/baseSize - 100
+		if enabled && percentage > 0 && currentSize > minSize && growth >= int64(percentage) {
+			fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", growth)
+			start = true
+		}
+	}
+
+	if start {
+		if err := rewriteAppendOnlyFileBackground(); err != nil {
+			fmt.Println("Failed to start the AOF rewrite: ", err)
+		}
+	}
+}
+
+// parseMemory parses sizes such as 64mb or 1gb the way redis.conf does.
+func parseMemory(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"gb", 1 << 30}, {"mb", 1 << 20}, {"kb", 1 << 10},
+		{"g", 1000 * 1000 * 1000}, {"m", 1000 * 1000}, {"k", 1000}, {"b", 1},
+	}
+	size = strings.ToLower(size)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSuffix(size, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory size %s", size)
+	}
+	return value * multiplier, nil
+}
+
+func handleBgrewriteaof() (string, error) {
+	err := rewriteAppendOnlyFileBackground()
+	if err == errBgsaveInProgress {
+		persistence.mu.Lock()
+		persistence.aofRewriteScheduled = true
+		persistence.mu.Unlock()
+		return encodeSimpleString("Background append only file rewriting scheduled"), nil
+	}
+	if err != nil {
+		return encodeSimpleError(fmt.Sprintf("ERR %v", err)), nil
+	}
+	return encodeSimpleString("Background append only file rewriting started"), nil
+}
+
+func aofInfo() string {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	enabled := 0
+	if aof.file != nil {
+		enabled = 1
+	}
+	info := "aof_enabled:" + fmt.Sprint(enabled) + "\n"
+	info += "aof_last_write_status:" + aof.lastWriteStatus
+	if aof.file != nil {
+		info += "\naof_current_size:" + fmt.Sprint(aof.baseSize+aof.incrSize)
+		info += "\naof_base_size:" + fmt.Sprint(aof.rewriteBaseSize)
+	}
+	return info
+}
@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	aofBaseFile = "b"
+	aofIncrFile = "i"
+)
+
+// aofManifestEntry is one line of the manifest, naming a file of the
+// multi-part AOF.
+type aofManifestEntry struct {
+	name     string
+	seq      int
+	fileType string
+}
+
+// aofManifest lists the files that make up the AOF: an optional base file
+// holding a snapshot of the dataset, followed by the incremental files with
+// the commands written since, in the order they have to be loaded.
+type aofManifest struct {
+	base  *aofManifestEntry
+	incrs []aofManifestEntry
+}
+
+func aofDirPath() string {
+	return filepath.Join(Config["dir"], Config["appenddirname"])
+}
+
+func aofManifestPath() string {
+	return filepath.Join(aofDirPath(), Config["appendfilename"]+".manifest")
+}
+
+func (m *aofManifest) files() []aofManifestEntry {
+	var files []aofManifestEntry
+	if m.base != nil {
+		files = append(files, *m.base)
+	}
+	return append(files, m.incrs...)
+}
+
+func (m *aofManifest) nextBase() aofManifestEntry {
+	seq := 1
+	if m.base != nil {
+		seq = m.base.seq + 1
+	}
+	extension := "aof"
+	if Config["aof-use-rdb-preamble"] == "yes" {
+		extension = "rdb"
+	}
+	return aofManifestEntry{
+		name:     fmt.Sprintf("%s.%d.base.%s", Config["appendfilename"], seq, extension),
+		seq:      seq,
+		fileType: aofBaseFile,
+	}
+}
+
+func (m *aofManifest) nextIncr() aofManifestEntry {
+	seq := 1
+	if len(m.incrs) > 0 {
+		seq = m.incrs[len(m.incrs)-1].seq + 1
+	}
+	return aofManifestEntry{
+		name:     fmt.Sprintf("%s.%d.incr.aof", Config["appendfilename"], seq),
+		seq:      seq,
+		fileType: aofIncrFile,
+	}
+}
+
+func (m *aofManifest) String() string {
+	var builder strings.Builder
+	for _, entry := range m.files() {
+		fmt.Fprintf(&builder, "file %s seq %d type %s\n", entry.name, entry.seq, entry.fileType)
+	}
+	return builder.String()
+}
+
+// loadAofManifest reads the manifest. It returns an error wrapping
+// os.ErrNotExist when there is none.
+func loadAofManifest() (*aofManifest, error) {
+	return readAofManifest(aofManifestPath())
+}
+
+func readAofManifest(manifestPath string) (*aofManifest, error) {
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := &aofManifest{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		entry, err := parseAofManifestLine(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aof manifest %s at line %d: %v", manifestPath, line, err)
+		}
+		switch entry.fileType {
+		case aofBaseFile:
+			if manifest.base != nil {
+				return nil, fmt.Errorf("invalid aof manifest %s at line %d: more than one base file", manifestPath, line)
+			}
+			manifest.base = &entry
+		case aofIncrFile:
+			manifest.incrs = append(manifest.incrs, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aof manifest %s: %v", manifestPath, err)
+	}
+	return manifest, nil
+}
+
+// AofManifestFiles lists the paths of the files making up the multi-part AOF
+// described by the manifest at manifestPath, in the order they are loaded.
+func AofManifestFiles(manifestPath string) ([]string, error) {
+	manifest, err := readAofManifest(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range manifest.files() {
+		files = append(files, filepath.Join(filepath.Dir(manifestPath), entry.name))
+	}
+	return files, nil
+}
+
+func parseAofManifestLine(line string) (aofManifestEntry, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return aofManifestEntry{}, errors.New("expected key value pairs")
+	}
+	var entry aofManifestEntry
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			entry.name = fields[i+1]
+		case "seq":
+			seq, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return entry, fmt.Errorf("invalid seq %s", fields[i+1])
+			}
+			entry.seq = seq
+		case "type":
+			entry.fileType = fields[i+1]
+		}
+	}
+	if entry.name == "" || entry.fileType == "" {
+		return entry, errors.New("missing file name or type")
+	}
+	if strings.ContainsRune(entry.name, filepath.Separator) {
+		return entry, fmt.Errorf("file name %s is not inside the aof directory", entry.name)
+	}
+	return entry, nil
+}
+
+func aofTempManifestPath() string {
+	return filepath.Join(aofDirPath(), "temp-"+Config["appendfilename"]+".manifest")
+}
+
+// persistAofManifest atomically replaces the manifest on disk.
+func persistAofManifest(manifest *aofManifest) error {
+	manifestPath := aofManifestPath()
+	tempPath := aofTempManifestPath()
+	if err := os.WriteFile(tempPath, []byte(manifest.String()), 0644); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write aof manifest %s: %v", tempPath, err)
+	}
+	file, err := os.Open(tempPath)
+	if err == nil {
+		err = file.Sync()
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to fsync aof manifest %s: %v", tempPath, err)
+	}
+	if err := os.Rename(tempPath, manifestPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename aof manifest %s to %s: %v", tempPath, manifestPath, err)
+	}
+	return syncDir(aofDirPath())
+}
+
+// removeUnusedAofFiles deletes AOF files the manifest no longer refers to,
+// left behind by a rewrite or by a crash in the middle of one.
+func removeUnusedAofFiles(manifest *aofManifest) {
+	used := make(map[string]bool)
+	for _, entry := range manifest.files() {
+		used[entry.name] = true
+	}
+	entries, err := os.ReadDir(aofDirPath())
+	if err != nil {
+		return
+	}
+	prefix := Config["appendfilename"] + "."
+	for _, entry := range entries {
+		name := entry.Name()
+		ours := strings.HasPrefix(name, "temp-rewriteaof-") ||
+			strings.HasPrefix(name, prefix) && (strings.Contains(name, ".base.") || strings.HasSuffix(name, ".incr.aof"))
+		if ours && !used[name] {
+			os.Remove(filepath.Join(aofDirPath(), name))
+		}
+	}
+	os.Remove(aofTempManifestPath())
+}
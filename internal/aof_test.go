@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const aofSetFoo = "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbar\r\n"
+
+// writeTestAof writes a multi-part AOF with an rdb base holding base and one
+// incremental file per entry of incrs.
+func writeTestAof(t *testing.T, base map[string]string, incrs ...string) *aofManifest {
+	t.Helper()
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range base {
+		kvStore.Set(key, value, 0, false)
+	}
+	manifest := &aofManifest{}
+	entry := manifest.nextBase()
+	err := writeAofBase(filepath.Join(aofDirPath(), entry.name), kvStore.freeze())
+	kvStore.thaw()
+	kvStore.flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.base = &entry
+
+	for _, contents := range incrs {
+		incr := manifest.nextIncr()
+		if err := os.WriteFile(filepath.Join(aofDirPath(), incr.name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		manifest.incrs = append(manifest.incrs, incr)
+	}
+	if err := persistAofManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func TestLoadAppendOnlyFile(t *testing.T) {
+	useTestDir(t)
+	writeTestAof(t, map[string]string{"base": "1", "foo": "old"},
+		aofSetFoo,
+		"#TS:1700000000\r\n*3\r\n$3\r\nSET\r\n$3\r\nnew\r\n$1\r\n2\r\n")
+
+	if err := LoadAppendOnlyFile(); err != nil {
+		t.Fatalf("Failed to load the AOF: %v", err)
+	}
+	expectValue(t, "base", "1")
+	expectValue(t, "foo", "bar")
+	expectValue(t, "new", "2")
+}
+
+func TestLoadTruncatedAppendOnlyFile(t *testing.T) {
+	useTestDir(t)
+	manifest := writeTestAof(t, nil, aofSetFoo, aofSetFoo+"*3\r\n$3\r\nSET\r\n$3\r\nbaz")
+	lastPath := filepath.Join(aofDirPath(), manifest.incrs[1].name)
+
+	Config["aof-load-truncated"] = "no"
+	err := LoadAppendOnlyFile()
+	if err == nil || !strings.Contains(err.Error(), "aof-load-truncated") {
+		t.Fatalf("Expected the truncated AOF to be refused, Got %v", err)
+	}
+
+	kvStore.flush()
+	Config["aof-load-truncated"] = "yes"
+	if err := LoadAppendOnlyFile(); err != nil {
+		t.Fatalf("Failed to load the truncated AOF: %v", err)
+	}
+	expectValue(t, "foo", "bar")
+	if contents, _ := os.ReadFile(lastPath); string(contents) != aofSetFoo {
+		t.Errorf("Expected the partial command to be truncated, Got %q", contents)
+	}
+}
+
+func TestLoadCorruptAppendOnlyFile(t *testing.T) {
+	for name, incr := range map[string]string{
+		"negative bulk length": "*2\r\n$3\r\nGET\r\n$-5\r\n",
+		"garbage array header": "*x\r\n" + aofSetFoo,
+		"not a command":        "hello\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			useTestDir(t)
+			// Only a truncated tail may be dropped, so the last file being
+			// corrupt is not enough to load it.
+			writeTestAof(t, nil, aofSetFoo, aofSetFoo+incr)
+			err := LoadAppendOnlyFile()
+			if err == nil || !strings.Contains(err.Error(), "Bad file format reading the append only file") {
+				t.Errorf("Expected a bad file format error, Got %v", err)
+			}
+		})
+	}
+}
+
+func TestAofManifestRoundTrip(t *testing.T) {
+	useTestDir(t)
+	if err := os.MkdirAll(aofDirPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &aofManifest{}
+	base := manifest.nextBase()
+	manifest.base = &base
+	manifest.incrs = append(manifest.incrs, manifest.nextIncr())
+	manifest.incrs = append(manifest.incrs, manifest.nextIncr())
+	if err := persistAofManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, _ := os.ReadFile(aofManifestPath())
+	expected := "file appendonly.aof.1.base.rdb seq 1 type b\n" +
+		"file appendonly.aof.1.incr.aof seq 1 type i\n" +
+		"file appendonly.aof.2.incr.aof seq 2 type i\n"
+	if string(contents) != expected {
+		t.Errorf("Expected manifest %q, Got %q", expected, contents)
+	}
+	loaded, err := loadAofManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded, manifest) {
+		t.Errorf("Expected manifest %v, Got %v", manifest, loaded)
+	}
+
+	for _, invalid := range []string{
+		"file a.aof seq 1 type b\nfile b.aof seq 2 type b\n",
+		"file ../a.aof seq 1 type i\n",
+		"file a.aof seq x type i\n",
+		"file a.aof seq 1\n",
+	} {
+		os.WriteFile(aofManifestPath(), []byte(invalid), 0644)
+		if _, err := loadAofManifest(); err == nil {
+			t.Errorf("Expected manifest %q to be rejected", invalid)
+		}
+	}
+}
+
+// restartAof drops the keyspace and the open AOF, then loads and opens the
+// AOF again the way a restarted server does.
+func restartAof(t *testing.T) {
+	t.Helper()
+	aof.mu.Lock()
+	if aof.file != nil {
+		aof.file.Close()
+	}
+	aof.file = nil
+	aof.manifest = nil
+	aof.mu.Unlock()
+	kvStore.flush()
+	if err := LoadAppendOnlyFile(); err != nil {
+		t.Fatalf("Failed to load the AOF: %v", err)
+	}
+	if err := OpenAppendOnlyFile(); err != nil {
+		t.Fatalf("Failed to open the AOF: %v", err)
+	}
+}
+
+// expectAofFiles fails the test unless the manifest lists files and the aof
+// directory holds nothing else.
+func expectAofFiles(t *testing.T, files ...string) {
+	t.Helper()
+	manifest, err := loadAofManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, entry := range manifest.files() {
+		listed = append(listed, entry.name)
+	}
+	if !reflect.DeepEqual(listed, files) {
+		t.Errorf("Expected the manifest to list %v, Got %v", files, listed)
+	}
+	entries, err := os.ReadDir(aofDirPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{filepath.Base(aofManifestPath()): true}
+	for _, name := range files {
+		expected[name] = true
+	}
+	for _, entry := range entries {
+		if !expected[entry.Name()] {
+			t.Errorf("Expected %s to be removed from the aof directory", entry.Name())
+		}
+	}
+}
+
+func TestRewriteAppendOnlyFile(t *testing.T) {
+	useTestDir(t)
+	Config["appendonly"] = "yes"
+	client, _ := newTestClient(t)
+	writeTestAof(t, map[string]string{"base": "1"}, aofSetFoo)
+	restartAof(t)
+	expectReply(t, client, "+OK\r\n", "SET", "before", "1")
+
+	expectReply(t, client, "+Background append only file rewriting started\r\n", "BGREWRITEAOF")
+	// Commands go to a new incremental file as soon as the rewrite starts.
+	expectReply(t, client, "+OK\r\n", "SET", "during", "2")
+	waitFor(t, "the AOF rewrite", func() bool {
+		persistence.mu.Lock()
+		defer persistence.mu.Unlock()
+		return !persistence.aofRewriteInProgress
+	})
+	if info := persistenceInfo(); !strings.Contains(info, "aof_last_bgrewrite_status:ok") {
+		t.Fatalf("Expected the rewrite to succeed, Got %q", info)
+	}
+	expectReply(t, client, "+OK\r\n", "SET", "after", "3")
+
+	// The old base and incremental files are history once the new base is in.
+	expectAofFiles(t, "appendonly.aof.2.base.rdb", "appendonly.aof.2.incr.aof")
+	contents, _ := os.ReadFile(filepath.Join(aofDirPath(), "appendonly.aof.2.incr.aof"))
+	if strings.Contains(string(contents), "before") || !strings.Contains(string(contents), "during") {
+		t.Errorf("Expected the new incremental file to start with the rewrite, Got %q", contents)
+	}
+
+	restartAof(t)
+	expectValue(t, "base", "1")
+	expectValue(t, "foo", "bar")
+	expectValue(t, "before", "1")
+	expectValue(t, "during", "2")
+	expectValue(t, "after", "3")
+}
+
+func TestAofRewriteInterrupted(t *testing.T) {
+	useTestDir(t)
+	Config["appendonly"] = "yes"
+	client, _ := newTestClient(t)
+	writeTestAof(t, map[string]string{"base": "1"}, aofSetFoo)
+	restartAof(t)
+
+	// The manifest lists the new incremental file before the new base is
+	// written, so a crash in between loses nothing.
+	aof.mu.Lock()
+	_, err := aof.switchIncrFile()
+	aof.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReply(t, client, "+OK\r\n", "SET", "during", "2")
+	expectAofFiles(t, "appendonly.aof.1.base.rdb", "appendonly.aof.1.incr.aof", "appendonly.aof.2.incr.aof")
+
+	// What the crash leaves behind: a half written base and manifest.
+	for _, name := range []string{"temp-rewriteaof-bg-1.aof", "appendonly.aof.2.base.rdb", "temp-appendonly.aof.manifest"} {
+		if err := os.WriteFile(filepath.Join(aofDirPath(), name), []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restartAof(t)
+	expectValue(t, "base", "1")
+	expectValue(t, "foo", "bar")
+	expectValue(t, "during", "2")
+	expectAofFiles(t, "appendonly.aof.1.base.rdb", "appendonly.aof.1.incr.aof", "appendonly.aof.2.incr.aof")
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+)
+
+const noAuthError = "NOAUTH Authentication required."
+
+const ProtectedModeError = "-DENIED Redis is running in protected mode because protected mode is enabled and no password is set for the default user. " +
+	"In this mode connections are only accepted from the loopback interface. " +
+	"If you want to connect from external computers to Redis you may adopt one of the following solutions: " +
+	"1) Just disable protected mode sending the command 'CONFIG SET protected-mode no' from the loopback interface by connecting to Redis from the same host the server is running, however MAKE SURE Redis is not publicly accessible from internet if you do so. Use CONFIG REWRITE to make this change permanent. " +
+	"2) Alternatively you can just disable the protected mode by editing the Redis configuration file, and setting the protected mode option to 'no', and then restarting the server. " +
+	"3) If you started the server manually just for testing, restart it with the '--protected-mode no' option. " +
+	"4) Set up an authentication password for the default user. " +
+	"NOTE: You only need to do one of the above things in order for the server to start accepting connections from the outside.\r\n"
+
+var noAuthCommands = map[string]bool{
+	"AUTH":  true,
+	"HELLO": true,
+}
+
+func requiresAuth(client *Client) bool {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	return !client.authenticated
+}
+
+func handleAuth(client *Client, args []interface{}) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", fmt.Errorf("failed to execute AUTH command, it requires a password and optionally a username")
+	}
+
+	username := "default"
+	password, _ := args[0].(string)
+	if len(args) == 2 {
+		username, _ = args[0].(string)
+		password, _ = args[1].(string)
+	}
+
+	if len(args) == 1 && defaultUserNoPass() {
+		return encodeSimpleError("ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?"), nil
+	}
+	if !authenticate(client, username, password) {
+		return encodeSimpleError("WRONGPASS invalid username-password pair or user is disabled."), nil
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+// DeniedByProtectedMode reports whether a new connection has to be refused
+// because protected mode is on, the default user has no password and the peer
+// is not on the loopback interface.
+func DeniedByProtectedMode(conn net.Conn) bool {
+	if Config["protected-mode"] != "yes" || !defaultUserNoPass() {
+		return false
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return !addr.IP.IsLoopback()
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// peerConn is a testConn connected from remote.
+type peerConn struct {
+	testConn
+	remote net.Addr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestDeniedByProtectedMode(t *testing.T) {
+	useTestDir(t)
+	useTestAcl(t)
+	Config["protected-mode"] = "yes"
+	tests := []struct {
+		remote net.Addr
+		denied bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 50000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 50000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 50000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 50000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::1"), Port: 50000}, false},
+		{&net.UnixAddr{Name: "/tmp/redis.sock", Net: "unix"}, false},
+	}
+	for _, test := range tests {
+		if denied := DeniedByProtectedMode(&peerConn{remote: test.remote}); denied != test.denied {
+			t.Errorf("Expected a connection from %v to be denied %v, Got %v", test.remote, test.denied, denied)
+		}
+	}
+
+	remote := &peerConn{remote: &net.TCPAddr{IP: net.ParseIP("10.0.0.7"), Port: 50000}}
+	Config["protected-mode"] = "no"
+	if DeniedByProtectedMode(remote) {
+		t.Errorf("Expected connections to be accepted with protected-mode no")
+	}
+
+	// A password for the default user lifts the protection.
+	Config["protected-mode"] = "yes"
+	client, _ := newTestClient(t)
+	expectReply(t, client, "+OK\r\n", "ACL", "SETUSER", "default", ">secret")
+	if DeniedByProtectedMode(remote) {
+		t.Errorf("Expected connections to be accepted once the default user has a password")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	useTestDir(t)
+	useTestAcl(t)
+	client, _ := newTestClient(t)
+	expectReply(t, client, "-ERR AUTH <password> called without any password configured for the default user. Are you sure your configuration is correct?\r\n", "AUTH", "secret")
+
+	Config["requirepass"] = "secret"
+	if err := LoadAcl(); err != nil {
+		t.Fatalf("Failed to load requirepass: %v", err)
+	}
+	client, _ = newTestClient(t)
+	expectReply(t, client, "-NOAUTH Authentication required.\r\n", "GET", "key")
+	expectReply(t, client, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "wrong")
+	expectReply(t, client, "-NOAUTH Authentication required.\r\n", "SET", "key", "value")
+	expectReply(t, client, "+OK\r\n", "AUTH", "secret")
+	expectReply(t, client, "+OK\r\n", "SET", "key", "value")
+
+	// AUTH <username> <password> authenticates as any user.
+	client, _ = newTestClient(t)
+	expectReply(t, client, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "nobody", "secret")
+	expectReply(t, client, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", "AUTH", "default", "wrong")
+	expectReply(t, client, "+OK\r\n", "AUTH", "default", "secret")
+	expectReply(t, client, "$5\r\nvalue\r\n", "GET", "key")
+}
+
+func TestHelloAuth(t *testing.T) {
+	useTestDir(t)
+	useTestAcl(t)
+	Config["requirepass"] = "secret"
+	if err := LoadAcl(); err != nil {
+		t.Fatalf("Failed to load requirepass: %v", err)
+	}
+	client, _ := newTestClient(t)
+
+	expectReply(t, client, "-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n", "HELLO", "3")
+	expectReply(t, client, "-ERR Syntax error in HELLO option 'AUTH'\r\n", "HELLO", "3", "AUTH", "default")
+	expectReply(t, client, "-WRONGPASS invalid username-password pair or user is disabled.\r\n", "HELLO", "3", "AUTH", "default", "wrong")
+	expectReply(t, client, "-NOAUTH Authentication required.\r\n", "GET", "key")
+	// A failed HELLO leaves the protocol alone.
+	clients.mu.Lock()
+	protocol := client.protocol
+	clients.mu.Unlock()
+	if protocol != 2 {
+		t.Errorf("Expected the client to stay on RESP2, Got RESP%d", protocol)
+	}
+
+	if resp := run(t, client, "HELLO", "3", "AUTH", "default", "secret", "SETNAME", "authed"); !strings.HasPrefix(resp, "%7\r\n") {
+		t.Errorf("Expected HELLO to reply with a RESP3 map, Got %q", resp)
+	}
+	expectReply(t, client, "$6\r\nauthed\r\n", "CLIENT", "GETNAME")
+}
@@ -0,0 +1,755 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	config "myredis/config"
+)
+
+const redisVersion = "7.2.4"
+
+const (
+	replyOn       = "on"
+	replyOff      = "off"
+	replySkip     = "skip"
+	replySkipNext = "skip-next"
+)
+
+type Client struct {
+	Id   int64
+	Conn net.Conn
+
+	reader          *bufio.Reader
+	name            string
+	db              int
+	user            string
+	createdAt       time.Time
+	lastInteraction time.Time
+	lastCommand     string
+	queryBufferLen  int
+	lastReplyLen    int
+	isReplica       bool
+	replica         *ReplicaConfig
+	isMaster        bool
+	noEvict         bool
+	replyMode       string
+	closeAfterReply bool
+	closed          bool
+	protocol        int
+	tracking        clientTracking
+	authenticated   bool
+}
+
+type clientRegistry struct {
+	mu      sync.Mutex
+	nextId  int64
+	clients map[int64]*Client
+}
+
+var clients = clientRegistry{
+	clients: make(map[int64]*Client),
+}
+
+type clientPauseState struct {
+	mu    sync.Mutex
+	until time.Time
+	all   bool
+	// failover holds back writes until a FAILOVER completes or is aborted,
+	// independently of CLIENT PAUSE.
+	failover bool
+	resume   chan struct{}
+}
+
+var clientPause = clientPauseState{}
+
+func RegisterClient(conn net.Conn) *Client {
+	authenticated := defaultUserNoPass()
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	clients.nextId++
+	now := time.Now()
+	client := &Client{
+		Id:              clients.nextId,
+		Conn:            conn,
+		reader:          bufio.NewReader(conn),
+		user:            "default",
+		createdAt:       now,
+		lastInteraction: now,
+		lastCommand:     "NULL",
+		replyMode:       replyOn,
+		protocol:        2,
+		authenticated:   authenticated,
+	}
+	clients.clients[client.Id] = client
+	return client
+}
+
+// registerMasterClient registers the connection a replica follows its master
+// on. Its commands skip authentication and its replies are discarded. reader
+// is the one the handshake used, as it may already hold buffered commands.
+func registerMasterClient(conn net.Conn, reader *bufio.Reader) *Client {
+	client := RegisterClient(conn)
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	client.reader = reader
+	client.isMaster = true
+	client.authenticated = true
+	return client
+}
+
+func UnregisterClient(client *Client) {
+	disableTracking(client)
+	unsubscribeAll(client)
+	removeReplica(client)
+
+	clients.mu.Lock()
+	delete(clients.clients, client.Id)
+	client.closed = true
+	clients.mu.Unlock()
+
+	client.Conn.Close()
+}
+
+// close disconnects the client from outside of its connection handler.
+func (c *Client) close() {
+	clients.mu.Lock()
+	c.closed = true
+	clients.mu.Unlock()
+	c.Conn.Close()
+}
+
+func (c *Client) Reader() *bufio.Reader {
+	return c.reader
+}
+
+func (c *Client) Closed() bool {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	return c.closed || c.closeAfterReply
+}
+
+func (c *Client) WriteReply(resp string) error {
+	clients.mu.Lock()
+	mode := c.replyMode
+	switch mode {
+	case replySkip:
+		c.replyMode = replySkipNext
+	case replySkipNext:
+		c.replyMode = replyOn
+	}
+	c.lastReplyLen = len(resp)
+	isReplica := c.isReplica
+	clients.mu.Unlock()
+
+	// Replicas only receive the replication stream.
+	if mode != replyOn || isReplica {
+		return nil
+	}
+	_, err := c.Conn.Write([]byte(resp))
+	return err
+}
+
+// writePush sends out of band data such as invalidation messages. It is not
+// subject to CLIENT REPLY.
+func (c *Client) writePush(message string) error {
+	_, err := c.Conn.Write([]byte(message))
+	return err
+}
+
+func (c *Client) beforeCommand(command string, args []interface{}) {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	c.lastInteraction = time.Now()
+	c.lastCommand = strings.ToLower(command)
+	if len(args) > 0 && command == "CLIENT" {
+		subcommand, _ := args[0].(string)
+		c.lastCommand += "|" + strings.ToLower(subcommand)
+	}
+	c.queryBufferLen = c.reader.Buffered()
+}
+
+func (c *Client) isUnixSocket() bool {
+	_, ok := c.Conn.LocalAddr().(*net.UnixAddr)
+	return ok
+}
+
+// remoteAddr reports unix socket peers as "<socket path>:0" like Redis does,
+// since they have no address of their own.
+func (c *Client) remoteAddr() string {
+	if c.isUnixSocket() {
+		return c.localAddr()
+	}
+	return c.Conn.RemoteAddr().String()
+}
+
+func (c *Client) localAddr() string {
+	if c.isUnixSocket() {
+		return c.Conn.LocalAddr().String() + ":0"
+	}
+	return c.Conn.LocalAddr().String()
+}
+
+func (c *Client) clientType() string {
+	switch {
+	case c.isMaster:
+		return "master"
+	case c.isReplica:
+		return "replica"
+	default:
+		return "normal"
+	}
+}
+
+func (c *Client) flags() string {
+	flags := ""
+	if c.isReplica {
+		flags += "S"
+	}
+	if c.isMaster {
+		flags += "M"
+	}
+	if c.closeAfterReply {
+		flags += "c"
+	}
+	if c.noEvict {
+		flags += "e"
+	}
+	if c.isUnixSocket() {
+		flags += "U"
+	}
+	tracking.mu.Lock()
+	if c.tracking.enabled {
+		flags += "t"
+		if c.tracking.bcast {
+			flags += "B"
+		}
+		if c.tracking.redirect != 0 && clients.clients[c.tracking.redirect] == nil {
+			flags += "R"
+		}
+	}
+	tracking.mu.Unlock()
+	if flags == "" {
+		flags = "N"
+	}
+	return flags
+}
+
+// info renders a client the way CLIENT LIST and CLIENT INFO report it.
+// The caller must hold clients.mu.
+func (c *Client) info() string {
+	now := time.Now()
+	fields := []string{
+		fmt.Sprintf("id=%d", c.Id),
+		fmt.Sprintf("addr=%s", c.remoteAddr()),
+		fmt.Sprintf("laddr=%s", c.localAddr()),
+		fmt.Sprintf("name=%s", c.name),
+		fmt.Sprintf("age=%d", int(now.Sub(c.createdAt).Seconds())),
+		fmt.Sprintf("idle=%d", int(now.Sub(c.lastInteraction).Seconds())),
+		fmt.Sprintf("flags=%s", c.flags()),
+		fmt.Sprintf("db=%d", c.db),
+		"sub=0",
+		"psub=0",
+		"multi=-1",
+		fmt.Sprintf("qbuf=%d", c.queryBufferLen),
+		fmt.Sprintf("qbuf-free=%d", c.reader.Size()-c.queryBufferLen),
+		fmt.Sprintf("rbs=%d", c.reader.Size()),
+		fmt.Sprintf("obl=%d", c.lastReplyLen),
+		"oll=0",
+		"omem=0",
+		fmt.Sprintf("cmd=%s", c.lastCommand),
+		fmt.Sprintf("user=%s", c.user),
+		fmt.Sprintf("redir=%d", c.trackingRedirect()),
+		fmt.Sprintf("resp=%d", c.protocol),
+	}
+	return strings.Join(fields, " ")
+}
+
+func (c *Client) trackingRedirect() int64 {
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+	if !c.tracking.enabled {
+		return -1
+	}
+	return c.tracking.redirect
+}
+
+// sortedClients returns the registered clients ordered by id.
+// The caller must hold clients.mu.
+func sortedClients() []*Client {
+	list := make([]*Client, 0, len(clients.clients))
+	for _, client := range clients.clients {
+		list = append(list, client)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+func handleClient(client *Client, args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("failed to execute CLIENT command, it requires a subcommand")
+	}
+	subcommand, _ := args[0].(string)
+	args = args[1:]
+
+	switch strings.ToUpper(subcommand) {
+	case "ID":
+		return encodeInteger(int(client.Id)), nil
+	case "INFO":
+		clients.mu.Lock()
+		info := client.info() + "\n"
+		clients.mu.Unlock()
+		return encodeBulkString(&info), nil
+	case "LIST":
+		return handleClientList(args)
+	case "SETNAME":
+		return handleClientSetName(client, args)
+	case "GETNAME":
+		clients.mu.Lock()
+		name := client.name
+		clients.mu.Unlock()
+		if name == "" {
+			return encodeBulkString(nil), nil
+		}
+		return encodeBulkString(&name), nil
+	case "KILL":
+		return handleClientKill(client, args)
+	case "PAUSE":
+		return handleClientPause(args)
+	case "UNPAUSE":
+		clientPause.unpause()
+		return encodeSimpleString("OK"), nil
+	case "REPLY":
+		return handleClientReply(client, args)
+	case "NO-EVICT":
+		return handleClientNoEvict(client, args)
+	case "TRACKING":
+		return handleClientTracking(client, args)
+	case "CACHING":
+		return handleClientCaching(client, args)
+	case "GETREDIR":
+		return handleClientGetRedir(client)
+	case "TRACKINGINFO":
+		return handleClientTrackingInfo(client)
+	default:
+		return "", fmt.Errorf("CLIENT subcommand %s is unsupported", subcommand)
+	}
+}
+
+func handleClientList(args []interface{}) (string, error) {
+	var clientType string
+	var ids map[int64]bool
+	for i := 0; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch strings.ToUpper(option) {
+		case "TYPE":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("CLIENT LIST TYPE requires a client type")
+			}
+			i++
+			typeStr, _ := args[i].(string)
+			clientType = normaliseClientType(typeStr)
+			if clientType == "" {
+				return "", fmt.Errorf("unknown client type '%s'", typeStr)
+			}
+		case "ID":
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("CLIENT LIST ID requires at least one client id")
+			}
+			ids = make(map[int64]bool)
+			for i+1 < len(args) {
+				var id int64
+				idStr, _ := args[i+1].(string)
+				if _, err := fmt.Sscanf(idStr, "%d", &id); err != nil {
+					break
+				}
+				ids[id] = true
+				i++
+			}
+		default:
+			return "", fmt.Errorf("unsupported CLIENT LIST option: %s", option)
+		}
+	}
+
+	clients.mu.Lock()
+	list := ""
+	for _, client := range sortedClients() {
+		if clientType != "" && client.clientType() != clientType {
+			continue
+		}
+		if ids != nil && !ids[client.Id] {
+			continue
+		}
+		list += client.info() + "\n"
+	}
+	clients.mu.Unlock()
+
+	return encodeBulkString(&list), nil
+}
+
+func handleClientSetName(client *Client, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("failed to execute CLIENT SETNAME command, it requires a name")
+	}
+	name, _ := args[0].(string)
+	for _, ch := range name {
+		if ch < '!' || ch > '~' {
+			return encodeSimpleError("ERR Client names cannot contain spaces, newlines or special characters."), nil
+		}
+	}
+
+	clients.mu.Lock()
+	client.name = name
+	clients.mu.Unlock()
+	return encodeSimpleString("OK"), nil
+}
+
+func normaliseClientType(clientType string) string {
+	switch strings.ToLower(clientType) {
+	case "normal":
+		return "normal"
+	case "master":
+		return "master"
+	case "replica", "slave":
+		return "replica"
+	case "pubsub":
+		return "pubsub"
+	default:
+		return ""
+	}
+}
+
+type clientKillFilter struct {
+	id         int64
+	addr       string
+	laddr      string
+	user       string
+	clientType string
+	maxAge     int
+	skipMe     bool
+}
+
+func (f clientKillFilter) matches(client *Client) bool {
+	if f.id != 0 && client.Id != f.id {
+		return false
+	}
+	if f.addr != "" && client.remoteAddr() != f.addr {
+		return false
+	}
+	if f.laddr != "" && client.localAddr() != f.laddr {
+		return false
+	}
+	if f.user != "" && client.user != f.user {
+		return false
+	}
+	if f.clientType != "" && client.clientType() != f.clientType {
+		return false
+	}
+	if f.maxAge != 0 && time.Since(client.createdAt) < time.Duration(f.maxAge)*time.Second {
+		return false
+	}
+	return true
+}
+
+func handleClientKill(caller *Client, args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("failed to execute CLIENT KILL command, it requires an address or filters")
+	}
+
+	// Old form: CLIENT KILL ip:port
+	if len(args) == 1 {
+		addr, _ := args[0].(string)
+		killed := killClients(caller, clientKillFilter{addr: addr})
+		if killed == 0 {
+			return encodeSimpleError("ERR No such client"), nil
+		}
+		return encodeSimpleString("OK"), nil
+	}
+
+	if len(args)%2 != 0 {
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+
+	filter := clientKillFilter{skipMe: true}
+	for i := 0; i < len(args); i += 2 {
+		option, _ := args[i].(string)
+		value, _ := args[i+1].(string)
+		switch strings.ToUpper(option) {
+		case "ID":
+			if _, err := fmt.Sscanf(value, "%d", &filter.id); err != nil || filter.id <= 0 {
+				return encodeSimpleError("ERR client-id should be greater than 0"), nil
+			}
+		case "ADDR":
+			filter.addr = value
+		case "LADDR":
+			filter.laddr = value
+		case "USER":
+			filter.user = value
+		case "TYPE":
+			filter.clientType = normaliseClientType(value)
+			if filter.clientType == "" {
+				return encodeSimpleError(fmt.Sprintf("ERR Unknown client type '%s'", value)), nil
+			}
+		case "MAXAGE":
+			if _, err := fmt.Sscanf(value, "%d", &filter.maxAge); err != nil {
+				return encodeSimpleError("ERR syntax error"), nil
+			}
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				filter.skipMe = true
+			case "no":
+				filter.skipMe = false
+			default:
+				return encodeSimpleError("ERR syntax error"), nil
+			}
+		default:
+			return encodeSimpleError("ERR syntax error"), nil
+		}
+	}
+
+	return encodeInteger(killClients(caller, filter)), nil
+}
+
+func killClients(caller *Client, filter clientKillFilter) int {
+	clients.mu.Lock()
+	var victims []*Client
+	for _, client := range sortedClients() {
+		if !filter.matches(client) {
+			continue
+		}
+		if client == caller {
+			if filter.skipMe {
+				continue
+			}
+			// The caller still has to receive the reply to CLIENT KILL.
+			caller.closeAfterReply = true
+			victims = append(victims, client)
+			continue
+		}
+		client.closed = true
+		victims = append(victims, client)
+	}
+	clients.mu.Unlock()
+
+	for _, client := range victims {
+		if client != caller {
+			client.Conn.Close()
+		}
+	}
+	return len(victims)
+}
+
+func handleClientPause(args []interface{}) (string, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return "", fmt.Errorf("failed to execute CLIENT PAUSE command, it requires a timeout")
+	}
+	var timeout int64
+	timeoutStr, _ := args[0].(string)
+	if _, err := fmt.Sscanf(timeoutStr, "%d", &timeout); err != nil || timeout < 0 {
+		return encodeSimpleError("ERR timeout is not an integer or out of range"), nil
+	}
+
+	all := true
+	if len(args) == 2 {
+		mode, _ := args[1].(string)
+		switch strings.ToUpper(mode) {
+		case "ALL":
+			all = true
+		case "WRITE":
+			all = false
+		default:
+			return encodeSimpleError("ERR CLIENT PAUSE mode must be WRITE or ALL"), nil
+		}
+	}
+
+	clientPause.pause(time.Duration(timeout)*time.Millisecond, all)
+	return encodeSimpleString("OK"), nil
+}
+
+func (p *clientPauseState) pause(timeout time.Duration, all bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	until := time.Now().Add(timeout)
+	// A new pause never shortens or weakens one that is already in effect.
+	if p.until.After(time.Now()) {
+		if p.until.After(until) {
+			until = p.until
+		}
+		all = all || p.all
+	}
+	if p.resume == nil {
+		p.resume = make(chan struct{})
+	}
+	p.until = until
+	p.all = all
+}
+
+func (p *clientPauseState) unpause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.until = time.Time{}
+	if p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+	}
+}
+
+// pauseWritesForFailover holds back writes while a FAILOVER is in progress.
+func (p *clientPauseState) pauseWritesForFailover(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.failover = paused
+	if !paused && p.resume != nil {
+		close(p.resume)
+		p.resume = nil
+	}
+}
+
+// wait blocks until the command is no longer held back by CLIENT PAUSE or a
+// FAILOVER. CLIENT commands are never held back, so CLIENT UNPAUSE can end a
+// pause of all commands.
+func (p *clientPauseState) wait(client *Client, command string) {
+	if client.isReplica || client.isMaster || command == "CLIENT" {
+		return
+	}
+	for {
+		p.mu.Lock()
+		remaining := time.Until(p.until)
+		paused := remaining > 0 && (p.all || isWriteCommand(command))
+		if !paused && !(p.failover && isWriteCommand(command)) {
+			p.mu.Unlock()
+			return
+		}
+		if p.resume == nil {
+			p.resume = make(chan struct{})
+		}
+		resume := p.resume
+		p.mu.Unlock()
+
+		var expired <-chan time.Time
+		if paused {
+			expired = time.After(remaining)
+		}
+		select {
+		case <-expired:
+		case <-resume:
+		}
+	}
+}
+
+func handleClientReply(client *Client, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("failed to execute CLIENT REPLY command, it requires ON, OFF or SKIP")
+	}
+	mode, _ := args[0].(string)
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	switch strings.ToUpper(mode) {
+	case "ON":
+		client.replyMode = replyOn
+	case "OFF":
+		client.replyMode = replyOff
+	case "SKIP":
+		if client.replyMode != replyOff {
+			client.replyMode = replySkip
+		}
+	default:
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+func handleClientNoEvict(client *Client, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("failed to execute CLIENT NO-EVICT command, it requires ON or OFF")
+	}
+	mode, _ := args[0].(string)
+
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+	switch strings.ToUpper(mode) {
+	case "ON":
+		client.noEvict = true
+	case "OFF":
+		client.noEvict = false
+	default:
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+func handleHello(client *Client, args []interface{}) (string, error) {
+	protocol := client.protocol
+	if len(args) > 0 {
+		versionStr, _ := args[0].(string)
+		if _, err := fmt.Sscanf(versionStr, "%d", &protocol); err != nil {
+			return encodeSimpleError("ERR Protocol version is not an integer or out of range"), nil
+		}
+		if protocol < 2 || protocol > 3 {
+			return encodeSimpleError("NOPROTO unsupported protocol version"), nil
+		}
+		args = args[1:]
+	}
+
+	var name *string
+	var username, password *string
+	for i := 0; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch {
+		case strings.ToUpper(option) == "AUTH" && i+2 < len(args):
+			user, _ := args[i+1].(string)
+			pass, _ := args[i+2].(string)
+			username, password = &user, &pass
+			i += 2
+		case strings.ToUpper(option) == "SETNAME" && i+1 < len(args):
+			i++
+			value, _ := args[i].(string)
+			name = &value
+		default:
+			return encodeSimpleError(fmt.Sprintf("ERR Syntax error in HELLO option '%s'", option)), nil
+		}
+	}
+	if username != nil && !authenticate(client, *username, *password) {
+		return encodeSimpleError("WRONGPASS invalid username-password pair or user is disabled."), nil
+	}
+	if requiresAuth(client) {
+		return encodeSimpleError("NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time"), nil
+	}
+	if name != nil {
+		if resp, _ := handleClientSetName(client, []interface{}{*name}); resp != encodeSimpleString("OK") {
+			return resp, nil
+		}
+	}
+
+	clients.mu.Lock()
+	client.protocol = protocol
+	clients.mu.Unlock()
+
+	info := []interface{}{
+		"server", "redis",
+		"version", redisVersion,
+		"proto", protocol,
+		"id", int(client.Id),
+		"mode", "standalone",
+		"role", config.InstReplicationInfo.Role,
+		"modules", []interface{}{},
+	}
+	if protocol == 3 {
+		return encodeMap(info)
+	}
+	return encodeArray(info)
+}
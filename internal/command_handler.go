@@ -3,17 +3,77 @@ package internal
 import (
 	"fmt"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	config "myredis/config"
 )
 
-func Handle(command string, args []interface{}) (string, error) {
+func Handle(client *Client, command string, args []interface{}) (string, error) {
+	client.beforeCommand(command, args)
+	if !noAuthCommands[command] && !client.isMaster {
+		if requiresAuth(client) {
+			return encodeSimpleError(noAuthError), nil
+		}
+		if aclError := aclCheckCommand(client, command, args); aclError != "" {
+			return encodeSimpleError(aclError), nil
+		}
+	}
+	if pubsubError := pubsubCheckCommand(client, command); pubsubError != "" {
+		return encodeSimpleError(pubsubError), nil
+	}
+	// The replication state is checked after the pause, as a failover
+	// turns the master into a replica while writes are paused.
+	clientPause.wait(client, command)
+	if replicationError := replicationCheckCommand(client, command); replicationError != "" {
+		return encodeSimpleError(replicationError), nil
+	}
+
+	var resp string
+	var err error
+	if isWriteCommand(command) {
+		resp, err = executeWrite(client, command, args)
+	} else {
+		resp, err = execute(client, command, args)
+	}
+	if err != nil {
+		return resp, err
+	}
+
+	if isWriteCommand(command) {
+		markDirty()
+		invalidateKeys(client, commandKeys(command, args))
+	}
+	trackCommandKeys(client, command, args)
+	return resp, nil
+}
+
+// writeCommands serialises write commands so they are logged to the AOF in
+// the same order they were applied to the keyspace.
+var writeCommands sync.Mutex
+
+func executeWrite(client *Client, command string, args []interface{}) (string, error) {
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+
+	resp, err := execute(client, command, args)
+	if err == nil && !strings.HasPrefix(resp, "-") {
+		feedAppendOnlyFile(command, args)
+		// Commands from the master reach the replication stream verbatim.
+		if !client.isMaster {
+			propagateToReplicas(client.db, append([]interface{}{command}, aofArgs(command, args)...))
+		}
+	}
+	return resp, err
+}
+
+func execute(client *Client, command string, args []interface{}) (string, error) {
 	switch command {
 	case "PING":
-		return handlePing()
+		return handlePing(client)
 	case "ECHO":
 		return handleEcho(args)
+	case "SELECT":
+		return handleSelect(client, args)
 	case "SET":
 		return handleSet(args)
 	case "GET":
@@ -22,20 +82,54 @@ func Handle(command string, args []interface{}) (string, error) {
 		return handleConfig(args)
 	case "SAVE":
 		return handleSave()
+	case "BGSAVE":
+		return handleBgsave(args)
+	case "LASTSAVE":
+		return handleLastSave()
+	case "BGREWRITEAOF":
+		return handleBgrewriteaof()
 	case "KEYS":
 		return handleKeys()
 	case "INFO":
-		return handleInfo()
+		return handleInfo(args)
 	case "REPLCONF":
-		return handleReplConf(args)
+		return handleReplConf(client, args)
 	case "PSYNC":
-		return handlePsync(args)
+		return handlePsync(client, args)
+	case "WAIT":
+		return handleWait(args)
+	case "REPLICAOF", "SLAVEOF":
+		return handleReplicaOf(command, args)
+	case "FAILOVER":
+		return handleFailover(args)
+	case "CLIENT":
+		return handleClient(client, args)
+	case "HELLO":
+		return handleHello(client, args)
+	case "AUTH":
+		return handleAuth(client, args)
+	case "ACL":
+		return handleAcl(client, args)
+	case "SUBSCRIBE":
+		return handleSubscribe(client, args)
+	case "UNSUBSCRIBE":
+		return handleUnsubscribe(client, args)
+	case "PUBLISH":
+		return handlePublish(args)
 	default:
 		return "", fmt.Errorf("unknown command: %s", command)
 	}
 }
 
-func handlePing() (string, error) {
+// handlePing replies like a message to a subscribed RESP2 client, which
+// expects nothing else.
+func handlePing(client *Client) (string, error) {
+	clients.mu.Lock()
+	protocol := client.protocol
+	clients.mu.Unlock()
+	if protocol != 3 && subscriptionCount(client) > 0 {
+		return encodeArray([]interface{}{"pong", ""})
+	}
 	return encodeSimpleString("PONG"), nil
 }
 
@@ -49,6 +143,27 @@ func handleEcho(args []interface{}) (string, error) {
 	return encodeBulkString(&message), nil
 }
 
+// handleSelect only knows database 0, as the keyspace is not split into
+// databases.
+func handleSelect(client *Client, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return encodeSimpleError("ERR wrong number of arguments for 'select' command"), nil
+	}
+	index, _ := args[0].(string)
+	db, err := strconv.Atoi(index)
+	if err != nil {
+		return encodeSimpleError("ERR value is not an integer or out of range"), nil
+	}
+	if db != 0 {
+		return encodeSimpleError("ERR DB index is out of range"), nil
+	}
+
+	clients.mu.Lock()
+	client.db = db
+	clients.mu.Unlock()
+	return encodeSimpleString("OK"), nil
+}
+
 func handleSet(args []interface{}) (string, error) {
 	if len(args) < 2 {
 		return "", fmt.Errorf("failed to execute SET command, it requires a key and a value")
@@ -58,7 +173,7 @@ func handleSet(args []interface{}) (string, error) {
 	value, _ := args[1].(string)
 	var parsedArgs map[string]string
 	if len(args) > 2 {
-		parsedArgs, _ = parseOptions(args[2:], map[string]bool{"PX": false})
+		parsedArgs, _ = parseOptions(args[2:], map[string]bool{"PX": false, "PXAT": false})
 	}
 
 	var px float64
@@ -69,11 +184,17 @@ func handleSet(args []interface{}) (string, error) {
 		expireTime = time.Now().Add(time.Duration(px) * time.Millisecond).UnixMilli()
 		expiryInMillseconds = true
 	}
+	if pxatStr, exists := parsedArgs["PXAT"]; exists {
+		expireTime, _ = strconv.ParseInt(pxatStr, 10, 64)
+		expiryInMillseconds = true
+	}
 
 	kvStore.Set(key, value, expireTime, expiryInMillseconds)
 	return encodeSimpleString("OK"), nil
 }
 
+const wrongTypeError = "WRONGTYPE Operation against a key holding the wrong kind of value"
+
 func handleGet(args []interface{}) (string, error) {
 	if len(args) < 1 {
 		return "", fmt.Errorf("failed to execute GET command, it requires a key to fetch")
@@ -87,7 +208,7 @@ func handleGet(args []interface{}) (string, error) {
 		case int:
 			return encodeInteger(t), nil
 		default:
-			return "", fmt.Errorf("unsupported type %T", t)
+			return encodeSimpleError(wrongTypeError), nil
 		}
 	} else {
 		return encodeBulkString(nil), nil
@@ -126,18 +247,9 @@ func handleConfigGet(args []interface{}) (string, error) {
 }
 
 func handleSave() (string, error) {
-	rdbFile, _ := initialiseRDBFile(true)
-	addAuxFieldToRdbFile(rdbFile, "redis-bits", int(64))
-	addAuxFieldToRdbFile(rdbFile, "ctime", int(time.Now().Unix()))
-	addDatabaseSelector(rdbFile, 1)
-	addResizeDBInfo(rdbFile, kvStore.Size(), kvStore.ExpiryTableSize())
-	for _, item := range kvStore.Items() {
-		err := addKeyValueToRdbFile(rdbFile, item.Key, item.Value, uint64(item.ExpiryTime), item.TimeInMilliseconds)
-		if err != nil {
-			return "", fmt.Errorf("failed to add key %s value %s in rdb file: %v", item.Key, item.Value, err)
-		}
+	if err := rdbSave(); err != nil {
+		return encodeSimpleError(fmt.Sprintf("ERR %v", err)), nil
 	}
-	addCheckSumToRdbFile(rdbFile)
 	return encodeSimpleString("OK"), nil
 }
 
@@ -150,21 +262,28 @@ func handleKeys() (string, error) {
 	return encodedKeysList, nil
 }
 
-func handleInfo() (string, error) {
-	replicationInfo := "role:" + config.InstReplicationInfo.Role + "\n"
-	replicationInfo += "master_replid:" + config.InstReplicationInfo.MasterReplId + "\n"
-	replicationInfo += "master_repl_offset:" + fmt.Sprint(config.InstReplicationInfo.MasterReplOffset)
-	return encodeBulkString(&replicationInfo), nil
-}
-
-func handleReplConf(args []interface{}) (string, error) {
+func handleInfo(args []interface{}) (string, error) {
+	sections := []struct {
+		name   string
+		render func() string
+	}{
+		{"persistence", persistenceInfo},
+		{"replication", replicationInfo},
+	}
 
-	return encodeSimpleString("OK"), nil
-}
+	requested := make(map[string]bool)
+	for _, arg := range args {
+		section, _ := arg.(string)
+		requested[strings.ToLower(section)] = true
+	}
+	all := len(requested) == 0 || requested["all"] || requested["default"] || requested["everything"]
 
-func handlePsync(args []interface{}) (string, error) {
-	replicationInfo := config.InstReplicationInfo
-	resp := fmt.Sprintf("FULLRESYNC %s %d", replicationInfo.MasterReplId, replicationInfo.MasterReplOffset)
-	sendRdbToReplica()
-	return encodeSimpleString(resp), nil
+	var rendered []string
+	for _, section := range sections {
+		if all || requested[section.name] {
+			rendered = append(rendered, section.render())
+		}
+	}
+	info := strings.Join(rendered, "\n")
+	return encodeBulkString(&info), nil
 }
@@ -0,0 +1,133 @@
+package internal
+
+import "sort"
+
+// commandInfo describes a command independently of how it is executed.
+// firstKey, lastKey and keyStep locate the keys in the argument vector the
+// same way the Redis command table does, with the command name at index 0
+// and a negative lastKey counting from the end. stale commands are served by
+// a replica whose link to the master is down even with
+// replica-serve-stale-data set to no.
+type commandInfo struct {
+	write      bool
+	stale      bool
+	firstKey   int
+	lastKey    int
+	keyStep    int
+	categories []string
+}
+
+var commandTable = map[string]commandInfo{
+	"PING":         {categories: []string{"fast", "connection"}},
+	"ECHO":         {categories: []string{"fast", "connection"}},
+	"SELECT":       {stale: true, categories: []string{"fast", "connection"}},
+	"SET":          {write: true, firstKey: 1, lastKey: 1, keyStep: 1, categories: []string{"write", "string", "slow"}},
+	"GET":          {firstKey: 1, lastKey: 1, keyStep: 1, categories: []string{"read", "string", "fast"}},
+	"CONFIG":       {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"SAVE":         {categories: []string{"admin", "slow", "dangerous"}},
+	"BGSAVE":       {categories: []string{"admin", "slow", "dangerous"}},
+	"LASTSAVE":     {stale: true, categories: []string{"admin", "fast", "dangerous"}},
+	"BGREWRITEAOF": {categories: []string{"admin", "slow", "dangerous"}},
+	"KEYS":         {categories: []string{"keyspace", "read", "slow", "dangerous"}},
+	"INFO":         {stale: true, categories: []string{"slow", "dangerous"}},
+	"REPLCONF":     {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"PSYNC":        {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"WAIT":         {categories: []string{"slow", "connection"}},
+	"REPLICAOF":    {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"SLAVEOF":      {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"FAILOVER":     {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"CLIENT":       {stale: true, categories: []string{"slow", "connection"}},
+	"HELLO":        {stale: true, categories: []string{"fast", "connection"}},
+	"AUTH":         {stale: true, categories: []string{"fast", "connection"}},
+	"ACL":          {stale: true, categories: []string{"admin", "slow", "dangerous"}},
+	"SUBSCRIBE":    {stale: true, categories: []string{"pubsub", "slow"}},
+	"UNSUBSCRIBE":  {stale: true, categories: []string{"pubsub", "slow"}},
+	"PUBLISH":      {stale: true, categories: []string{"pubsub", "fast"}},
+}
+
+var commandCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast", "slow",
+	"blocking", "dangerous", "connection", "transaction", "scripting",
+}
+
+func isWriteCommand(command string) bool {
+	return commandTable[command].write
+}
+
+func isStaleCommand(command string) bool {
+	return commandTable[command].stale
+}
+
+func commandInCategory(command string, category string) bool {
+	if category == "all" {
+		return true
+	}
+	for _, c := range commandTable[command].categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func commandsInCategory(category string) []string {
+	var commands []string
+	for command := range commandTable {
+		if commandInCategory(command, category) {
+			commands = append(commands, command)
+		}
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+func isCommandCategory(category string) bool {
+	if category == "all" {
+		return true
+	}
+	for _, c := range commandCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+func commandKeys(command string, args []interface{}) []string {
+	info := commandTable[command]
+	if info.firstKey == 0 {
+		return nil
+	}
+
+	lastKey := info.lastKey
+	if lastKey < 0 {
+		lastKey = len(args) + 1 + lastKey
+	}
+
+	var keys []string
+	for i := info.firstKey; i <= lastKey && i <= len(args); i += info.keyStep {
+		key, _ := args[i-1].(string)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// commandChannels returns the Pub/Sub channels a command accesses, which ACL
+// channel permissions apply to.
+func commandChannels(command string, args []interface{}) []string {
+	var channels []string
+	switch command {
+	case "SUBSCRIBE":
+		for _, arg := range args {
+			channel, _ := arg.(string)
+			channels = append(channels, channel)
+		}
+	case "PUBLISH":
+		if len(args) > 0 {
+			channel, _ := args[0].(string)
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
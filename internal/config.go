@@ -1,6 +1,58 @@
 package internal
 
 var Config = map[string]string{
-	"dir":        "../dump/",
-	"dbfilename": "dump.rdb",
+	"dir":            "../dump/",
+	"dbfilename":     "dump.rdb",
+	"rdbchecksum":    "yes",
+	"rdbcompression": "yes",
+	"save":           "3600 1 300 100 60 10000",
+	"requirepass":    "",
+	"aclfile":        "",
+
+	"appendonly":                  "no",
+	"appendfilename":              "appendonly.aof",
+	"appendfsync":                 "everysec",
+	"aof-load-truncated":          "yes",
+	"appenddirname":               "appendonlydir",
+	"aof-use-rdb-preamble":        "yes",
+	"auto-aof-rewrite-percentage": "100",
+	"auto-aof-rewrite-min-size":   "64mb",
+
+	"hash-max-listpack-entries": "128",
+	"hash-max-listpack-value":   "64",
+	"set-max-intset-entries":    "512",
+	"set-max-listpack-entries":  "128",
+	"set-max-listpack-value":    "64",
+	"zset-max-listpack-entries": "128",
+	"zset-max-listpack-value":   "64",
+	"list-max-listpack-size":    "-2",
+
+	"bind":           "* -::*",
+	"protected-mode": "yes",
+
+	"tls-port":         "0",
+	"tls-cert-file":    "",
+	"tls-key-file":     "",
+	"tls-ca-cert-file": "",
+	"tls-auth-clients": "yes",
+	"tls-replication":  "no",
+
+	"masterauth":               "",
+	"masteruser":               "",
+	"repl-timeout":             "60",
+	"repl-ping-replica-period": "10",
+	"repl-backlog-size":        "1mb",
+	"repl-backlog-ttl":         "3600",
+	"repl-diskless-sync":       "no",
+	"repl-diskless-sync-delay": "5",
+	"repl-diskless-load":       "disabled",
+	"replica-read-only":        "yes",
+	"replica-serve-stale-data": "yes",
+	"min-replicas-to-write":    "0",
+	"min-replicas-max-lag":     "10",
+
+	"client-output-buffer-limit": "normal 0 0 0 replica 256mb 64mb 60 pubsub 32mb 8mb 60",
+
+	"unixsocket":     "",
+	"unixsocketperm": "0",
 }
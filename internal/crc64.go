@@ -0,0 +1,41 @@
+package internal
+
+// Redis checksums RDB files with the Jones CRC-64 polynomial, reflected, with
+// a zero initial value and no final xor. hash/crc64 always complements the
+// crc, so it cannot produce the same values.
+const crc64JonesPolynomial = 0x95ac9329ac4bc9b5
+
+var crc64JonesTable = makeCrc64JonesTable()
+
+func makeCrc64JonesTable() [256]uint64 {
+	var table [256]uint64
+	for i := 0; i < 256; i++ {
+		crc := uint64(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ crc64JonesPolynomial
+			} else {
+				crc >>= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}
+
+func crc64Jones(crc uint64, data []byte) uint64 {
+	for _, b := range data {
+		crc = crc64JonesTable[byte(crc)^b] ^ (crc >> 8)
+	}
+	return crc
+}
+
+// crc64Writer accumulates the checksum of everything written to it.
+type crc64Writer struct {
+	crc uint64
+}
+
+func (w *crc64Writer) Write(data []byte) (int, error) {
+	w.crc = crc64Jones(w.crc, data)
+	return len(data), nil
+}
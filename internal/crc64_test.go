@@ -0,0 +1,19 @@
+package internal
+
+import "testing"
+
+func TestCrc64Jones(t *testing.T) {
+	// The check value of the Jones CRC-64 Redis uses.
+	if crc := crc64Jones(0, []byte("123456789")); crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected 0xe9c6d914c4b8d9ca, Got %#x", crc)
+	}
+
+	// Written in pieces, the data has the same checksum.
+	writer := &crc64Writer{}
+	for _, piece := range []string{"1234", "", "5", "6789"} {
+		writer.Write([]byte(piece))
+	}
+	if writer.crc != 0xe9c6d914c4b8d9ca {
+		t.Errorf("Expected 0xe9c6d914c4b8d9ca, Got %#x", writer.crc)
+	}
+}
@@ -0,0 +1,22 @@
+package internal
+
+import "time"
+
+// cronInterval is how often the periodic server tasks run.
+const cronInterval = 100 * time.Millisecond
+
+// StartServerCron runs the periodic server tasks in the background.
+func StartServerCron() {
+	go func() {
+		ticker := time.NewTicker(cronInterval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			checkSavePoints(now)
+			fsyncAppendOnlyFile(now)
+			checkAofRewrite()
+			replicationCron(now)
+			replicaCron(now)
+			failoverCron(now)
+		}
+	}()
+}
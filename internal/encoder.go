@@ -25,13 +25,30 @@ func encodeBulkString(input *string) string {
 }
 
 func encodeArray(input []interface{}) (string, error) {
-	encodedArr := "*" + strconv.FormatInt(int64(len(input)), 10) + "\r\n"
+	return encodeAggregate("*", len(input), input)
+}
+
+func encodeMap(input []interface{}) (string, error) {
+	if len(input)%2 != 0 {
+		return "", fmt.Errorf("failed to encode map, expected key value pairs got %d elements", len(input))
+	}
+	return encodeAggregate("%", len(input)/2, input)
+}
+
+func encodePush(input []interface{}) (string, error) {
+	return encodeAggregate(">", len(input), input)
+}
+
+func encodeAggregate(prefix string, length int, input []interface{}) (string, error) {
+	encodedArr := prefix + strconv.FormatInt(int64(length), 10) + "\r\n"
 	for i := 0; i < len(input); i++ {
 		switch t := input[i].(type) {
 		case string:
 			encodedArr += encodeBulkString(&t)
 		case int:
 			encodedArr += encodeInteger(t)
+		case nil:
+			encodedArr += encodeBulkString(nil)
 		case []interface{}:
 			res, err := encodeArray(t)
 			if err != nil {
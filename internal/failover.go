@@ -0,0 +1,229 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	config "myredis/config"
+)
+
+// States of a FAILOVER, as reported by INFO replication.
+const (
+	failoverStateNone        = "no-failover"
+	failoverStateWaitForSync = "waiting-for-sync"
+	failoverStateInProgress  = "failover-in-progress"
+)
+
+// failoverState is the FAILOVER coordinated by this server, guarded by
+// replication.mu. While it waits for the target to catch up writes are
+// paused, then the server becomes a replica of the target and asks it to
+// take over with PSYNC FAILOVER.
+type failoverState struct {
+	state string
+	// host and port are the target, or empty when any replica that caught
+	// up will do.
+	host string
+	port string
+	// force fails over once the deadline passes even if the target did not
+	// catch up. The deadline is zero without a timeout.
+	force    bool
+	deadline time.Time
+}
+
+// handleFailover implements FAILOVER [TO host port [FORCE]] [ABORT]
+// [TIMEOUT ms].
+func handleFailover(args []interface{}) (string, error) {
+	var host, port string
+	var timeout int
+	force, abort := false, false
+	for i := 0; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch {
+		case strings.EqualFold(option, "TO") && i+2 < len(args) && host == "":
+			host, _ = args[i+1].(string)
+			port, _ = args[i+2].(string)
+			if _, err := strconv.Atoi(port); err != nil {
+				return encodeSimpleError("ERR value is not an integer or out of range"), nil
+			}
+			i += 2
+		case strings.EqualFold(option, "TIMEOUT") && i+1 < len(args) && timeout == 0:
+			value, _ := args[i+1].(string)
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return encodeSimpleError("ERR value is not an integer or out of range"), nil
+			}
+			if n <= 0 {
+				return encodeSimpleError("ERR FAILOVER timeout must be greater than 0"), nil
+			}
+			timeout = n
+			i++
+		case strings.EqualFold(option, "FORCE") && !force:
+			force = true
+		case strings.EqualFold(option, "ABORT") && !abort:
+			abort = true
+		default:
+			return encodeSimpleError("ERR syntax error"), nil
+		}
+	}
+
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if abort {
+		if host != "" || timeout > 0 || force {
+			return encodeSimpleError("ERR syntax error"), nil
+		}
+		if replication.failover.state == failoverStateNone {
+			return encodeSimpleError("ERR No failover in progress."), nil
+		}
+		abortFailover("Failover manually aborted")
+		return encodeSimpleString("OK"), nil
+	}
+
+	if config.InstReplicationInfo.Role != "master" {
+		return encodeSimpleError("ERR FAILOVER is not valid when server is a replica."), nil
+	}
+	if len(Replicas) == 0 {
+		return encodeSimpleError("ERR FAILOVER requires connected replicas."), nil
+	}
+	if replication.failover.state != failoverStateNone {
+		return encodeSimpleError("ERR FAILOVER already in progress."), nil
+	}
+	if host != "" {
+		replica := findReplica(host, port)
+		if replica == nil {
+			return encodeSimpleError("ERR FAILOVER target HOST and PORT is not a replica."), nil
+		}
+		if replica.state != replicaStateOnline {
+			return encodeSimpleError("ERR FAILOVER target replica is not online."), nil
+		}
+	}
+	if force && (timeout == 0 || host == "") {
+		return encodeSimpleError("ERR FAILOVER with force option requires both a timeout and target HOST and IP."), nil
+	}
+
+	replication.failover = failoverState{state: failoverStateWaitForSync, host: host, port: port, force: force}
+	if timeout > 0 {
+		replication.failover.deadline = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+	}
+	clientPause.pauseWritesForFailover(true)
+	if host != "" {
+		fmt.Printf("FAILOVER requested to %s.\n", net.JoinHostPort(host, port))
+	} else {
+		fmt.Println("FAILOVER requested to any replica.")
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+// findReplica returns the replica listening on host:port. The caller must
+// hold replication.mu.
+func findReplica(host string, port string) *ReplicaConfig {
+	for _, replica := range Replicas {
+		if replica.IpAddress == host && replica.Port == port {
+			return replica
+		}
+	}
+	return nil
+}
+
+// failoverCron hands over to the target once it acknowledged every write,
+// or gives up, or forces the failover, when the timeout expires.
+func failoverCron(now time.Time) {
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	failover := &replication.failover
+	if failover.state != failoverStateWaitForSync {
+		return
+	}
+	offset := config.InstReplicationInfo.MasterReplOffset
+	for _, replica := range Replicas {
+		if replica.state != replicaStateOnline || replica.ackOffset < offset {
+			continue
+		}
+		if failover.host == "" || (replica.IpAddress == failover.host && replica.Port == failover.port) {
+			fmt.Printf("Failover target %s is synced, failing over.\n", net.JoinHostPort(replica.IpAddress, replica.Port))
+			failoverTo(replica.IpAddress, replica.Port)
+			return
+		}
+	}
+
+	if !failover.deadline.IsZero() && now.After(failover.deadline) {
+		if failover.force {
+			fmt.Printf("Failover target %s never caught up, forcing failover.\n", net.JoinHostPort(failover.host, failover.port))
+			failoverTo(failover.host, failover.port)
+		} else {
+			abortFailover("Replica never caught up before timeout")
+		}
+	}
+}
+
+// failoverTo makes the server a replica of the target, whose PSYNC will
+// carry the FAILOVER option. The caller must hold writeCommands and
+// replication.mu.
+func failoverTo(host string, port string) {
+	replication.failover.state = failoverStateInProgress
+	replication.failover.host = host
+	replication.failover.port = port
+	becomeReplicaOf(host, port)
+}
+
+// abortFailover gives up on the failover, going back to being a master if
+// the server already followed the target. The caller must hold
+// writeCommands and replication.mu.
+func abortFailover(reason string) {
+	fmt.Printf("FAILOVER aborted: %s\n", reason)
+	if replication.failover.state == failoverStateInProgress {
+		promoteToMaster()
+	}
+	clearFailover()
+}
+
+// clearFailover ends the failover and resumes the paused writes. The caller
+// must hold replication.mu.
+func clearFailover() {
+	replication.failover = failoverState{state: failoverStateNone}
+	clientPause.pauseWritesForFailover(false)
+}
+
+// failoverTargetAccepted completes the failover once the target answered the
+// PSYNC of link, as it is the master now.
+func failoverTargetAccepted(l *masterLink) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if replication.link == l && replication.failover.state == failoverStateInProgress {
+		fmt.Printf("Failover target %s:%s is now master.\n", l.host, l.port)
+		clearFailover()
+	}
+}
+
+// failoverTargetFailed aborts the failover when link could not get the
+// target to take over.
+func failoverTargetFailed(l *masterLink) {
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if replication.link == l && replication.failover.state == failoverStateInProgress {
+		abortFailover("Failover target rejected the PSYNC request")
+	}
+}
+
+// acceptFailover promotes this replica when its master asks it to take over
+// with PSYNC FAILOVER, provided both follow the same history. The caller
+// must hold writeCommands and replication.mu.
+func acceptFailover(client *Client, replId string) bool {
+	if replId != config.InstReplicationInfo.MasterReplId {
+		return false
+	}
+	fmt.Printf("Failover request received for replica %s\n", client.Conn.RemoteAddr())
+	promoteToMaster()
+	return true
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	config "myredis/config"
+)
+
+// useTestDir points dir at a fresh temporary directory and starts from an
+// empty keyspace on a master. Config, the keyspace and the AOF are restored
+// when the test ends.
+func useTestDir(t *testing.T) string {
+	t.Helper()
+	saved := make(map[string]string, len(Config))
+	for name, value := range Config {
+		saved[name] = value
+	}
+	dir := t.TempDir()
+	Config["dir"] = dir
+	kvStore.flush()
+	if config.InstReplicationInfo.Role == "" {
+		config.InstReplicationInfo.Role = "master"
+	}
+
+	t.Cleanup(func() {
+		for name := range Config {
+			if _, exists := saved[name]; !exists {
+				delete(Config, name)
+			}
+		}
+		for name, value := range saved {
+			Config[name] = value
+		}
+		kvStore.flush()
+		aof.mu.Lock()
+		if aof.file != nil {
+			aof.file.Close()
+		}
+		aof.file = nil
+		aof.manifest = nil
+		aof.fileSize, aof.baseSize, aof.incrSize, aof.rewriteBaseSize = 0, 0, 0, 0
+		aof.lastWriteStatus = "ok"
+		aof.mu.Unlock()
+	})
+	return dir
+}
+
+// expectValue fails the test unless key holds value.
+func expectValue(t *testing.T, key string, value interface{}) {
+	t.Helper()
+	got, exists := kvStore.Get(key)
+	if !exists {
+		t.Errorf("Expected key %s to hold %v, it does not exist", key, value)
+	} else if got != value {
+		t.Errorf("Expected key %s to hold %v, Got %v", key, value, got)
+	}
+}
+
+// testConn is a connection that records what the server writes to it.
+type testConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *testConn) Read(p []byte) (int, error) {
+	return 0, net.ErrClosed
+}
+
+func (c *testConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written.Write(p)
+}
+
+func (c *testConn) Close() error {
+	return nil
+}
+
+func (c *testConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6379}
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+// takeWritten returns what was written since the last call.
+func (c *testConn) takeWritten() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	written := c.written.String()
+	c.written.Reset()
+	return written
+}
+
+// newTestClient registers a client on a testConn, unregistered when the test
+// ends.
+func newTestClient(t *testing.T) (*Client, *testConn) {
+	t.Helper()
+	conn := &testConn{}
+	client := RegisterClient(conn)
+	t.Cleanup(func() { UnregisterClient(client) })
+	return client, conn
+}
+
+// run handles a command the way a connection would and returns the reply.
+func run(t *testing.T, client *Client, command string, args ...interface{}) string {
+	t.Helper()
+	resp, err := Handle(client, command, args)
+	if err != nil {
+		t.Fatalf("Failed to run %s: %v", command, err)
+	}
+	return resp
+}
+
+// expectReply fails the test unless command replies with expected.
+func expectReply(t *testing.T, client *Client, expected string, command string, args ...interface{}) {
+	t.Helper()
+	if resp := run(t, client, command, args...); resp != expected {
+		t.Errorf("Expected %s to reply %q, Got %q", command, expected, resp)
+	}
+}
+
+// useTestAcl starts from the default users, restored when the test ends.
+func useTestAcl(t *testing.T) {
+	t.Helper()
+	acl.mu.Lock()
+	saved := acl.users
+	acl.users = map[string]*aclUser{"default": newDefaultAclUser()}
+	acl.log = nil
+	acl.mu.Unlock()
+
+	t.Cleanup(func() {
+		acl.mu.Lock()
+		acl.users = saved
+		acl.log = nil
+		acl.mu.Unlock()
+	})
+}
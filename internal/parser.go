@@ -8,10 +8,18 @@ import (
 	"strings"
 )
 
+// Limits on the lengths announced by RESP headers, matching the defaults of
+// proto-max-bulk-len and the largest multi bulk request Redis accepts, so a
+// corrupt header cannot make the parser allocate without bound.
+const (
+	maxBulkLength  = 512 * 1024 * 1024
+	maxArrayLength = 1024 * 1024 * 1024
+)
+
 func ParseRESP(reader *bufio.Reader) (interface{}, error) {
 	prefix, err := reader.Peek(1)
 	if err != nil {
-		return nil, fmt.Errorf("failed to peek at RESP type: %v", err)
+		return nil, fmt.Errorf("failed to peek at RESP type: %w", err)
 	}
 
 	switch prefix[0] {
@@ -64,7 +72,10 @@ func parseInteger(reader *bufio.Reader) (int, error) {
 }
 
 func parseBulkStrings(reader *bufio.Reader) (interface{}, error) {
-	lengthStr, _ := reader.ReadString('\n')
+	lengthStr, err := reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read bulk string length: %w", err)
+	}
 
 	lengthStr = strings.TrimSuffix(lengthStr[1:], "\r\n")
 
@@ -76,29 +87,46 @@ func parseBulkStrings(reader *bufio.Reader) (interface{}, error) {
 	if length == -1 {
 		return nil, nil
 	}
+	if length < 0 || length > maxBulkLength {
+		return "", fmt.Errorf("invalid bulk string length %d", length)
+	}
 	data := make([]byte, length+2)
-	_, _ = io.ReadFull(reader, data)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", fmt.Errorf("failed to read bulk string data: %w", err)
+	}
+	if string(data[length:]) != "\r\n" {
+		return "", fmt.Errorf("bulk string of length %d is not terminated by CRLF", length)
+	}
 
 	res := string(data)
 	return res[:length], nil
 }
 
 func ParseArray(reader *bufio.Reader) ([]interface{}, error) {
-	lengthStr, _ := reader.ReadString('\n')
+	lengthStr, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
 
 	lengthStr = strings.TrimSuffix(lengthStr[1:], "\r\n")
-	length, _ := strconv.ParseInt(lengthStr, 10, 64)
+	length, err := strconv.ParseInt(lengthStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid array '%s': length is not a valid integer", lengthStr)
+	}
 
 	if length == -1 {
 		return nil, nil
 	}
+	if length < 0 || length > maxArrayLength {
+		return nil, fmt.Errorf("invalid array length %d", length)
+	}
 
 	parsedArr := []interface{}{}
 
 	for i := 0; i < int(length); i++ {
 		arrElem, err := ParseRESP(reader)
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse array element '%d' : %v", i, err)
+			return nil, fmt.Errorf("failed to parse array element '%d' : %w", i, err)
 		}
 
 		parsedArr = append(parsedArr, arrElem)
@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bgsaveRetryDelay is how long automatic saves wait after a failed
+// background save before trying again.
+const bgsaveRetryDelay = 5 * time.Second
+
+var errBgsaveInProgress = errors.New("Background save already in progress")
+
+type persistenceState struct {
+	mu       sync.Mutex
+	lastSave time.Time
+	saves    int
+	// lastSaveStatus is the outcome of the last save, SAVE or BGSAVE, which
+	// INFO reports as rdb_last_bgsave_status like Redis does.
+	lastSaveStatus string
+
+	// dirty counts the writes since the last successful save.
+	dirty int
+
+	saveInProgress     bool
+	bgsaveInProgress   bool
+	bgsaveScheduled    bool
+	bgsaveStart        time.Time
+	lastBgsaveTry      time.Time
+	lastBgsaveDuration time.Duration
+
+	aofRewriteInProgress   bool
+	aofRewriteScheduled    bool
+	aofRewriteStart        time.Time
+	lastAofRewriteDuration time.Duration
+	lastAofRewriteStatus   string
+	aofRewrites            int
+}
+
+var persistence = persistenceState{
+	lastSave:           time.Now(),
+	lastSaveStatus:     "ok",
+	lastBgsaveDuration: -1,
+
+	lastAofRewriteDuration: -1,
+	lastAofRewriteStatus:   "ok",
+}
+
+func markDirty() {
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+	persistence.dirty++
+}
+
+// rdbSave writes a snapshot before returning. Other clients keep being
+// served while it runs, but it never overlaps another save.
+func rdbSave() error {
+	persistence.mu.Lock()
+	if persistence.saveInProgress || persistence.bgsaveInProgress {
+		persistence.mu.Unlock()
+		return errBgsaveInProgress
+	}
+	if persistence.aofRewriteInProgress {
+		persistence.mu.Unlock()
+		return errAofRewriteInProgress
+	}
+	dirty := persistence.dirty
+	snapshot := kvStore.freeze()
+	persistence.saveInProgress = true
+	persistence.mu.Unlock()
+
+	saved, err := writeRdbFile(snapshot)
+	kvStore.thaw()
+	if err == nil {
+		saved.Close()
+	}
+
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+	persistence.saveInProgress = false
+	persistence.recordSave(err, dirty)
+	return err
+}
+
+// rdbSaveBackground starts writing a snapshot in a goroutine and returns
+// straight away.
+func rdbSaveBackground() error {
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+	if persistence.saveInProgress || persistence.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	if persistence.aofRewriteInProgress {
+		return errAofRewriteActive
+	}
+
+	dirty := persistence.dirty
+	snapshot := kvStore.freeze()
+	persistence.bgsaveInProgress = true
+	persistence.bgsaveScheduled = false
+	persistence.bgsaveStart = time.Now()
+	persistence.lastBgsaveTry = persistence.bgsaveStart
+	fmt.Println("Background saving started")
+
+	go func() {
+		saved, err := writeRdbFile(snapshot)
+		kvStore.thaw()
+
+		persistence.mu.Lock()
+		persistence.bgsaveInProgress = false
+		persistence.lastBgsaveDuration = time.Since(persistence.bgsaveStart)
+		persistence.recordSave(err, dirty)
+		if err == nil {
+			fmt.Println("Background saving terminated with success")
+		}
+		persistence.mu.Unlock()
+
+		replicationBgsaveDone(saved, err)
+	}()
+	return nil
+}
+
+// rdbSaveToReplicas starts streaming a snapshot to the sockets of replicas
+// in a goroutine and returns straight away. It never overlaps another save,
+// like a background save, but leaves the rdb file and the save statistics
+// alone.
+func rdbSaveToReplicas(replicas []*ReplicaConfig, reply string) error {
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+	if persistence.saveInProgress || persistence.bgsaveInProgress {
+		return errBgsaveInProgress
+	}
+	if persistence.aofRewriteInProgress {
+		return errAofRewriteActive
+	}
+
+	snapshot := kvStore.freeze()
+	persistence.bgsaveInProgress = true
+	persistence.bgsaveStart = time.Now()
+	fmt.Println("Starting BGSAVE for SYNC with target: replicas sockets")
+
+	go func() {
+		err := streamRdbToReplicas(replicas, reply, snapshot)
+		kvStore.thaw()
+
+		persistence.mu.Lock()
+		persistence.bgsaveInProgress = false
+		if err == nil {
+			fmt.Println("Background RDB transfer terminated with success")
+		}
+		persistence.mu.Unlock()
+
+		replicationBgsaveDone(nil, err)
+	}()
+	return nil
+}
+
+// recordSave updates the save statistics after a snapshot that included the
+// first dirty writes has finished. The caller must hold persistence.mu.
+func (p *persistenceState) recordSave(err error, dirty int) {
+	if err != nil {
+		p.lastSaveStatus = "err"
+		fmt.Println("Failed to save rdb file: ", err)
+		return
+	}
+	p.lastSaveStatus = "ok"
+	p.lastSave = time.Now()
+	p.saves++
+	p.dirty -= dirty
+}
+
+type savePoint struct {
+	seconds int
+	changes int
+}
+
+// parseSavePoints parses the save config, pairs of "<seconds> <changes>".
+func parseSavePoints(save string) ([]savePoint, error) {
+	fields := strings.Fields(save)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters %q", save)
+	}
+	var points []savePoint
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return nil, fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		points = append(points, savePoint{seconds: seconds, changes: changes})
+	}
+	return points, nil
+}
+
+// checkSavePoints starts a background save when one was scheduled or when a
+// save point has been reached.
+func checkSavePoints(now time.Time) {
+	persistence.mu.Lock()
+	if persistence.saveInProgress || persistence.bgsaveInProgress || persistence.aofRewriteInProgress {
+		persistence.mu.Unlock()
+		return
+	}
+	start := persistence.bgsaveScheduled
+	canRetry := persistence.lastSaveStatus == "ok" || now.Sub(persistence.lastBgsaveTry) > bgsaveRetryDelay
+	if !start && canRetry {
+		points, _ := parseSavePoints(Config["save"])
+		for _, point := range points {
+			if persistence.dirty >= point.changes && persistence.dirty > 0 &&
+				now.Sub(persistence.lastSave) > time.Duration(point.seconds)*time.Second {
+				fmt.Printf("%d changes in %d seconds. Saving...\n", point.changes, point.seconds)
+				start = true
+				break
+			}
+		}
+	}
+	persistence.mu.Unlock()
+
+	if start {
+		rdbSaveBackground()
+	}
+}
+
+func handleBgsave(args []interface{}) (string, error) {
+	schedule := false
+	if len(args) > 0 {
+		option, _ := args[0].(string)
+		if len(args) > 1 || strings.ToUpper(option) != "SCHEDULE" {
+			return encodeSimpleError("ERR syntax error"), nil
+		}
+		schedule = true
+	}
+
+	err := rdbSaveBackground()
+	if (err == errBgsaveInProgress || err == errAofRewriteActive) && schedule {
+		persistence.mu.Lock()
+		persistence.bgsaveScheduled = true
+		persistence.mu.Unlock()
+		return encodeSimpleString("Background saving scheduled"), nil
+	}
+	if err != nil {
+		return encodeSimpleError(fmt.Sprintf("ERR %v", err)), nil
+	}
+	return encodeSimpleString("Background saving started"), nil
+}
+
+func handleLastSave() (string, error) {
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+	return encodeInteger(int(persistence.lastSave.Unix())), nil
+}
+
+func persistenceInfo() string {
+	persistence.mu.Lock()
+	defer persistence.mu.Unlock()
+
+	bgsaveInProgress := 0
+	currentBgsaveTime := -1
+	if persistence.bgsaveInProgress {
+		bgsaveInProgress = 1
+		currentBgsaveTime = int(time.Since(persistence.bgsaveStart).Seconds())
+	}
+	lastBgsaveTime := -1
+	if persistence.lastBgsaveDuration >= 0 {
+		lastBgsaveTime = int(persistence.lastBgsaveDuration.Seconds())
+	}
+
+	info := "rdb_changes_since_last_save:" + fmt.Sprint(persistence.dirty) + "\n"
+	info += "rdb_bgsave_in_progress:" + fmt.Sprint(bgsaveInProgress) + "\n"
+	info += "rdb_last_save_time:" + fmt.Sprint(persistence.lastSave.Unix()) + "\n"
+	info += "rdb_last_bgsave_status:" + persistence.lastSaveStatus + "\n"
+	info += "rdb_last_bgsave_time_sec:" + fmt.Sprint(lastBgsaveTime) + "\n"
+	info += "rdb_current_bgsave_time_sec:" + fmt.Sprint(currentBgsaveTime) + "\n"
+	info += "rdb_saves:" + fmt.Sprint(persistence.saves) + "\n"
+
+	aofRewriteInProgress := 0
+	currentAofRewriteTime := -1
+	if persistence.aofRewriteInProgress {
+		aofRewriteInProgress = 1
+		currentAofRewriteTime = int(time.Since(persistence.aofRewriteStart).Seconds())
+	}
+	aofRewriteScheduled := 0
+	if persistence.aofRewriteScheduled {
+		aofRewriteScheduled = 1
+	}
+	lastAofRewriteTime := -1
+	if persistence.lastAofRewriteDuration >= 0 {
+		lastAofRewriteTime = int(persistence.lastAofRewriteDuration.Seconds())
+	}
+	info += "aof_rewrite_in_progress:" + fmt.Sprint(aofRewriteInProgress) + "\n"
+	info += "aof_rewrite_scheduled:" + fmt.Sprint(aofRewriteScheduled) + "\n"
+	info += "aof_last_rewrite_time_sec:" + fmt.Sprint(lastAofRewriteTime) + "\n"
+	info += "aof_current_rewrite_time_sec:" + fmt.Sprint(currentAofRewriteTime) + "\n"
+	info += "aof_last_bgrewrite_status:" + persistence.lastAofRewriteStatus + "\n"
+	info += "aof_rewrites:" + fmt.Sprint(persistence.aofRewrites) + "\n"
+	info += aofInfo()
+	return info
+}
@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// usePersistenceState restores the save statistics when the test ends.
+func usePersistenceState(t *testing.T) {
+	t.Helper()
+	persistence.mu.Lock()
+	lastSave, saves, dirty := persistence.lastSave, persistence.saves, persistence.dirty
+	lastSaveStatus, lastBgsaveTry := persistence.lastSaveStatus, persistence.lastBgsaveTry
+	persistence.mu.Unlock()
+	t.Cleanup(func() {
+		persistence.mu.Lock()
+		persistence.lastSave, persistence.saves, persistence.dirty = lastSave, saves, dirty
+		persistence.lastSaveStatus, persistence.lastBgsaveTry = lastSaveStatus, lastBgsaveTry
+		persistence.bgsaveScheduled = false
+		persistence.mu.Unlock()
+	})
+}
+
+// waitForBgsave waits for the background save in progress to finish.
+func waitForBgsave(t *testing.T) {
+	t.Helper()
+	waitFor(t, "the background save", func() bool {
+		persistence.mu.Lock()
+		defer persistence.mu.Unlock()
+		return !persistence.bgsaveInProgress
+	})
+}
+
+func TestFailedSave(t *testing.T) {
+	dir := useTestDir(t)
+	usePersistenceState(t)
+	client, _ := newTestClient(t)
+	run(t, client, "SET", "key", "old")
+	expectReply(t, client, "+OK\r\n", "SAVE")
+	dumpPath := filepath.Join(dir, Config["dbfilename"])
+	saved, err := os.ReadFile(dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The temp file cannot be created where a directory is in the way.
+	tempPath := filepath.Join(dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	if err := os.Mkdir(tempPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	run(t, client, "SET", "key", "new")
+	if resp := run(t, client, "SAVE"); !strings.HasPrefix(resp, "-ERR failed to create rdb file") {
+		t.Errorf("Expected SAVE to fail, Got %q", resp)
+	}
+	if current, err := os.ReadFile(dumpPath); err != nil || !bytes.Equal(current, saved) {
+		t.Errorf("Expected the failed SAVE to leave the previous dump in place: %v", err)
+	}
+	expectPersistenceInfo(t, "rdb_changes_since_last_save:1", "rdb_last_bgsave_status:err")
+
+	// A failed BGSAVE is reported the same way, and a good SAVE clears it.
+	expectReply(t, client, "+Background saving started\r\n", "BGSAVE")
+	waitForBgsave(t)
+	expectPersistenceInfo(t, "rdb_changes_since_last_save:1", "rdb_last_bgsave_status:err")
+	os.Remove(tempPath)
+	expectReply(t, client, "+OK\r\n", "SAVE")
+	expectPersistenceInfo(t, "rdb_changes_since_last_save:0", "rdb_last_bgsave_status:ok")
+
+	// A dir that cannot be created fails the save as well.
+	Config["dir"] = filepath.Join(dumpPath, "sub")
+	if resp := run(t, client, "SAVE"); !strings.HasPrefix(resp, "-ERR failed to create rdb directory") {
+		t.Errorf("Expected SAVE to fail, Got %q", resp)
+	}
+	expectPersistenceInfo(t, "rdb_last_bgsave_status:err")
+}
+
+func TestSavePoints(t *testing.T) {
+	dir := useTestDir(t)
+	usePersistenceState(t)
+	Config["save"] = "10 2 60 1"
+	client, _ := newTestClient(t)
+	start := time.Now()
+	persistence.mu.Lock()
+	persistence.lastSave, persistence.dirty = start, 0
+	persistence.mu.Unlock()
+	run(t, client, "SET", "key", "value")
+
+	// One change is due after 60 seconds, two after 10.
+	checkSavePoints(start.Add(30 * time.Second))
+	expectPersistenceInfo(t, "rdb_bgsave_in_progress:0", "rdb_changes_since_last_save:1")
+	run(t, client, "SET", "other", "value")
+	checkSavePoints(start.Add(5 * time.Second))
+	expectPersistenceInfo(t, "rdb_bgsave_in_progress:0", "rdb_changes_since_last_save:2")
+	checkSavePoints(start.Add(11 * time.Second))
+	waitForBgsave(t)
+	expectPersistenceInfo(t, "rdb_changes_since_last_save:0", "rdb_last_bgsave_status:ok")
+	if _, err := os.Stat(filepath.Join(dir, Config["dbfilename"])); err != nil {
+		t.Errorf("Expected the save point to save the rdb file: %v", err)
+	}
+
+	// A failed save is only retried once bgsaveRetryDelay has passed.
+	Config["dir"] = filepath.Join(dir, Config["dbfilename"], "sub")
+	run(t, client, "SET", "key", "again")
+	checkSavePoints(time.Now().Add(time.Hour))
+	waitForBgsave(t)
+	expectPersistenceInfo(t, "rdb_last_bgsave_status:err", "rdb_changes_since_last_save:1")
+	Config["dir"] = dir
+	persistence.mu.Lock()
+	persistence.lastSave = time.Now().Add(-time.Hour)
+	persistence.mu.Unlock()
+	checkSavePoints(time.Now().Add(time.Second))
+	expectPersistenceInfo(t, "rdb_bgsave_in_progress:0", "rdb_changes_since_last_save:1")
+	checkSavePoints(time.Now().Add(bgsaveRetryDelay + time.Second))
+	waitForBgsave(t)
+	expectPersistenceInfo(t, "rdb_last_bgsave_status:ok", "rdb_changes_since_last_save:0")
+}
+
+func TestBgsaveSchedule(t *testing.T) {
+	useTestDir(t)
+	usePersistenceState(t)
+	client, _ := newTestClient(t)
+	expectReply(t, client, "-ERR syntax error\r\n", "BGSAVE", "LATER")
+
+	// Another save is in progress.
+	persistence.mu.Lock()
+	persistence.saveInProgress = true
+	persistence.mu.Unlock()
+	expectReply(t, client, "-ERR Background save already in progress\r\n", "BGSAVE")
+	expectReply(t, client, "+Background saving scheduled\r\n", "BGSAVE", "SCHEDULE")
+	checkSavePoints(time.Now())
+	expectPersistenceInfo(t, "rdb_bgsave_in_progress:0")
+
+	persistence.mu.Lock()
+	persistence.saveInProgress = false
+	saves := persistence.saves
+	persistence.mu.Unlock()
+	checkSavePoints(time.Now())
+	waitForBgsave(t)
+	expectPersistenceInfo(t, fmt.Sprintf("rdb_saves:%d", saves+1))
+	persistence.mu.Lock()
+	scheduled := persistence.bgsaveScheduled
+	persistence.mu.Unlock()
+	if scheduled {
+		t.Errorf("Expected the scheduled save to have started")
+	}
+
+	expectReply(t, client, "+Background saving started\r\n", "BGSAVE", "SCHEDULE")
+	waitForBgsave(t)
+}
+
+func TestPersistenceInfo(t *testing.T) {
+	useTestDir(t)
+	usePersistenceState(t)
+	client, _ := newTestClient(t)
+	before := time.Now().Unix()
+	run(t, client, "SET", "key", "value")
+
+	persistence.mu.Lock()
+	saves := persistence.saves
+	persistence.bgsaveInProgress = true
+	persistence.bgsaveStart = time.Now()
+	persistence.mu.Unlock()
+	expectPersistenceInfo(t, "rdb_bgsave_in_progress:1", "rdb_current_bgsave_time_sec:0")
+	persistence.mu.Lock()
+	persistence.bgsaveInProgress = false
+	persistence.mu.Unlock()
+
+	expectReply(t, client, "+Background saving started\r\n", "BGSAVE")
+	waitForBgsave(t)
+	expectPersistenceInfo(t, "rdb_bgsave_in_progress:0", "rdb_current_bgsave_time_sec:-1",
+		"rdb_last_bgsave_time_sec:0", "rdb_changes_since_last_save:0", fmt.Sprintf("rdb_saves:%d", saves+1))
+	if lastSave := run(t, client, "LASTSAVE"); lastSave < fmt.Sprintf(":%d", before) {
+		t.Errorf("Expected LASTSAVE to be at least %d, Got %q", before, lastSave)
+	}
+}
+
+// expectPersistenceInfo fails the test unless INFO persistence holds fields.
+func expectPersistenceInfo(t *testing.T, fields ...string) {
+	t.Helper()
+	info := persistenceInfo()
+	for _, field := range fields {
+		if !strings.Contains(info, field+"\n") {
+			t.Errorf("Expected INFO persistence to hold %s, Got %q", field, info)
+		}
+	}
+}
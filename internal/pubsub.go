@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// invalidationChannel is the channel RESP2 clients subscribe to for the
+// invalidation messages of the clients that redirect their tracking to them.
+const invalidationChannel = "__redis__:invalidate"
+
+type pubsubState struct {
+	mu sync.Mutex
+	// channels maps a channel to the clients subscribed to it, and
+	// subscriptions maps a client id to the channels it is subscribed to.
+	channels      map[string]map[int64]*Client
+	subscriptions map[int64]map[string]bool
+}
+
+var pubsub = pubsubState{
+	channels:      make(map[string]map[int64]*Client),
+	subscriptions: make(map[int64]map[string]bool),
+}
+
+// pubsubContextCommands are the commands a RESP2 client may run while it is
+// subscribed, since anything else it receives is a message.
+var pubsubContextCommands = map[string]bool{
+	"SUBSCRIBE":   true,
+	"UNSUBSCRIBE": true,
+	"PING":        true,
+}
+
+// pubsubCheckCommand returns the error to reply with when a subscribed RESP2
+// client runs a command outside of the Pub/Sub context, or an empty string
+// when it may run it.
+func pubsubCheckCommand(client *Client, command string) string {
+	if pubsubContextCommands[command] || subscriptionCount(client) == 0 {
+		return ""
+	}
+	clients.mu.Lock()
+	protocol := client.protocol
+	clients.mu.Unlock()
+	if protocol == 3 {
+		return ""
+	}
+	return fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", strings.ToLower(command))
+}
+
+func subscriptionCount(client *Client) int {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	return len(pubsub.subscriptions[client.Id])
+}
+
+func isSubscribed(client *Client, channel string) bool {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	return pubsub.subscriptions[client.Id][channel]
+}
+
+func handleSubscribe(client *Client, args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return encodeSimpleError("ERR wrong number of arguments for 'subscribe' command"), nil
+	}
+
+	resp := ""
+	for _, arg := range args {
+		channel, _ := arg.(string)
+		pubsub.mu.Lock()
+		if pubsub.channels[channel] == nil {
+			pubsub.channels[channel] = make(map[int64]*Client)
+		}
+		pubsub.channels[channel][client.Id] = client
+		if pubsub.subscriptions[client.Id] == nil {
+			pubsub.subscriptions[client.Id] = make(map[string]bool)
+		}
+		pubsub.subscriptions[client.Id][channel] = true
+		count := len(pubsub.subscriptions[client.Id])
+		pubsub.mu.Unlock()
+
+		reply, err := encodePubsubMessage(client, []interface{}{"subscribe", channel, count})
+		if err != nil {
+			return "", err
+		}
+		resp += reply
+	}
+	return resp, nil
+}
+
+// handleUnsubscribe unsubscribes from the given channels, or from all of
+// them without arguments.
+func handleUnsubscribe(client *Client, args []interface{}) (string, error) {
+	var channels []string
+	for _, arg := range args {
+		channel, _ := arg.(string)
+		channels = append(channels, channel)
+	}
+	if len(channels) == 0 {
+		pubsub.mu.Lock()
+		for channel := range pubsub.subscriptions[client.Id] {
+			channels = append(channels, channel)
+		}
+		pubsub.mu.Unlock()
+		sort.Strings(channels)
+	}
+	if len(channels) == 0 {
+		return encodePubsubMessage(client, []interface{}{"unsubscribe", nil, 0})
+	}
+
+	resp := ""
+	for _, channel := range channels {
+		pubsub.mu.Lock()
+		unsubscribe(client.Id, channel)
+		count := len(pubsub.subscriptions[client.Id])
+		pubsub.mu.Unlock()
+
+		reply, err := encodePubsubMessage(client, []interface{}{"unsubscribe", channel, count})
+		if err != nil {
+			return "", err
+		}
+		resp += reply
+	}
+	return resp, nil
+}
+
+// unsubscribe removes a client from a channel. The caller must hold
+// pubsub.mu.
+func unsubscribe(id int64, channel string) {
+	delete(pubsub.channels[channel], id)
+	if len(pubsub.channels[channel]) == 0 {
+		delete(pubsub.channels, channel)
+	}
+	delete(pubsub.subscriptions[id], channel)
+	if len(pubsub.subscriptions[id]) == 0 {
+		delete(pubsub.subscriptions, id)
+	}
+}
+
+// unsubscribeAll drops the subscriptions of a client that disconnected.
+func unsubscribeAll(client *Client) {
+	pubsub.mu.Lock()
+	defer pubsub.mu.Unlock()
+	for channel := range pubsub.subscriptions[client.Id] {
+		unsubscribe(client.Id, channel)
+	}
+}
+
+func handlePublish(args []interface{}) (string, error) {
+	if len(args) != 2 {
+		return encodeSimpleError("ERR wrong number of arguments for 'publish' command"), nil
+	}
+	channel, _ := args[0].(string)
+	message, _ := args[1].(string)
+	return encodeInteger(publish(channel, message)), nil
+}
+
+// publish sends message to the clients subscribed to channel and returns how
+// many there are.
+func publish(channel string, message interface{}) int {
+	pubsub.mu.Lock()
+	var receivers []*Client
+	for _, client := range pubsub.channels[channel] {
+		receivers = append(receivers, client)
+	}
+	pubsub.mu.Unlock()
+
+	for _, client := range receivers {
+		sendPubsubMessage(client, channel, message)
+	}
+	return len(receivers)
+}
+
+// sendPubsubMessage writes a message received on channel to a subscribed
+// client, out of band for RESP3 clients.
+func sendPubsubMessage(client *Client, channel string, message interface{}) {
+	encoded, err := encodePubsubMessage(client, []interface{}{"message", channel, message})
+	if err != nil {
+		fmt.Println("Failed to encode Pub/Sub message: ", err)
+		return
+	}
+	client.writePush(encoded)
+}
+
+func encodePubsubMessage(client *Client, message []interface{}) (string, error) {
+	clients.mu.Lock()
+	protocol := client.protocol
+	clients.mu.Unlock()
+	if protocol == 3 {
+		return encodePush(message)
+	}
+	return encodeArray(message)
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestPubsub(t *testing.T) {
+	useTestDir(t)
+	subscriber, subscriberConn := newTestClient(t)
+	publisher, _ := newTestClient(t)
+
+	expectReply(t, subscriber, "*3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$6\r\nsports\r\n:2\r\n", "SUBSCRIBE", "news", "sports")
+	expectReply(t, publisher, ":1\r\n", "PUBLISH", "news", "hello")
+	expectReply(t, publisher, ":0\r\n", "PUBLISH", "weather", "rain")
+	if written := subscriberConn.takeWritten(); written != "*3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n" {
+		t.Errorf("Expected the message on news, Got %q", written)
+	}
+
+	// A subscribed RESP2 client only reads messages.
+	expectReply(t, subscriber, "-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n", "GET", "key")
+	expectReply(t, subscriber, "*2\r\n$4\r\npong\r\n$0\r\n\r\n", "PING")
+
+	expectReply(t, subscriber, "*3\r\n$11\r\nunsubscribe\r\n$4\r\nnews\r\n:1\r\n", "UNSUBSCRIBE", "news")
+	expectReply(t, subscriber, "*3\r\n$11\r\nunsubscribe\r\n$6\r\nsports\r\n:0\r\n", "UNSUBSCRIBE")
+	expectReply(t, subscriber, "*3\r\n$11\r\nunsubscribe\r\n$-1\r\n:0\r\n", "UNSUBSCRIBE")
+	expectReply(t, subscriber, "$-1\r\n", "GET", "key")
+	expectReply(t, subscriber, "+PONG\r\n", "PING")
+}
+
+func TestPubsubResp3(t *testing.T) {
+	useTestDir(t)
+	subscriber, subscriberConn := newTestClient(t)
+	publisher, _ := newTestClient(t)
+	run(t, subscriber, "HELLO", "3")
+
+	expectReply(t, subscriber, ">3\r\n$9\r\nsubscribe\r\n$4\r\nnews\r\n:1\r\n", "SUBSCRIBE", "news")
+	// RESP3 tells messages and replies apart, so any command can be run.
+	expectReply(t, subscriber, "$-1\r\n", "GET", "key")
+	expectReply(t, publisher, ":1\r\n", "PUBLISH", "news", "hello")
+	if written := subscriberConn.takeWritten(); written != ">3\r\n$7\r\nmessage\r\n$4\r\nnews\r\n$5\r\nhello\r\n" {
+		t.Errorf("Expected the message on news as push data, Got %q", written)
+	}
+
+	// A client that disconnected is no longer subscribed.
+	UnregisterClient(subscriber)
+	expectReply(t, publisher, ":0\r\n", "PUBLISH", "news", "hello")
+}
+
+func TestPubsubAcl(t *testing.T) {
+	useTestDir(t)
+	useTestAcl(t)
+	admin, _ := newTestClient(t)
+	expectReply(t, admin, "+OK\r\n", "ACL", "SETUSER", "reader", "on", "nopass", "&news:*", "+@pubsub", "+auth")
+	client, _ := newTestClient(t)
+	expectReply(t, client, "+OK\r\n", "AUTH", "reader", "any")
+
+	expectReply(t, client, "-NOPERM No permissions to access a channel\r\n", "SUBSCRIBE", "news:today", "sports")
+	expectReply(t, client, "-NOPERM No permissions to access a channel\r\n", "PUBLISH", "sports", "goal")
+	expectReply(t, client, "*3\r\n$9\r\nsubscribe\r\n$10\r\nnews:today\r\n:1\r\n", "SUBSCRIBE", "news:today")
+	expectReply(t, admin, "$61\r\nUser reader has no permissions to access the 'sports' channel\r\n", "ACL", "DRYRUN", "reader", "PUBLISH", "sports", "goal")
+}
@@ -5,28 +5,279 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"hash/crc64"
 	"io"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
 
 	lzf "github.com/zhuyie/golzf"
 )
 
+const (
+	// rdbVersion is the version written in the header of saved files, the
+	// one of Redis 7.2 which introduced the listpack encoding of sets. Files
+	// holding hash field expiries are written as rdbMaxVersion instead.
+	rdbVersion = 11
+	// rdbMaxVersion is the newest version ParseRdbFile can load, the one
+	// written by Redis 7.4.
+	rdbMaxVersion = 12
+)
+
 func initialiseRDBFile(isTemp bool) (*os.File, error) {
 	fileName := Config["dbfilename"]
+	if isTemp {
+		fileName = fmt.Sprintf("temp-%d.rdb", os.Getpid())
+	}
 	fileDir := Config["dir"]
 	filePath := filepath.Join(fileDir, fileName)
 
-	os.MkdirAll(fileDir, 0755)
-	file, _ := os.Create(filePath)
-	file.Write([]byte("REDIS0007"))
+	if err := os.MkdirAll(fileDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create rdb directory %s: %v", fileDir, err)
+	}
+	return createRdbFile(filePath)
+}
+
+// createRdbFile creates filePath for an rdb file.
+func createRdbFile(filePath string) (*os.File, error) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rdb file %s: %v", filePath, err)
+	}
 	return file, nil
 }
 
-func addKeyValueToRdbFile(file *os.File, key string, value interface{}, expiryTime uint64, expiryInMilliseconds bool) error {
-	file.Seek(0, io.SeekEnd)
+// rdbOutput buffers an rdb file on its way to w and computes its checksum,
+// so it can be written to sockets as well as files.
+type rdbOutput struct {
+	writer   *bufio.Writer
+	checksum crc64Writer
+}
+
+func newRdbOutput(w io.Writer) *rdbOutput {
+	return &rdbOutput{writer: bufio.NewWriterSize(w, 64*1024)}
+}
+
+func (o *rdbOutput) Write(data []byte) (int, error) {
+	o.checksum.Write(data)
+	return o.writer.Write(data)
+}
+
+// rdbValueVersion returns the oldest rdb version able to hold value.
+func rdbValueVersion(value interface{}) int {
+	if hash, ok := value.(HashFieldExpiryValue); ok && len(hash.Expiries) > 0 {
+		return rdbMaxVersion
+	}
+	return rdbVersion
+}
+
+// writeRdbHeader writes the magic string, the version and the aux fields
+// every rdb file starts with.
+func writeRdbHeader(out *rdbOutput, version int) error {
+	if _, err := out.Write([]byte(fmt.Sprintf("REDIS%04d", version))); err != nil {
+		return fmt.Errorf("failed to write rdb header: %v", err)
+	}
+	if err := addAuxFieldToRdbFile(out, "redis-bits", int(64)); err != nil {
+		return err
+	}
+	return addAuxFieldToRdbFile(out, "ctime", int(time.Now().Unix()))
+}
+
+// finaliseRDBFile flushes a temp rdb file to disk and atomically renames it
+// over dbfilename, so a crash never leaves a partially written snapshot in
+// place of the previous one.
+func finaliseRDBFile(file *os.File) error {
+	tempPath := file.Name()
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to fsync rdb file %s: %v", tempPath, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to close rdb file %s: %v", tempPath, err)
+	}
+
+	filePath := filepath.Join(Config["dir"], Config["dbfilename"])
+	if err := os.Rename(tempPath, filePath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename rdb file %s to %s: %v", tempPath, filePath, err)
+	}
+	return syncDir(Config["dir"])
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to open directory %s to fsync it: %v", dirPath, err)
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync directory %s: %v", dirPath, err)
+	}
+	return nil
+}
+
+// writeRdbFile saves a snapshot of the keyspace to dbfilename, and returns
+// the saved file opened for reading. Opened before the rename, the handle
+// keeps reading this snapshot even once a later save replaced dbfilename.
+func writeRdbFile(snapshot keyspaceSnapshot) (*os.File, error) {
+	rdbFile, err := initialiseRDBFile(true)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeRdbSnapshot(rdbFile, snapshot); err != nil {
+		rdbFile.Close()
+		os.Remove(rdbFile.Name())
+		return nil, err
+	}
+	saved, err := os.Open(rdbFile.Name())
+	if err != nil {
+		rdbFile.Close()
+		os.Remove(rdbFile.Name())
+		return nil, fmt.Errorf("failed to open rdb file %s for reading: %v", rdbFile.Name(), err)
+	}
+	if err := finaliseRDBFile(rdbFile); err != nil {
+		saved.Close()
+		return nil, err
+	}
+	return saved, nil
+}
+
+// writeRdbSnapshot writes a whole rdb file holding the snapshot to w.
+func writeRdbSnapshot(w io.Writer, snapshot keyspaceSnapshot) error {
+	items := snapshot.Items()
+	version := rdbVersion
+	for _, item := range items {
+		version = max(version, rdbValueVersion(item.Value))
+	}
+
+	out := newRdbOutput(w)
+	if err := writeRdbHeader(out, version); err != nil {
+		return err
+	}
+	if err := addDatabaseSelector(out, 0); err != nil {
+		return err
+	}
+	if err := addResizeDBInfo(out, snapshot.Size(), snapshot.ExpiryTableSize()); err != nil {
+		return err
+	}
+	for _, item := range items {
+		err := addKeyValueToRdbFile(out, item.Key, item.Value, uint64(item.ExpiryTime), item.TimeInMilliseconds)
+		if err != nil {
+			return fmt.Errorf("failed to add key %s value %s in rdb file: %v", item.Key, item.Value, err)
+		}
+	}
+	if err := addCheckSumToRdbFile(out); err != nil {
+		return err
+	}
+	return out.writer.Flush()
+}
+
+// RdbWriter builds an rdb file one key at a time, for tools that write rdb
+// files without going through the keyspace. Keys go to a temp file next to
+// the output, which only replaces it once the file is complete.
+type RdbWriter struct {
+	file     *os.File
+	out      *rdbOutput
+	filePath string
+	db       int
+	// version is the one the keys written so far need, which may be newer
+	// than the one in the header.
+	version int
+}
+
+// NewRdbWriter starts an rdb file to be saved as filePath, writing the rdb
+// header and aux fields.
+func NewRdbWriter(filePath string) (*RdbWriter, error) {
+	file, err := createRdbFile(filepath.Join(filepath.Dir(filePath), fmt.Sprintf("temp-%d.rdb", os.Getpid())))
+	if err != nil {
+		return nil, err
+	}
+	out := newRdbOutput(file)
+	if err := writeRdbHeader(out, rdbVersion); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &RdbWriter{file: file, out: out, filePath: filePath, db: -1, version: rdbVersion}, nil
+}
+
+// WriteEntry appends a key, preceded by a db selector when its db differs
+// from the previous key's.
+func (w *RdbWriter) WriteEntry(entry RdbEntry) error {
+	if entry.DB != w.db {
+		if err := addDatabaseSelector(w.out, entry.DB); err != nil {
+			return err
+		}
+		w.db = entry.DB
+	}
+	w.version = max(w.version, rdbValueVersion(entry.Value))
+	return addKeyValueToRdbFile(w.out, entry.Key, entry.Value, uint64(entry.ExpiryTime), entry.TimeInMilliseconds)
+}
+
+// Close ends the file with the EOF opcode and its checksum, and renames it
+// to the output path. The output is left alone when this fails.
+func (w *RdbWriter) Close() error {
+	err := addCheckSumToRdbFile(w.out)
+	if err == nil {
+		err = w.out.writer.Flush()
+	}
+	if err == nil && w.version != rdbVersion {
+		err = w.upgradeVersion()
+	}
+	if err == nil {
+		if err = w.file.Sync(); err != nil {
+			err = fmt.Errorf("failed to fsync rdb file %s: %v", w.file.Name(), err)
+		}
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to close rdb file %s: %v", w.file.Name(), err)
+	}
+	if err := os.Rename(w.file.Name(), w.filePath); err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to rename rdb file %s to %s: %v", w.file.Name(), w.filePath, err)
+	}
+	return nil
+}
+
+// Abort discards the keys written so far without touching the output.
+func (w *RdbWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// upgradeVersion rewrites the version in the header of the complete file
+// when one of its keys needs a newer one, along with the checksum.
+func (w *RdbWriter) upgradeVersion() error {
+	if _, err := w.file.WriteAt([]byte(fmt.Sprintf("%04d", w.version)), int64(len("REDIS"))); err != nil {
+		return fmt.Errorf("failed to update the version of rdb file %s: %v", w.file.Name(), err)
+	}
+	if Config["rdbchecksum"] != "yes" {
+		return nil
+	}
+	info, err := w.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat rdb file %s: %v", w.file.Name(), err)
+	}
+	var checksum crc64Writer
+	if _, err := io.Copy(&checksum, io.NewSectionReader(w.file, 0, info.Size()-8)); err != nil {
+		return fmt.Errorf("failed to read back rdb file %s: %v", w.file.Name(), err)
+	}
+	if _, err := w.file.WriteAt(binary.LittleEndian.AppendUint64(nil, checksum.crc), info.Size()-8); err != nil {
+		return fmt.Errorf("failed to update the checksum of rdb file %s: %v", w.file.Name(), err)
+	}
+	return nil
+}
+
+func addKeyValueToRdbFile(out *rdbOutput, key string, value interface{}, expiryTime uint64, expiryInMilliseconds bool) error {
 	encodedKey, err := encodeString(key)
 	if err != nil {
 		return fmt.Errorf("failed to encode key value - %s : %v", key, err)
@@ -46,7 +297,25 @@ func addKeyValueToRdbFile(file *os.File, key string, value interface{}, expiryTi
 		if err != nil {
 			return fmt.Errorf("failed to encode key value - %s : %v", value, err)
 		}
-
+	case ListValue:
+		valueType, encodedValue, err = encodeListValue(t)
+	case SetValue:
+		valueType, encodedValue, err = encodeSetValue(t)
+	case SortedSetValue:
+		valueType, encodedValue, err = encodeSortedSetValue(t)
+	case HashValue:
+		valueType, encodedValue, err = encodeHashValue(t)
+	case HashFieldExpiryValue:
+		valueType, encodedValue, err = encodeHashFieldExpiryValue(t)
+	case StreamValue:
+		valueType, encodedValue, err = encodeStreamValue(t)
+	case ModuleValue:
+		valueType, encodedValue, err = encodeModuleValue(t)
+	default:
+		return fmt.Errorf("unsupported value type %T for key %s", value, key)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode value of key %s: %v", key, err)
 	}
 
 	var buffer bytes.Buffer
@@ -73,12 +342,13 @@ func addKeyValueToRdbFile(file *os.File, key string, value interface{}, expiryTi
 	buffer.Write(encodedKey)
 	buffer.Write(encodedValue)
 
-	file.Write(buffer.Bytes())
+	if _, err := out.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("failed to write key %s to rdb file: %v", key, err)
+	}
 	return nil
 }
 
-func addAuxFieldToRdbFile(file *os.File, key string, value interface{}) error {
-	file.Seek(0, io.SeekEnd)
+func addAuxFieldToRdbFile(out *rdbOutput, key string, value interface{}) error {
 	encodedKey, err := encodeString(key)
 	if err != nil {
 		return fmt.Errorf("failed to encode key value - %s : %v", key, err)
@@ -105,12 +375,13 @@ func addAuxFieldToRdbFile(file *os.File, key string, value interface{}) error {
 	buffer.Write(encodedKey)
 	buffer.Write(encodedValue)
 
-	file.Write(buffer.Bytes())
+	if _, err := out.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("failed to write aux field %s to rdb file: %v", key, err)
+	}
 	return nil
 }
 
-func addDatabaseSelector(file *os.File, db int) error {
-	file.Seek(0, io.SeekEnd)
+func addDatabaseSelector(out *rdbOutput, db int) error {
 
 	encodedBytes, err := encodeLength(db, false, -1)
 	if err != nil {
@@ -123,13 +394,14 @@ func addDatabaseSelector(file *os.File, db int) error {
 	buffer.Write(encodedBytes)
 	// buffer.WriteString("\n")
 
-	file.Write(buffer.Bytes())
+	if _, err := out.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("failed to write db selector to rdb file: %v", err)
+	}
 
 	return nil
 }
 
-func addResizeDBInfo(file *os.File, tableSize int, expiryTableSize int) error {
-	file.Seek(0, io.SeekEnd)
+func addResizeDBInfo(out *rdbOutput, tableSize int, expiryTableSize int) error {
 
 	encodedTableSize, err := encodeLength(tableSize, false, -1)
 	if err != nil {
@@ -147,28 +419,30 @@ func addResizeDBInfo(file *os.File, tableSize int, expiryTableSize int) error {
 	buffer.Write(encodedTableSize)
 	buffer.Write(encodedExpiryTableSize)
 
-	file.Write(buffer.Bytes())
+	if _, err := out.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("failed to write resize db info to rdb file: %v", err)
+	}
 
 	return nil
 }
 
-func addCheckSumToRdbFile(file *os.File) error {
-	file.Seek(0, io.SeekEnd)
-
-	var encodedChecksum = make([]byte, 8)
-	_, _ = file.Seek(0, io.SeekStart)
-	data, _ := io.ReadAll(file)
-	table := crc64.MakeTable(crc64.ECMA)
-	checksum := crc64.Checksum(data, table)
-	binary.BigEndian.AppendUint64(encodedChecksum, checksum)
-	_, _ = file.Seek(0, io.SeekEnd)
-
+func addCheckSumToRdbFile(out *rdbOutput) error {
 	var buffer bytes.Buffer
 	startByte := 0xFF
 	buffer.Write([]byte{byte(startByte)})
+
+	var encodedChecksum = make([]byte, 8)
+	if Config["rdbchecksum"] == "yes" {
+		// The checksum covers every byte of the file up to and including the
+		// EOF opcode.
+		out.checksum.Write(buffer.Bytes())
+		binary.LittleEndian.PutUint64(encodedChecksum, out.checksum.crc)
+	}
 	buffer.Write(encodedChecksum)
 
-	file.Write(buffer.Bytes())
+	if _, err := out.writer.Write(buffer.Bytes()); err != nil {
+		return fmt.Errorf("failed to write checksum to rdb file: %v", err)
+	}
 
 	return nil
 }
@@ -209,25 +483,22 @@ func encodeList(list []interface{}) ([]byte, error) {
 }
 
 func getIntType(num int) (int, error) {
-
-	if num <= math.MaxInt8 {
+	switch {
+	case num >= math.MinInt8 && num <= math.MaxInt8:
 		return 0, nil
-	}
-	if num <= math.MaxInt16 {
+	case num >= math.MinInt16 && num <= math.MaxInt16:
 		return 1, nil
-	}
-	if num <= math.MaxInt32 {
+	case num >= math.MinInt32 && num <= math.MaxInt32:
 		return 2, nil
 	}
-
-	return 0, fmt.Errorf("error: number too large to be encoded as integer")
+	return -1, fmt.Errorf("error: number %d too large to be encoded as integer", num)
 }
 
 func encodeIntegerAsString(num int) ([]byte, error) {
-
 	numType, err := getIntType(num)
-	if numType < 0 || numType > 2 {
-		return nil, fmt.Errorf("error: number type should be between (0-2) got: %v", err)
+	if err != nil {
+		// Integers beyond 32 bits are saved as their decimal string.
+		return encodeRawString(strconv.Itoa(num))
 	}
 
 	encodedLength, err := encodeLength(-1, true, numType)
@@ -250,7 +521,26 @@ func encodeIntegerAsString(num int) ([]byte, error) {
 	return encodedByte, nil
 }
 
+// encodeString saves strings holding a 32 bit integer as that integer and,
+// with rdbcompression, LZF compresses strings longer than 20 bytes when that
+// makes them smaller, as Redis does.
 func encodeString(input string) ([]byte, error) {
+	if len(input) <= 11 {
+		if num, err := strconv.Atoi(input); err == nil && strconv.Itoa(num) == input {
+			if _, err := getIntType(num); err == nil {
+				return encodeIntegerAsString(num)
+			}
+		}
+	}
+	if Config["rdbcompression"] == "yes" && len(input) > 20 {
+		if encoded, ok := encodeLzfString(input); ok {
+			return encoded, nil
+		}
+	}
+	return encodeRawString(input)
+}
+
+func encodeRawString(input string) ([]byte, error) {
 	encodedLength, err := encodeLength(len(input), false, -1)
 	if err != nil {
 		return nil, fmt.Errorf("filed to encode string length: %v", err)
@@ -260,9 +550,23 @@ func encodeString(input string) ([]byte, error) {
 	return encodedBytes, nil
 }
 
+// encodeLzfString compresses input, reporting false when that would not
+// save at least 4 bytes.
+func encodeLzfString(input string) ([]byte, bool) {
+	compressed := make([]byte, len(input)-4)
+	n, err := lzf.Compress([]byte(input), compressed)
+	if err != nil || n == 0 {
+		return nil, false
+	}
+	encoded, _ := encodeLength(-1, true, 3)
+	encoded = append(encoded, encodeUint(uint64(n))...)
+	encoded = append(encoded, encodeUint(uint64(len(input)))...)
+	return append(encoded, compressed[:n]...), true
+}
+
 func encodeLength(length int, isSpecialType bool, dataType int) ([]byte, error) {
-	if (length < 0 || length > 2147483648) && !isSpecialType {
-		return nil, fmt.Errorf("length must be in the range [0, 2^31 - 1]: %d", length)
+	if length < 0 && !isSpecialType {
+		return nil, fmt.Errorf("length must not be negative: %d", length)
 	}
 
 	if isSpecialType {
@@ -272,169 +576,332 @@ func encodeLength(length int, isSpecialType bool, dataType int) ([]byte, error)
 		encodedByte |= (1 << 7)
 		return []byte{encodedByte}, nil
 	}
+	return encodeUint(uint64(length)), nil
+}
 
-	if length <= 63 {
-		return []byte{byte(length)}, nil
+// encodeUint length encodes a number, using 1, 2, 5 or 9 bytes.
+func encodeUint(value uint64) []byte {
+	if value <= 63 {
+		return []byte{byte(value)}
 	}
 
-	if length <= 16383 {
+	if value <= 16383 {
 		var encodedBytes = make([]byte, 2)
-		binary.BigEndian.PutUint16(encodedBytes, uint16(length))
+		binary.BigEndian.PutUint16(encodedBytes, uint16(value))
 		encodedBytes[0] |= (1 << 6)
-		return encodedBytes, nil
+		return encodedBytes
 	}
 
-	var encodedBytes = make([]byte, 5)
-	binary.BigEndian.PutUint32(encodedBytes[1:], uint32(length))
-	encodedBytes[0] |= (1 << 7)
-	return encodedBytes, nil
+	if value <= math.MaxUint32 {
+		var encodedBytes = make([]byte, 5)
+		binary.BigEndian.PutUint32(encodedBytes[1:], uint32(value))
+		encodedBytes[0] = 0x80
+		return encodedBytes
+	}
+
+	var encodedBytes = make([]byte, 9)
+	binary.BigEndian.PutUint64(encodedBytes[1:], value)
+	encodedBytes[0] = 0x81
+	return encodedBytes
 }
 
-func ParseRdbFile(rdbFileName string) error {
-	file, _ := os.Open(rdbFileName)
-	defer file.Close()
+func configInt(name string) int {
+	value, _ := strconv.Atoi(Config[name])
+	return value
+}
 
-	reader := bufio.NewReaderSize(file, 4096)
-	headerBytes := make([]byte, 9)
-	reader.Read(headerBytes)
-	headerString := string(headerBytes)
-	magicString := headerString[0:5]
+// fitsListpack reports whether an aggregate is small enough for the listpack
+// encoding under the <prefix>-max-listpack-entries and -value limits.
+func fitsListpack(prefix string, count int, elements ...[]string) bool {
+	if count > configInt(prefix+"-max-listpack-entries") {
+		return false
+	}
+	maxValue := configInt(prefix + "-max-listpack-value")
+	for _, list := range elements {
+		for _, element := range list {
+			if len(element) > maxValue {
+				return false
+			}
+		}
+	}
+	return true
+}
 
-	if magicString != "REDIS" {
-		return fmt.Errorf("expected magin string 'REDIS' at the start of file")
+func appendStrings(encoded []byte, elements []string) ([]byte, error) {
+	for _, element := range elements {
+		encodedElement, err := encodeString(element)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, encodedElement...)
 	}
+	return encoded, nil
+}
 
-	for {
-		var expiryTimeStamp uint64
-		var expiryInMilliseconds bool
-		opCode, _ := reader.Peek(1)
+// encodeListValue saves a list as a quicklist of listpacks, each holding as
+// many elements as list-max-listpack-size allows: a count when positive,
+// or a size from 4kb for -1 to 64kb for -5.
+func encodeListValue(list ListValue) (uint8, []byte, error) {
+	maxEntries, maxBytes := configInt("list-max-listpack-size"), 0
+	if maxEntries <= 0 {
+		maxBytes = 4096 << min(max(-maxEntries-1, 0), 4)
+		maxEntries = 0
+	}
 
-		if opCode[0] == 0xFF {
-			reader.ReadByte()
-			break
+	var nodes [][]string
+	var node []string
+	nodeBytes := 0
+	for _, element := range list {
+		if len(node) > 0 && (maxEntries > 0 && len(node) >= maxEntries || maxBytes > 0 && nodeBytes+len(element) > maxBytes) {
+			nodes = append(nodes, node)
+			node, nodeBytes = nil, 0
 		}
+		node = append(node, element)
+		nodeBytes += len(element) + 2
+	}
+	if len(node) > 0 {
+		nodes = append(nodes, node)
+	}
 
-		if opCode[0] == 0xFA {
-			reader.ReadByte()
-			parseStringEncoding(reader) // key
-			parseStringEncoding(reader) // value
-			continue
+	encoded := encodeUint(uint64(len(nodes)))
+	for _, node := range nodes {
+		encoded = append(encoded, encodeUint(rdbQuicklistNodePacked)...)
+		encodedNode, err := encodeString(string(encodeListpack(node)))
+		if err != nil {
+			return 0, nil, err
 		}
+		encoded = append(encoded, encodedNode...)
+	}
+	return rdbTypeListQuicklist2, encoded, nil
+}
 
-		if opCode[0] == 0xFB {
-			reader.ReadByte()
-			parseLengthEncoding(reader) // HashTableSize
-			parseLengthEncoding(reader) // ExpiryTableSize
-			continue
+// encodeSetValue saves a set as an intset when all its members are
+// integers, as a listpack when it is small, and member by member otherwise.
+func encodeSetValue(set SetValue) (uint8, []byte, error) {
+	if len(set) <= configInt("set-max-intset-entries") {
+		if intset, ok := encodeIntset(set); ok {
+			encoded, err := encodeString(string(intset))
+			return rdbTypeSetIntset, encoded, err
 		}
+	}
+	if fitsListpack("set", len(set), set) {
+		encoded, err := encodeString(string(encodeListpack(set)))
+		return rdbTypeSetListpack, encoded, err
+	}
+	encoded, err := appendStrings(encodeUint(uint64(len(set))), set)
+	return rdbTypeSet, encoded, err
+}
 
-		if opCode[0] == 0xFE {
-			reader.ReadByte()
-			parseLengthEncoding(reader) // DB ID
-			continue
-		}
+// formatScore formats a score the way Redis stores it in a listpack.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
 
-		if opCode[0] == 0xFD {
-			// Set Expiry in seconds
-			reader.ReadByte()
-			var expiryBytes = make([]byte, 4)
-			reader.Read(expiryBytes)
-			expiryTimeStamp = uint64(binary.LittleEndian.Uint32(expiryBytes))
-			expiryInMilliseconds = false
+// encodeSortedSetValue saves a small sorted set as a listpack of members
+// and scores ordered by score, and a larger one with binary scores.
+func encodeSortedSetValue(zset SortedSetValue) (uint8, []byte, error) {
+	var members []string
+	for _, member := range zset {
+		members = append(members, member.Member)
+	}
+	if fitsListpack("zset", len(zset), members) {
+		sorted := append(SortedSetValue(nil), zset...)
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].Score != sorted[j].Score {
+				return sorted[i].Score < sorted[j].Score
+			}
+			return sorted[i].Member < sorted[j].Member
+		})
+		var elements []string
+		for _, member := range sorted {
+			elements = append(elements, member.Member, formatScore(member.Score))
 		}
+		encoded, err := encodeString(string(encodeListpack(elements)))
+		return rdbTypeZsetListpack, encoded, err
+	}
 
-		if opCode[0] == 0xFC {
-			// Set Expiry in ms
-			reader.ReadByte()
-			var expiryBytes = make([]byte, 8)
-			reader.Read(expiryBytes)
-			expiryTimeStamp = binary.LittleEndian.Uint64(expiryBytes)
-			expiryInMilliseconds = true
+	encoded := encodeUint(uint64(len(zset)))
+	for _, member := range zset {
+		encodedMember, err := encodeString(member.Member)
+		if err != nil {
+			return 0, nil, err
 		}
+		encoded = append(encoded, encodedMember...)
+		encoded = binary.LittleEndian.AppendUint64(encoded, math.Float64bits(member.Score))
+	}
+	return rdbTypeZset2, encoded, nil
+}
 
-		valueType, _ := reader.ReadByte()
-		parseValue := getValueParser(valueType)
-		key := parseStringEncoding(reader).(string)
-		value := parseValue(reader)
-		kvStore.Set(key, value, int64(expiryTimeStamp), expiryInMilliseconds)
+// encodeHashValue saves a small hash as a listpack of fields and values,
+// and a larger one field by field.
+func encodeHashValue(hash HashValue) (uint8, []byte, error) {
+	var fields, values []string
+	for field, value := range hash {
+		fields = append(fields, field)
+		values = append(values, value)
+	}
+	if fitsListpack("hash", len(hash), fields, values) {
+		var elements []string
+		for i := range fields {
+			elements = append(elements, fields[i], values[i])
+		}
+		encoded, err := encodeString(string(encodeListpack(elements)))
+		return rdbTypeHashListpack, encoded, err
+	}
 
+	encoded := encodeUint(uint64(len(hash)))
+	for i := range fields {
+		var err error
+		if encoded, err = appendStrings(encoded, []string{fields[i], values[i]}); err != nil {
+			return 0, nil, err
+		}
 	}
-	return nil
+	return rdbTypeHash, encoded, nil
 }
 
-func parseLengthEncoding(reader *bufio.Reader) (int, int) {
-	firstByte, _ := reader.ReadByte()
-	eigthBit := (firstByte & (1 << 7) >> 7)
-	seventhBit := (firstByte & (1 << 6) >> 6)
-	if eigthBit == 0 && seventhBit == 0 {
-		return int(firstByte), -1
-	}
-
-	if eigthBit == 0 && seventhBit == 1 {
-		firstByte = firstByte & 0b00111111
-		secondByte, _ := reader.ReadByte()
-		var length uint16
-		length = binary.LittleEndian.Uint16([]byte{firstByte, secondByte})
-		return int(length), -1
-	}
-
-	if eigthBit == 1 && seventhBit == 0 {
-		lengthBytes := make([]byte, 4)
-		reader.Read(lengthBytes)
-		var length uint32
-		length = binary.LittleEndian.Uint32(lengthBytes)
-		return int(length), -1
-	}
-
-	if eigthBit == 1 && seventhBit == 1 {
-		firstByte = firstByte & 0b00111111
-		switch int(firstByte) {
-		case 0:
-			return 1, -2
-		case 1:
-			return 2, -2
-		case 2:
-			return 4, -2
-		case 3:
-			clen, _ := parseLengthEncoding(reader)
-			uclen, _ := parseLengthEncoding(reader)
-			return clen, uclen
+// encodeHashFieldExpiryValue saves a hash with field expiries field by
+// field, each expiry relative to the smallest one and zero for none.
+func encodeHashFieldExpiryValue(hash HashFieldExpiryValue) (uint8, []byte, error) {
+	if len(hash.Expiries) == 0 {
+		return encodeHashValue(hash.Fields)
+	}
+	minExpiry := int64(math.MaxInt64)
+	for _, expiry := range hash.Expiries {
+		minExpiry = min(minExpiry, expiry)
+	}
+
+	encoded := binary.LittleEndian.AppendUint64(nil, uint64(minExpiry))
+	encoded = append(encoded, encodeUint(uint64(len(hash.Fields)))...)
+	for field, value := range hash.Fields {
+		ttl := uint64(0)
+		if expiry, exists := hash.Expiries[field]; exists {
+			ttl = uint64(expiry-minExpiry) + 1
+		}
+		encoded = append(encoded, encodeUint(ttl)...)
+		var err error
+		if encoded, err = appendStrings(encoded, []string{field, value}); err != nil {
+			return 0, nil, err
 		}
 	}
-	return -1, -1
+	return rdbTypeHashMetadata, encoded, nil
 }
 
-type parseFunType func(*bufio.Reader) interface{}
+func appendStreamID(encoded []byte, id StreamID) []byte {
+	encoded = append(encoded, encodeUint(id.Ms)...)
+	return append(encoded, encodeUint(id.Seq)...)
+}
 
-func getValueParser(valueType byte) parseFunType {
-	return []parseFunType{
-		parseStringEncoding,
-	}[int(valueType)]
+func appendRawStreamID(encoded []byte, id StreamID) []byte {
+	encoded = binary.BigEndian.AppendUint64(encoded, id.Ms)
+	return binary.BigEndian.AppendUint64(encoded, id.Seq)
 }
 
-func parseStringEncoding(reader *bufio.Reader) interface{} {
-	length, uclen := parseLengthEncoding(reader)
-	if uclen == -1 {
-		valueBytes := make([]byte, length)
-		reader.Read(valueBytes)
-		return string(valueBytes)
+// streamNodeMaxEntries is the number of entries of each listpack of a
+// stream, the default of stream-node-max-entries.
+const streamNodeMaxEntries = 100
+
+// encodeStreamValue saves a stream in the format of Redis 7.2, with its
+// entries in listpacks keyed by the ID of their first entry.
+func encodeStreamValue(stream StreamValue) (uint8, []byte, error) {
+	nodes := (len(stream.Entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	encoded := encodeUint(uint64(nodes))
+	for start := 0; start < len(stream.Entries); start += streamNodeMaxEntries {
+		entries := stream.Entries[start:min(start+streamNodeMaxEntries, len(stream.Entries))]
+		listpack, err := encodeStreamListpack(entries)
+		if err != nil {
+			return 0, nil, err
+		}
+		if encoded, err = appendStrings(encoded, []string{string(appendRawStreamID(nil, entries[0].ID)), string(listpack)}); err != nil {
+			return 0, nil, err
+		}
 	}
 
-	if uclen == -2 {
-		valueBytes := make([]byte, length)
-		reader.Read(valueBytes)
-		switch length {
-		case 1:
-			return int(valueBytes[0])
-		case 2:
-			return int(binary.LittleEndian.Uint16(valueBytes))
-		case 4:
-			return int(binary.LittleEndian.Uint32(valueBytes))
+	encoded = append(encoded, encodeUint(stream.Length)...)
+	encoded = appendStreamID(encoded, stream.LastID)
+	encoded = appendStreamID(encoded, stream.FirstID)
+	encoded = appendStreamID(encoded, stream.MaxDeletedID)
+	encoded = append(encoded, encodeUint(stream.EntriesAdded)...)
+
+	encoded = append(encoded, encodeUint(uint64(len(stream.Groups)))...)
+	for _, group := range stream.Groups {
+		var err error
+		if encoded, err = appendStrings(encoded, []string{group.Name}); err != nil {
+			return 0, nil, err
+		}
+		encoded = appendStreamID(encoded, group.LastID)
+		encoded = append(encoded, encodeUint(uint64(group.EntriesRead))...)
+
+		encoded = append(encoded, encodeUint(uint64(len(group.Pending)))...)
+		for _, pending := range group.Pending {
+			encoded = appendRawStreamID(encoded, pending.ID)
+			encoded = binary.LittleEndian.AppendUint64(encoded, uint64(pending.DeliveryTime))
+			encoded = append(encoded, encodeUint(pending.DeliveryCount)...)
+		}
+
+		encoded = append(encoded, encodeUint(uint64(len(group.Consumers)))...)
+		for _, consumer := range group.Consumers {
+			if encoded, err = appendStrings(encoded, []string{consumer.Name}); err != nil {
+				return 0, nil, err
+			}
+			encoded = binary.LittleEndian.AppendUint64(encoded, uint64(consumer.SeenTime))
+			activeTime := consumer.ActiveTime
+			if activeTime < 0 {
+				activeTime = consumer.SeenTime
+			}
+			encoded = binary.LittleEndian.AppendUint64(encoded, uint64(activeTime))
+
+			var pending []StreamID
+			for _, entry := range group.Pending {
+				if entry.Consumer == consumer.Name {
+					pending = append(pending, entry.ID)
+				}
+			}
+			encoded = append(encoded, encodeUint(uint64(len(pending)))...)
+			for _, id := range pending {
+				encoded = appendRawStreamID(encoded, id)
+			}
 		}
 	}
+	return rdbTypeStreamListpacks3, encoded, nil
+}
 
-	valueBytes := make([]byte, length)
-	unCompressedValue := make([]byte, uclen)
-	lzf.Decompress(valueBytes, unCompressedValue)
-	return unCompressedValue
+// encodeModuleValue saves a module value in the self-describing format it
+// was read in.
+func encodeModuleValue(value ModuleValue) (uint8, []byte, error) {
+	id, err := moduleID(value.Module, value.Version)
+	if err != nil {
+		return 0, nil, err
+	}
+	encoded := encodeUint(id)
+	for _, field := range value.Data {
+		switch t := field.(type) {
+		case int64:
+			encoded = append(encoded, encodeUint(rdbModuleOpcodeSint)...)
+			encoded = append(encoded, encodeUint(uint64(t))...)
+		case uint64:
+			encoded = append(encoded, encodeUint(rdbModuleOpcodeUint)...)
+			encoded = append(encoded, encodeUint(t)...)
+		case float32:
+			encoded = append(encoded, encodeUint(rdbModuleOpcodeFloat)...)
+			encoded = binary.LittleEndian.AppendUint32(encoded, math.Float32bits(t))
+		case float64:
+			encoded = append(encoded, encodeUint(rdbModuleOpcodeDouble)...)
+			encoded = binary.LittleEndian.AppendUint64(encoded, math.Float64bits(t))
+		case string:
+			encoded = append(encoded, encodeUint(rdbModuleOpcodeString)...)
+			if encoded, err = appendStrings(encoded, []string{t}); err != nil {
+				return 0, nil, err
+			}
+		default:
+			return 0, nil, fmt.Errorf("unsupported module data %T", field)
+		}
+	}
+	encoded = append(encoded, encodeUint(rdbModuleOpcodeEOF)...)
+	return rdbTypeModule2, encoded, nil
 }
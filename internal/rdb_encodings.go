@@ -0,0 +1,612 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// Small aggregates are stored in rdb files as a single string holding one
+// of the compact encodings Redis uses in memory: ziplists, listpacks,
+// intsets and zipmaps. The decoders below check every length against the
+// data they are given, so a corrupt blob is reported as an error.
+
+var errCompactTruncated = errors.New("unexpected end of encoded data")
+
+// compactReader walks through the bytes of a compact encoding.
+type compactReader struct {
+	data []byte
+	pos  int
+}
+
+func (c *compactReader) next(n int) ([]byte, error) {
+	if n < 0 || n > len(c.data)-c.pos {
+		return nil, errCompactTruncated
+	}
+	b := c.data[c.pos : c.pos+n]
+	c.pos += n
+	return b, nil
+}
+
+func (c *compactReader) byte() (byte, error) {
+	b, err := c.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// littleEndianInt decodes a signed little endian integer of 1 to 8 bytes.
+func littleEndianInt(b []byte) int64 {
+	var value uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		value = value<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(value<<shift) >> shift
+}
+
+// decodeListpack returns the elements of a listpack, with integers
+// formatted as decimal strings.
+func decodeListpack(data []byte) ([]string, error) {
+	c := &compactReader{data: data}
+	header, err := c.next(6)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listpack header: %w", err)
+	}
+	if int(binary.LittleEndian.Uint32(header)) != len(data) {
+		return nil, fmt.Errorf("listpack size %d does not match its header %d", len(data), binary.LittleEndian.Uint32(header))
+	}
+	count := int(binary.LittleEndian.Uint16(header[4:]))
+
+	var elements []string
+	for {
+		start := c.pos
+		first, err := c.byte()
+		if err != nil {
+			return nil, fmt.Errorf("listpack has no terminator: %w", err)
+		}
+		if first == 0xFF {
+			break
+		}
+
+		var element string
+		switch {
+		case first&0x80 == 0:
+			element = strconv.Itoa(int(first & 0x7F))
+		case first&0xC0 == 0x80:
+			b, err := c.next(int(first & 0x3F))
+			if err != nil {
+				return nil, err
+			}
+			element = string(b)
+		case first&0xE0 == 0xC0:
+			b, err := c.byte()
+			if err != nil {
+				return nil, err
+			}
+			value := int(first&0x1F)<<8 | int(b)
+			if value >= 1<<12 {
+				value -= 1 << 13
+			}
+			element = strconv.Itoa(value)
+		case first&0xF0 == 0xE0:
+			b, err := c.byte()
+			if err != nil {
+				return nil, err
+			}
+			s, err := c.next(int(first&0x0F)<<8 | int(b))
+			if err != nil {
+				return nil, err
+			}
+			element = string(s)
+		case first == 0xF0:
+			b, err := c.next(4)
+			if err != nil {
+				return nil, err
+			}
+			s, err := c.next(int(binary.LittleEndian.Uint32(b)))
+			if err != nil {
+				return nil, err
+			}
+			element = string(s)
+		case first >= 0xF1 && first <= 0xF4:
+			sizes := map[byte]int{0xF1: 2, 0xF2: 3, 0xF3: 4, 0xF4: 8}
+			b, err := c.next(sizes[first])
+			if err != nil {
+				return nil, err
+			}
+			element = strconv.FormatInt(littleEndianInt(b), 10)
+		default:
+			return nil, fmt.Errorf("invalid listpack encoding 0x%02X at offset %d", first, start)
+		}
+
+		// Every element ends with its own length, encoded in 1 to 5 bytes.
+		if _, err := c.next(listpackBacklenSize(c.pos - start)); err != nil {
+			return nil, err
+		}
+		elements = append(elements, element)
+	}
+
+	if c.pos != len(data) {
+		return nil, fmt.Errorf("listpack has %d bytes after its terminator", len(data)-c.pos)
+	}
+	if count != 0xFFFF && count != len(elements) {
+		return nil, fmt.Errorf("listpack has %d elements, its header says %d", len(elements), count)
+	}
+	return elements, nil
+}
+
+func listpackBacklenSize(length int) int {
+	switch {
+	case length <= 127:
+		return 1
+	case length < 16383:
+		return 2
+	case length < 2097151:
+		return 3
+	case length < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
+
+// decodeZiplist returns the elements of a ziplist, the encoding listpacks
+// replaced in Redis 7.
+func decodeZiplist(data []byte) ([]string, error) {
+	c := &compactReader{data: data}
+	header, err := c.next(10)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ziplist header: %w", err)
+	}
+	if int(binary.LittleEndian.Uint32(header)) != len(data) {
+		return nil, fmt.Errorf("ziplist size %d does not match its header %d", len(data), binary.LittleEndian.Uint32(header))
+	}
+	count := int(binary.LittleEndian.Uint16(header[8:]))
+
+	var elements []string
+	for {
+		first, err := c.byte()
+		if err != nil {
+			return nil, fmt.Errorf("ziplist has no terminator: %w", err)
+		}
+		if first == 0xFF {
+			break
+		}
+		// The length of the previous entry, one byte or 0xFE and four bytes.
+		if first == 0xFE {
+			if _, err := c.next(4); err != nil {
+				return nil, err
+			}
+		}
+
+		encoding, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		var element string
+		switch encoding >> 6 {
+		case 0:
+			b, err := c.next(int(encoding & 0x3F))
+			if err != nil {
+				return nil, err
+			}
+			element = string(b)
+		case 1:
+			b, err := c.byte()
+			if err != nil {
+				return nil, err
+			}
+			s, err := c.next(int(encoding&0x3F)<<8 | int(b))
+			if err != nil {
+				return nil, err
+			}
+			element = string(s)
+		case 2:
+			if encoding != 0x80 {
+				return nil, fmt.Errorf("invalid ziplist encoding 0x%02X", encoding)
+			}
+			b, err := c.next(4)
+			if err != nil {
+				return nil, err
+			}
+			s, err := c.next(int(binary.BigEndian.Uint32(b)))
+			if err != nil {
+				return nil, err
+			}
+			element = string(s)
+		default:
+			sizes := map[byte]int{0xC0: 2, 0xD0: 4, 0xE0: 8, 0xF0: 3, 0xFE: 1}
+			if size, exists := sizes[encoding]; exists {
+				b, err := c.next(size)
+				if err != nil {
+					return nil, err
+				}
+				element = strconv.FormatInt(littleEndianInt(b), 10)
+			} else if encoding >= 0xF1 && encoding <= 0xFD {
+				element = strconv.Itoa(int(encoding&0x0F) - 1)
+			} else {
+				return nil, fmt.Errorf("invalid ziplist encoding 0x%02X", encoding)
+			}
+		}
+		elements = append(elements, element)
+	}
+
+	if c.pos != len(data) {
+		return nil, fmt.Errorf("ziplist has %d bytes after its terminator", len(data)-c.pos)
+	}
+	if count != 0xFFFF && count != len(elements) {
+		return nil, fmt.Errorf("ziplist has %d elements, its header says %d", len(elements), count)
+	}
+	return elements, nil
+}
+
+// decodeIntset returns the members of an intset as decimal strings.
+func decodeIntset(data []byte) ([]string, error) {
+	c := &compactReader{data: data}
+	header, err := c.next(8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid intset header: %w", err)
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	if size != 2 && size != 4 && size != 8 {
+		return nil, fmt.Errorf("invalid intset encoding %d", size)
+	}
+	count := int(binary.LittleEndian.Uint32(header[4:]))
+	if count*size != len(data)-8 {
+		return nil, fmt.Errorf("intset of %d bytes cannot hold %d integers of %d bytes", len(data), count, size)
+	}
+
+	members := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		b, _ := c.next(size)
+		members = append(members, strconv.FormatInt(littleEndianInt(b), 10))
+	}
+	return members, nil
+}
+
+// decodeZipmap returns the fields of a hash stored as a zipmap, the
+// encoding used for small hashes before Redis 2.6.
+func decodeZipmap(data []byte) (HashValue, error) {
+	c := &compactReader{data: data}
+	if _, err := c.byte(); err != nil {
+		return nil, fmt.Errorf("invalid zipmap header: %w", err)
+	}
+
+	readLength := func() (int, bool, error) {
+		first, err := c.byte()
+		if err != nil {
+			return 0, false, err
+		}
+		switch first {
+		case 0xFF:
+			return 0, true, nil
+		case 0xFE:
+			b, err := c.next(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return int(binary.LittleEndian.Uint32(b)), false, nil
+		}
+		return int(first), false, nil
+	}
+
+	hash := make(HashValue)
+	for {
+		length, end, err := readLength()
+		if err != nil {
+			return nil, fmt.Errorf("zipmap has no terminator: %w", err)
+		}
+		if end {
+			break
+		}
+		field, err := c.next(length)
+		if err != nil {
+			return nil, err
+		}
+		length, end, err = readLength()
+		if err != nil || end {
+			return nil, fmt.Errorf("zipmap field %s has no value", field)
+		}
+		free, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		value, err := c.next(length)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.next(int(free)); err != nil {
+			return nil, err
+		}
+		hash[string(field)] = string(value)
+	}
+	if c.pos != len(data) {
+		return nil, fmt.Errorf("zipmap has %d bytes after its terminator", len(data)-c.pos)
+	}
+	return hash, nil
+}
+
+// pairsToHash builds a hash from alternating fields and values.
+func pairsToHash(elements []string) (HashValue, error) {
+	if len(elements)%2 != 0 {
+		return nil, fmt.Errorf("hash has a field without a value")
+	}
+	hash := make(HashValue, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		hash[elements[i]] = elements[i+1]
+	}
+	return hash, nil
+}
+
+// pairsToSortedSet builds a sorted set from alternating members and scores.
+func pairsToSortedSet(elements []string) (SortedSetValue, error) {
+	if len(elements)%2 != 0 {
+		return nil, fmt.Errorf("sorted set has a member without a score")
+	}
+	zset := make(SortedSetValue, 0, len(elements)/2)
+	for i := 0; i < len(elements); i += 2 {
+		score, err := strconv.ParseFloat(elements[i+1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score %s of member %s", elements[i+1], elements[i])
+		}
+		zset = append(zset, SortedSetMember{Member: elements[i], Score: score})
+	}
+	return zset, nil
+}
+
+// Flags of the entries of a stream listpack.
+const (
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// decodeStreamListpack returns the live entries of one listpack of a stream.
+// The listpack starts with a master entry whose fields the other entries can
+// share, and the IDs of the entries are stored relative to master.
+func decodeStreamListpack(master StreamID, data []byte) ([]StreamEntry, error) {
+	elements, err := decodeListpack(data)
+	if err != nil {
+		return nil, err
+	}
+	position := 0
+	next := func() (string, error) {
+		if position >= len(elements) {
+			return "", errCompactTruncated
+		}
+		position++
+		return elements[position-1], nil
+	}
+	nextInt := func() (int64, error) {
+		element, err := next()
+		if err != nil {
+			return 0, err
+		}
+		value, err := strconv.ParseInt(element, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected an integer in stream listpack, got %q", element)
+		}
+		return value, nil
+	}
+
+	// The master entry: live count, deleted count, the master fields and a
+	// zero terminator.
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	if _, err := nextInt(); err != nil {
+		return nil, err
+	}
+	fieldCount, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	if fieldCount < 0 || fieldCount > int64(len(elements)) {
+		return nil, fmt.Errorf("invalid stream master field count %d", fieldCount)
+	}
+	masterFields := make([]string, fieldCount)
+	for i := range masterFields {
+		if masterFields[i], err = next(); err != nil {
+			return nil, err
+		}
+	}
+	if terminator, err := nextInt(); err != nil || terminator != 0 {
+		return nil, fmt.Errorf("stream master entry is not terminated")
+	}
+
+	var entries []StreamEntry
+	for position < len(elements) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		entry := StreamEntry{ID: StreamID{Ms: master.Ms + uint64(msDiff), Seq: master.Seq + uint64(seqDiff)}}
+
+		if flags&streamItemFlagSameFields != 0 {
+			for _, field := range masterFields {
+				value, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, field, value)
+			}
+		} else {
+			count, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			if count < 0 || count > int64(len(elements)) {
+				return nil, fmt.Errorf("invalid stream entry field count %d", count)
+			}
+			for i := int64(0); i < 2*count; i++ {
+				element, err := next()
+				if err != nil {
+					return nil, err
+				}
+				entry.Fields = append(entry.Fields, element)
+			}
+		}
+		// The number of listpack elements of the entry, to walk it backwards.
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// canonicalInt parses s when it is the canonical decimal form of an int64,
+// the only strings compact encodings store as integers.
+func canonicalInt(s string) (int64, bool) {
+	if len(s) == 0 || len(s) > 20 {
+		return 0, false
+	}
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(value, 10) != s {
+		return 0, false
+	}
+	return value, true
+}
+
+// encodeListpack builds a listpack holding elements, storing the ones that
+// are integers in the smallest integer encoding that fits them.
+func encodeListpack(elements []string) []byte {
+	data := make([]byte, 6)
+	for _, element := range elements {
+		start := len(data)
+		if value, ok := canonicalInt(element); ok {
+			switch {
+			case value >= 0 && value <= 127:
+				data = append(data, byte(value))
+			case value >= -4096 && value <= 4095:
+				encoded := uint16(value) & 0x1FFF
+				data = append(data, 0xC0|byte(encoded>>8), byte(encoded))
+			case value >= math.MinInt16 && value <= math.MaxInt16:
+				data = append(data, 0xF1)
+				data = binary.LittleEndian.AppendUint16(data, uint16(value))
+			case value >= -1<<23 && value < 1<<23:
+				data = append(data, 0xF2, byte(value), byte(value>>8), byte(value>>16))
+			case value >= math.MinInt32 && value <= math.MaxInt32:
+				data = append(data, 0xF3)
+				data = binary.LittleEndian.AppendUint32(data, uint32(value))
+			default:
+				data = append(data, 0xF4)
+				data = binary.LittleEndian.AppendUint64(data, uint64(value))
+			}
+		} else {
+			switch length := len(element); {
+			case length < 64:
+				data = append(data, 0x80|byte(length))
+			case length < 4096:
+				data = append(data, 0xE0|byte(length>>8), byte(length))
+			default:
+				data = append(data, 0xF0)
+				data = binary.LittleEndian.AppendUint32(data, uint32(length))
+			}
+			data = append(data, element...)
+		}
+
+		// The length of the element, most significant 7 bits first, with
+		// the high bit set on all but the first byte.
+		length := len(data) - start
+		size := listpackBacklenSize(length)
+		data = append(data, byte(length>>(7*(size-1))))
+		for i := size - 2; i >= 0; i-- {
+			data = append(data, byte(length>>(7*i))&127|128)
+		}
+	}
+	data = append(data, 0xFF)
+
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	binary.LittleEndian.PutUint16(data[4:], uint16(min(len(elements), 0xFFFF)))
+	return data
+}
+
+// encodeIntset builds an intset of members, reporting false when one of
+// them is not an integer.
+func encodeIntset(members []string) ([]byte, bool) {
+	values := make([]int64, 0, len(members))
+	size := 2
+	for _, member := range members {
+		value, ok := canonicalInt(member)
+		if !ok {
+			return nil, false
+		}
+		if value < math.MinInt32 || value > math.MaxInt32 {
+			size = 8
+		} else if (value < math.MinInt16 || value > math.MaxInt16) && size < 4 {
+			size = 4
+		}
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	data := binary.LittleEndian.AppendUint32(nil, uint32(size))
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(values)))
+	for _, value := range values {
+		switch size {
+		case 2:
+			data = binary.LittleEndian.AppendUint16(data, uint16(value))
+		case 4:
+			data = binary.LittleEndian.AppendUint32(data, uint32(value))
+		default:
+			data = binary.LittleEndian.AppendUint64(data, uint64(value))
+		}
+	}
+	return data, true
+}
+
+// encodeStreamListpack builds the listpack of a stream node. Its master
+// entry is the first entry, whose fields the entries with the same fields
+// share.
+func encodeStreamListpack(entries []StreamEntry) ([]byte, error) {
+	master := entries[0]
+	var masterFields []string
+	for i := 0; i < len(master.Fields); i += 2 {
+		masterFields = append(masterFields, master.Fields[i])
+	}
+
+	itoa := func(value int64) string { return strconv.FormatInt(value, 10) }
+	elements := []string{itoa(int64(len(entries))), "0", itoa(int64(len(masterFields)))}
+	elements = append(elements, masterFields...)
+	elements = append(elements, "0")
+
+	for _, entry := range entries {
+		if len(entry.Fields)%2 != 0 {
+			return nil, fmt.Errorf("stream entry %s has a field without a value", entry.ID)
+		}
+		sameFields := len(entry.Fields) == 2*len(masterFields)
+		for i := 0; sameFields && i < len(masterFields); i++ {
+			sameFields = entry.Fields[2*i] == masterFields[i]
+		}
+
+		msDiff := itoa(int64(entry.ID.Ms - master.ID.Ms))
+		seqDiff := itoa(int64(entry.ID.Seq - master.ID.Seq))
+		if sameFields {
+			elements = append(elements, itoa(streamItemFlagSameFields), msDiff, seqDiff)
+			for i := 1; i < len(entry.Fields); i += 2 {
+				elements = append(elements, entry.Fields[i])
+			}
+			elements = append(elements, itoa(int64(len(masterFields)+3)))
+		} else {
+			elements = append(elements, "0", msDiff, seqDiff, itoa(int64(len(entry.Fields)/2)))
+			elements = append(elements, entry.Fields...)
+			elements = append(elements, itoa(int64(len(entry.Fields)+4)))
+		}
+	}
+	return encodeListpack(elements), nil
+}
@@ -0,0 +1,616 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	lzf "github.com/zhuyie/golzf"
+)
+
+// Opcodes that introduce the sections of an rdb file other than keys.
+const (
+	rdbOpcodeSlotInfo     = 0xF4
+	rdbOpcodeFunction2    = 0xF5
+	rdbOpcodeFunctionPre  = 0xF6
+	rdbOpcodeModuleAux    = 0xF7
+	rdbOpcodeIdle         = 0xF8
+	rdbOpcodeFreq         = 0xF9
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeExpireTime   = 0xFD
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+)
+
+// Value types, each naming a data type and the way it is encoded.
+const (
+	rdbTypeString            = 0
+	rdbTypeList              = 1
+	rdbTypeSet               = 2
+	rdbTypeZset              = 3
+	rdbTypeHash              = 4
+	rdbTypeZset2             = 5
+	rdbTypeModulePre         = 6
+	rdbTypeModule2           = 7
+	rdbTypeHashZipmap        = 9
+	rdbTypeListZiplist       = 10
+	rdbTypeSetIntset         = 11
+	rdbTypeZsetZiplist       = 12
+	rdbTypeHashZiplist       = 13
+	rdbTypeListQuicklist     = 14
+	rdbTypeStreamListpacks   = 15
+	rdbTypeHashListpack      = 16
+	rdbTypeZsetListpack      = 17
+	rdbTypeListQuicklist2    = 18
+	rdbTypeStreamListpacks2  = 19
+	rdbTypeSetListpack       = 20
+	rdbTypeStreamListpacks3  = 21
+	rdbTypeHashMetadataPre   = 22
+	rdbTypeHashListpackExPre = 23
+	rdbTypeHashMetadata      = 24
+	rdbTypeHashListpackEx    = 25
+)
+
+// Containers of the nodes of a quicklist: a single large element or a
+// listpack of small ones.
+const (
+	rdbQuicklistNodePlain  = 1
+	rdbQuicklistNodePacked = 2
+)
+
+// Opcodes of the self-describing format modules save their values in.
+const (
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+)
+
+// rdbMaxStringLength bounds the strings read from an rdb file, so a corrupt
+// length cannot make the parser allocate arbitrary amounts of memory.
+const rdbMaxStringLength = 512 << 20
+
+var rdbTypeNames = map[byte]string{
+	0: "string", 1: "list", 2: "set", 3: "zset", 4: "hash", 5: "zset",
+	6: "module", 7: "module", 9: "hash", 10: "list", 11: "set", 12: "zset",
+	13: "hash", 14: "list", 15: "stream", 16: "hash", 17: "zset", 18: "list",
+	19: "stream", 20: "set", 21: "stream", 22: "hash", 23: "hash", 24: "hash",
+	25: "hash",
+}
+
+// RdbTypeName returns the name of the data type stored by an rdb value type.
+func RdbTypeName(valueType byte) string {
+	if name, exists := rdbTypeNames[valueType]; exists {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", valueType)
+}
+
+var rdbOpcodeNames = map[int]string{
+	rdbOpcodeSlotInfo:     "SLOT_INFO",
+	rdbOpcodeFunction2:    "FUNCTION2",
+	rdbOpcodeFunctionPre:  "FUNCTION_PRE_GA",
+	rdbOpcodeModuleAux:    "MODULE_AUX",
+	rdbOpcodeIdle:         "IDLE",
+	rdbOpcodeFreq:         "FREQ",
+	rdbOpcodeAux:          "AUX",
+	rdbOpcodeResizeDB:     "RESIZEDB",
+	rdbOpcodeExpireTimeMs: "EXPIRETIME_MS",
+	rdbOpcodeExpireTime:   "EXPIRETIME",
+	rdbOpcodeSelectDB:     "SELECTDB",
+	rdbOpcodeEOF:          "EOF",
+}
+
+// RdbOpcodeName describes the byte that starts a record of an rdb file,
+// either an opcode or the value type of a key.
+func RdbOpcodeName(opcode int) string {
+	if name, exists := rdbOpcodeNames[opcode]; exists {
+		return name
+	}
+	return "value type " + RdbTypeName(byte(opcode))
+}
+
+// RdbEntry is a key read from an rdb file. ExpiryTime is zero for keys
+// without a TTL. Idle and Freq hold the LRU idle time in seconds and the
+// LFU counter when the file records them, and are -1 otherwise.
+//
+// Strings are read as a string, or an int when integer encoded. The other
+// data types are read as a ListValue, SetValue, SortedSetValue, HashValue,
+// HashFieldExpiryValue, StreamValue or ModuleValue, whatever their encoding.
+type RdbEntry struct {
+	DB                 int
+	Key                string
+	Type               byte
+	Value              interface{}
+	ExpiryTime         int64
+	TimeInMilliseconds bool
+	Idle               int64
+	Freq               int
+}
+
+// RdbVisitor receives the contents of an rdb file in the order ParseRdb
+// reads them. Returning an error stops the parse.
+type RdbVisitor interface {
+	Header(version int) error
+	Aux(key string, value string) error
+	ModuleAux(value ModuleValue) error
+	// Function receives the code of a library of functions.
+	Function(code string) error
+	SelectDB(db int) error
+	ResizeDB(dbSize int, expiresSize int) error
+	// SlotInfo receives the sizes of a cluster slot in the db.
+	SlotInfo(slot int, size int, expiresSize int) error
+	Entry(entry RdbEntry) error
+	// End is called at the EOF opcode with the checksum stored after it,
+	// zero when the file was written without one.
+	End(checksum uint64) error
+}
+
+// RdbError reports where in an rdb file parsing failed: the offset of the
+// record being read and the opcode or value type that started it, -1 while
+// reading the header.
+type RdbError struct {
+	Offset int64
+	Opcode int
+	Err    error
+}
+
+func (e *RdbError) Error() string {
+	if e.Opcode < 0 {
+		return fmt.Sprintf("rdb error at offset %d: %v", e.Offset, e.Err)
+	}
+	return fmt.Sprintf("rdb error at offset %d (opcode 0x%02X): %v", e.Offset, e.Opcode, e.Err)
+}
+
+func (e *RdbError) Unwrap() error {
+	return e.Err
+}
+
+// rdbReader tracks the offset and the running checksum of the bytes read.
+type rdbReader struct {
+	reader *bufio.Reader
+	offset int64
+	crc    uint64
+}
+
+func (r *rdbReader) readByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == io.EOF {
+		// Files only end cleanly before the opcode of a record, which
+		// ParseRdb checks for itself.
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return 0, err
+	}
+	r.offset++
+	r.crc = crc64Jones(r.crc, []byte{b})
+	return b, nil
+}
+
+func (r *rdbReader) readFull(length uint64) ([]byte, error) {
+	if length > rdbMaxStringLength {
+		return nil, fmt.Errorf("length %d is too large", length)
+	}
+	var buffer bytes.Buffer
+	n, err := io.CopyN(&buffer, r.reader, int64(length))
+	r.offset += n
+	r.crc = crc64Jones(r.crc, buffer.Bytes())
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buffer.Bytes(), err
+}
+
+// readLength reads a length encoded length. When encoded is true the
+// length is instead the format of a specially encoded string.
+func (r *rdbReader) readLength() (length uint64, encoded bool, err error) {
+	first, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		second, err := r.readByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(second), false, nil
+	case 2:
+		switch first {
+		case 0x80:
+			lengthBytes, err := r.readFull(4)
+			if err != nil {
+				return 0, false, err
+			}
+			return uint64(binary.BigEndian.Uint32(lengthBytes)), false, nil
+		case 0x81:
+			lengthBytes, err := r.readFull(8)
+			if err != nil {
+				return 0, false, err
+			}
+			return binary.BigEndian.Uint64(lengthBytes), false, nil
+		}
+		return 0, false, fmt.Errorf("unknown length encoding 0x%02X", first)
+	default:
+		return uint64(first & 0x3F), true, nil
+	}
+}
+
+func (r *rdbReader) readPlainLength() (int, error) {
+	length, encoded, err := r.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding %d where a length was expected", length)
+	}
+	if length > uint64(int(^uint(0)>>1)) {
+		return 0, fmt.Errorf("length %d is too large", length)
+	}
+	return int(length), nil
+}
+
+// readString reads a string. Integer encoded strings are returned as an int.
+func (r *rdbReader) readString() (interface{}, error) {
+	length, encoded, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		data, err := r.readFull(length)
+		if err != nil {
+			return nil, err
+		}
+		return string(data), nil
+	}
+
+	switch length {
+	case 0:
+		b, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		return int(int8(b)), nil
+	case 1:
+		data, err := r.readFull(2)
+		if err != nil {
+			return nil, err
+		}
+		return int(int16(binary.LittleEndian.Uint16(data))), nil
+	case 2:
+		data, err := r.readFull(4)
+		if err != nil {
+			return nil, err
+		}
+		return int(int32(binary.LittleEndian.Uint32(data))), nil
+	case 3:
+		compressedLength, err := r.readPlainLength()
+		if err != nil {
+			return nil, err
+		}
+		length, err := r.readPlainLength()
+		if err != nil {
+			return nil, err
+		}
+		if length > rdbMaxStringLength {
+			return nil, fmt.Errorf("compressed string length %d is too large", length)
+		}
+		compressed, err := r.readFull(uint64(compressedLength))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length)
+		n, err := lzf.Decompress(compressed, data)
+		if err != nil || n != length {
+			return nil, fmt.Errorf("invalid LZF compressed string")
+		}
+		return string(data), nil
+	}
+	return nil, fmt.Errorf("unknown string encoding %d", length)
+}
+
+// readStringValue reads a string, formatting integer encoded ones.
+func (r *rdbReader) readStringValue() (string, error) {
+	value, err := r.readString()
+	if err != nil {
+		return "", err
+	}
+	if number, ok := value.(int); ok {
+		return strconv.Itoa(number), nil
+	}
+	return value.(string), nil
+}
+
+func (r *rdbReader) readUint() (uint64, error) {
+	value, encoded, err := r.readLength()
+	if err != nil {
+		return 0, err
+	}
+	if encoded {
+		return 0, fmt.Errorf("unexpected string encoding %d where a number was expected", value)
+	}
+	return value, nil
+}
+
+func (r *rdbReader) readMillisecondTime() (int64, error) {
+	data, err := r.readFull(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+// readStrings reads a count followed by count*width strings.
+func (r *rdbReader) readStrings(width int) ([]string, error) {
+	count, err := r.readPlainLength()
+	if err != nil {
+		return nil, err
+	}
+	var elements []string
+	for i := 0; i < count; i++ {
+		for j := 0; j < width; j++ {
+			element, err := r.readStringValue()
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+	}
+	return elements, nil
+}
+
+func isKeyPrefix(opcode byte) bool {
+	switch opcode {
+	case rdbOpcodeExpireTime, rdbOpcodeExpireTimeMs, rdbOpcodeIdle, rdbOpcodeFreq:
+		return true
+	}
+	return false
+}
+
+// readKeyPrefix reads the data following an opcode that precedes a key.
+func (r *rdbReader) readKeyPrefix(entry *RdbEntry) error {
+	switch entry.Type {
+	case rdbOpcodeExpireTime:
+		expiry, err := r.readFull(4)
+		if err != nil {
+			return fmt.Errorf("failed to read expiry time: %w", err)
+		}
+		entry.ExpiryTime = int64(binary.LittleEndian.Uint32(expiry))
+		entry.TimeInMilliseconds = false
+	case rdbOpcodeExpireTimeMs:
+		expiry, err := r.readMillisecondTime()
+		if err != nil {
+			return fmt.Errorf("failed to read expiry time: %w", err)
+		}
+		entry.ExpiryTime = expiry
+		entry.TimeInMilliseconds = true
+	case rdbOpcodeIdle:
+		idle, err := r.readUint()
+		if err != nil {
+			return fmt.Errorf("failed to read idle time: %w", err)
+		}
+		entry.Idle = int64(idle)
+	case rdbOpcodeFreq:
+		freq, err := r.readByte()
+		if err != nil {
+			return fmt.Errorf("failed to read access frequency: %w", err)
+		}
+		entry.Freq = int(freq)
+	}
+	return nil
+}
+
+// ParseRdb reads an rdb file from reader, handing its contents to visitor.
+// With verifyChecksum the checksum at the end of the file is compared with
+// the one computed while reading, unless it was written as zero.
+func ParseRdb(reader io.Reader, visitor RdbVisitor, verifyChecksum bool) error {
+	r := &rdbReader{reader: bufio.NewReaderSize(reader, 64*1024)}
+
+	header, err := r.readFull(9)
+	if err != nil {
+		return &RdbError{Offset: 0, Opcode: -1, Err: fmt.Errorf("failed to read rdb header: %w", err)}
+	}
+	if string(header[:5]) != "REDIS" {
+		return &RdbError{Offset: 0, Opcode: -1, Err: fmt.Errorf("expected magic string 'REDIS' at the start of file")}
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 {
+		return &RdbError{Offset: 5, Opcode: -1, Err: fmt.Errorf("invalid rdb version %s", header[5:])}
+	}
+	if version > rdbMaxVersion {
+		return &RdbError{Offset: 5, Opcode: -1, Err: fmt.Errorf("can't handle RDB format version %d, the newest supported version is %d", version, rdbMaxVersion)}
+	}
+	if err := visitor.Header(version); err != nil {
+		return err
+	}
+
+	db := 0
+	for {
+		start := r.offset
+		opcode, err := r.readByte()
+		if err == io.ErrUnexpectedEOF && version < 5 {
+			// Files older than version 5 may end without an EOF opcode.
+			return visitor.End(0)
+		}
+		if err != nil {
+			return &RdbError{Offset: start, Opcode: -1, Err: fmt.Errorf("unexpected end of file, missing EOF opcode: %w", err)}
+		}
+		fail := func(err error) error {
+			return &RdbError{Offset: start, Opcode: int(opcode), Err: err}
+		}
+
+		switch opcode {
+		case rdbOpcodeEOF:
+			// Checksums were introduced with RDB version 5.
+			if version < 5 {
+				return visitor.End(0)
+			}
+			computed := r.crc
+			stored, err := r.readFull(8)
+			if err != nil {
+				return fail(fmt.Errorf("failed to read rdb checksum: %w", err))
+			}
+			checksum := binary.LittleEndian.Uint64(stored)
+			if verifyChecksum && checksum != 0 && checksum != computed {
+				return fail(fmt.Errorf("wrong RDB checksum expected: (%x) got: (%x)", checksum, computed))
+			}
+			return visitor.End(checksum)
+
+		case rdbOpcodeSelectDB:
+			db, err = r.readPlainLength()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read db number: %w", err))
+			}
+			if err := visitor.SelectDB(db); err != nil {
+				return err
+			}
+
+		case rdbOpcodeResizeDB:
+			dbSize, err := r.readPlainLength()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read db size: %w", err))
+			}
+			expiresSize, err := r.readPlainLength()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read expires size: %w", err))
+			}
+			if err := visitor.ResizeDB(dbSize, expiresSize); err != nil {
+				return err
+			}
+
+		case rdbOpcodeAux:
+			key, err := r.readString()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read aux field key: %w", err))
+			}
+			value, err := r.readString()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read aux field %v: %w", key, err))
+			}
+			if err := visitor.Aux(fmt.Sprint(key), fmt.Sprint(value)); err != nil {
+				return err
+			}
+
+		case rdbOpcodeModuleAux:
+			value, err := r.readModuleAux()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read module aux data: %w", err))
+			}
+			if err := visitor.ModuleAux(value); err != nil {
+				return err
+			}
+
+		case rdbOpcodeFunction2:
+			code, err := r.readStringValue()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read function library: %w", err))
+			}
+			if err := visitor.Function(code); err != nil {
+				return err
+			}
+
+		case rdbOpcodeFunctionPre:
+			return fail(fmt.Errorf("functions saved by a pre-release of Redis 7.0 are not supported"))
+
+		case rdbOpcodeSlotInfo:
+			var sizes [3]int
+			for i := range sizes {
+				if sizes[i], err = r.readPlainLength(); err != nil {
+					return fail(fmt.Errorf("failed to read slot info: %w", err))
+				}
+			}
+			if err := visitor.SlotInfo(sizes[0], sizes[1], sizes[2]); err != nil {
+				return err
+			}
+
+		default:
+			// A key, optionally preceded by its expiry and its LRU or LFU
+			// information.
+			entry := RdbEntry{DB: db, Type: opcode, Idle: -1, Freq: -1}
+			for isKeyPrefix(entry.Type) {
+				if err := r.readKeyPrefix(&entry); err != nil {
+					return fail(err)
+				}
+				if entry.Type, err = r.readByte(); err != nil {
+					return fail(fmt.Errorf("failed to read value type: %w", err))
+				}
+			}
+
+			key, err := r.readString()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read key: %w", err))
+			}
+			entry.Key = fmt.Sprint(key)
+			if entry.Value, err = r.readValue(entry.Type); err != nil {
+				return fail(fmt.Errorf("failed to read value of key %s: %w", entry.Key, err))
+			}
+			if err := visitor.Entry(entry); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// rdbLoader loads the keys of an rdb file into store. The server has a
+// single db: the keys of a file written for another db are loaded into it
+// with a warning, but a file with keys in several dbs is refused rather
+// than merged.
+type rdbLoader struct {
+	store *KeyValueStore
+	// db is the db of the keys loaded so far, -1 before the first key.
+	db int
+}
+
+func newRdbLoader(store *KeyValueStore) *rdbLoader {
+	return &rdbLoader{store: store, db: -1}
+}
+
+func (*rdbLoader) Header(version int) error                   { return nil }
+func (*rdbLoader) Aux(key string, value string) error         { return nil }
+func (*rdbLoader) ModuleAux(value ModuleValue) error          { return nil }
+func (*rdbLoader) Function(code string) error                 { return nil }
+func (*rdbLoader) SelectDB(db int) error                      { return nil }
+func (*rdbLoader) ResizeDB(dbSize int, expiresSize int) error { return nil }
+func (*rdbLoader) SlotInfo(slot, size, expiresSize int) error { return nil }
+func (*rdbLoader) End(checksum uint64) error                  { return nil }
+
+func (l *rdbLoader) Entry(entry RdbEntry) error {
+	if l.db < 0 {
+		l.db = entry.DB
+		if entry.DB != 0 {
+			fmt.Printf("Loading the keys of db %d into db 0, the only db of this server\n", entry.DB)
+		}
+	} else if entry.DB != l.db {
+		return fmt.Errorf("keys of db %d and db %d can't be loaded into the single db of this server", l.db, entry.DB)
+	}
+	// Strings saved as integers are still strings to clients.
+	if number, ok := entry.Value.(int); ok {
+		entry.Value = strconv.Itoa(number)
+	}
+	l.store.Set(entry.Key, entry.Value, entry.ExpiryTime, entry.TimeInMilliseconds)
+	return nil
+}
+
+func ParseRdbFile(rdbFileName string) error {
+	file, err := os.Open(rdbFileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := ParseRdb(file, newRdbLoader(&kvStore), Config["rdbchecksum"] == "yes"); err != nil {
+		return fmt.Errorf("failed to load %s: %w", rdbFileName, err)
+	}
+	return nil
+}
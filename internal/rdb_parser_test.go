@@ -0,0 +1,558 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The fixtures below are built byte by byte following the layout each
+// version of Redis writes, as documented in rdb.h and rdb.c, including the
+// compact encodings of small aggregates.
+
+// rdbFixture builds the contents of an rdb file.
+type rdbFixture struct {
+	version int
+	data    []byte
+}
+
+func newRdbFixture(version int) *rdbFixture {
+	return &rdbFixture{version: version, data: []byte(fmt.Sprintf("REDIS%04d", version))}
+}
+
+func (f *rdbFixture) bytes(b ...byte) *rdbFixture {
+	f.data = append(f.data, b...)
+	return f
+}
+
+func (f *rdbFixture) length(n int) *rdbFixture {
+	switch {
+	case n < 1<<6:
+		return f.bytes(byte(n))
+	case n < 1<<14:
+		return f.bytes(0x40|byte(n>>8), byte(n))
+	}
+	return f.bytes(0x80).bigEndian(4, uint64(n))
+}
+
+func (f *rdbFixture) str(s string) *rdbFixture {
+	return f.length(len(s)).bytes([]byte(s)...)
+}
+
+func (f *rdbFixture) littleEndian(size int, value uint64) *rdbFixture {
+	for i := 0; i < size; i++ {
+		f.bytes(byte(value >> (8 * i)))
+	}
+	return f
+}
+
+func (f *rdbFixture) bigEndian(size int, value uint64) *rdbFixture {
+	for i := size - 1; i >= 0; i-- {
+		f.bytes(byte(value >> (8 * i)))
+	}
+	return f
+}
+
+func (f *rdbFixture) aux(key, value string) *rdbFixture {
+	return f.bytes(rdbOpcodeAux).str(key).str(value)
+}
+
+func (f *rdbFixture) key(valueType byte, key string) *rdbFixture {
+	return f.bytes(valueType).str(key)
+}
+
+func (f *rdbFixture) moduleID(name string, version int) *rdbFixture {
+	id, err := moduleID(name, version)
+	if err != nil {
+		panic(err)
+	}
+	return f.bytes(0x81).bigEndian(8, id)
+}
+
+func (f *rdbFixture) offset() int64 {
+	return int64(len(f.data))
+}
+
+// end adds the EOF opcode, followed from version 5 on by the checksum.
+func (f *rdbFixture) end() []byte {
+	f.bytes(rdbOpcodeEOF)
+	if f.version >= 5 {
+		f.littleEndian(8, crc64Jones(0, f.data))
+	}
+	return f.data
+}
+
+// ziplist lays out entries, each an encoding followed by its data.
+func ziplist(entries ...[]byte) []byte {
+	data := make([]byte, 10)
+	tail, previous := 10, 0
+	for _, entry := range entries {
+		tail = len(data)
+		data = append(data, byte(previous))
+		data = append(data, entry...)
+		previous = 1 + len(entry)
+	}
+	data = append(data, 0xFF)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	binary.LittleEndian.PutUint32(data[4:], uint32(tail))
+	binary.LittleEndian.PutUint16(data[8:], uint16(len(entries)))
+	return data
+}
+
+func zipString(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+// zipInt encodes 0 to 12 in the encoding byte and others as an int16.
+func zipInt(n int) []byte {
+	if n >= 0 && n <= 12 {
+		return []byte{0xF1 + byte(n)}
+	}
+	return []byte{0xC0, byte(n), byte(n >> 8)}
+}
+
+// listpack lays out entries, each followed by its length.
+func listpack(entries ...[]byte) []byte {
+	data := make([]byte, 6)
+	for _, entry := range entries {
+		data = append(data, entry...)
+		data = append(data, byte(len(entry)))
+	}
+	data = append(data, 0xFF)
+	binary.LittleEndian.PutUint32(data, uint32(len(data)))
+	binary.LittleEndian.PutUint16(data[4:], uint16(len(entries)))
+	return data
+}
+
+func lpString(s string) []byte {
+	return append([]byte{0x80 | byte(len(s))}, s...)
+}
+
+// lpInt encodes 0 to 127 in 7 bits and others in 13 bits.
+func lpInt(n int) []byte {
+	if n >= 0 && n <= 127 {
+		return []byte{byte(n)}
+	}
+	return []byte{0xC0 | byte(n>>8)&0x1F, byte(n)}
+}
+
+func intset16(values ...int16) []byte {
+	data := binary.LittleEndian.AppendUint32(nil, 2)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(values)))
+	for _, value := range values {
+		data = binary.LittleEndian.AppendUint16(data, uint16(value))
+	}
+	return data
+}
+
+// zipmap lays out alternating fields and values, each value followed by a
+// free byte.
+func zipmap(pairs ...string) []byte {
+	data := []byte{byte(len(pairs) / 2)}
+	for i := 0; i < len(pairs); i += 2 {
+		data = append(data, byte(len(pairs[i])))
+		data = append(data, pairs[i]...)
+		data = append(data, byte(len(pairs[i+1])), 1)
+		data = append(data, pairs[i+1]...)
+		data = append(data, 0)
+	}
+	return append(data, 0xFF)
+}
+
+func rdbEntry(valueType byte, key string, value interface{}) RdbEntry {
+	return RdbEntry{Key: key, Type: valueType, Value: value, Idle: -1, Freq: -1}
+}
+
+func TestParseRdbVersions(t *testing.T) {
+	const expiry = 1893456000000
+	module := ModuleValue{Module: "mymodtype", Version: 3}
+
+	tests := []struct {
+		version   int
+		build     func(f *rdbFixture) []byte
+		entries   []RdbEntry
+		aux       map[string]string
+		modules   []ModuleValue
+		functions []string
+		slots     [][3]int
+	}{
+		{
+			// Redis 2.4: zipmaps, expiries in seconds and no EOF opcode.
+			version: 4,
+			build: func(f *rdbFixture) []byte {
+				f.bytes(rdbOpcodeSelectDB, 0)
+				f.bytes(rdbOpcodeExpireTime).littleEndian(4, expiry/1000).key(rdbTypeString, "seconds").str("v")
+				f.key(rdbTypeHashZipmap, "zipmap").str(string(zipmap("f1", "v1", "f2", "v22")))
+				return f.data
+			},
+			entries: []RdbEntry{
+				{Key: "seconds", Type: rdbTypeString, Value: "v", ExpiryTime: expiry / 1000, Idle: -1, Freq: -1},
+				rdbEntry(rdbTypeHashZipmap, "zipmap", HashValue{"f1": "v1", "f2": "v22"}),
+			},
+		},
+		{
+			// Redis 2.6 and 2.8: ziplists, intsets and integer encoded and
+			// LZF compressed strings.
+			version: 6,
+			build: func(f *rdbFixture) []byte {
+				f.bytes(rdbOpcodeSelectDB, 0)
+				f.bytes(rdbOpcodeExpireTimeMs).littleEndian(8, expiry).key(rdbTypeString, "lzf")
+				f.bytes(0xC3).length(7).length(12).bytes(0x02, 'a', 'b', 'c', 0xE0, 0x00, 0x02)
+				f.key(rdbTypeString, "int8").bytes(0xC0, 0x85)
+				f.key(rdbTypeString, "int16").bytes(0xC1).littleEndian(2, 12345)
+				f.key(rdbTypeString, "int32").bytes(0xC2).littleEndian(4, 0x12345678)
+				f.key(rdbTypeListZiplist, "list").str(string(ziplist(zipString("a"), zipInt(7), zipInt(-300))))
+				f.key(rdbTypeSetIntset, "set").str(string(intset16(-2, 3, 1000)))
+				f.key(rdbTypeZsetZiplist, "zset").str(string(ziplist(zipString("m1"), zipString("1.5"), zipString("m2"), zipInt(2))))
+				f.key(rdbTypeHashZiplist, "hash").str(string(ziplist(zipString("f1"), zipString("v1"), zipString("f2"), zipInt(12))))
+				f.key(rdbTypeZset, "zset-strings").length(2).str("a").str("1.5").str("b").bytes(254)
+				return f.end()
+			},
+			entries: []RdbEntry{
+				{Key: "lzf", Type: rdbTypeString, Value: "abcabcabcabc", ExpiryTime: expiry, TimeInMilliseconds: true, Idle: -1, Freq: -1},
+				rdbEntry(rdbTypeString, "int8", -123),
+				rdbEntry(rdbTypeString, "int16", 12345),
+				rdbEntry(rdbTypeString, "int32", 0x12345678),
+				rdbEntry(rdbTypeListZiplist, "list", ListValue{"a", "7", "-300"}),
+				rdbEntry(rdbTypeSetIntset, "set", SetValue{"-2", "3", "1000"}),
+				rdbEntry(rdbTypeZsetZiplist, "zset", SortedSetValue{{"m1", 1.5}, {"m2", 2}}),
+				rdbEntry(rdbTypeHashZiplist, "hash", HashValue{"f1": "v1", "f2": "12"}),
+				rdbEntry(rdbTypeZset, "zset-strings", SortedSetValue{{"a", 1.5}, {"b", math.Inf(1)}}),
+			},
+		},
+		{
+			// Redis 3.2: aux fields and quicklists of ziplists.
+			version: 7,
+			build: func(f *rdbFixture) []byte {
+				f.aux("redis-ver", "3.2.0")
+				f.bytes(rdbOpcodeAux).str("redis-bits").bytes(0xC0, 64)
+				f.bytes(rdbOpcodeSelectDB, 0, rdbOpcodeResizeDB, 2, 0)
+				f.key(rdbTypeListQuicklist, "quicklist").length(2)
+				f.str(string(ziplist(zipString("a"), zipString("b")))).str(string(ziplist(zipString("c"))))
+				f.key(rdbTypeList, "list").length(2).str("x").str("y")
+				return f.end()
+			},
+			entries: []RdbEntry{
+				rdbEntry(rdbTypeListQuicklist, "quicklist", ListValue{"a", "b", "c"}),
+				rdbEntry(rdbTypeList, "list", ListValue{"x", "y"}),
+			},
+			aux: map[string]string{"redis-ver": "3.2.0", "redis-bits": "64"},
+		},
+		{
+			// Redis 4.0: binary sorted set scores, LRU and LFU information and
+			// module values.
+			version: 8,
+			build: func(f *rdbFixture) []byte {
+				f.aux("redis-ver", "4.0.0")
+				f.bytes(rdbOpcodeSelectDB, 0)
+				f.bytes(rdbOpcodeIdle).length(100).key(rdbTypeString, "idle").str("v")
+				f.bytes(rdbOpcodeFreq, 5).key(rdbTypeString, "freq").str("v")
+				f.key(rdbTypeZset2, "zset").length(1).str("a").littleEndian(8, math.Float64bits(2.5))
+				f.key(rdbTypeHash, "hash").length(1).str("f").str("v")
+				f.key(rdbTypeModule2, "module").moduleID("mymodtype", 3)
+				f.bytes(rdbModuleOpcodeUint, 5, rdbModuleOpcodeString).str("x")
+				f.bytes(rdbModuleOpcodeDouble).littleEndian(8, math.Float64bits(1.5))
+				f.bytes(rdbModuleOpcodeFloat).littleEndian(4, uint64(math.Float32bits(0.25)))
+				f.bytes(rdbModuleOpcodeSint, 3, rdbModuleOpcodeEOF)
+				return f.end()
+			},
+			entries: []RdbEntry{
+				{Key: "idle", Type: rdbTypeString, Value: "v", Idle: 100, Freq: -1},
+				{Key: "freq", Type: rdbTypeString, Value: "v", Idle: -1, Freq: 5},
+				rdbEntry(rdbTypeZset2, "zset", SortedSetValue{{"a", 2.5}}),
+				rdbEntry(rdbTypeHash, "hash", HashValue{"f": "v"}),
+				rdbEntry(rdbTypeModule2, "module", ModuleValue{Module: "mymodtype", Version: 3, Data: []interface{}{uint64(5), "x", 1.5, float32(0.25), int64(3)}}),
+			},
+			aux: map[string]string{"redis-ver": "4.0.0"},
+		},
+		{
+			// Redis 5.0: the aux data of modules.
+			version: 9,
+			build: func(f *rdbFixture) []byte {
+				f.bytes(rdbOpcodeModuleAux).moduleID("mymodtype", 3)
+				f.bytes(rdbModuleOpcodeUint, 2, rdbModuleOpcodeString).str("aux").bytes(rdbModuleOpcodeEOF)
+				f.bytes(rdbOpcodeSelectDB, 0)
+				f.key(rdbTypeSet, "set").length(2).str("a").bytes(0xC0, 7)
+				return f.end()
+			},
+			entries: []RdbEntry{
+				rdbEntry(rdbTypeSet, "set", SetValue{"a", "7"}),
+			},
+			modules: []ModuleValue{{Module: module.Module, Version: module.Version, Data: []interface{}{"aux"}}},
+		},
+		{
+			// Redis 7.0: functions and listpacks.
+			version: 10,
+			build: func(f *rdbFixture) []byte {
+				f.bytes(rdbOpcodeFunction2).str("#!lua name=lib\nredis.register_function('f', function() return 1 end)")
+				f.bytes(rdbOpcodeSelectDB, 0)
+				f.key(rdbTypeHashListpack, "hash").str(string(listpack(lpString("f"), lpInt(1000))))
+				f.key(rdbTypeZsetListpack, "zset").str(string(listpack(lpString("a"), lpString("0.5"), lpString("b"), lpInt(-3))))
+				f.key(rdbTypeListQuicklist2, "list").length(2)
+				f.length(rdbQuicklistNodePacked).str(string(listpack(lpString("a"), lpInt(1))))
+				f.length(rdbQuicklistNodePlain).str("big")
+				return f.end()
+			},
+			entries: []RdbEntry{
+				rdbEntry(rdbTypeHashListpack, "hash", HashValue{"f": "1000"}),
+				rdbEntry(rdbTypeZsetListpack, "zset", SortedSetValue{{"a", 0.5}, {"b", -3}}),
+				rdbEntry(rdbTypeListQuicklist2, "list", ListValue{"a", "1", "big"}),
+			},
+			functions: []string{"#!lua name=lib\nredis.register_function('f', function() return 1 end)"},
+		},
+		{
+			// Redis 7.2: sets as listpacks.
+			version: 11,
+			build: func(f *rdbFixture) []byte {
+				f.bytes(rdbOpcodeSelectDB, 0)
+				f.key(rdbTypeSetListpack, "set").str(string(listpack(lpString("x"), lpInt(5))))
+				return f.end()
+			},
+			entries: []RdbEntry{
+				rdbEntry(rdbTypeSetListpack, "set", SetValue{"x", "5"}),
+			},
+		},
+		{
+			// Redis 7.4: slot info and hashes with field expiries.
+			version: 12,
+			build: func(f *rdbFixture) []byte {
+				f.bytes(rdbOpcodeSelectDB, 0, rdbOpcodeSlotInfo, 3, 2, 1)
+				f.key(rdbTypeHashMetadata, "metadata").littleEndian(8, expiry).length(2)
+				f.length(1).str("a").str("1")
+				f.length(0).str("b").str("2")
+				f.key(rdbTypeHashListpackEx, "listpack-ex").littleEndian(8, expiry)
+				f.str(string(listpack(lpString("f"), lpString("v"), lpString(fmt.Sprint(expiry)), lpString("g"), lpString("w"), lpInt(0))))
+				return f.end()
+			},
+			entries: []RdbEntry{
+				rdbEntry(rdbTypeHashMetadata, "metadata", HashFieldExpiryValue{Fields: HashValue{"a": "1", "b": "2"}, Expiries: map[string]int64{"a": expiry}}),
+				rdbEntry(rdbTypeHashListpackEx, "listpack-ex", HashFieldExpiryValue{Fields: HashValue{"f": "v", "g": "w"}, Expiries: map[string]int64{"f": expiry}}),
+			},
+			slots: [][3]int{{3, 2, 1}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("version %d", test.version), func(t *testing.T) {
+			data := test.build(newRdbFixture(test.version))
+			recorder := &rdbRecorder{}
+			if err := ParseRdb(bytes.NewReader(data), recorder, true); err != nil {
+				t.Fatalf("Failed to parse the rdb file: %v", err)
+			}
+			if recorder.version != test.version {
+				t.Errorf("Expected version %d, Got %d", test.version, recorder.version)
+			}
+			if !reflect.DeepEqual(recorder.entries, test.entries) {
+				t.Errorf("Expected entries %+v, Got %+v", test.entries, recorder.entries)
+			}
+			if test.aux == nil {
+				test.aux = map[string]string{}
+			}
+			if !reflect.DeepEqual(recorder.aux, test.aux) {
+				t.Errorf("Expected aux fields %v, Got %v", test.aux, recorder.aux)
+			}
+			if !reflect.DeepEqual(recorder.modules, test.modules) {
+				t.Errorf("Expected module aux data %v, Got %v", test.modules, recorder.modules)
+			}
+			if !reflect.DeepEqual(recorder.functions, test.functions) {
+				t.Errorf("Expected functions %q, Got %q", test.functions, recorder.functions)
+			}
+			if !reflect.DeepEqual(recorder.slots, test.slots) {
+				t.Errorf("Expected slot info %v, Got %v", test.slots, recorder.slots)
+			}
+		})
+	}
+}
+
+func TestParseRdbErrors(t *testing.T) {
+	// Each case returns a file and the offset of the record that breaks it.
+	tests := []struct {
+		name    string
+		build   func(f *rdbFixture) ([]byte, int64)
+		opcode  int
+		message string
+	}{
+		{"bad magic", func(f *rdbFixture) ([]byte, int64) {
+			return []byte("RODIS0010\xff"), 0
+		}, -1, "expected magic string"},
+		{"truncated header", func(f *rdbFixture) ([]byte, int64) {
+			return []byte("REDIS00"), 0
+		}, -1, "failed to read rdb header"},
+		{"bad version", func(f *rdbFixture) ([]byte, int64) {
+			return []byte("REDIS00x1\xff"), 5
+		}, -1, "invalid rdb version 00x1"},
+		{"newer version", func(f *rdbFixture) ([]byte, int64) {
+			return []byte("REDIS0013\xff"), 5
+		}, -1, "can't handle RDB format version 13"},
+		{"missing EOF opcode", func(f *rdbFixture) ([]byte, int64) {
+			f.key(rdbTypeString, "k").str("v")
+			return f.data, f.offset()
+		}, -1, "missing EOF opcode"},
+		{"truncated string", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.key(rdbTypeString, "k").length(10).bytes('a', 'b')
+			return f.data, offset
+		}, rdbTypeString, "failed to read value of key k: unexpected EOF"},
+		{"truncated expiry", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.bytes(rdbOpcodeExpireTimeMs, 1, 2, 3)
+			return f.data, offset
+		}, rdbOpcodeExpireTimeMs, "failed to read expiry time"},
+		{"unknown value type", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.key(0x1F, "k").str("v")
+			return f.end(), offset
+		}, 0x1F, "unsupported value type"},
+		{"ziplist size mismatch", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			zl := ziplist(zipString("a"))
+			zl[0]++
+			f.key(rdbTypeListZiplist, "k").str(string(zl))
+			return f.end(), offset
+		}, rdbTypeListZiplist, "does not match its header"},
+		{"ziplist count mismatch", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			zl := ziplist(zipString("a"), zipString("b"))
+			zl[8] = 3
+			f.key(rdbTypeHashZiplist, "k").str(string(zl))
+			return f.end(), offset
+		}, rdbTypeHashZiplist, "its header says 3"},
+		{"listpack without terminator", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			lp := listpack(lpString("a"))
+			lp = lp[:len(lp)-1]
+			binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+			f.key(rdbTypeSetListpack, "k").str(string(lp))
+			return f.end(), offset
+		}, rdbTypeSetListpack, "listpack has no terminator"},
+		{"listpack string overflowing", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			lp := listpack([]byte{0x85, 'a'})
+			f.key(rdbTypeHashListpack, "k").str(string(lp))
+			return f.end(), offset
+		}, rdbTypeHashListpack, "unexpected end of encoded data"},
+		{"intset too short", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			is := intset16(1, 2)
+			is[4] = 3
+			f.key(rdbTypeSetIntset, "k").str(string(is))
+			return f.end(), offset
+		}, rdbTypeSetIntset, "cannot hold 3 integers"},
+		{"zipmap field without value", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.key(rdbTypeHashZipmap, "k").str(string([]byte{1, 1, 'f', 0xFF}))
+			return f.end(), offset
+		}, rdbTypeHashZipmap, "zipmap field f has no value"},
+		{"invalid LZF data", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.key(rdbTypeString, "k").bytes(0xC3).length(3).length(12).bytes(0x02, 'a', 'b')
+			return f.end(), offset
+		}, rdbTypeString, "invalid LZF compressed string"},
+		{"invalid quicklist node", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.key(rdbTypeListQuicklist2, "k").length(1).length(3).str("x")
+			return f.end(), offset
+		}, rdbTypeListQuicklist2, "invalid quicklist node container 3"},
+		{"invalid module aux", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.bytes(rdbOpcodeModuleAux).moduleID("mymodtype", 3).bytes(rdbModuleOpcodeSint, 2, rdbModuleOpcodeEOF)
+			return f.end(), offset
+		}, rdbOpcodeModuleAux, "invalid module aux when opcode 1"},
+		{"unknown module opcode", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.key(rdbTypeModule2, "k").moduleID("mymodtype", 3).bytes(9)
+			return f.end(), offset
+		}, rdbTypeModule2, "unknown module opcode 9"},
+		{"pre-release functions", func(f *rdbFixture) ([]byte, int64) {
+			offset := f.offset()
+			f.bytes(rdbOpcodeFunctionPre).str("code")
+			return f.end(), offset
+		}, rdbOpcodeFunctionPre, "pre-release of Redis 7.0"},
+		{"wrong checksum", func(f *rdbFixture) ([]byte, int64) {
+			f.key(rdbTypeString, "k").str("v")
+			offset := f.offset()
+			data := f.end()
+			data[len(data)-1] ^= 0xFF
+			return data, offset
+		}, rdbOpcodeEOF, "wrong RDB checksum"},
+		{"truncated checksum", func(f *rdbFixture) ([]byte, int64) {
+			f.key(rdbTypeString, "k").str("v")
+			offset := f.offset()
+			data := f.end()
+			return data[:len(data)-3], offset
+		}, rdbOpcodeEOF, "failed to read rdb checksum"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newRdbFixture(10).aux("redis-ver", "7.0.0").bytes(rdbOpcodeSelectDB, 0)
+			data, offset := test.build(f)
+			err := ParseRdb(bytes.NewReader(data), &rdbRecorder{}, true)
+			var rdbErr *RdbError
+			if !errors.As(err, &rdbErr) {
+				t.Fatalf("Expected an RdbError, Got %v", err)
+			}
+			if rdbErr.Offset != offset || rdbErr.Opcode != test.opcode {
+				t.Errorf("Expected an error at offset %d with opcode %d, Got offset %d with opcode %d: %v", offset, test.opcode, rdbErr.Offset, rdbErr.Opcode, err)
+			}
+			if !strings.Contains(err.Error(), test.message) {
+				t.Errorf("Expected the error to mention %q, Got %q", test.message, err)
+			}
+		})
+	}
+}
+
+func TestParseTruncatedRdb(t *testing.T) {
+	f := newRdbFixture(10).aux("redis-ver", "7.0.0").bytes(rdbOpcodeSelectDB, 0)
+	f.bytes(rdbOpcodeExpireTimeMs).littleEndian(8, 1893456000000).key(rdbTypeString, "k").str("value")
+	f.key(rdbTypeHashListpack, "hash").str(string(listpack(lpString("f"), lpInt(1000))))
+	f.key(rdbTypeListQuicklist2, "list").length(1).length(rdbQuicklistNodePacked).str(string(listpack(lpString("a"))))
+	data := f.end()
+
+	// Cutting the file anywhere leaves a record, or the EOF opcode, unread.
+	for size := 0; size < len(data); size++ {
+		err := ParseRdb(bytes.NewReader(data[:size]), &rdbRecorder{}, true)
+		var rdbErr *RdbError
+		if !errors.As(err, &rdbErr) {
+			t.Fatalf("Expected an RdbError for the file cut at %d bytes, Got %v", size, err)
+		}
+		if size >= 9 && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Expected an unexpected EOF for the file cut at %d bytes, Got %v", size, err)
+		}
+	}
+	if err := ParseRdb(bytes.NewReader(data), &rdbRecorder{}, true); err != nil {
+		t.Fatalf("Failed to parse the whole file: %v", err)
+	}
+}
+
+func TestRdbLoaderDatabases(t *testing.T) {
+	dir := useTestDir(t)
+	path := filepath.Join(dir, "dump.rdb")
+
+	// Files written for another db are loaded into the only one there is.
+	f := newRdbFixture(11).bytes(rdbOpcodeSelectDB, 3).key(rdbTypeString, "a").str("1")
+	os.WriteFile(path, f.end(), 0644)
+	if err := ParseRdbFile(path); err != nil {
+		t.Fatalf("Failed to load the keys of db 3: %v", err)
+	}
+	expectValue(t, "a", "1")
+
+	// Keys of different dbs would be merged.
+	kvStore.flush()
+	f = newRdbFixture(11)
+	f.bytes(rdbOpcodeSelectDB, 0).key(rdbTypeString, "a").str("1")
+	f.bytes(rdbOpcodeSelectDB, 1).key(rdbTypeString, "a").str("2")
+	os.WriteFile(path, f.end(), 0644)
+	err := ParseRdbFile(path)
+	if err == nil || !strings.Contains(err.Error(), "keys of db 0 and db 1") {
+		t.Fatalf("Expected keys of several dbs to be refused, Got %v", err)
+	}
+}
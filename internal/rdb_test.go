@@ -0,0 +1,205 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rdbRecorder keeps everything ParseRdb hands to it.
+type rdbRecorder struct {
+	version   int
+	aux       map[string]string
+	modules   []ModuleValue
+	functions []string
+	dbs       []int
+	slots     [][3]int
+	entries   []RdbEntry
+	checksum  uint64
+}
+
+func (r *rdbRecorder) Header(version int) error {
+	r.version = version
+	r.aux = make(map[string]string)
+	return nil
+}
+func (r *rdbRecorder) Aux(key string, value string) error { r.aux[key] = value; return nil }
+func (r *rdbRecorder) ModuleAux(value ModuleValue) error {
+	r.modules = append(r.modules, value)
+	return nil
+}
+func (r *rdbRecorder) Function(code string) error {
+	r.functions = append(r.functions, code)
+	return nil
+}
+func (r *rdbRecorder) SelectDB(db int) error                      { r.dbs = append(r.dbs, db); return nil }
+func (r *rdbRecorder) ResizeDB(dbSize int, expiresSize int) error { return nil }
+func (r *rdbRecorder) SlotInfo(slot, size, expiresSize int) error {
+	r.slots = append(r.slots, [3]int{slot, size, expiresSize})
+	return nil
+}
+func (r *rdbRecorder) Entry(entry RdbEntry) error { r.entries = append(r.entries, entry); return nil }
+func (r *rdbRecorder) End(checksum uint64) error  { r.checksum = checksum; return nil }
+
+// parseTestRdb parses the rdb file at path, verifying its checksum.
+func parseTestRdb(t *testing.T, path string) (*rdbRecorder, error) {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	recorder := &rdbRecorder{}
+	return recorder, ParseRdb(file, recorder, true)
+}
+
+// saveTestRdb saves the keyspace to dbfilename and returns its path.
+func saveTestRdb(t *testing.T) string {
+	t.Helper()
+	saved, err := writeRdbFile(kvStore.freeze())
+	kvStore.thaw()
+	if err != nil {
+		t.Fatalf("Failed to save the rdb file: %v", err)
+	}
+	saved.Close()
+	return filepath.Join(Config["dir"], Config["dbfilename"])
+}
+
+func TestRdbSaveAndLoad(t *testing.T) {
+	useTestDir(t)
+	expireMs := time.Now().Add(time.Hour).UnixMilli()
+	expireSeconds := time.Now().Add(time.Hour).Unix()
+	kvStore.Set("plain", "value", 0, false)
+	kvStore.Set("number", "12345", 0, false)
+	kvStore.Set("ttl-ms", "soon", expireMs, true)
+	kvStore.Set("ttl-seconds", "later", expireSeconds, false)
+	kvStore.Set("list", ListValue{"a", "b"}, 0, false)
+	saved := itemsByKey(kvStore.Items())
+
+	recorder, err := parseTestRdb(t, saveTestRdb(t))
+	if err != nil {
+		t.Fatalf("Failed to parse the saved rdb file: %v", err)
+	}
+	if recorder.version != rdbVersion {
+		t.Errorf("Expected rdb version %d, Got %d", rdbVersion, recorder.version)
+	}
+	// Real Redis loads the keys into the db the file selects.
+	if !reflect.DeepEqual(recorder.dbs, []int{0}) {
+		t.Errorf("Expected the keys to be saved in db 0, Got dbs %v", recorder.dbs)
+	}
+
+	kvStore.flush()
+	if err := ParseRdbFile(filepath.Join(Config["dir"], Config["dbfilename"])); err != nil {
+		t.Fatalf("Failed to load the saved rdb file: %v", err)
+	}
+	if loaded := itemsByKey(kvStore.Items()); !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("Expected the keys %v to be loaded back, Got %v", saved, loaded)
+	}
+}
+
+func TestRdbChecksumMismatch(t *testing.T) {
+	useTestDir(t)
+	kvStore.Set("key", "value", 0, false)
+	path := saveTestRdb(t)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := bytes.Index(data, []byte("value"))
+	if index < 0 {
+		t.Fatalf("Expected the value to be saved as is, Got %q", data)
+	}
+	data[index] = 'V'
+	os.WriteFile(path, data, 0644)
+
+	kvStore.flush()
+	err = ParseRdbFile(path)
+	var rdbErr *RdbError
+	if !errors.As(err, &rdbErr) || rdbErr.Opcode != rdbOpcodeEOF || !strings.Contains(err.Error(), "wrong RDB checksum") {
+		t.Fatalf("Expected the flipped byte to fail the checksum, Got %v", err)
+	}
+}
+
+func TestRdbVersionOfHashFieldExpiries(t *testing.T) {
+	useTestDir(t)
+	expiry := time.Now().Add(time.Hour).UnixMilli()
+	hash := HashFieldExpiryValue{
+		Fields:   HashValue{"a": "1", "b": "2"},
+		Expiries: map[string]int64{"a": expiry},
+	}
+	kvStore.Set("hash", hash, 0, false)
+
+	recorder, err := parseTestRdb(t, saveTestRdb(t))
+	if err != nil {
+		t.Fatalf("Failed to parse the saved rdb file: %v", err)
+	}
+	if recorder.version != rdbMaxVersion {
+		t.Errorf("Expected hash field expiries to be saved as rdb version %d, Got %d", rdbMaxVersion, recorder.version)
+	}
+
+	// The writer only finds out about the expiries after the header, which
+	// it rewrites along with the checksum.
+	path := filepath.Join(Config["dir"], "written.rdb")
+	writer, err := NewRdbWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []RdbEntry{
+		{Key: "plain", Value: "value"},
+		{Key: "hash", Value: hash},
+	}
+	for _, entry := range entries {
+		if err := writer.WriteEntry(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	recorder, err = parseTestRdb(t, path)
+	if err != nil {
+		t.Fatalf("Failed to parse the written rdb file: %v", err)
+	}
+	if recorder.version != rdbMaxVersion || recorder.checksum == 0 || len(recorder.entries) != 2 {
+		t.Errorf("Expected 2 keys in a checksummed rdb version %d, Got %d keys in version %d", rdbMaxVersion, len(recorder.entries), recorder.version)
+	}
+	if loaded := recorder.entries[1].Value; !reflect.DeepEqual(loaded, hash) {
+		t.Errorf("Expected hash %v, Got %v", hash, loaded)
+	}
+}
+
+func TestWriteRdbFileKeepsSnapshot(t *testing.T) {
+	useTestDir(t)
+	kvStore.Set("key", "first", 0, false)
+	saved, err := writeRdbFile(kvStore.freeze())
+	kvStore.thaw()
+	if err != nil {
+		t.Fatalf("Failed to save the rdb file: %v", err)
+	}
+	defer saved.Close()
+
+	// A replica is sent the snapshot of the save started for it, not the
+	// one a later save put in its place.
+	kvStore.Set("key", "second", 0, false)
+	saveTestRdb(t)
+	recorder := &rdbRecorder{}
+	if err := ParseRdb(saved, recorder, true); err != nil {
+		t.Fatalf("Failed to parse the saved rdb file: %v", err)
+	}
+	if len(recorder.entries) != 1 || recorder.entries[0].Value != "first" {
+		t.Errorf("Expected the first snapshot to be read back, Got %+v", recorder.entries)
+	}
+}
+
+func itemsByKey(items []KeyValueWithExpiry) map[string]KeyValueWithExpiry {
+	byKey := make(map[string]KeyValueWithExpiry)
+	for _, item := range items {
+		byKey[item.Key] = item
+	}
+	return byKey
+}
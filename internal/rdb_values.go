@@ -0,0 +1,626 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The values of the data types other than strings, as read from rdb files.
+
+// ListValue holds the elements of a list, from head to tail.
+type ListValue []string
+
+// SetValue holds the members of a set.
+type SetValue []string
+
+// SortedSetMember is a member of a sorted set and its score.
+type SortedSetMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SortedSetValue holds the members of a sorted set.
+type SortedSetValue []SortedSetMember
+
+// HashValue maps the fields of a hash to their values.
+type HashValue map[string]string
+
+// HashFieldExpiryValue is a hash with fields that expire, as written by
+// Redis 7.4. Expiries maps fields to their expiry as a unix time in
+// milliseconds.
+type HashFieldExpiryValue struct {
+	Fields   HashValue        `json:"fields"`
+	Expiries map[string]int64 `json:"expiries"`
+}
+
+// StreamID identifies an entry of a stream.
+type StreamID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+func (id StreamID) String() string {
+	return fmt.Sprintf("%d-%d", id.Ms, id.Seq)
+}
+
+func (id StreamID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *StreamID) UnmarshalText(text []byte) error {
+	ms, seq, found := strings.Cut(string(text), "-")
+	var err error
+	if id.Ms, err = strconv.ParseUint(ms, 10, 64); err != nil || !found {
+		return fmt.Errorf("invalid stream ID %s", text)
+	}
+	if id.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+		return fmt.Errorf("invalid stream ID %s", text)
+	}
+	return nil
+}
+
+// StreamEntry is an entry of a stream, with its fields and values
+// alternating in Fields.
+type StreamEntry struct {
+	ID     StreamID `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+// StreamPendingEntry is an entry delivered to a consumer of a group but not
+// acknowledged yet.
+type StreamPendingEntry struct {
+	ID            StreamID `json:"id"`
+	DeliveryTime  int64    `json:"delivery_time"`
+	DeliveryCount uint64   `json:"delivery_count"`
+	Consumer      string   `json:"consumer"`
+}
+
+// StreamConsumer is a consumer of a group. ActiveTime is -1 in files
+// written before Redis 7.2.
+type StreamConsumer struct {
+	Name       string `json:"name"`
+	SeenTime   int64  `json:"seen_time"`
+	ActiveTime int64  `json:"active_time"`
+}
+
+// StreamGroup is a consumer group. EntriesRead is -1 when unknown.
+type StreamGroup struct {
+	Name        string               `json:"name"`
+	LastID      StreamID             `json:"last_id"`
+	EntriesRead int64                `json:"entries_read"`
+	Pending     []StreamPendingEntry `json:"pending"`
+	Consumers   []StreamConsumer     `json:"consumers"`
+}
+
+// StreamValue holds a stream with its consumer groups.
+type StreamValue struct {
+	Entries      []StreamEntry `json:"entries"`
+	Length       uint64        `json:"length"`
+	LastID       StreamID      `json:"last_id"`
+	FirstID      StreamID      `json:"first_id"`
+	MaxDeletedID StreamID      `json:"max_deleted_id"`
+	EntriesAdded uint64        `json:"entries_added"`
+	Groups       []StreamGroup `json:"groups"`
+}
+
+// ModuleValue is a value saved by a module, or the aux data of a module.
+// Without the module its data can only be kept in the self-describing form
+// it was saved in: a sequence of int64, uint64, float32, float64 and string.
+type ModuleValue struct {
+	Module  string        `json:"module"`
+	Version int           `json:"version"`
+	Data    []interface{} `json:"data"`
+}
+
+// readStreamID reads a stream ID saved as 16 raw big endian bytes.
+func (r *rdbReader) readStreamID() (StreamID, error) {
+	data, err := r.readFull(16)
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{Ms: binary.BigEndian.Uint64(data), Seq: binary.BigEndian.Uint64(data[8:])}, nil
+}
+
+// readStreamIDFields reads a stream ID saved as two lengths.
+func (r *rdbReader) readStreamIDFields() (StreamID, error) {
+	ms, err := r.readUint()
+	if err != nil {
+		return StreamID{}, err
+	}
+	seq, err := r.readUint()
+	if err != nil {
+		return StreamID{}, err
+	}
+	return StreamID{Ms: ms, Seq: seq}, nil
+}
+
+// readSortedSet reads a sorted set, whose scores are binary doubles in
+// rdbTypeZset2 and strings prefixed with their length in rdbTypeZset.
+func (r *rdbReader) readSortedSet(valueType byte) (SortedSetValue, error) {
+	count, err := r.readPlainLength()
+	if err != nil {
+		return nil, err
+	}
+	var zset SortedSetValue
+	for i := 0; i < count; i++ {
+		member, err := r.readStringValue()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if valueType == rdbTypeZset2 {
+			data, err := r.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			score = math.Float64frombits(binary.LittleEndian.Uint64(data))
+		} else {
+			length, err := r.readByte()
+			if err != nil {
+				return nil, err
+			}
+			switch length {
+			case 253:
+				score = math.NaN()
+			case 254:
+				score = math.Inf(1)
+			case 255:
+				score = math.Inf(-1)
+			default:
+				data, err := r.readFull(uint64(length))
+				if err != nil {
+					return nil, err
+				}
+				if score, err = strconv.ParseFloat(string(data), 64); err != nil {
+					return nil, fmt.Errorf("invalid score %s of member %s", data, member)
+				}
+			}
+		}
+		zset = append(zset, SortedSetMember{Member: member, Score: score})
+	}
+	return zset, nil
+}
+
+// readQuicklist reads a list saved as a sequence of ziplists, or in
+// rdbTypeListQuicklist2 of listpacks and plain elements.
+func (r *rdbReader) readQuicklist(valueType byte) (ListValue, error) {
+	count, err := r.readPlainLength()
+	if err != nil {
+		return nil, err
+	}
+	var list ListValue
+	for i := 0; i < count; i++ {
+		container := uint64(rdbQuicklistNodePacked)
+		if valueType == rdbTypeListQuicklist2 {
+			if container, err = r.readUint(); err != nil {
+				return nil, err
+			}
+		}
+		node, err := r.readStringValue()
+		if err != nil {
+			return nil, err
+		}
+
+		var elements []string
+		switch {
+		case container == rdbQuicklistNodePlain:
+			elements = []string{node}
+		case container != rdbQuicklistNodePacked:
+			return nil, fmt.Errorf("invalid quicklist node container %d", container)
+		case valueType == rdbTypeListQuicklist2:
+			elements, err = decodeListpack([]byte(node))
+		default:
+			elements, err = decodeZiplist([]byte(node))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid quicklist node %d: %w", i, err)
+		}
+		list = append(list, elements...)
+	}
+	return list, nil
+}
+
+// readHashMetadata reads a hash with field expiries saved field by field.
+// In rdbTypeHashMetadata expiries are relative to the smallest one.
+func (r *rdbReader) readHashMetadata(valueType byte) (HashFieldExpiryValue, error) {
+	hash := HashFieldExpiryValue{Fields: make(HashValue), Expiries: make(map[string]int64)}
+	var minExpiry int64
+	var err error
+	if valueType == rdbTypeHashMetadata {
+		if minExpiry, err = r.readMillisecondTime(); err != nil {
+			return hash, err
+		}
+	}
+	count, err := r.readPlainLength()
+	if err != nil {
+		return hash, err
+	}
+	for i := 0; i < count; i++ {
+		ttl, err := r.readUint()
+		if err != nil {
+			return hash, err
+		}
+		field, err := r.readStringValue()
+		if err != nil {
+			return hash, err
+		}
+		value, err := r.readStringValue()
+		if err != nil {
+			return hash, err
+		}
+		hash.Fields[field] = value
+		if ttl != 0 {
+			if valueType == rdbTypeHashMetadata {
+				hash.Expiries[field] = int64(ttl) + minExpiry - 1
+			} else {
+				hash.Expiries[field] = int64(ttl)
+			}
+		}
+	}
+	return hash, nil
+}
+
+// readHashListpackEx reads a hash with field expiries saved as a listpack
+// of field, value and expiry triplets, where a zero expiry means none.
+func (r *rdbReader) readHashListpackEx(valueType byte) (HashFieldExpiryValue, error) {
+	hash := HashFieldExpiryValue{Fields: make(HashValue), Expiries: make(map[string]int64)}
+	if valueType == rdbTypeHashListpackEx {
+		// The smallest expiry, only needed to index the hash.
+		if _, err := r.readMillisecondTime(); err != nil {
+			return hash, err
+		}
+	}
+	blob, err := r.readStringValue()
+	if err != nil {
+		return hash, err
+	}
+	elements, err := decodeListpack([]byte(blob))
+	if err != nil {
+		return hash, err
+	}
+	if len(elements)%3 != 0 {
+		return hash, fmt.Errorf("hash listpack has %d elements, expected triplets", len(elements))
+	}
+	for i := 0; i < len(elements); i += 3 {
+		expiry, err := strconv.ParseInt(elements[i+2], 10, 64)
+		if err != nil {
+			return hash, fmt.Errorf("invalid expiry %s of field %s", elements[i+2], elements[i])
+		}
+		hash.Fields[elements[i]] = elements[i+1]
+		if expiry != 0 {
+			hash.Expiries[elements[i]] = expiry
+		}
+	}
+	return hash, nil
+}
+
+// readStream reads a stream: its entries as listpacks keyed by their master
+// ID, its metadata and its consumer groups. rdbTypeStreamListpacks2 added
+// the first and max deleted IDs and entry counters, rdbTypeStreamListpacks3
+// the active time of consumers.
+func (r *rdbReader) readStream(valueType byte) (StreamValue, error) {
+	var stream StreamValue
+	nodes, err := r.readPlainLength()
+	if err != nil {
+		return stream, err
+	}
+	for i := 0; i < nodes; i++ {
+		nodeKey, err := r.readStringValue()
+		if err != nil {
+			return stream, err
+		}
+		if len(nodeKey) != 16 {
+			return stream, fmt.Errorf("invalid stream node key of %d bytes", len(nodeKey))
+		}
+		master := StreamID{Ms: binary.BigEndian.Uint64([]byte(nodeKey)), Seq: binary.BigEndian.Uint64([]byte(nodeKey[8:]))}
+		node, err := r.readStringValue()
+		if err != nil {
+			return stream, err
+		}
+		entries, err := decodeStreamListpack(master, []byte(node))
+		if err != nil {
+			return stream, fmt.Errorf("invalid stream node %s: %w", master, err)
+		}
+		stream.Entries = append(stream.Entries, entries...)
+	}
+
+	if stream.Length, err = r.readUint(); err != nil {
+		return stream, err
+	}
+	if stream.LastID, err = r.readStreamIDFields(); err != nil {
+		return stream, err
+	}
+	if valueType >= rdbTypeStreamListpacks2 {
+		if stream.FirstID, err = r.readStreamIDFields(); err != nil {
+			return stream, err
+		}
+		if stream.MaxDeletedID, err = r.readStreamIDFields(); err != nil {
+			return stream, err
+		}
+		if stream.EntriesAdded, err = r.readUint(); err != nil {
+			return stream, err
+		}
+	} else {
+		stream.EntriesAdded = stream.Length
+		if len(stream.Entries) > 0 {
+			stream.FirstID = stream.Entries[0].ID
+		}
+	}
+
+	groups, err := r.readPlainLength()
+	if err != nil {
+		return stream, err
+	}
+	for i := 0; i < groups; i++ {
+		group, err := r.readStreamGroup(valueType)
+		if err != nil {
+			return stream, err
+		}
+		stream.Groups = append(stream.Groups, group)
+	}
+	return stream, nil
+}
+
+func (r *rdbReader) readStreamGroup(valueType byte) (StreamGroup, error) {
+	group := StreamGroup{EntriesRead: -1}
+	var err error
+	if group.Name, err = r.readStringValue(); err != nil {
+		return group, err
+	}
+	if group.LastID, err = r.readStreamIDFields(); err != nil {
+		return group, err
+	}
+	if valueType >= rdbTypeStreamListpacks2 {
+		entriesRead, err := r.readUint()
+		if err != nil {
+			return group, err
+		}
+		group.EntriesRead = int64(entriesRead)
+	}
+
+	pendingCount, err := r.readPlainLength()
+	if err != nil {
+		return group, err
+	}
+	pendingIndex := make(map[StreamID]int)
+	for i := 0; i < pendingCount; i++ {
+		var pending StreamPendingEntry
+		if pending.ID, err = r.readStreamID(); err != nil {
+			return group, err
+		}
+		if pending.DeliveryTime, err = r.readMillisecondTime(); err != nil {
+			return group, err
+		}
+		if pending.DeliveryCount, err = r.readUint(); err != nil {
+			return group, err
+		}
+		if _, exists := pendingIndex[pending.ID]; exists {
+			return group, fmt.Errorf("duplicated pending entry %s in group %s", pending.ID, group.Name)
+		}
+		pendingIndex[pending.ID] = len(group.Pending)
+		group.Pending = append(group.Pending, pending)
+	}
+
+	consumers, err := r.readPlainLength()
+	if err != nil {
+		return group, err
+	}
+	for i := 0; i < consumers; i++ {
+		consumer := StreamConsumer{ActiveTime: -1}
+		if consumer.Name, err = r.readStringValue(); err != nil {
+			return group, err
+		}
+		if consumer.SeenTime, err = r.readMillisecondTime(); err != nil {
+			return group, err
+		}
+		if valueType >= rdbTypeStreamListpacks3 {
+			if consumer.ActiveTime, err = r.readMillisecondTime(); err != nil {
+				return group, err
+			}
+		}
+		// The entries pending for the consumer, all of them in the group's
+		// list of pending entries.
+		count, err := r.readPlainLength()
+		if err != nil {
+			return group, err
+		}
+		for j := 0; j < count; j++ {
+			id, err := r.readStreamID()
+			if err != nil {
+				return group, err
+			}
+			index, exists := pendingIndex[id]
+			if !exists {
+				return group, fmt.Errorf("pending entry %s of consumer %s is not pending in group %s", id, consumer.Name, group.Name)
+			}
+			group.Pending[index].Consumer = consumer.Name
+		}
+		group.Consumers = append(group.Consumers, consumer)
+	}
+	return group, nil
+}
+
+// readModuleValue reads the ID of a module followed by its data.
+func (r *rdbReader) readModuleValue() (ModuleValue, error) {
+	id, err := r.readUint()
+	if err != nil {
+		return ModuleValue{}, err
+	}
+	value := moduleFromID(id)
+	value.Data, err = r.readModuleData()
+	return value, err
+}
+
+// moduleFromID decodes the 9 character name and the version packed in the
+// 64 bit ID of a module data type.
+func moduleFromID(id uint64) ModuleValue {
+	name := make([]byte, 9)
+	for i := range name {
+		name[i] = moduleNameCharset[(id>>(58-6*i))&63]
+	}
+	return ModuleValue{Module: string(name), Version: int(id & 1023)}
+}
+
+const moduleNameCharset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+
+// moduleID packs the name and version of a module data type into its ID.
+func moduleID(name string, version int) (uint64, error) {
+	if len(name) != 9 {
+		return 0, fmt.Errorf("module type name %s is not 9 characters long", name)
+	}
+	if version < 0 || version > 1023 {
+		return 0, fmt.Errorf("module type version %d is out of range", version)
+	}
+	var id uint64
+	for i := 0; i < len(name); i++ {
+		index := strings.IndexByte(moduleNameCharset, name[i])
+		if index < 0 {
+			return 0, fmt.Errorf("invalid character %q in module type name %s", name[i], name)
+		}
+		id = id<<6 | uint64(index)
+	}
+	return id<<10 | uint64(version), nil
+}
+
+// readModuleAux reads the aux data of a module, saved with the ID of the
+// module and the point of the load it has to be handed to the module.
+func (r *rdbReader) readModuleAux() (ModuleValue, error) {
+	id, err := r.readUint()
+	if err != nil {
+		return ModuleValue{}, err
+	}
+	whenOpcode, err := r.readUint()
+	if err != nil {
+		return ModuleValue{}, err
+	}
+	if whenOpcode != rdbModuleOpcodeUint {
+		return ModuleValue{}, fmt.Errorf("invalid module aux when opcode %d", whenOpcode)
+	}
+	if _, err := r.readUint(); err != nil {
+		return ModuleValue{}, err
+	}
+	value := moduleFromID(id)
+	value.Data, err = r.readModuleData()
+	return value, err
+}
+
+func (r *rdbReader) readModuleData() ([]interface{}, error) {
+	var data []interface{}
+	for {
+		opcode, err := r.readUint()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return data, nil
+		case rdbModuleOpcodeSint, rdbModuleOpcodeUint:
+			value, err := r.readUint()
+			if err != nil {
+				return nil, err
+			}
+			if opcode == rdbModuleOpcodeSint {
+				data = append(data, int64(value))
+			} else {
+				data = append(data, value)
+			}
+		case rdbModuleOpcodeFloat:
+			bits, err := r.readFull(4)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, math.Float32frombits(binary.LittleEndian.Uint32(bits)))
+		case rdbModuleOpcodeDouble:
+			bits, err := r.readFull(8)
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, math.Float64frombits(binary.LittleEndian.Uint64(bits)))
+		case rdbModuleOpcodeString:
+			value, err := r.readStringValue()
+			if err != nil {
+				return nil, err
+			}
+			data = append(data, value)
+		default:
+			return nil, fmt.Errorf("unknown module opcode %d", opcode)
+		}
+	}
+}
+
+// readCompactValue reads an aggregate saved as a single ziplist, listpack,
+// intset or zipmap.
+func (r *rdbReader) readCompactValue(valueType byte) (interface{}, error) {
+	blob, err := r.readStringValue()
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(blob)
+	var elements []string
+	switch valueType {
+	case rdbTypeHashZipmap:
+		return decodeZipmap(data)
+	case rdbTypeSetIntset:
+		elements, err = decodeIntset(data)
+		return SetValue(elements), err
+	case rdbTypeListZiplist, rdbTypeZsetZiplist, rdbTypeHashZiplist:
+		elements, err = decodeZiplist(data)
+	default:
+		elements, err = decodeListpack(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch valueType {
+	case rdbTypeListZiplist:
+		return ListValue(elements), nil
+	case rdbTypeSetListpack:
+		return SetValue(elements), nil
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		return pairsToSortedSet(elements)
+	default:
+		return pairsToHash(elements)
+	}
+}
+
+func (r *rdbReader) readValue(valueType byte) (interface{}, error) {
+	switch valueType {
+	case rdbTypeString:
+		return r.readString()
+	case rdbTypeList:
+		elements, err := r.readStrings(1)
+		return ListValue(elements), err
+	case rdbTypeSet:
+		elements, err := r.readStrings(1)
+		return SetValue(elements), err
+	case rdbTypeZset, rdbTypeZset2:
+		return r.readSortedSet(valueType)
+	case rdbTypeHash:
+		elements, err := r.readStrings(2)
+		if err != nil {
+			return nil, err
+		}
+		return pairsToHash(elements)
+	case rdbTypeModule2:
+		return r.readModuleValue()
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZsetZiplist,
+		rdbTypeHashZiplist, rdbTypeHashListpack, rdbTypeZsetListpack, rdbTypeSetListpack:
+		return r.readCompactValue(valueType)
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return r.readQuicklist(valueType)
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return r.readStream(valueType)
+	case rdbTypeHashMetadataPre, rdbTypeHashMetadata:
+		return r.readHashMetadata(valueType)
+	case rdbTypeHashListpackExPre, rdbTypeHashListpackEx:
+		return r.readHashListpackEx(valueType)
+	case rdbTypeModulePre:
+		return nil, fmt.Errorf("module values saved before Redis 4.0 are not supported")
+	default:
+		return nil, fmt.Errorf("unsupported value type %s (%d)", RdbTypeName(valueType), valueType)
+	}
+}
@@ -2,88 +2,682 @@ package internal
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"myredis/config"
-	"myredis/internal"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type ReplicaConfig struct {
-	Port      string
-	IpAddress string
-	Capa      []string
+// replReconnectDelay is how long a replica waits before connecting to its
+// master again after the link broke.
+const replReconnectDelay = time.Second
+
+// States of the link from a replica to its master.
+const (
+	replStateConnect    = "connect"
+	replStateConnecting = "connecting"
+	replStateTransfer   = "transfer"
+	replStateConnected  = "connected"
+)
+
+// masterLink follows one master until the server is pointed elsewhere, at
+// which point it is no longer the current link and stops reconnecting.
+type masterLink struct {
+	host    string
+	port    string
+	state   string
+	conn    net.Conn
+	lastIO  time.Time
+	lastAck time.Time
 }
 
-var Replicas []ReplicaConfig
+// StartReplication makes the server a replica of host:port. The link is
+// established in the background and re-established whenever it breaks.
+func StartReplication(host string, port string) {
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	setMaster(host, port)
+}
 
-func HandshakeWithMaster() error {
-	reader, err := sendToMaster(encodeSimpleError("PING"))
-	if err != nil {
-		return err
+// setMaster follows host:port from now on, dropping the link to the previous
+// master if any. The caller must hold writeCommands and replication.mu.
+func setMaster(host string, port string) {
+	if replication.link != nil {
+		replication.link.close()
 	}
-	resp, _ := parseSimpleString(reader)
-	if resp != "PONG" {
-		return fmt.Errorf("invalid response from master on PING when performing handshake: %s", resp)
+	link := &masterLink{host: host, port: port, state: replStateConnect}
+	config.InstReplicationInfo.Role = "slave"
+	config.InstReplicationInfo.MasterHost = host
+	config.InstReplicationInfo.MasterPort = port
+	replication.link = link
+
+	go link.run()
+}
+
+// promoteToMaster stops replicating and carries on the history of the master
+// under a new replication ID, so the replicas of both can still continue
+// from their offset. The caller must hold writeCommands and replication.mu.
+func promoteToMaster() {
+	info := &config.InstReplicationInfo
+	if info.Role == "master" {
+		return
 	}
-	ip := config.InstanceConfig.IpAddress
-	port := config.InstanceConfig.Port
-	announceReplicaConfig := []interface{}{"REPLCONF", "ip-address", ip, "listening-port", port, "capa", "psync2"}
-	encodedCommand, err := encodeArray(announceReplicaConfig)
-	reader, err = sendToMaster(encodedCommand)
+	if replication.link != nil {
+		replication.link.close()
+		replication.link = nil
+	}
+	info.Role = "master"
+	info.MasterHost = ""
+	info.MasterPort = ""
+	info.MasterConn = nil
+	shiftReplicationId(newReplicationId())
+	disconnectReplicas()
+	replication.cachedMaster = false
+	// The stream of the replicas starts with a SELECT, whatever the master
+	// selected last.
+	replication.selectedDb = -1
+	fmt.Println("MASTER MODE enabled")
+}
+
+// newReplicationId returns a random 40 characters replication ID.
+func newReplicationId() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// handleReplicaOf implements REPLICAOF and its alias SLAVEOF.
+func handleReplicaOf(command string, args []interface{}) (string, error) {
+	if len(args) != 2 {
+		return encodeSimpleError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command))), nil
+	}
+	host, _ := args[0].(string)
+	port, _ := args[1].(string)
+
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if replication.failover.state != failoverStateNone {
+		return encodeSimpleError("ERR REPLICAOF not allowed while failing over."), nil
+	}
+
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		promoteToMaster()
+		return encodeSimpleString("OK"), nil
+	}
+
+	if _, err := strconv.Atoi(port); err != nil {
+		return encodeSimpleError("ERR Invalid master port"), nil
+	}
+	if link := replication.link; link != nil && link.host == host && link.port == port {
+		return encodeSimpleString("OK Already connected to specified master"), nil
+	}
+	becomeReplicaOf(host, port)
+	fmt.Printf("REPLICAOF %s enabled\n", net.JoinHostPort(host, port))
+	return encodeSimpleString("OK"), nil
+}
+
+// becomeReplicaOf turns the server into a replica of host:port at runtime. A
+// master keeps its dataset as the cached master, so the new master may only
+// have to send what is missing, and its replicas have to resynchronise. The
+// caller must hold writeCommands and replication.mu.
+func becomeReplicaOf(host string, port string) {
+	if config.InstReplicationInfo.Role == "master" {
+		replication.cachedMaster = true
+	}
+	disconnectReplicas()
+	setMaster(host, port)
+}
+
+func (l *masterLink) run() {
+	for l.active() {
+		err := l.syncWithMaster()
+		if !l.active() {
+			return
+		}
+		fmt.Printf("Lost connection with master %s:%s: %v\n", l.host, l.port, err)
+		failoverTargetFailed(l)
+		l.setState(replStateConnect)
+		time.Sleep(replReconnectDelay)
+	}
+}
+
+func (l *masterLink) active() bool {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	return replication.link == l
+}
+
+// close drops the connection to the master. The caller must hold
+// replication.mu.
+func (l *masterLink) close() {
+	if l.conn != nil {
+		l.conn.Close()
+	}
+}
+
+func (l *masterLink) setState(state string) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	l.state = state
+}
+
+// syncWithMaster connects to the master, resynchronises, partially when the
+// master still has the writes this replica missed, and then applies the
+// command stream until the connection fails.
+func (l *masterLink) syncWithMaster() error {
+	l.setState(replStateConnecting)
+	fmt.Printf("Connecting to master %s:%s\n", l.host, l.port)
+	conn, err := dialMaster(l.host, l.port)
 	if err != nil {
 		return err
 	}
-	resp, _ = parseSimpleString(reader)
-	if resp != "OK" {
-		return fmt.Errorf("expected OK response from master when Sending Replica during handshake: %s", resp)
+	defer conn.Close()
+
+	// The link may have been dropped while connecting.
+	replication.mu.Lock()
+	if replication.link != l {
+		replication.mu.Unlock()
+		return fmt.Errorf("replication link to %s:%s was dropped", l.host, l.port)
 	}
+	l.conn = conn
+	config.InstReplicationInfo.MasterConn = conn
+	replication.mu.Unlock()
 
-	syncCommand := []interface{}{"PSYNC", "?", "-1"}
-	encodedCommand, err = encodeArray(syncCommand)
+	counter := &masterReader{link: l, conn: conn, timeout: replTimeout()}
+	reader := bufio.NewReader(counter)
+	if err := handshakeWithMaster(conn, reader); err != nil {
+		return err
+	}
+	fullSync, replId, offset, err := psyncWithMaster(conn, reader)
 	if err != nil {
 		return err
 	}
-	reader, err = sendToMaster(encodedCommand)
+	failoverTargetAccepted(l)
+
+	if fullSync {
+		l.setState(replStateTransfer)
+		// The replicas of this server followed the history being replaced.
+		replication.mu.Lock()
+		replication.cachedMaster = false
+		disconnectReplicas()
+		replication.mu.Unlock()
+		if err := receiveRdb(reader); err != nil {
+			return err
+		}
+	}
+
+	replication.mu.Lock()
+	info := &config.InstReplicationInfo
+	if fullSync {
+		info.MasterReplId = replId
+		info.MasterReplOffset = offset
+		info.MasterReplId2 = noReplId
+		info.SecondReplOffset = -1
+		replication.backlog = newReplBacklog()
+		replication.cachedMaster = true
+		fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+	} else {
+		if replId != "" && replId != info.MasterReplId {
+			// The master was promoted and carries on the history of the
+			// previous one under a new ID, which the replicas of this
+			// server learn when they reconnect.
+			shiftReplicationId(replId)
+			disconnectReplicas()
+		}
+		fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization")
+	}
+	l.state = replStateConnected
+	replication.mu.Unlock()
+
+	// The master waits for an acknowledgement after a diskless transfer
+	// before it streams the writes.
+	if fullSync {
+		sendAckToMaster(conn)
+	}
+	return l.applyCommandStream(conn, reader, counter)
+}
+
+func dialMaster(host string, port string) (net.Conn, error) {
+	address := net.JoinHostPort(host, port)
+	dialer := &net.Dialer{Timeout: replTimeout()}
+	if Config["tls-replication"] == "yes" {
+		tlsConfig, err := replicationTLSConfig(host)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for replication: %v", err)
+		}
+		return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	}
+	return dialer.Dial("tcp", address)
+}
+
+// replTimeout is how long the master may stay silent before the link is
+// considered broken.
+func replTimeout() time.Duration {
+	seconds := configInt("repl-timeout")
+	if seconds <= 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// masterReader reads from the master connection, failing once the master has
+// been silent for longer than the timeout. While capturing it keeps a copy of
+// what it reads, so the command stream can be fed to the backlog verbatim.
+type masterReader struct {
+	link      *masterLink
+	conn      net.Conn
+	timeout   time.Duration
+	capturing bool
+	capture   []byte
+}
+
+func (r *masterReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	n, err := r.conn.Read(p)
+	if r.capturing {
+		r.capture = append(r.capture, p[:n]...)
+	}
+	if n > 0 {
+		replication.mu.Lock()
+		r.link.lastIO = time.Now()
+		replication.mu.Unlock()
+	}
+	return n, err
+}
+
+// handshakeWithMaster introduces the replica to its master.
+func handshakeWithMaster(conn net.Conn, reader *bufio.Reader) error {
+	reply, err := masterCommand(conn, reader, "PING")
 	if err != nil {
 		return err
 	}
-	resp, _ = parseSimpleString(reader)
+	// A master that requires authentication refuses the PING, which is fine
+	// since AUTH comes next.
+	if strings.HasPrefix(reply, "-") && !strings.HasPrefix(reply, "-NOAUTH") &&
+		!strings.HasPrefix(reply, "-NOPERM") && !strings.HasPrefix(reply, "-ERR operation not permitted") {
+		return fmt.Errorf("error reply to PING from master: %s", reply[1:])
+	}
+
+	if password := Config["masterauth"]; password != "" {
+		args := []interface{}{"AUTH"}
+		if user := Config["masteruser"]; user != "" {
+			args = append(args, user)
+		}
+		reply, err = masterCommand(conn, reader, append(args, password)...)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(reply, "-") {
+			return fmt.Errorf("unable to AUTH to master: %s", reply[1:])
+		}
+	}
+
+	// Older masters do not understand every REPLCONF option but still serve
+	// the PSYNC, so errors here are not fatal.
+	port := config.InstanceConfig.Port
+	if Config["tls-replication"] == "yes" {
+		port = Config["tls-port"]
+	}
+	for _, option := range [][]interface{}{{"listening-port", port}, {"capa", "eof", "capa", "psync2"}} {
+		reply, err = masterCommand(conn, reader, append([]interface{}{"REPLCONF"}, option...)...)
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(reply, "-") {
+			fmt.Printf("Master does not understand REPLCONF %s: %s\n", option[0], reply[1:])
+		}
+	}
 
 	return nil
 }
 
-func sendToMaster(command string) (*bufio.Reader, error) {
-	conn := getMasterConnection()
-	_, err := conn.Write([]byte(command))
+// psyncWithMaster asks the master to continue from the offset this replica
+// reached, or for a full resynchronisation when it has no usable dataset. It
+// returns whether the master chose a full resynchronisation, with the
+// replication ID and offset it announced.
+func psyncWithMaster(conn net.Conn, reader *bufio.Reader) (bool, string, int, error) {
+	args := []interface{}{"PSYNC", "?", "-1"}
+	replication.mu.Lock()
+	if replication.cachedMaster {
+		args = []interface{}{"PSYNC", config.InstReplicationInfo.MasterReplId, strconv.Itoa(config.InstReplicationInfo.MasterReplOffset + 1)}
+	}
+	// During a FAILOVER the target promotes itself when it gets the PSYNC.
+	if replication.failover.state == failoverStateInProgress {
+		args = append(args, "FAILOVER")
+	}
+	replication.mu.Unlock()
+
+	reply, err := masterCommand(conn, reader, args...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to send command %s error: %v", command, err)
+		return false, "", 0, err
+	}
+	fields := strings.Fields(reply)
+	switch {
+	case len(fields) == 3 && fields[0] == "+FULLRESYNC":
+		masterOffset, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return false, "", 0, fmt.Errorf("invalid offset in FULLRESYNC reply from master: %s", reply)
+		}
+		fmt.Printf("Full resync from master: %s:%d\n", fields[1], masterOffset)
+		return true, fields[1], masterOffset, nil
+	case len(fields) <= 2 && len(fields) > 0 && fields[0] == "+CONTINUE":
+		newReplId := ""
+		if len(fields) == 2 {
+			newReplId = fields[1]
+		}
+		return false, newReplId, 0, nil
+	}
+	return false, "", 0, fmt.Errorf("unexpected reply to PSYNC from master: %s", reply)
+}
+
+// masterCommand sends a command to the master and returns its one line reply.
+func masterCommand(conn net.Conn, reader *bufio.Reader, args ...interface{}) (string, error) {
+	command, err := encodeArray(args)
+	if err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(command)); err != nil {
+		return "", fmt.Errorf("failed to send %s to master: %v", args[0], err)
+	}
+	return readMasterLine(reader)
+}
+
+// readMasterLine reads a line from the master, skipping the empty lines it
+// sends to keep the connection alive while it prepares the rdb file.
+func readMasterLine(reader *bufio.Reader) (string, error) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("failed to read from master: %v", err)
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line != "" {
+			return line, nil
+		}
+	}
+}
+
+// receiveRdb reads the rdb payload that follows FULLRESYNC, $<length> and
+// the file, or $EOF:<mark>, the file and the mark from a diskless master, and
+// loads it in place of the current dataset. It is parsed straight from the
+// socket when repl-diskless-load allows it, and stored as the rdb file
+// first otherwise.
+func receiveRdb(reader *bufio.Reader) error {
+	line, err := readMasterLine(reader)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "$") {
+		return fmt.Errorf("unexpected reply from master while waiting for the rdb file: %s", line)
+	}
+	var payload io.Reader
+	length := int64(-1)
+	if mark, ok := strings.CutPrefix(line, "$EOF:"); ok {
+		if len(mark) != rdbEofMarkSize {
+			return fmt.Errorf("invalid EOF mark from master: %s", line)
+		}
+		payload = &eofMarkReader{reader: reader, mark: []byte(mark)}
+		fmt.Println("MASTER <-> REPLICA sync: receiving streamed RDB from master")
+	} else {
+		length, err = strconv.ParseInt(line[1:], 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("invalid rdb file length from master: %s", line)
+		}
+		payload = io.LimitReader(reader, length)
+		fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master\n", length)
+	}
+
+	switch Config["repl-diskless-load"] {
+	case "swapdb":
+		return loadRdbFromSocket(payload, true)
+	case "on-empty-db":
+		if kvStore.Size() == 0 {
+			return loadRdbFromSocket(payload, false)
+		}
+	}
+
+	tempPath := filepath.Join(Config["dir"], fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+	file, err := os.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s for the rdb file from master: %v", tempPath, err)
+	}
+	n, err := io.Copy(file, payload)
+	if err == nil && length >= 0 && n != length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to receive the rdb file from master: %v", err)
+	}
+
+	rdbPath := filepath.Join(Config["dir"], Config["dbfilename"])
+	if err := os.Rename(tempPath, rdbPath); err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to rename the rdb file from master: %v", err)
 	}
-	reader := bufio.NewReader(conn)
+	return loadMasterRdb(rdbPath)
+}
+
+// rdbEofMarkSize is the length of the mark around an rdb payload sent in the
+// EOF format.
+const rdbEofMarkSize = 40
 
-	return reader, nil
+// eofMarkReader reads an rdb payload sent in the EOF format, which ends with
+// the mark rather than following its length. The last bytes read are held
+// back until more data shows they are not the mark.
+type eofMarkReader struct {
+	reader *bufio.Reader
+	mark   []byte
+	held   []byte
+	done   bool
 }
 
-func getMasterConnection() net.Conn {
-	replicationInfo := config.InstReplicationInfo
-	if replicationInfo.MasterConn == nil {
-		masterUrl := fmt.Sprintf("%s:%s", replicationInfo.MasterHost, replicationInfo.MasterPort)
-		replicationInfo.MasterConn, _ = net.Dial("tcp", masterUrl)
+func (r *eofMarkReader) Read(p []byte) (int, error) {
+	for {
+		// Everything but what may be the start of the mark is payload, and
+		// all of it once the mark was found.
+		available := len(r.held) - len(r.mark)
+		if r.done {
+			available = len(r.held)
+		}
+		if available > 0 {
+			n := copy(p, r.held[:available])
+			r.held = r.held[n:]
+			return n, nil
+		}
+		if r.done {
+			return 0, io.EOF
+		}
+
+		var chunk [16 * 1024]byte
+		n, err := r.reader.Read(chunk[:])
+		r.held = append(r.held, chunk[:n]...)
+		if bytes.HasSuffix(r.held, r.mark) {
+			r.held = r.held[:len(r.held)-len(r.mark)]
+			r.done = true
+		} else if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
 	}
-	return replicationInfo.MasterConn
 }
 
-func sendRdbToReplica() error {
-	rdbFilePath := filepath.Join(internal.Config["dir"], internal.Config["dbfilename"])
-	file, err := os.Open(rdbFilePath)
+// loadMasterRdb replaces the dataset with the rdb file received from the
+// master.
+func loadMasterRdb(rdbPath string) error {
+	writeCommands.Lock()
+	flushed := kvStore.flush()
+	err := ParseRdbFile(rdbPath)
+	writeCommands.Unlock()
+
+	invalidateKeys(nil, flushed)
 	if err != nil {
-		return fmt.Errorf("failed to open rdb file to send to replica error: %v", err)
+		return err
 	}
+	masterDatasetLoaded()
+	return nil
+}
 
-	rdbContent, _ := io.ReadAll(file)
-	encodedRdbContent := encodeBulkString(&rdbFilePath)
+// loadRdbFromSocket parses the rdb payload as it arrives. With swap the
+// current dataset keeps being served while it loads, and stays in place if
+// the transfer fails. Otherwise it is flushed first.
+func loadRdbFromSocket(payload io.Reader, swap bool) error {
+	verifyChecksum := Config["rdbchecksum"] == "yes"
+	var flushed []string
+	var err error
+	if swap {
+		loaded := newKeyValueStore()
+		err = ParseRdb(payload, newRdbLoader(loaded), verifyChecksum)
+		if err == nil {
+			_, err = io.Copy(io.Discard, payload)
+		}
+		if err == nil {
+			writeCommands.Lock()
+			flushed = kvStore.flush()
+			for _, item := range loaded.Items() {
+				kvStore.Set(item.Key, item.Value, item.ExpiryTime, item.TimeInMilliseconds)
+			}
+			writeCommands.Unlock()
+		}
+	} else {
+		writeCommands.Lock()
+		flushed = kvStore.flush()
+		err = ParseRdb(payload, newRdbLoader(&kvStore), verifyChecksum)
+		// The mark, or the end of a payload shorter than announced, is still
+		// to be read.
+		if err == nil {
+			_, err = io.Copy(io.Discard, payload)
+		}
+		// Nothing is left to serve from when the transfer fails half way.
+		if err != nil {
+			flushed = append(flushed, kvStore.flush()...)
+		}
+		writeCommands.Unlock()
+	}
 
+	invalidateKeys(nil, flushed)
+	if err != nil {
+		return fmt.Errorf("failed to load the rdb file from master: %v", err)
+	}
+	fmt.Println("MASTER <-> REPLICA sync: Finished loading the RDB from the socket")
+	masterDatasetLoaded()
 	return nil
 }
+
+// masterDatasetLoaded schedules an AOF rewrite, when it is enabled, since
+// the AOF no longer matches the dataset received from the master.
+func masterDatasetLoaded() {
+	if aofEnabled() {
+		persistence.mu.Lock()
+		persistence.aofRewriteScheduled = true
+		persistence.mu.Unlock()
+	}
+}
+
+// applyCommandStream executes the commands the master propagates and feeds
+// them to the replication stream of this server, which advances the
+// replication offset and forwards them to its own replicas.
+func (l *masterLink) applyCommandStream(conn net.Conn, reader *bufio.Reader, counter *masterReader) error {
+	client := registerMasterClient(conn, reader)
+	defer UnregisterClient(client)
+
+	// The stream starts with what the handshake already buffered.
+	buffered, _ := reader.Peek(reader.Buffered())
+	counter.capture = append([]byte(nil), buffered...)
+	counter.capturing = true
+	for {
+		parsedArr, err := ParseArray(reader)
+		if err != nil {
+			return err
+		}
+
+		// The command reaches the replicas of this server exactly as it was
+		// received, so they share the offsets of the master.
+		replication.applying.Lock()
+		if len(parsedArr) > 0 {
+			if command, ok := parsedArr[0].(string); ok {
+				Handle(client, command, parsedArr[1:])
+			}
+		}
+		consumed := len(counter.capture) - reader.Buffered()
+		replication.mu.Lock()
+		replication.feedReplicationStream(counter.capture[:consumed])
+		replication.mu.Unlock()
+		replication.applying.Unlock()
+		counter.capture = append(counter.capture[:0], counter.capture[consumed:]...)
+	}
+}
+
+// replicaAckPeriod is how often a replica reports its offset to its master.
+const replicaAckPeriod = time.Second
+
+// sendAckToMaster reports how much of the replication stream was processed.
+func sendAckToMaster(conn net.Conn) {
+	replication.mu.Lock()
+	offset := config.InstReplicationInfo.MasterReplOffset
+	replication.mu.Unlock()
+
+	ack, _ := encodeArray([]interface{}{"REPLCONF", "ACK", strconv.Itoa(offset)})
+	conn.Write([]byte(ack))
+}
+
+// replicaCron acknowledges the offset to the master once a second, which
+// also tells the master the link is alive.
+func replicaCron(now time.Time) {
+	replication.mu.Lock()
+	link := replication.link
+	var conn net.Conn
+	if link != nil && link.state == replStateConnected && now.Sub(link.lastAck) >= replicaAckPeriod {
+		conn = link.conn
+		link.lastAck = now
+	}
+	replication.mu.Unlock()
+
+	if conn != nil {
+		sendAckToMaster(conn)
+	}
+}
+
+// info describes the link for INFO replication. The caller must hold
+// replication.mu.
+func (l *masterLink) info() []string {
+	status := "down"
+	if l.state == replStateConnected {
+		status = "up"
+	}
+	lastIO := -1
+	if !l.lastIO.IsZero() {
+		lastIO = int(time.Since(l.lastIO).Seconds())
+	}
+	syncInProgress := 0
+	if l.state == replStateTransfer {
+		syncInProgress = 1
+	}
+	return []string{
+		"master_host:" + l.host,
+		"master_port:" + l.port,
+		"master_link_status:" + status,
+		fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+		fmt.Sprintf("master_sync_in_progress:%d", syncInProgress),
+	}
+}
@@ -0,0 +1,374 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	config "myredis/config"
+)
+
+// fakeMaster plays the master's side of replication, one command at a time,
+// for the replica this server becomes.
+type fakeMaster struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+// startFakeMaster listens for the replica and makes this server a replica of
+// it. The server is a master again once the test ends.
+func startFakeMaster(t *testing.T) *fakeMaster {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := &fakeMaster{listener: listener, conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			master.conns <- conn
+		}
+	}()
+
+	savedInfo := config.InstReplicationInfo
+	savedInstance := config.InstanceConfig
+	config.InstanceConfig.Port = "6390"
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	StartReplication("127.0.0.1", port)
+
+	t.Cleanup(func() {
+		writeCommands.Lock()
+		replication.mu.Lock()
+		promoteToMaster()
+		config.InstReplicationInfo = savedInfo
+		config.InstanceConfig = savedInstance
+		replication.mu.Unlock()
+		writeCommands.Unlock()
+		listener.Close()
+	})
+	return master
+}
+
+// masterSession is a connection of the replica to the fake master.
+type masterSession struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// accept waits for the replica to connect.
+func (m *fakeMaster) accept(t *testing.T) *masterSession {
+	t.Helper()
+	select {
+	case conn := <-m.conns:
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return &masterSession{conn: conn, reader: bufio.NewReader(conn)}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the replica to connect to its master")
+		return nil
+	}
+}
+
+// expect reads a command from the replica and fails the test unless it is
+// args.
+func (s *masterSession) expect(t *testing.T, args ...interface{}) {
+	t.Helper()
+	command, err := ParseArray(s.reader)
+	if err != nil {
+		t.Fatalf("Expected %v from the replica, Got %v", args, err)
+	}
+	if !reflect.DeepEqual(command, args) {
+		t.Fatalf("Expected %v from the replica, Got %v", args, command)
+	}
+}
+
+func (s *masterSession) send(t *testing.T, data string) {
+	t.Helper()
+	if _, err := s.conn.Write([]byte(data)); err != nil {
+		t.Fatalf("Failed to write to the replica: %v", err)
+	}
+}
+
+// handshake answers the commands a replica sends before PSYNC, and reads
+// the PSYNC of a replica without a dataset to continue from.
+func (s *masterSession) handshake(t *testing.T) {
+	t.Helper()
+	s.expect(t, "PING")
+	s.send(t, "+PONG\r\n")
+	s.expect(t, "REPLCONF", "listening-port", "6390")
+	s.send(t, "+OK\r\n")
+	s.expect(t, "REPLCONF", "capa", "eof", "capa", "psync2")
+	s.send(t, "+OK\r\n")
+	s.expect(t, "PSYNC", "?", "-1")
+}
+
+// testMasterRdb returns an rdb file holding the given keys and values.
+func testMasterRdb(pairs ...string) []byte {
+	f := newRdbFixture(rdbVersion).bytes(rdbOpcodeSelectDB, 0)
+	for i := 0; i < len(pairs); i += 2 {
+		f.key(rdbTypeString, pairs[i]).str(pairs[i+1])
+	}
+	return f.end()
+}
+
+func TestEofMarkReader(t *testing.T) {
+	mark := strings.Repeat("m", rdbEofMarkSize-1) + "x"
+	for _, test := range []struct {
+		name    string
+		payload string
+	}{
+		{"empty payload", ""},
+		{"short payload", "REDIS0011"},
+		// The payload may hold any prefix of the mark.
+		{"payload with most of the mark", "REDIS" + mark[:rdbEofMarkSize-1] + "tail"},
+		{"large payload", strings.Repeat("0123456789", 5000)},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// One byte at a time, the mark reaches the reader in pieces.
+			for _, source := range []io.Reader{
+				strings.NewReader(test.payload + mark),
+				iotest.OneByteReader(strings.NewReader(test.payload + mark)),
+			} {
+				reader := &eofMarkReader{reader: bufio.NewReader(source), mark: []byte(mark)}
+				payload, err := io.ReadAll(reader)
+				if err != nil || string(payload) != test.payload {
+					t.Errorf("Expected payload of %d bytes, Got %d bytes: %v", len(test.payload), len(payload), err)
+				}
+			}
+
+			// Without the mark the transfer was cut short.
+			truncated := test.payload + mark[:rdbEofMarkSize/2]
+			reader := &eofMarkReader{reader: bufio.NewReader(strings.NewReader(truncated)), mark: []byte(mark)}
+			if _, err := io.ReadAll(reader); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("Expected an unexpected EOF without the mark, Got %v", err)
+			}
+		})
+	}
+}
+
+func TestReplicaDisklessLoad(t *testing.T) {
+	dir := useTestDir(t)
+	Config["repl-diskless-load"] = "on-empty-db"
+	master := startFakeMaster(t)
+	mark := strings.Repeat("0123456789", 4)
+
+	// An empty replica parses the rdb file straight from the socket.
+	session := master.accept(t)
+	session.handshake(t)
+	session.send(t, "+FULLRESYNC 1111111111111111111111111111111111111111 10\r\n")
+	session.send(t, "$EOF:"+mark+"\r\n"+string(testMasterRdb("foo", "bar"))+mark)
+	session.expect(t, "REPLCONF", "ACK", "10")
+	expectValue(t, "foo", "bar")
+	if _, err := os.Stat(filepath.Join(dir, Config["dbfilename"])); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no rdb file to be written for a diskless load, Got %v", err)
+	}
+
+	// Once it holds keys it stores the file first.
+	session.conn.Close()
+	session = master.accept(t)
+	session.expect(t, "PING")
+	session.send(t, "+PONG\r\n")
+	session.expect(t, "REPLCONF", "listening-port", "6390")
+	session.send(t, "+OK\r\n")
+	session.expect(t, "REPLCONF", "capa", "eof", "capa", "psync2")
+	session.send(t, "+OK\r\n")
+	session.expect(t, "PSYNC", "1111111111111111111111111111111111111111", "11")
+	session.send(t, "+FULLRESYNC 2222222222222222222222222222222222222222 20\r\n")
+	session.send(t, "$EOF:"+mark+"\r\n"+string(testMasterRdb("foo", "baz"))+mark)
+	session.expect(t, "REPLCONF", "ACK", "20")
+	expectValue(t, "foo", "baz")
+	saved, err := os.ReadFile(filepath.Join(dir, Config["dbfilename"]))
+	if err != nil || !bytes.Equal(saved, testMasterRdb("foo", "baz")) {
+		t.Errorf("Expected the rdb file from the master to be saved, Got %d bytes: %v", len(saved), err)
+	}
+}
+
+func TestReplicaDisklessLoadFailure(t *testing.T) {
+	useTestDir(t)
+	Config["repl-diskless-load"] = "on-empty-db"
+	master := startFakeMaster(t)
+	mark := strings.Repeat("0123456789", 4)
+
+	// The whole file arrived, but without the mark the transfer is not
+	// complete and the keys already loaded are dropped.
+	session := master.accept(t)
+	session.handshake(t)
+	session.send(t, "+FULLRESYNC 1111111111111111111111111111111111111111 10\r\n")
+	rdb := testMasterRdb("foo", "bar", "baz", strings.Repeat("x", 100))
+	session.send(t, fmt.Sprintf("$EOF:%s\r\n%s%s", mark, rdb, mark[:rdbEofMarkSize/2]))
+	session.conn.Close()
+
+	// The replica connects again, with nothing to continue from.
+	session = master.accept(t)
+	if size := kvStore.Size(); size != 0 {
+		t.Errorf("Expected an empty dataset after a failed transfer, Got %d keys", size)
+	}
+	session.handshake(t)
+}
+
+// waitFor polls condition for up to 5 seconds.
+func waitFor(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if condition() {
+			return
+		}
+	}
+	t.Fatalf("Timed out waiting for %s", what)
+}
+
+func TestReplicaHandshake(t *testing.T) {
+	dir := useTestDir(t)
+	Config["masteruser"] = "replica"
+	Config["masterauth"] = "secret"
+	master := startFakeMaster(t)
+
+	session := master.accept(t)
+	session.expect(t, "PING")
+	session.send(t, "-NOAUTH Authentication required.\r\n")
+	session.expect(t, "AUTH", "replica", "secret")
+	session.send(t, "+OK\r\n")
+	session.expect(t, "REPLCONF", "listening-port", "6390")
+	session.send(t, "+OK\r\n")
+	session.expect(t, "REPLCONF", "capa", "eof", "capa", "psync2")
+	// Older masters do not know every capability.
+	session.send(t, "-ERR Unrecognized REPLCONF option: capa\r\n")
+	session.expect(t, "PSYNC", "?", "-1")
+
+	// Empty lines keep the link alive while the master saves the file.
+	rdb := testMasterRdb("foo", "bar")
+	session.send(t, "\n\n+FULLRESYNC 3333333333333333333333333333333333333333 42\r\n\n")
+	session.send(t, fmt.Sprintf("$%d\r\n%s", len(rdb), rdb))
+	session.expect(t, "REPLCONF", "ACK", "42")
+	expectValue(t, "foo", "bar")
+	if saved, err := os.ReadFile(filepath.Join(dir, Config["dbfilename"])); err != nil || !bytes.Equal(saved, rdb) {
+		t.Errorf("Expected the rdb file from the master to be saved, Got %d bytes: %v", len(saved), err)
+	}
+	replication.mu.Lock()
+	info := config.InstReplicationInfo
+	state := replication.link.state
+	replication.mu.Unlock()
+	if info.MasterReplId != "3333333333333333333333333333333333333333" || info.MasterReplOffset != 42 || state != replStateConnected {
+		t.Errorf("Expected to follow the master from offset 42, Got %s:%d in state %s", info.MasterReplId, info.MasterReplOffset, state)
+	}
+
+	// Then the writes of the master are applied as they come.
+	set := "*3\r\n$3\r\nSET\r\n$3\r\nfoo\r\n$3\r\nbaz\r\n"
+	session.send(t, set)
+	waitFor(t, "the SET from the master", func() bool {
+		value, _ := kvStore.Get("foo")
+		return value == "baz"
+	})
+	replication.mu.Lock()
+	offset := config.InstReplicationInfo.MasterReplOffset
+	replication.mu.Unlock()
+	if offset != 42+len(set) {
+		t.Errorf("Expected offset %d after the SET, Got %d", 42+len(set), offset)
+	}
+}
+
+func TestReplicaHandshakeErrors(t *testing.T) {
+	useTestDir(t)
+	Config["masterauth"] = "secret"
+	for _, test := range []struct {
+		name    string
+		replies string
+		err     string
+	}{
+		{"PING refused", "-ERR not now\r\n", "error reply to PING from master: ERR not now"},
+		{"AUTH refused", "-NOAUTH Authentication required.\r\n-WRONGPASS invalid username-password pair\r\n", "unable to AUTH to master: WRONGPASS"},
+		{"connection closed", "+PONG\r\n+OK\r\n", "failed to read from master"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(strings.NewReader(test.replies))
+			err := handshakeWithMaster(&testConn{}, reader)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error mentioning %q, Got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestPsyncReplies(t *testing.T) {
+	useTestDir(t)
+	for _, test := range []struct {
+		reply    string
+		fullSync bool
+		replId   string
+		offset   int
+		err      string
+	}{
+		{"+FULLRESYNC 4444444444444444444444444444444444444444 100", true, "4444444444444444444444444444444444444444", 100, ""},
+		{"+CONTINUE", false, "", 0, ""},
+		{"+CONTINUE 5555555555555555555555555555555555555555", false, "5555555555555555555555555555555555555555", 0, ""},
+		{"+FULLRESYNC 4444444444444444444444444444444444444444 abc", false, "", 0, "invalid offset in FULLRESYNC reply"},
+		{"+FULLRESYNC 4444444444444444444444444444444444444444", false, "", 0, "unexpected reply to PSYNC"},
+		{"-NOMASTERLINK Can't SYNC while not connected with my master", false, "", 0, "unexpected reply to PSYNC"},
+	} {
+		conn := &testConn{}
+		fullSync, replId, offset, err := psyncWithMaster(conn, bufio.NewReader(strings.NewReader(test.reply+"\r\n")))
+		if written := conn.takeWritten(); written != "*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n" {
+			t.Errorf("Expected PSYNC ? -1 without a dataset to continue from, Got %q", written)
+		}
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected %q to be refused with %q, Got %v", test.reply, test.err, err)
+			}
+			continue
+		}
+		if err != nil || fullSync != test.fullSync || replId != test.replId || offset != test.offset {
+			t.Errorf("Expected %q to be read as %v %q %d, Got %v %q %d: %v", test.reply, test.fullSync, test.replId, test.offset, fullSync, replId, offset, err)
+		}
+	}
+}
+
+func TestReplicaReconnectsAfterFailedTransfer(t *testing.T) {
+	dir := useTestDir(t)
+	kvStore.Set("old", "1", 0, false)
+	master := startFakeMaster(t)
+
+	// The master goes away 10 bytes into a file of 100.
+	session := master.accept(t)
+	session.handshake(t)
+	session.send(t, "+FULLRESYNC 3333333333333333333333333333333333333333 0\r\n")
+	session.send(t, "$100\r\nREDIS0011\x00")
+	session.conn.Close()
+
+	// The replica tries again, still serving the dataset it had and without
+	// leaving the partial file behind.
+	session = master.accept(t)
+	expectValue(t, "old", "1")
+	if temps, _ := filepath.Glob(filepath.Join(dir, "temp-*.rdb")); len(temps) != 0 {
+		t.Errorf("Expected the partial rdb file to be removed, Got %v", temps)
+	}
+	replication.mu.Lock()
+	state := replication.link.state
+	replication.mu.Unlock()
+	if state == replStateConnected {
+		t.Errorf("Expected the link to be down until the sync succeeds")
+	}
+
+	session.handshake(t)
+	rdb := testMasterRdb("foo", "bar")
+	session.send(t, "+FULLRESYNC 3333333333333333333333333333333333333333 0\r\n")
+	session.send(t, fmt.Sprintf("$%d\r\n%s", len(rdb), rdb))
+	session.expect(t, "REPLCONF", "ACK", "0")
+	expectValue(t, "foo", "bar")
+	if _, exists := kvStore.Get("old"); exists {
+		t.Errorf("Expected the dataset of the master to replace the old one")
+	}
+}
@@ -0,0 +1,916 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	config "myredis/config"
+)
+
+// States of a replica connected to this server.
+const (
+	replicaStateWaitBgsaveStart = "wait_bgsave"
+	replicaStateWaitBgsaveEnd   = "wait_bgsave_end"
+	replicaStateSendBulk        = "send_bulk"
+	replicaStateOnline          = "online"
+)
+
+// ReplicaConfig is a replica connected to this server, described by the
+// REPLCONF options it sent before PSYNC.
+type ReplicaConfig struct {
+	Port      string
+	IpAddress string
+	Capa      []string
+
+	client    *Client
+	state     string
+	ackOffset int
+	ackTime   time.Time
+	// waitStart is when the replica asked for a full resynchronisation, and
+	// diskless is set when the rdb file goes straight to its socket.
+	waitStart time.Time
+	diskless  bool
+	// output holds the replication stream not yet written to the replica.
+	output  []byte
+	wake    chan struct{}
+	closed  chan struct{}
+	rdbDone chan error
+	// rdbFile is the rdb file saved for the replica, until it is sent.
+	rdbFile *replicaRdbFile
+	// closing is set once output outgrew the replica class of
+	// client-output-buffer-limit, and softLimitSince is when it first went
+	// over the soft limit.
+	closing        bool
+	softLimitSince time.Time
+}
+
+// replicaRdbFile is the rdb file a background save wrote for the replicas
+// waiting for it. They share the handle the save returned, which keeps
+// reading that snapshot whatever replaces dbfilename since, and it is
+// closed once every one of them sent it or went away.
+type replicaRdbFile struct {
+	file    *os.File
+	size    int64
+	senders sync.WaitGroup
+}
+
+// Replicas lists the replicas that sent PSYNC, guarded by replication.mu.
+var Replicas []*ReplicaConfig
+
+// noReplId is the replication ID reported when there is none.
+const noReplId = "0000000000000000000000000000000000000000"
+
+// replicationState holds both sides of replication: the replicas of this
+// server and, while it is a replica itself, the link to its master. mu also
+// guards config.InstReplicationInfo. Lock order: applying, writeCommands,
+// then mu, then persistence.mu.
+type replicationState struct {
+	mu   sync.Mutex
+	link *masterLink
+
+	// applying is held by a replica while it applies a command of its master
+	// and forwards it, so the snapshot for a replica of its own never falls
+	// in between.
+	applying sync.Mutex
+
+	// selectedDb is the database the replication stream last selected, or
+	// -1 when the next write must be preceded by a SELECT.
+	selectedDb int
+	lastPing   time.Time
+
+	backlog         *replBacklog
+	noReplicasSince time.Time
+
+	// cachedMaster is set while the dataset matches the replication ID and
+	// offset, so a replica can ask its master to continue from there.
+	cachedMaster bool
+
+	// acked is closed and replaced whenever a replica acknowledges an
+	// offset, waking up the clients blocked in WAIT.
+	acked chan struct{}
+
+	failover failoverState
+}
+
+var replication = replicationState{selectedDb: -1, failover: failoverState{state: failoverStateNone}}
+
+// replBacklog is a circular buffer holding the end of the replication
+// stream, so replicas that reconnect can continue from their offset.
+type replBacklog struct {
+	buf     []byte
+	next    int
+	histlen int
+}
+
+// newReplBacklog allocates a backlog of repl-backlog-size bytes.
+func newReplBacklog() *replBacklog {
+	size, err := parseMemory(Config["repl-backlog-size"])
+	if err != nil || size < 16*1024 {
+		size = 16 * 1024
+	}
+	return &replBacklog{buf: make([]byte, size)}
+}
+
+func (b *replBacklog) write(data []byte) {
+	for len(data) > 0 {
+		n := copy(b.buf[b.next:], data)
+		b.next = (b.next + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		data = data[n:]
+	}
+}
+
+// last copies the last count bytes of the stream.
+func (b *replBacklog) last(count int) []byte {
+	data := make([]byte, count)
+	start := (b.next - count + len(b.buf)) % len(b.buf)
+	n := copy(data, b.buf[start:])
+	copy(data[n:], b.buf)
+	return data
+}
+
+// feedReplicationStream appends data to the replication stream: it is kept
+// in the backlog, advances the replication offset and is sent to the
+// replicas. The caller must hold mu.
+func (r *replicationState) feedReplicationStream(data []byte) {
+	if r.backlog != nil {
+		r.backlog.write(data)
+	}
+	config.InstReplicationInfo.MasterReplOffset += len(data)
+
+	limit := clientOutputBufferLimit("replica")
+	now := time.Now()
+	for _, replica := range Replicas {
+		if replica.state == replicaStateWaitBgsaveStart || replica.closing {
+			continue
+		}
+		replica.output = append(replica.output, data...)
+		if replica.overOutputBufferLimit(limit, now) {
+			fmt.Printf("Client %s scheduled to be closed ASAP for overcoming of output buffer limits.\n",
+				net.JoinHostPort(replica.IpAddress, replica.Port))
+			replica.closing = true
+			replica.output = nil
+			replica.client.close()
+			continue
+		}
+		select {
+		case replica.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// outputBufferLimit is the limit of client-output-buffer-limit for a class
+// of clients: the client is dropped once its pending output reaches hard
+// bytes, or stays above soft bytes for more than softSeconds. Zero disables
+// a limit.
+type outputBufferLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int
+}
+
+// clientOutputBufferLimit reads the limit of class from
+// client-output-buffer-limit, a list of <class> <hard> <soft> <seconds>
+// where slave is another name for replica. A class that is missing or
+// malformed has no limit.
+func clientOutputBufferLimit(class string) outputBufferLimit {
+	fields := strings.Fields(Config["client-output-buffer-limit"])
+	for i := 0; i+3 < len(fields); i += 4 {
+		if normaliseClientType(fields[i]) != class {
+			continue
+		}
+		hard, hardErr := parseMemory(fields[i+1])
+		soft, softErr := parseMemory(fields[i+2])
+		softSeconds, secondsErr := strconv.Atoi(fields[i+3])
+		if hardErr != nil || softErr != nil || secondsErr != nil {
+			return outputBufferLimit{}
+		}
+		return outputBufferLimit{hard: hard, soft: soft, softSeconds: softSeconds}
+	}
+	return outputBufferLimit{}
+}
+
+// overOutputBufferLimit tells whether the output pending for the replica
+// went over limit, keeping track of how long it has been above the soft
+// limit. The caller must hold replication.mu.
+func (r *ReplicaConfig) overOutputBufferLimit(limit outputBufferLimit, now time.Time) bool {
+	size := int64(len(r.output))
+	if limit.hard > 0 && size >= limit.hard {
+		return true
+	}
+	if limit.soft == 0 || size < limit.soft {
+		r.softLimitSince = time.Time{}
+		return false
+	}
+	if r.softLimitSince.IsZero() {
+		r.softLimitSince = now
+	}
+	return now.Sub(r.softLimitSince) > time.Duration(limit.softSeconds)*time.Second
+}
+
+// disconnectReplicas closes the connection of every replica, so they
+// reconnect and learn about a new replication ID or master. The caller must
+// hold mu.
+func disconnectReplicas() {
+	for _, replica := range Replicas {
+		replica.client.close()
+	}
+}
+
+// shiftReplicationId switches to a new replication ID, keeping the current
+// one as the secondary ID so replicas that followed the previous history up
+// to this point can still continue. The caller must hold replication.mu.
+func shiftReplicationId(replId string) {
+	info := &config.InstReplicationInfo
+	info.MasterReplId2 = info.MasterReplId
+	info.SecondReplOffset = info.MasterReplOffset + 1
+	info.MasterReplId = replId
+	fmt.Printf("Setting secondary replication ID to %s, valid up to offset: %d. New replication ID is %s\n",
+		info.MasterReplId2, info.SecondReplOffset, replId)
+}
+
+func handleReplConf(client *Client, args []interface{}) (string, error) {
+	if len(args)%2 != 0 {
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+
+	// ACK and GETACK travel over the replication link and are never
+	// answered with a reply.
+	if option, _ := args[0].(string); len(args) == 2 {
+		switch strings.ToLower(option) {
+		case "ack":
+			offset, _ := args[1].(string)
+			handleReplConfAck(client, offset)
+			return "", nil
+		case "getack":
+			if client.isMaster {
+				sendAckToMaster(client.Conn)
+			}
+			return "", nil
+		}
+	}
+
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if client.replica == nil {
+		client.replica = &ReplicaConfig{client: client}
+	}
+	for i := 0; i < len(args); i += 2 {
+		option, _ := args[i].(string)
+		value, _ := args[i+1].(string)
+		switch strings.ToLower(option) {
+		case "listening-port":
+			if _, err := strconv.Atoi(value); err != nil {
+				return encodeSimpleError("ERR value is not an integer or out of range"), nil
+			}
+			client.replica.Port = value
+		case "ip-address":
+			client.replica.IpAddress = value
+		case "capa":
+			client.replica.Capa = append(client.replica.Capa, value)
+		default:
+			return encodeSimpleError("ERR Unrecognized REPLCONF option: " + option), nil
+		}
+	}
+	return encodeSimpleString("OK"), nil
+}
+
+// handleReplConfAck records the offset a replica acknowledged.
+func handleReplConfAck(client *Client, offsetArg string) {
+	offset, err := strconv.Atoi(offsetArg)
+	if err != nil {
+		return
+	}
+
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	replica := client.replica
+	if replica == nil || replica.state == replicaStateWaitBgsaveStart {
+		return
+	}
+	if offset > replica.ackOffset {
+		replica.ackOffset = offset
+	}
+	replica.ackTime = time.Now()
+	if replication.acked != nil {
+		close(replication.acked)
+		replication.acked = nil
+	}
+}
+
+// handleWait blocks until the replicas acknowledged every write made so far,
+// or the timeout in milliseconds expired, and returns how many did.
+func handleWait(args []interface{}) (string, error) {
+	if len(args) != 2 {
+		return encodeSimpleError("ERR wrong number of arguments for 'wait' command"), nil
+	}
+	numReplicasArg, _ := args[0].(string)
+	timeoutArg, _ := args[1].(string)
+	numReplicas, err := strconv.Atoi(numReplicasArg)
+	if err != nil {
+		return encodeSimpleError("ERR value is not an integer or out of range"), nil
+	}
+	timeout, err := strconv.Atoi(timeoutArg)
+	if err != nil {
+		return encodeSimpleError("ERR timeout is not an integer or out of range"), nil
+	}
+	if timeout < 0 {
+		return encodeSimpleError("ERR timeout is negative"), nil
+	}
+
+	replication.mu.Lock()
+	if config.InstReplicationInfo.Role != "master" {
+		replication.mu.Unlock()
+		return encodeSimpleError("ERR WAIT cannot be used with replica instances."), nil
+	}
+	offset := config.InstReplicationInfo.MasterReplOffset
+	acked := ackedReplicas(offset)
+	replication.mu.Unlock()
+	if acked >= numReplicas {
+		return encodeInteger(acked), nil
+	}
+
+	// Ask the replicas for their offset now instead of waiting for their
+	// next periodic acknowledgement.
+	writeCommands.Lock()
+	propagateToReplicas(-1, []interface{}{"REPLCONF", "GETACK", "*"})
+	writeCommands.Unlock()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(timeout) * time.Millisecond)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		replication.mu.Lock()
+		acked = ackedReplicas(offset)
+		if replication.acked == nil {
+			replication.acked = make(chan struct{})
+		}
+		changed := replication.acked
+		replication.mu.Unlock()
+		if acked >= numReplicas {
+			return encodeInteger(acked), nil
+		}
+
+		select {
+		case <-changed:
+		case <-expired:
+			return encodeInteger(acked), nil
+		}
+	}
+}
+
+// replicationCheckCommand returns the error refusing the command because of
+// the replication state, or "" when it may run: a read only replica refuses
+// writes, a replica that lost its master only serves stale commands unless
+// replica-serve-stale-data is on, and a master refuses writes when fewer than
+// min-replicas-to-write replicas acknowledged within min-replicas-max-lag
+// seconds.
+func replicationCheckCommand(client *Client, command string) string {
+	if client.isMaster {
+		return ""
+	}
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	if config.InstReplicationInfo.Role == "master" {
+		if isWriteCommand(command) && minReplicasEnabled() && goodReplicas() < configInt("min-replicas-to-write") {
+			return "NOREPLICAS Not enough good replicas to write."
+		}
+		return ""
+	}
+	if isWriteCommand(command) && Config["replica-read-only"] == "yes" {
+		return "READONLY You can't write against a read only replica."
+	}
+	if link := replication.link; link != nil && link.state != replStateConnected &&
+		Config["replica-serve-stale-data"] == "no" && !isStaleCommand(command) {
+		return "MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+	}
+	return ""
+}
+
+func minReplicasEnabled() bool {
+	return configInt("min-replicas-to-write") > 0 && configInt("min-replicas-max-lag") > 0
+}
+
+// goodReplicas counts the online replicas that acknowledged their offset
+// within min-replicas-max-lag seconds. The caller must hold replication.mu.
+func goodReplicas() int {
+	maxLag := time.Duration(configInt("min-replicas-max-lag")) * time.Second
+	count := 0
+	for _, replica := range Replicas {
+		if replica.state == replicaStateOnline && time.Since(replica.ackTime) <= maxLag {
+			count++
+		}
+	}
+	return count
+}
+
+// ackedReplicas counts the replicas that acknowledged offset. The caller
+// must hold replication.mu.
+func ackedReplicas(offset int) int {
+	count := 0
+	for _, replica := range Replicas {
+		if replica.state == replicaStateOnline && replica.ackOffset >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// handlePsync registers the client as a replica and starts a full
+// resynchronisation. Everything sent to a replica from then on, starting with
+// the FULLRESYNC reply, goes through its replication stream, so the returned
+// reply is empty. A replica serves PSYNC too, with the replication ID of its
+// master, as long as it is connected to it.
+func handlePsync(client *Client, args []interface{}) (string, error) {
+	if len(args) < 2 {
+		return encodeSimpleError("ERR wrong number of arguments for 'psync' command"), nil
+	}
+	replId, _ := args[0].(string)
+	offset, _ := args[1].(string)
+
+	replication.applying.Lock()
+	defer replication.applying.Unlock()
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if option, _ := args[len(args)-1].(string); len(args) == 3 && strings.EqualFold(option, "FAILOVER") {
+		if !acceptFailover(client, replId) {
+			return encodeSimpleError("ERR PSYNC FAILOVER replid must match my replid."), nil
+		}
+	} else if len(args) != 2 {
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+	if link := replication.link; link != nil && link.state != replStateConnected {
+		return encodeSimpleError("NOMASTERLINK Can't SYNC while not connected with my master"), nil
+	}
+
+	replica := client.replica
+	if replica == nil {
+		replica = &ReplicaConfig{client: client}
+	}
+	if replica.IpAddress == "" {
+		replica.IpAddress, _, _ = net.SplitHostPort(client.Conn.RemoteAddr().String())
+	}
+	replica.state = replicaStateWaitBgsaveStart
+	replica.waitStart = time.Now()
+	replica.wake = make(chan struct{}, 1)
+	replica.closed = make(chan struct{})
+	replica.rdbDone = make(chan error, 1)
+	client.replica = replica
+	Replicas = append(Replicas, replica)
+
+	clients.mu.Lock()
+	client.isReplica = true
+	clients.mu.Unlock()
+
+	// Without a backlog the offset did not follow the writes, so only a full
+	// resynchronisation brings the replica up to date.
+	canContinue := replication.backlog != nil
+	if replication.backlog == nil {
+		replication.backlog = newReplBacklog()
+	}
+	if canContinue && replica.continueFrom(replId, offset) {
+		return "", nil
+	}
+
+	fmt.Printf("Replica %s asks for synchronization\n", net.JoinHostPort(replica.IpAddress, replica.Port))
+	startBgsaveForReplication()
+	return "", nil
+}
+
+// continueFrom starts a partial resynchronisation when the replica follows
+// the current history, or the previous one up to where it diverged, and the
+// backlog still holds everything after its offset. The caller must hold
+// writeCommands and replication.mu.
+func (r *ReplicaConfig) continueFrom(replId string, offsetArg string) bool {
+	info := config.InstReplicationInfo
+	offset, err := strconv.Atoi(offsetArg)
+	if err != nil || replId == "?" {
+		return false
+	}
+	if replId != info.MasterReplId && (replId != info.MasterReplId2 || offset > info.SecondReplOffset) {
+		fmt.Printf("Partial resynchronization not accepted: replication ID mismatch (replica asked for %s)\n", replId)
+		return false
+	}
+	// The offset is the one of the first byte the replica is missing.
+	missing := info.MasterReplOffset - (offset - 1)
+	if missing < 0 || missing > replication.backlog.histlen {
+		fmt.Printf("Unable to partial resync with replica: lack of backlog (replica request was: %d)\n", offset)
+		return false
+	}
+
+	reply := "CONTINUE"
+	if r.hasCapa("psync2") {
+		reply += " " + info.MasterReplId
+	}
+	r.state = replicaStateOnline
+	r.output = replication.backlog.last(missing)
+	go r.stream(encodeSimpleString(reply))
+	fmt.Printf("Partial resynchronization request from %s accepted, sending %d bytes of backlog\n",
+		net.JoinHostPort(r.IpAddress, r.Port), missing)
+	return true
+}
+
+// info describes the replica for INFO replication. The caller must hold
+// replication.mu.
+func (r *ReplicaConfig) info() string {
+	state := r.state
+	if state == replicaStateWaitBgsaveEnd {
+		state = replicaStateWaitBgsaveStart
+	}
+	lag := 0
+	if !r.ackTime.IsZero() {
+		lag = int(time.Since(r.ackTime).Seconds())
+	}
+	return fmt.Sprintf("ip=%s,port=%s,state=%s,offset=%d,lag=%d", r.IpAddress, r.Port, state, r.ackOffset, lag)
+}
+
+func (r *ReplicaConfig) hasCapa(capa string) bool {
+	for _, c := range r.Capa {
+		if c == capa {
+			return true
+		}
+	}
+	return false
+}
+
+// startBgsaveForReplication starts a background save for the replicas
+// waiting for one. With repl-diskless-sync the rdb file is streamed to their
+// sockets instead, once the first one waited repl-diskless-sync-delay
+// seconds so that others can join the same transfer, provided they all
+// understand the EOF format. When a save is already running they keep
+// waiting and the replication cron tries again. The caller must hold
+// writeCommands and replication.mu, so the snapshot and the replication
+// stream of the replicas start from the same write.
+func startBgsaveForReplication() {
+	var waiting []*ReplicaConfig
+	diskless := Config["repl-diskless-sync"] == "yes"
+	var firstWait time.Time
+	for _, replica := range Replicas {
+		if replica.state == replicaStateWaitBgsaveStart {
+			waiting = append(waiting, replica)
+			diskless = diskless && replica.hasCapa("eof")
+			if firstWait.IsZero() || replica.waitStart.Before(firstWait) {
+				firstWait = replica.waitStart
+			}
+		}
+	}
+	if len(waiting) == 0 {
+		return
+	}
+	delay := time.Duration(configInt("repl-diskless-sync-delay")) * time.Second
+	if diskless && time.Since(firstWait) < delay {
+		return
+	}
+
+	info := config.InstReplicationInfo
+	reply := encodeSimpleString(fmt.Sprintf("FULLRESYNC %s %d", info.MasterReplId, info.MasterReplOffset))
+	if diskless {
+		// The reply goes out with the rdb file, ahead of it on the socket.
+		if err := rdbSaveToReplicas(waiting, reply); err != nil {
+			return
+		}
+		reply = ""
+	} else if err := rdbSaveBackground(); err != nil {
+		return
+	}
+
+	// The stream of the new replicas starts with a SELECT.
+	replication.selectedDb = -1
+	for _, replica := range waiting {
+		replica.state = replicaStateWaitBgsaveEnd
+		replica.diskless = diskless
+		replica.output = nil
+		go replica.stream(reply)
+	}
+}
+
+// replicationBgsaveDone hands the result of a background save to the
+// replicas waiting for it, along with the file it saved unless it streamed
+// the snapshot to their sockets.
+func replicationBgsaveDone(saved *os.File, err error) {
+	var rdbFile *replicaRdbFile
+	if saved != nil {
+		rdbFile = &replicaRdbFile{file: saved}
+		if info, statErr := saved.Stat(); statErr != nil {
+			err = statErr
+		} else {
+			rdbFile.size = info.Size()
+		}
+	}
+
+	replication.mu.Lock()
+	for _, replica := range Replicas {
+		if replica.state == replicaStateWaitBgsaveEnd {
+			replica.state = replicaStateSendBulk
+			if rdbFile != nil && err == nil {
+				rdbFile.senders.Add(1)
+				replica.rdbFile = rdbFile
+			}
+			replica.rdbDone <- err
+		}
+	}
+	replication.mu.Unlock()
+
+	if rdbFile != nil {
+		go func() {
+			rdbFile.senders.Wait()
+			rdbFile.file.Close()
+		}()
+	}
+}
+
+// takeRdbFile returns the rdb file saved for the replica, if any, which the
+// caller has to release.
+func (r *ReplicaConfig) takeRdbFile() *replicaRdbFile {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	rdbFile := r.rdbFile
+	r.rdbFile = nil
+	return rdbFile
+}
+
+// stream writes the resynchronisation to the replica: the PSYNC reply, the
+// rdb file once it is saved for a full resynchronisation, unless a diskless
+// transfer sends both itself, and then the replication stream from the
+// replica's offset on. The client is closed on failure, which unregisters
+// the replica.
+func (r *ReplicaConfig) stream(reply string) {
+	conn := r.client.Conn
+	if reply != "" {
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			r.client.close()
+			return
+		}
+	}
+
+	replication.mu.Lock()
+	fullSync := r.state != replicaStateOnline
+	replication.mu.Unlock()
+
+	if fullSync {
+		select {
+		case err := <-r.rdbDone:
+			if err == nil && !r.diskless {
+				err = sendRdbToReplica(conn, r.takeRdbFile())
+			}
+			if err != nil {
+				fmt.Println("Failed to send the rdb file to replica: ", err)
+				r.client.close()
+				return
+			}
+		case <-r.closed:
+			if rdbFile := r.takeRdbFile(); rdbFile != nil {
+				rdbFile.senders.Done()
+			}
+			return
+		}
+
+		// Nothing marks the end of an rdb file sent in the EOF format but
+		// the mark itself, so the stream only starts once the replica
+		// acknowledged it loaded the file.
+		if r.diskless && !r.waitForAck() {
+			return
+		}
+
+		replication.mu.Lock()
+		r.state = replicaStateOnline
+		replication.mu.Unlock()
+		fmt.Printf("Synchronization with replica %s succeeded\n", net.JoinHostPort(r.IpAddress, r.Port))
+	}
+
+	for {
+		replication.mu.Lock()
+		output := r.output
+		r.output = nil
+		replication.mu.Unlock()
+
+		if len(output) > 0 {
+			if _, err := conn.Write(output); err != nil {
+				r.client.close()
+				return
+			}
+		}
+
+		select {
+		case <-r.wake:
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// waitForAck blocks until the replica sent REPLCONF ACK, and returns false
+// if it disconnected first.
+func (r *ReplicaConfig) waitForAck() bool {
+	for {
+		replication.mu.Lock()
+		acked := !r.ackTime.IsZero()
+		if replication.acked == nil {
+			replication.acked = make(chan struct{})
+		}
+		changed := replication.acked
+		replication.mu.Unlock()
+		if acked {
+			return true
+		}
+
+		select {
+		case <-changed:
+		case <-r.closed:
+			return false
+		}
+	}
+}
+
+// streamRdbToReplicas sends the FULLRESYNC reply and the snapshot to every
+// replica at once, in the EOF format since the length of the rdb file is not
+// known upfront: $EOF:<mark>, the file, and the 40 bytes mark again.
+func streamRdbToReplicas(replicas []*ReplicaConfig, reply string, snapshot keyspaceSnapshot) error {
+	mark := newReplicationId()
+	sockets := &replicaSockets{replicas: replicas, failed: make([]bool, len(replicas))}
+	if _, err := fmt.Fprintf(sockets, "%s$EOF:%s\r\n", reply, mark); err != nil {
+		return err
+	}
+	if err := writeRdbSnapshot(sockets, snapshot); err != nil {
+		return err
+	}
+	_, err := sockets.Write([]byte(mark))
+	return err
+}
+
+// replicaSockets writes to the connections of several replicas. A replica
+// that fails is disconnected without holding up the others, and writing
+// only fails once none is left.
+type replicaSockets struct {
+	replicas []*ReplicaConfig
+	failed   []bool
+}
+
+func (s *replicaSockets) Write(data []byte) (int, error) {
+	alive := 0
+	for i, replica := range s.replicas {
+		if s.failed[i] {
+			continue
+		}
+		if _, err := replica.client.Conn.Write(data); err != nil {
+			fmt.Printf("Diskless rdb transfer to replica %s failed: %v\n", net.JoinHostPort(replica.IpAddress, replica.Port), err)
+			s.failed[i] = true
+			replica.client.close()
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, fmt.Errorf("no replica left to transfer the rdb file to")
+	}
+	return len(data), nil
+}
+
+// sendRdbToReplica sends the rdb file saved for the replica as a $<length>
+// bulk payload without the trailing CRLF.
+func sendRdbToReplica(conn net.Conn, rdbFile *replicaRdbFile) error {
+	if rdbFile == nil {
+		return fmt.Errorf("no rdb file was saved for the replica")
+	}
+	defer rdbFile.senders.Done()
+
+	if _, err := fmt.Fprintf(conn, "$%d\r\n", rdbFile.size); err != nil {
+		return err
+	}
+	_, err := io.Copy(conn, io.NewSectionReader(rdbFile.file, 0, rdbFile.size))
+	return err
+}
+
+// removeReplica forgets a replica once its connection is closed.
+func removeReplica(client *Client) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	for i, replica := range Replicas {
+		if replica.client == client {
+			close(replica.closed)
+			Replicas = append(Replicas[:i], Replicas[i+1:]...)
+			if len(Replicas) == 0 {
+				replication.noReplicasSince = time.Now()
+			}
+			fmt.Printf("Connection with replica %s lost\n", net.JoinHostPort(replica.IpAddress, replica.Port))
+			return
+		}
+	}
+}
+
+// propagateToReplicas appends a write to the replication stream, preceded
+// by a SELECT when it targets another database than the previous write, and
+// feeds it to the backlog. db is -1 for commands that
+// do not depend on the database. The caller must hold writeCommands.
+func propagateToReplicas(db int, args []interface{}) {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	// The stream of a replica is the one of its master, its own writes stay
+	// local.
+	if config.InstReplicationInfo.Role != "master" {
+		return
+	}
+	if replication.backlog == nil && len(Replicas) == 0 {
+		return
+	}
+
+	var stream string
+	if db >= 0 && db != replication.selectedDb {
+		selectDb, _ := encodeArray([]interface{}{"SELECT", strconv.Itoa(db)})
+		stream += selectDb
+		replication.selectedDb = db
+	}
+	command, err := encodeArray(args)
+	if err != nil {
+		fmt.Println("Failed to encode command for replicas: ", err)
+		return
+	}
+	stream += command
+	replication.feedReplicationStream([]byte(stream))
+}
+
+// replicationCron starts the background saves replicas are waiting for,
+// pings the replicas every repl-ping-replica-period seconds, so they can
+// tell a quiet master from a lost one, and frees the backlog once there
+// have been no replicas for repl-backlog-ttl seconds.
+func replicationCron(now time.Time) {
+	replication.applying.Lock()
+	defer replication.applying.Unlock()
+	writeCommands.Lock()
+	defer writeCommands.Unlock()
+
+	replication.mu.Lock()
+	startBgsaveForReplication()
+	period := time.Duration(configInt("repl-ping-replica-period")) * time.Second
+	// The stream stays still during a failover, so the target can catch up.
+	// Replicas forward the pings of their master instead of their own.
+	ping := len(Replicas) > 0 && period > 0 && now.Sub(replication.lastPing) >= period &&
+		replication.failover.state == failoverStateNone && config.InstReplicationInfo.Role == "master"
+	if ping {
+		replication.lastPing = now
+	}
+
+	// Only masters free the backlog, a replica may have to serve it once it
+	// is promoted.
+	ttl := time.Duration(configInt("repl-backlog-ttl")) * time.Second
+	if replication.backlog != nil && config.InstReplicationInfo.Role == "master" && len(Replicas) == 0 &&
+		ttl > 0 && now.Sub(replication.noReplicasSince) > ttl {
+		replication.backlog = nil
+		fmt.Printf("Replication backlog freed after %d seconds without connected replicas\n", int(ttl.Seconds()))
+	}
+	replication.mu.Unlock()
+
+	if ping {
+		propagateToReplicas(-1, []interface{}{"PING"})
+	}
+}
+
+func replicationInfo() string {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+
+	info := []string{"role:" + config.InstReplicationInfo.Role}
+	if link := replication.link; link != nil {
+		info = append(info, link.info()...)
+	}
+	info = append(info, fmt.Sprintf("connected_slaves:%d", len(Replicas)))
+	for i, replica := range Replicas {
+		info = append(info, fmt.Sprintf("slave%d:%s", i, replica.info()))
+	}
+	if minReplicasEnabled() {
+		info = append(info, fmt.Sprintf("min_slaves_good_slaves:%d", goodReplicas()))
+	}
+	info = append(info, "master_failover_state:"+replication.failover.state)
+	replInfo := config.InstReplicationInfo
+	backlogActive, firstByteOffset, histlen := 0, 0, 0
+	if backlog := replication.backlog; backlog != nil {
+		backlogActive = 1
+		histlen = backlog.histlen
+		firstByteOffset = replInfo.MasterReplOffset - histlen + 1
+	}
+	backlogSize, _ := parseMemory(Config["repl-backlog-size"])
+	info = append(info,
+		"master_replid:"+replInfo.MasterReplId,
+		"master_replid2:"+replInfo.MasterReplId2,
+		fmt.Sprintf("master_repl_offset:%d", replInfo.MasterReplOffset),
+		fmt.Sprintf("second_repl_offset:%d", replInfo.SecondReplOffset),
+		fmt.Sprintf("repl_backlog_active:%d", backlogActive),
+		fmt.Sprintf("repl_backlog_size:%d", backlogSize),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", firstByteOffset),
+		fmt.Sprintf("repl_backlog_histlen:%d", histlen),
+	)
+	return strings.Join(info, "\n")
+}
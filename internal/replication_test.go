@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	config "myredis/config"
+)
+
+// useTestReplicas makes replicas the replicas of this server until the test
+// ends, when the replication offset and backlog are restored too.
+func useTestReplicas(t *testing.T, replicas ...*ReplicaConfig) {
+	t.Helper()
+	replication.mu.Lock()
+	savedReplicas := Replicas
+	savedInfo := config.InstReplicationInfo
+	savedBacklog := replication.backlog
+	savedSelectedDb := replication.selectedDb
+	for _, replica := range replicas {
+		if replica.wake == nil {
+			replica.wake = make(chan struct{}, 1)
+		}
+	}
+	Replicas = replicas
+	replication.mu.Unlock()
+
+	t.Cleanup(func() {
+		replication.mu.Lock()
+		Replicas = savedReplicas
+		config.InstReplicationInfo = savedInfo
+		replication.backlog = savedBacklog
+		replication.selectedDb = savedSelectedDb
+		replication.mu.Unlock()
+	})
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	useTestDir(t)
+	Config["min-replicas-to-write"] = "1"
+	Config["min-replicas-max-lag"] = "10"
+	replica := &ReplicaConfig{IpAddress: "127.0.0.1", Port: "6390", state: replicaStateOnline}
+	useTestReplicas(t, replica)
+	client, _ := newTestClient(t)
+
+	// A replica that never acknowledged is not a good one.
+	expectReply(t, client, "-NOREPLICAS Not enough good replicas to write.\r\n", "SET", "foo", "bar")
+	expectReply(t, client, "$-1\r\n", "GET", "foo")
+
+	replication.mu.Lock()
+	replica.ackTime = time.Now()
+	replication.mu.Unlock()
+	expectReply(t, client, "+OK\r\n", "SET", "foo", "bar")
+	if info := replicationInfo(); !strings.Contains(info, "min_slaves_good_slaves:1\n") {
+		t.Errorf("Expected INFO to count the good replica, Got %q", info)
+	}
+
+	// Nor is one that lags behind min-replicas-max-lag.
+	replication.mu.Lock()
+	replica.ackTime = time.Now().Add(-11 * time.Second)
+	replication.mu.Unlock()
+	expectReply(t, client, "-NOREPLICAS Not enough good replicas to write.\r\n", "SET", "foo", "baz")
+	expectReply(t, client, "$3\r\nbar\r\n", "GET", "foo")
+
+	Config["min-replicas-to-write"] = "0"
+	expectReply(t, client, "+OK\r\n", "SET", "foo", "baz")
+}
+
+func TestReplicaServeStaleData(t *testing.T) {
+	useTestDir(t)
+	kvStore.Set("foo", "bar", 0, false)
+	client, _ := newTestClient(t)
+	startFakeMaster(t)
+
+	// The link is down until the master answers the handshake.
+	expectReply(t, client, "$3\r\nbar\r\n", "GET", "foo")
+	Config["replica-serve-stale-data"] = "no"
+	expectReply(t, client, "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n", "GET", "foo")
+	expectReply(t, client, "-MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.\r\n", "KEYS", "*")
+
+	// Stale commands are served still.
+	expectReply(t, client, "*2\r\n$24\r\nreplica-serve-stale-data\r\n$2\r\nno\r\n", "CONFIG", "GET", "replica-serve-stale-data")
+	expectReply(t, client, "+OK\r\n", "SELECT", "0")
+	if reply := run(t, client, "INFO", "replication"); !strings.Contains(reply, "master_link_status:down") {
+		t.Errorf("Expected INFO to be served, Got %q", reply)
+	}
+}
+
+// replicationOffset returns the offset of the replication stream.
+func replicationOffset() int {
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	return config.InstReplicationInfo.MasterReplOffset
+}
+
+func TestPsyncContinue(t *testing.T) {
+	useTestDir(t)
+	useTestReplicas(t)
+	replication.mu.Lock()
+	replication.backlog = newReplBacklog()
+	replication.selectedDb = -1
+	replId := config.InstReplicationInfo.MasterReplId
+	replication.mu.Unlock()
+	writer, _ := newTestClient(t)
+
+	run(t, writer, "SET", "a", "1")
+	offset := replicationOffset()
+	run(t, writer, "SET", "b", "2")
+
+	// A replica that reconnects within the backlog gets only the writes it
+	// missed.
+	replica, replicaConn := newTestClient(t)
+	expectReply(t, replica, "", "PSYNC", replId, fmt.Sprint(offset+1))
+	expected := "+CONTINUE\r\n*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	written := ""
+	waitFor(t, "the missing writes", func() bool {
+		written += replicaConn.takeWritten()
+		return len(written) >= len(expected)
+	})
+	if written != expected {
+		t.Errorf("Expected %q, Got %q", expected, written)
+	}
+
+	// And then the stream.
+	run(t, writer, "SET", "c", "3")
+	expected = "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$1\r\n3\r\n"
+	written = ""
+	waitFor(t, "the stream", func() bool {
+		written += replicaConn.takeWritten()
+		return len(written) >= len(expected)
+	})
+	if written != expected {
+		t.Errorf("Expected %q, Got %q", expected, written)
+	}
+}
+
+func TestPsyncFullResync(t *testing.T) {
+	useTestDir(t)
+	usePersistenceState(t)
+	useTestReplicas(t)
+	replication.mu.Lock()
+	replication.backlog = newReplBacklog()
+	backlogSize := len(replication.backlog.buf)
+	replId := config.InstReplicationInfo.MasterReplId
+	replication.mu.Unlock()
+	writer, _ := newTestClient(t)
+
+	run(t, writer, "SET", "a", "1")
+	offset := replicationOffset()
+	// Enough writes to push the offset out of the backlog.
+	run(t, writer, "SET", "b", strings.Repeat("x", backlogSize))
+
+	for _, test := range []struct {
+		replId string
+		offset int
+	}{
+		{replId, offset + 1},
+		{"?", -1},
+		{"0123456789012345678901234567890123456789", replicationOffset() + 1},
+		{replId, replicationOffset() + 2},
+	} {
+		replica, replicaConn := newTestClient(t)
+		expectReply(t, replica, "", "PSYNC", test.replId, fmt.Sprint(test.offset))
+		expected := fmt.Sprintf("+FULLRESYNC %s %d\r\n", replId, replicationOffset())
+		written := ""
+		waitFor(t, "the FULLRESYNC reply", func() bool {
+			written += replicaConn.takeWritten()
+			return len(written) >= len(expected)
+		})
+		if !strings.HasPrefix(written, expected) {
+			t.Errorf("Expected PSYNC %s %d to reply %q, Got %q", test.replId, test.offset, expected, written)
+		}
+		waitForBgsave(t)
+		UnregisterClient(replica)
+	}
+}
+
+func TestReplicaOutputBufferLimit(t *testing.T) {
+	useTestDir(t)
+	Config["client-output-buffer-limit"] = "normal 0 0 0 slave 4kb 1kb 10 pubsub 32mb 8mb 60"
+	slowClient, _ := newTestClient(t)
+	lateClient, _ := newTestClient(t)
+	goodClient, _ := newTestClient(t)
+	// None of them reads what is sent, as their connection is not served.
+	slow := &ReplicaConfig{client: slowClient, state: replicaStateOnline}
+	late := &ReplicaConfig{client: lateClient, state: replicaStateSendBulk}
+	good := &ReplicaConfig{client: goodClient, state: replicaStateOnline}
+	useTestReplicas(t, slow, late, good)
+	writer, _ := newTestClient(t)
+
+	// Over the soft limit a replica gets soft seconds to catch up.
+	run(t, writer, "SET", "a", strings.Repeat("x", 2000))
+	replication.mu.Lock()
+	softLimitSince := slow.softLimitSince
+	slow.softLimitSince = softLimitSince.Add(-11 * time.Second)
+	good.output = nil
+	replication.mu.Unlock()
+	if softLimitSince.IsZero() || slowClient.Closed() {
+		t.Fatalf("Expected the replica over the soft limit to be kept for now")
+	}
+	run(t, writer, "SET", "b", "1")
+	if !slowClient.Closed() {
+		t.Errorf("Expected the replica over the soft limit for longer than 10 seconds to be dropped")
+	}
+
+	// The hard limit drops it right away, even while the rdb file is sent.
+	run(t, writer, "SET", "c", strings.Repeat("x", 3000))
+	if !lateClient.Closed() {
+		t.Errorf("Expected the replica over the hard limit to be dropped")
+	}
+	if goodClient.Closed() {
+		t.Errorf("Expected the replica that keeps up to stay")
+	}
+	replication.mu.Lock()
+	defer replication.mu.Unlock()
+	if !slow.closing || slow.output != nil || !late.closing || late.output != nil {
+		t.Errorf("Expected the dropped replicas to stop buffering the stream")
+	}
+}
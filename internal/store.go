@@ -1,10 +1,20 @@
 package internal
 
-import "time"
+import (
+	"sync"
+	"time"
+)
 
 type KeyValueStore struct {
+	mu        sync.Mutex
 	store     map[string]Item
 	expireMap map[string]ExpiryMetadata
+
+	// While a snapshot is being written store and expireMap are frozen, so the
+	// snapshot can read them without holding mu. Changes made in the meantime
+	// are staged in pending and merged back once the snapshot is released.
+	frozen  bool
+	pending map[string]pendingChange
 }
 
 type Item struct {
@@ -16,37 +26,90 @@ type ExpiryMetadata struct {
 	timeInMilliseconds bool
 }
 
+type pendingChange struct {
+	deleted   bool
+	item      Item
+	expiry    ExpiryMetadata
+	hasExpiry bool
+}
+
 var kvStore = KeyValueStore{
 	store:     make(map[string]Item),
 	expireMap: make(map[string]ExpiryMetadata),
 }
 
+// newKeyValueStore returns an empty store besides the keyspace, for datasets
+// being loaded.
+func newKeyValueStore() *KeyValueStore {
+	return &KeyValueStore{
+		store:     make(map[string]Item),
+		expireMap: make(map[string]ExpiryMetadata),
+	}
+}
+
 func (kv *KeyValueStore) Get(key string) (interface{}, bool) {
-	item, exists := kv.store[key]
+	kv.mu.Lock()
+	item, expiry, hasExpiry, exists := kv.lookup(key)
 	if !exists {
+		kv.mu.Unlock()
 		return "", false
 	}
-	if kv.isExpired(key) {
-		delete(kv.store, key)
+	if hasExpiry && expiry.isExpired() {
+		kv.remove(key)
+		kv.mu.Unlock()
+		invalidateKeys(nil, []string{key})
 		return "", false
 	}
+	kv.mu.Unlock()
 	return item.value, true
 }
 
-func (kv *KeyValueStore) isExpired(key string) bool {
-	expireInfo, exists := kv.expireMap[key]
-	if !exists {
-		return false
+// lookup returns the current state of a key, including changes staged while
+// the store is frozen. The caller must hold kv.mu.
+func (kv *KeyValueStore) lookup(key string) (Item, ExpiryMetadata, bool, bool) {
+	if kv.frozen {
+		if change, exists := kv.pending[key]; exists {
+			return change.item, change.expiry, change.hasExpiry, !change.deleted
+		}
+	}
+	item, exists := kv.store[key]
+	expiry, hasExpiry := kv.expireMap[key]
+	return item, expiry, hasExpiry, exists
+}
+
+// write stores the new state of a key. The caller must hold kv.mu.
+func (kv *KeyValueStore) write(key string, item Item, expiry ExpiryMetadata, hasExpiry bool) {
+	if kv.frozen {
+		kv.pending[key] = pendingChange{item: item, expiry: expiry, hasExpiry: hasExpiry}
+		return
+	}
+	kv.store[key] = item
+	if hasExpiry {
+		kv.expireMap[key] = expiry
+	} else {
+		delete(kv.expireMap, key)
 	}
+}
+
+// remove deletes a key. The caller must hold kv.mu.
+func (kv *KeyValueStore) remove(key string) {
+	if kv.frozen {
+		kv.pending[key] = pendingChange{deleted: true}
+		return
+	}
+	delete(kv.store, key)
+	delete(kv.expireMap, key)
+}
 
+func (expiry ExpiryMetadata) isExpired() bool {
 	var curTime int64
-	if expireInfo.timeInMilliseconds {
+	if expiry.timeInMilliseconds {
 		curTime = time.Now().UnixMilli()
 	} else {
 		curTime = time.Now().Unix()
 	}
 
-	if expireInfo.expireTimestamp < curTime {
+	if expiry.expireTimestamp < curTime {
 		return true
 	}
 
@@ -54,29 +117,51 @@ func (kv *KeyValueStore) isExpired(key string) bool {
 }
 
 func (kv *KeyValueStore) Set(key string, value interface{}, expiryTime int64, expiryInMillseconds bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-	if expiryTime != 0 {
-		kv.expireMap[key] = ExpiryMetadata{
-			expireTimestamp:    expiryTime,
-			timeInMilliseconds: expiryInMillseconds,
-		}
-		if kv.isExpired(key) {
-			delete(kv.expireMap, key)
-			return
-		}
+	expiry := ExpiryMetadata{
+		expireTimestamp:    expiryTime,
+		timeInMilliseconds: expiryInMillseconds,
+	}
+	if expiryTime != 0 && expiry.isExpired() {
+		kv.remove(key)
+		return
 	}
 
-	kv.store[key] = Item{
-		value: value,
+	kv.write(key, Item{value: value}, expiry, expiryTime != 0)
+}
+
+// flush removes every key and returns the keys that were removed.
+func (kv *KeyValueStore) flush() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var keys []string
+	for _, item := range kv.itemsLocked() {
+		kv.remove(item.Key)
+		keys = append(keys, item.Key)
 	}
+	return keys
 }
 
 func (kv *KeyValueStore) Size() int {
-	return len(kv.store)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	return len(kv.itemsLocked())
 }
 
 func (kv *KeyValueStore) ExpiryTableSize() int {
-	return len(kv.expireMap)
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	size := 0
+	for _, item := range kv.itemsLocked() {
+		if item.ExpiryTime != 0 {
+			size++
+		}
+	}
+	return size
 }
 
 type KeyValueWithExpiry struct {
@@ -87,27 +172,109 @@ type KeyValueWithExpiry struct {
 }
 
 func (kv *KeyValueStore) Items() []KeyValueWithExpiry {
-	var items []KeyValueWithExpiry
-	for key, item := range kv.store {
-		if kv.isExpired(key) {
-			delete(kv.store, key)
+	kv.mu.Lock()
+	items := kv.itemsLocked()
+
+	var expiredKeys []string
+	live := items[:0]
+	for _, item := range items {
+		expiry := ExpiryMetadata{expireTimestamp: item.ExpiryTime, timeInMilliseconds: item.TimeInMilliseconds}
+		if item.ExpiryTime != 0 && expiry.isExpired() {
+			kv.remove(item.Key)
+			expiredKeys = append(expiredKeys, item.Key)
 			continue
 		}
+		live = append(live, item)
+	}
+	kv.mu.Unlock()
+
+	invalidateKeys(nil, expiredKeys)
+	return live
+}
+
+// itemsLocked lists every key with its current value, expired or not. The
+// caller must hold kv.mu.
+func (kv *KeyValueStore) itemsLocked() []KeyValueWithExpiry {
+	var items []KeyValueWithExpiry
+	for key := range kv.store {
+		if kv.frozen {
+			if _, changed := kv.pending[key]; changed {
+				continue
+			}
+		}
+		items = append(items, newKeyValueWithExpiry(key, kv.store[key], kv.expireMap[key]))
+	}
+	if kv.frozen {
+		for key, change := range kv.pending {
+			if !change.deleted {
+				items = append(items, newKeyValueWithExpiry(key, change.item, change.expiry))
+			}
+		}
+	}
+	return items
+}
+
+func newKeyValueWithExpiry(key string, item Item, expiry ExpiryMetadata) KeyValueWithExpiry {
+	return KeyValueWithExpiry{
+		Key:                key,
+		Value:              item.value,
+		ExpiryTime:         expiry.expireTimestamp,
+		TimeInMilliseconds: expiry.timeInMilliseconds,
+	}
+}
+
+// keyspaceSnapshot is a read-only, point-in-time view of the store, valid
+// until the store is thawed.
+type keyspaceSnapshot struct {
+	store     map[string]Item
+	expireMap map[string]ExpiryMetadata
+}
+
+// freeze takes a snapshot of the store without copying it. Only one snapshot
+// may exist at a time and it must be released with thaw.
+func (kv *KeyValueStore) freeze() keyspaceSnapshot {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-		var expiryTime int64
-		var timeInMilliseconds bool
+	kv.frozen = true
+	kv.pending = make(map[string]pendingChange)
+	return keyspaceSnapshot{store: kv.store, expireMap: kv.expireMap}
+}
+
+// thaw releases the snapshot and applies the changes staged while it existed.
+func (kv *KeyValueStore) thaw() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 
-		if expiryInfo, exists := kv.expireMap[key]; exists {
-			expiryTime = expiryInfo.expireTimestamp
-			timeInMilliseconds = expiryInfo.timeInMilliseconds
+	kv.frozen = false
+	for key, change := range kv.pending {
+		if change.deleted {
+			kv.remove(key)
+		} else {
+			kv.write(key, change.item, change.expiry, change.hasExpiry)
 		}
+	}
+	kv.pending = nil
+}
 
-		items = append(items, KeyValueWithExpiry{
-			Key:                key,
-			Value:              item.value,
-			ExpiryTime:         int64(expiryTime),
-			TimeInMilliseconds: timeInMilliseconds,
-		})
+func (s keyspaceSnapshot) Size() int {
+	return len(s.store)
+}
+
+func (s keyspaceSnapshot) ExpiryTableSize() int {
+	return len(s.expireMap)
+}
+
+// Items lists the keys of the snapshot, leaving out the ones that have
+// expired since.
+func (s keyspaceSnapshot) Items() []KeyValueWithExpiry {
+	var items []KeyValueWithExpiry
+	for key, item := range s.store {
+		expiry, hasExpiry := s.expireMap[key]
+		if hasExpiry && expiry.isExpired() {
+			continue
+		}
+		items = append(items, newKeyValueWithExpiry(key, item, expiry))
 	}
 	return items
 }
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+func loadTLSCertificate() (tls.Certificate, error) {
+	certFile, keyFile := Config["tls-cert-file"], Config["tls-key-file"]
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, fmt.Errorf("tls-cert-file and tls-key-file are required to use TLS")
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load TLS certificate %s and key %s: %v", certFile, keyFile, err)
+	}
+	return certificate, nil
+}
+
+func loadCACertPool() (*x509.CertPool, error) {
+	caFile := Config["tls-ca-cert-file"]
+	if caFile == "" {
+		return nil, nil
+	}
+	caCert, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS CA certificate %s: %v", caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("failed to parse TLS CA certificate %s", caFile)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig builds the configuration of the TLS listener from the tls-*
+// options.
+func ServerTLSConfig() (*tls.Config, error) {
+	certificate, err := loadTLSCertificate()
+	if err != nil {
+		return nil, err
+	}
+	caPool, err := loadCACertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		ClientCAs:    caPool,
+		MinVersion:   tls.VersionTLS12,
+	}
+	switch Config["tls-auth-clients"] {
+	case "yes":
+		if caPool == nil {
+			return nil, fmt.Errorf("tls-ca-cert-file is required to authenticate clients, set tls-auth-clients to no otherwise")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "no":
+		tlsConfig.ClientAuth = tls.NoClientCert
+	default:
+		return nil, fmt.Errorf("tls-auth-clients must be yes, no or optional: %s", Config["tls-auth-clients"])
+	}
+	return tlsConfig, nil
+}
+
+// replicationTLSConfig builds the configuration used by a replica to connect
+// to its master. The server certificate doubles as the client certificate.
+func replicationTLSConfig(serverName string) (*tls.Config, error) {
+	caPool, err := loadCACertPool()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		RootCAs:    caPool,
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if Config["tls-cert-file"] != "" {
+		certificate, err := loadTLSCertificate()
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
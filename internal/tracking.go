@@ -0,0 +1,366 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+type clientTracking struct {
+	enabled  bool
+	bcast    bool
+	optin    bool
+	optout   bool
+	noloop   bool
+	redirect int64
+	prefixes []string
+
+	// caching holds the CLIENT CACHING answer for the next command only.
+	caching      bool
+	cachingGiven bool
+}
+
+type trackingTables struct {
+	mu sync.Mutex
+	// keys maps a key read in default mode to the ids of the clients that
+	// cached it. Entries are dropped once the invalidation is sent.
+	keys map[string]map[int64]bool
+	// prefixes maps a BCAST prefix to the ids of the clients subscribed to it.
+	prefixes map[string]map[int64]bool
+}
+
+var tracking = trackingTables{
+	keys:     make(map[string]map[int64]bool),
+	prefixes: make(map[string]map[int64]bool),
+}
+
+func handleClientTracking(client *Client, args []interface{}) (string, error) {
+	if len(args) < 1 {
+		return "", fmt.Errorf("failed to execute CLIENT TRACKING command, it requires ON or OFF")
+	}
+	toggle, _ := args[0].(string)
+
+	options := clientTracking{}
+	for i := 1; i < len(args); i++ {
+		option, _ := args[i].(string)
+		switch strings.ToUpper(option) {
+		case "REDIRECT":
+			if i+1 >= len(args) {
+				return encodeSimpleError("ERR syntax error"), nil
+			}
+			i++
+			idStr, _ := args[i].(string)
+			if _, err := fmt.Sscanf(idStr, "%d", &options.redirect); err != nil {
+				return encodeSimpleError("ERR value is not an integer or out of range"), nil
+			}
+		case "PREFIX":
+			if i+1 >= len(args) {
+				return encodeSimpleError("ERR syntax error"), nil
+			}
+			i++
+			prefix, _ := args[i].(string)
+			options.prefixes = append(options.prefixes, prefix)
+		case "BCAST":
+			options.bcast = true
+		case "OPTIN":
+			options.optin = true
+		case "OPTOUT":
+			options.optout = true
+		case "NOLOOP":
+			options.noloop = true
+		default:
+			return encodeSimpleError("ERR syntax error"), nil
+		}
+	}
+
+	switch strings.ToUpper(toggle) {
+	case "ON":
+		return enableTracking(client, options)
+	case "OFF":
+		disableTracking(client)
+		return encodeSimpleString("OK"), nil
+	default:
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+}
+
+func enableTracking(client *Client, options clientTracking) (string, error) {
+	if len(options.prefixes) > 0 && !options.bcast {
+		return encodeSimpleError("ERR PREFIX option requires BCAST mode to be enabled"), nil
+	}
+	if options.optin && options.optout {
+		return encodeSimpleError("ERR You can't use both OPTIN and OPTOUT"), nil
+	}
+	if options.bcast && (options.optin || options.optout) {
+		return encodeSimpleError("ERR OPTIN and OPTOUT are not compatible with BCAST"), nil
+	}
+	if options.redirect != 0 {
+		if options.redirect == client.Id {
+			return encodeSimpleError("ERR A client can only redirect to a different client"), nil
+		}
+		clients.mu.Lock()
+		_, exists := clients.clients[options.redirect]
+		clients.mu.Unlock()
+		if !exists {
+			return encodeSimpleError("ERR The client ID you want redirect to does not exist"), nil
+		}
+	}
+
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+
+	if client.tracking.enabled && client.tracking.bcast != options.bcast {
+		return encodeSimpleError("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode."), nil
+	}
+
+	if options.bcast {
+		if len(options.prefixes) == 0 {
+			options.prefixes = []string{""}
+		}
+		for _, prefix := range options.prefixes {
+			if tracking.prefixes[prefix] == nil {
+				tracking.prefixes[prefix] = make(map[int64]bool)
+			}
+			tracking.prefixes[prefix][client.Id] = true
+		}
+		options.prefixes = append(client.tracking.prefixes, options.prefixes...)
+	}
+	options.enabled = true
+	client.tracking = options
+	return encodeSimpleString("OK"), nil
+}
+
+func disableTracking(client *Client) {
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+
+	// Keys are only tracked per client in default mode, and have to be
+	// looked for in the whole table.
+	if client.tracking.enabled && !client.tracking.bcast {
+		for key, ids := range tracking.keys {
+			delete(ids, client.Id)
+			if len(ids) == 0 {
+				delete(tracking.keys, key)
+			}
+		}
+	}
+	for _, prefix := range client.tracking.prefixes {
+		delete(tracking.prefixes[prefix], client.Id)
+		if len(tracking.prefixes[prefix]) == 0 {
+			delete(tracking.prefixes, prefix)
+		}
+	}
+	client.tracking = clientTracking{}
+}
+
+func handleClientCaching(client *Client, args []interface{}) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("failed to execute CLIENT CACHING command, it requires YES or NO")
+	}
+	answer, _ := args[0].(string)
+
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+
+	if !client.tracking.enabled {
+		return encodeSimpleError("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled"), nil
+	}
+	switch strings.ToUpper(answer) {
+	case "YES":
+		if !client.tracking.optin {
+			return encodeSimpleError("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode."), nil
+		}
+		client.tracking.caching = true
+	case "NO":
+		if !client.tracking.optout {
+			return encodeSimpleError("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode."), nil
+		}
+		client.tracking.caching = false
+	default:
+		return encodeSimpleError("ERR syntax error"), nil
+	}
+	client.tracking.cachingGiven = true
+	return encodeSimpleString("OK"), nil
+}
+
+func handleClientGetRedir(client *Client) (string, error) {
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+
+	if !client.tracking.enabled {
+		return encodeInteger(-1), nil
+	}
+	return encodeInteger(int(client.tracking.redirect)), nil
+}
+
+func handleClientTrackingInfo(client *Client) (string, error) {
+	tracking.mu.Lock()
+	state := client.tracking
+	tracking.mu.Unlock()
+
+	var flags []interface{}
+	if !state.enabled {
+		flags = append(flags, "off")
+	} else {
+		flags = append(flags, "on")
+		if state.bcast {
+			flags = append(flags, "bcast")
+		}
+		if state.optin {
+			flags = append(flags, "optin")
+			if state.cachingGiven && state.caching {
+				flags = append(flags, "caching-yes")
+			}
+		}
+		if state.optout {
+			flags = append(flags, "optout")
+			if state.cachingGiven && !state.caching {
+				flags = append(flags, "caching-no")
+			}
+		}
+		if state.noloop {
+			flags = append(flags, "noloop")
+		}
+	}
+
+	redirect := -1
+	if state.enabled {
+		redirect = int(state.redirect)
+	}
+	var prefixes []interface{}
+	for _, prefix := range state.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+
+	info := []interface{}{"flags", flags, "redirect", redirect, "prefixes", prefixes}
+	clients.mu.Lock()
+	protocol := client.protocol
+	clients.mu.Unlock()
+	if protocol == 3 {
+		return encodeMap(info)
+	}
+	return encodeArray(info)
+}
+
+// trackCommandKeys remembers the keys read by a command so that the client
+// can be told when they change. It runs after every command.
+func trackCommandKeys(client *Client, command string, args []interface{}) {
+	tracking.mu.Lock()
+	defer tracking.mu.Unlock()
+
+	state := &client.tracking
+	if !state.enabled || state.bcast {
+		return
+	}
+	if command == "CLIENT" && len(args) > 0 {
+		if subcommand, _ := args[0].(string); strings.ToUpper(subcommand) == "CACHING" {
+			return
+		}
+	}
+
+	track := true
+	if state.optin {
+		track = state.cachingGiven && state.caching
+	} else if state.optout {
+		track = !state.cachingGiven || state.caching
+	}
+	state.cachingGiven = false
+
+	if !track || isWriteCommand(command) {
+		return
+	}
+	for _, key := range commandKeys(command, args) {
+		if tracking.keys[key] == nil {
+			tracking.keys[key] = make(map[int64]bool)
+		}
+		tracking.keys[key][client.Id] = true
+	}
+}
+
+// invalidateKeys notifies every client caching one of the keys that it has
+// changed. source is the client whose command modified the keys, or nil when
+// the server changed them on its own, e.g. on expiry.
+func invalidateKeys(source *Client, keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	tracking.mu.Lock()
+	targets := make(map[int64][]string)
+	for _, key := range keys {
+		for id := range tracking.keys[key] {
+			targets[id] = append(targets[id], key)
+		}
+		delete(tracking.keys, key)
+
+		for prefix, ids := range tracking.prefixes {
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			for id := range ids {
+				targets[id] = append(targets[id], key)
+			}
+		}
+	}
+	tracking.mu.Unlock()
+
+	for id, invalidatedKeys := range targets {
+		sendInvalidation(source, id, invalidatedKeys)
+	}
+}
+
+func sendInvalidation(source *Client, clientId int64, keys []string) {
+	clients.mu.Lock()
+	client, exists := clients.clients[clientId]
+	clients.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	tracking.mu.Lock()
+	state := client.tracking
+	tracking.mu.Unlock()
+	if !state.enabled || (state.noloop && source == client) {
+		return
+	}
+
+	var invalidated []interface{}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			invalidated = append(invalidated, key)
+		}
+	}
+
+	target := client
+	if state.redirect != 0 {
+		clients.mu.Lock()
+		target, exists = clients.clients[state.redirect]
+		protocol := client.protocol
+		clients.mu.Unlock()
+		if !exists {
+			if protocol == 3 {
+				message, _ := encodePush([]interface{}{"tracking-redir-broken", int(state.redirect)})
+				client.writePush(message)
+			}
+			return
+		}
+	}
+
+	clients.mu.Lock()
+	protocol := target.protocol
+	clients.mu.Unlock()
+	if protocol == 3 {
+		message, _ := encodePush([]interface{}{"invalidate", invalidated})
+		target.writePush(message)
+		return
+	}
+	// A RESP2 connection can only receive out of band data as a message on
+	// a channel it subscribed to, anything else would be read as the reply
+	// to its next command. Without redirection the client itself can't be
+	// subscribed, as it couldn't have read the keys.
+	if state.redirect != 0 && isSubscribed(target, invalidationChannel) {
+		sendPubsubMessage(target, invalidationChannel, invalidated)
+	}
+}
@@ -0,0 +1,148 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+func invalidateMessage(keys ...string) string {
+	message := fmt.Sprintf(">2\r\n$10\r\ninvalidate\r\n*%d\r\n", len(keys))
+	for _, key := range keys {
+		message += fmt.Sprintf("$%d\r\n%s\r\n", len(key), key)
+	}
+	return message
+}
+
+// newTrackingClient returns a RESP3 client with tracking enabled with the
+// given options.
+func newTrackingClient(t *testing.T, options ...interface{}) (*Client, *testConn) {
+	t.Helper()
+	client, conn := newTestClient(t)
+	run(t, client, "HELLO", "3")
+	expectReply(t, client, "+OK\r\n", "CLIENT", append([]interface{}{"TRACKING", "ON"}, options...)...)
+	t.Cleanup(func() { disableTracking(client) })
+	return client, conn
+}
+
+func TestTrackingInvalidation(t *testing.T) {
+	useTestDir(t)
+	tracked, trackedConn := newTrackingClient(t)
+	writer, _ := newTestClient(t)
+
+	run(t, tracked, "GET", "foo")
+	run(t, writer, "SET", "foo", "1")
+	if written := trackedConn.takeWritten(); written != invalidateMessage("foo") {
+		t.Errorf("Expected %q, Got %q", invalidateMessage("foo"), written)
+	}
+
+	// The key has to be read again to be tracked again.
+	run(t, writer, "SET", "foo", "2")
+	if written := trackedConn.takeWritten(); written != "" {
+		t.Errorf("Expected no invalidation for a key not read since, Got %q", written)
+	}
+
+	// The client is told about its own writes unless NOLOOP is set.
+	run(t, tracked, "GET", "foo")
+	run(t, tracked, "SET", "foo", "3")
+	if written := trackedConn.takeWritten(); written != invalidateMessage("foo") {
+		t.Errorf("Expected %q, Got %q", invalidateMessage("foo"), written)
+	}
+}
+
+func TestTrackingNoLoop(t *testing.T) {
+	useTestDir(t)
+	tracked, trackedConn := newTrackingClient(t, "NOLOOP")
+	writer, _ := newTestClient(t)
+
+	run(t, tracked, "GET", "foo")
+	run(t, tracked, "SET", "foo", "1")
+	if written := trackedConn.takeWritten(); written != "" {
+		t.Errorf("Expected no invalidation for the client's own write, Got %q", written)
+	}
+	run(t, tracked, "GET", "foo")
+	run(t, writer, "SET", "foo", "2")
+	if written := trackedConn.takeWritten(); written != invalidateMessage("foo") {
+		t.Errorf("Expected %q, Got %q", invalidateMessage("foo"), written)
+	}
+}
+
+func TestTrackingBroadcast(t *testing.T) {
+	useTestDir(t)
+	_, trackedConn := newTrackingClient(t, "BCAST", "PREFIX", "user:", "PREFIX", "session:")
+	writer, _ := newTestClient(t)
+
+	// Keys are announced without being read first, when they match a prefix.
+	run(t, writer, "SET", "user:1", "a")
+	run(t, writer, "SET", "other", "b")
+	run(t, writer, "SET", "session:1", "c")
+	if written, expected := trackedConn.takeWritten(), invalidateMessage("user:1")+invalidateMessage("session:1"); written != expected {
+		t.Errorf("Expected %q, Got %q", expected, written)
+	}
+
+	expectReply(t, writer, "-ERR PREFIX option requires BCAST mode to be enabled\r\n", "CLIENT", "TRACKING", "ON", "PREFIX", "user:")
+}
+
+func TestTrackingRedirect(t *testing.T) {
+	useTestDir(t)
+	client, clientConn := newTestClient(t)
+	target, targetConn := newTestClient(t)
+	writer, _ := newTestClient(t)
+	targetId := fmt.Sprint(target.Id)
+
+	expectReply(t, client, "-ERR The client ID you want redirect to does not exist\r\n", "CLIENT", "TRACKING", "ON", "REDIRECT", "999999")
+	expectReply(t, client, "+OK\r\n", "CLIENT", "TRACKING", "ON", "REDIRECT", targetId)
+	t.Cleanup(func() { disableTracking(client) })
+
+	// A RESP2 target gets the invalidations once it subscribes to the
+	// __redis__:invalidate channel, and nothing before, where they would be
+	// read as a reply.
+	run(t, client, "GET", "foo")
+	run(t, writer, "SET", "foo", "1")
+	if written := targetConn.takeWritten(); written != "" {
+		t.Errorf("Expected nothing written to a RESP2 target that did not subscribe, Got %q", written)
+	}
+	expectReply(t, target, "*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n", "SUBSCRIBE", "__redis__:invalidate")
+	run(t, client, "GET", "foo")
+	run(t, writer, "SET", "foo", "2")
+	expected := "*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$3\r\nfoo\r\n"
+	if written := targetConn.takeWritten(); written != expected {
+		t.Errorf("Expected %q, Got %q", expected, written)
+	}
+
+	// A RESP3 target gets them as push data.
+	run(t, target, "UNSUBSCRIBE")
+	run(t, target, "HELLO", "3")
+	run(t, client, "GET", "foo")
+	run(t, writer, "SET", "foo", "3")
+	if written := targetConn.takeWritten(); written != invalidateMessage("foo") {
+		t.Errorf("Expected %q, Got %q", invalidateMessage("foo"), written)
+	}
+
+	// Once the target is gone the client is told the redirection is broken.
+	run(t, client, "HELLO", "3")
+	UnregisterClient(target)
+	run(t, client, "GET", "foo")
+	run(t, writer, "SET", "foo", "4")
+	expected = fmt.Sprintf(">2\r\n$21\r\ntracking-redir-broken\r\n:%d\r\n", target.Id)
+	if written := clientConn.takeWritten(); written != expected {
+		t.Errorf("Expected %q, Got %q", expected, written)
+	}
+}
+
+func TestTrackingDisconnect(t *testing.T) {
+	useTestDir(t)
+	tracked, _ := newTrackingClient(t)
+	other, _ := newTrackingClient(t)
+	run(t, tracked, "GET", "foo")
+	run(t, tracked, "GET", "bar")
+	run(t, other, "GET", "bar")
+
+	UnregisterClient(tracked)
+	tracking.mu.Lock()
+	_, fooTracked := tracking.keys["foo"]
+	barIds := tracking.keys["bar"]
+	tracking.mu.Unlock()
+	if fooTracked || len(barIds) != 1 || !barIds[other.Id] {
+		t.Errorf("Expected only the keys of the remaining client to stay tracked, Got foo %v and bar %v", fooTracked, barIds)
+	}
+}